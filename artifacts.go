@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// CollectOutputs copies the declared outputs of taskIDs from the workspace
+// into outDir, keeping their relative paths, e.g. for a CI artifact upload.
+// It runs after a successful build, so outputs are already in the workspace
+// (sandbox builds export the requested tasks). Tasks whose failure was
+// allowed, and tasks pruned with -skip, have no reliable outputs and are
+// left out. Two tasks producing the same path, or an output outside the
+// workspace (which would land outside outDir), is an error, reported before
+// anything is copied.
+//
+// Outputs are copied rather than hardlinked: they may share inodes with the
+// cache, and packaging steps that edit artifacts in place must not corrupt it.
+func (e *TaskExecutor) CollectOutputs(taskMap TaskMap, taskIDs []TaskID, outDir string) error {
+	owners := make(map[Path]TaskID)
+	var files, dirs []Path
+	for _, id := range taskIDs {
+		task, ok := taskMap[id]
+		if !ok || len(task.Outputs) == 0 || e.failedAllowed(id) || e.skipped(id) {
+			continue
+		}
+		outs, outDirs, err := expandOutputSpecs("", task.Outputs, e.ignore)
+		if err != nil {
+			return fmt.Errorf("expand outputs for task %s: %w", id, err)
+		}
+		for _, out := range append(outs, outDirs...) {
+			if !filepath.IsLocal(filepath.FromSlash(string(out))) {
+				return withExitCode(exitUsage, fmt.Errorf("out dir: output %q of task %s is outside the workspace", out, id))
+			}
+		}
+		for _, out := range outs {
+			if owner, ok := owners[out]; ok {
+				if owner == id {
+					continue
+				}
+				return withExitCode(exitUsage, fmt.Errorf("out dir: %q is an output of both task %s and task %s", out, owner, id))
+			}
+			owners[out] = id
+			files = append(files, out)
+		}
+		dirs = append(dirs, outDirs...)
+	}
+
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(outDir, filepath.FromSlash(string(dir))), 0o755); err != nil {
+			return withExitCode(exitInternal, fmt.Errorf("out dir: %w", err))
+		}
+	}
+	for _, out := range files {
+		src := filepath.FromSlash(string(out))
+		if err := copyFile(src, filepath.Join(outDir, src)); err != nil {
+			return withExitCode(exitInternal, fmt.Errorf("out dir: copy %q: %w", out, err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCollectOutputs(t *testing.T) {
+	tests := []struct {
+		name  string
+		tasks []Task
+		// separateBuilds builds each task on its own first, so the final
+		// build restores them all from the cache. A single build would
+		// already fail when the second task claims the first one's output.
+		separateBuilds bool
+		want           map[string]string
+		wantErr        string
+	}{
+		{
+			name: "preserves-structure",
+			tasks: []Task{
+				{ID: "a", Outputs: []Path{"bin/a"}, Command: "mkdir -p bin && echo a > bin/a", Cache: true},
+				{ID: "b", Outputs: []Path{"dist"}, Command: "mkdir -p dist/sub && echo b > dist/sub/b", Cache: true},
+			},
+			want: map[string]string{"bin/a": "a\n", "dist/sub/b": "b\n"},
+		},
+		{
+			name: "collision",
+			tasks: []Task{
+				{ID: "a", Outputs: []Path{"out.txt"}, Command: "echo a > out.txt", Cache: true},
+				{ID: "b", Outputs: []Path{"out.txt"}, Command: "echo b > out.txt", Cache: true},
+			},
+			separateBuilds: true,
+			wantErr:        `"out.txt" is an output of both task a and task b`,
+		},
+		{
+			name: "outside-workspace",
+			tasks: []Task{
+				{ID: "a", Outputs: []Path{"bin/a"}, Command: "mkdir -p bin && echo a > bin/a", Cache: true},
+				{ID: "up", Outputs: []Path{"../up.txt"}, Command: "echo up > ../up.txt", Cache: true},
+			},
+			wantErr: `output "../up.txt" of task up is outside the workspace`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempWD(t, func() {
+				taskMap := NewTaskMap(tt.tasks)
+				ids := make([]TaskID, len(tt.tasks))
+				for i, task := range tt.tasks {
+					ids[i] = task.ID
+				}
+				if tt.separateBuilds {
+					// A combined build would refuse the overlap up front.
+					for _, id := range ids {
+						build(t, taskMap, TaskExecutorOptions{Jobs: 1}, id)
+					}
+				}
+				e := newTestExecutor(t, TaskExecutorOptions{Jobs: 1})
+				if !tt.separateBuilds {
+					if err := e.ExecuteTasks(taskMap, ids); err != nil {
+						t.Fatalf("ExecuteTasks: %v", err)
+					}
+				}
+
+				err := e.CollectOutputs(taskMap, ids, "artifacts")
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Fatalf("CollectOutputs = %v, want error containing %q", err, tt.wantErr)
+					}
+					if _, err := os.Stat("artifacts"); !os.IsNotExist(err) {
+						t.Errorf("artifacts dir created despite the error: %v", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("CollectOutputs: %v", err)
+				}
+				for path, want := range tt.want {
+					got, err := os.ReadFile(filepath.Join("artifacts", filepath.FromSlash(path)))
+					if err != nil || string(got) != want {
+						t.Errorf("artifacts/%s = %q, %v; want %q", path, got, err, want)
+					}
+				}
+			})
+		})
+	}
+}
@@ -1,43 +1,231 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
+	"time"
 )
 
 type BuildState struct {
 	localCache *LocalCache
+	baseCache  *LocalCache // optional read-only cache consulted before localCache
 	stampCache *FileStampCache
+	history    *TaskHistory
+	remote     *RemoteCache // optional
+	keyOpts    KeyOptions
+	// offline makes the build use the local cache alone: the base and
+	// remote caches are ignored even when configured, so nothing waits on a
+	// network (or a network filesystem).
+	offline bool
 }
 
-func NewBuildState(cacheRoot string, stampCachePath string) *BuildState {
+func NewBuildState(cacheRoot string, stampCachePath string, stampOpts StampCacheOptions) *BuildState {
 	return &BuildState{
 		localCache: NewLocalCache(cacheRoot),
-		stampCache: NewFileStampCache(stampCachePath),
+		stampCache: NewFileStampCache(stampCachePath, stampOpts),
+		history:    NewTaskHistory(taskHistoryPath(cacheRoot)),
 	}
 }
 
+func taskHistoryPath(cacheRoot string) string {
+	return filepath.Join(cacheRoot, "history.json")
+}
+
 func (s *BuildState) Load() error {
-	return s.stampCache.Load()
+	if err := s.stampCache.Load(); err != nil {
+		return err
+	}
+	return s.history.Load()
 }
 
 func (s *BuildState) Save() error {
-	return s.stampCache.Save()
+	return errors.Join(s.stampCache.Save(), s.history.Save())
+}
+
+// ComputeKey computes task's key. progress, if non-nil, reports on hashing
+// large inputs (see KeyOptions.Progress); trace, if non-nil, on every input
+// (see KeyOptions.Trace).
+func (s *BuildState) ComputeKey(task Task, depKeys []string, progress func(in Path, done, total int64), trace func(in Path, digest string, stamped bool)) (string, []byte, KeyStats, error) {
+	opts := s.keyOpts
+	opts.Progress = progress
+	opts.Trace = trace
+	return ComputeTaskKeyWithStats(task, depKeys, s.stampCache, opts)
+}
+
+// Restore links cached outputs into the workspace and, on a hit, records
+// their stamps so downstream tasks don't re-hash them. A corrupt local entry
+// is evicted before ErrCorruptCacheEntry is returned; the base cache is
+// read-only and keeps it. only, if non-nil, selects the outputs to restore
+// (see LocalCache.Restore), and keepUnchanged leaves outputs already in
+// place untouched (see LocalCache.RestoreChanged).
+func (s *BuildState) Restore(taskKey string, only []Path, keepUnchanged bool) (bool, error) {
+	if err := s.CheckUnmodified(taskKey); err != nil {
+		return false, err
+	}
+	cache := s.cacheFor(taskKey)
+	restore := cache.Restore
+	if keepUnchanged {
+		restore = cache.RestoreChanged
+	}
+	manifest, err := restore(taskKey, only)
+	if errors.Is(err, ErrCorruptCacheEntry) && cache == s.localCache {
+		if evictErr := cache.EvictCorrupt(taskKey); evictErr != nil {
+			return false, errors.Join(err, evictErr)
+		}
+	}
+	if err != nil || manifest == nil {
+		return false, err
+	}
+	s.recordOutputStamps(manifest)
+	return true, nil
+}
+
+// CheckUnmodified evicts a local entry whose outputs were written in place
+// since it was stored (see LocalCache.CheckUnmodified) and returns the
+// ErrCorruptCacheEntry; Restore checks this itself. Base cache entries
+// aren't checked: their mtimes depend on how the snapshot was copied.
+func (s *BuildState) CheckUnmodified(taskKey string) error {
+	if s.cacheFor(taskKey) != s.localCache {
+		return nil
+	}
+	err := s.localCache.CheckUnmodified(taskKey)
+	if errors.Is(err, ErrCorruptCacheEntry) {
+		if evictErr := s.localCache.EvictCorrupt(taskKey); evictErr != nil {
+			return errors.Join(err, evictErr)
+		}
+	}
+	return err
+}
+
+// cacheFor returns the cache to read the entry for taskKey from: the base
+// cache if it has the entry, otherwise the local one. New entries are only
+// ever written to the local cache.
+func (s *BuildState) cacheFor(taskKey string) *LocalCache {
+	if s.baseCache != nil && !s.offline && s.baseCache.Has(taskKey) {
+		return s.baseCache
+	}
+	return s.localCache
+}
+
+// Has reports whether the base or local cache has an entry for taskKey.
+func (s *BuildState) Has(taskKey string) bool {
+	return s.cacheFor(taskKey).Has(taskKey)
+}
+
+// remoteCache returns the remote cache to use, or nil if there is none or
+// the build is offline. Every remote operation goes through it.
+func (s *BuildState) remoteCache() *RemoteCache {
+	if s.offline {
+		return nil
+	}
+	return s.remote
+}
+
+// FetchRemote downloads the entry for taskKey from the remote cache into the
+// local cache unless it is already there. It reports whether the entry is
+// available locally afterwards.
+func (s *BuildState) FetchRemote(ctx context.Context, taskKey string) (bool, error) {
+	if s.Has(taskKey) {
+		return true, nil
+	}
+	remote := s.remoteCache()
+	if remote == nil {
+		return false, nil
+	}
+
+	tDir := s.localCache.taskDir(taskKey)
+	if err := os.MkdirAll(filepath.Dir(tDir), 0o755); err != nil {
+		return false, err
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(tDir), "tmp-task-")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ok, err := remote.Download(ctx, taskKey, tmpDir)
+	if err != nil || !ok {
+		return false, err
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "manifest.json")); err != nil {
+		return false, fmt.Errorf("remote entry %s has no manifest", taskKey)
+	}
+	if err := os.Rename(tmpDir, tDir); err != nil {
+		// Another task may have fetched or stored it concurrently.
+		if s.localCache.Has(taskKey) {
+			return true, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// UploadRemote pushes the local entry for taskKey to the remote cache, if one
+// is configured.
+func (s *BuildState) UploadRemote(ctx context.Context, taskKey string) error {
+	remote := s.remoteCache()
+	if remote == nil {
+		return nil
+	}
+	return remote.Upload(ctx, taskKey, s.cacheFor(taskKey).taskDir(taskKey))
 }
 
-func (s *BuildState) ComputeKey(task Task, depKeys []string) (string, []byte, error) {
-	return ComputeTaskKey(task, depKeys, s.stampCache)
+// StoredCommand returns the command recorded in the manifest for taskKey, if
+// there is an entry.
+func (s *BuildState) StoredCommand(taskKey string) (string, bool) {
+	manifest, err := s.cacheFor(taskKey).readManifest(taskKey)
+	if err != nil {
+		return "", false
+	}
+	var task struct {
+		Command string `json:"command"`
+	}
+	if err := json.Unmarshal(manifest.Task, &task); err != nil {
+		return "", false
+	}
+	return task.Command, true
 }
 
-func (s *BuildState) Restore(taskKey string, outputs []Path) (bool, error) {
-	return s.localCache.Restore(taskKey, outputs)
+// recordOutputStamps stamps stored or restored outputs using the manifest's
+// digests, hashing only outputs from older entries that have no recorded
+// digest.
+func (s *BuildState) recordOutputStamps(manifest *cacheManifest) {
+	var missing []Path
+	for _, out := range manifest.Outputs {
+		d, ok := manifest.Digests[out]
+		if !ok {
+			missing = append(missing, out)
+			continue
+		}
+		s.stampCache.Update(filepath.FromSlash(string(out)), d)
+	}
+	s.UpdateOutputStamps(missing)
 }
 
-func (s *BuildState) Store(taskKey string, taskJSON []byte, outputs []Path) error {
-	return s.localCache.Store(taskKey, taskJSON, outputs)
+func (s *BuildState) Store(taskID TaskID, taskKey string, taskJSON []byte, outputs, dirs []Path, runDuration time.Duration) (int64, error) {
+	return s.StoreFromDir(taskID, taskKey, taskJSON, outputs, dirs, ".", runDuration)
 }
 
-func (s *BuildState) StoreFromDir(taskKey string, taskJSON []byte, outputs []Path, baseDir string) error {
-	return s.localCache.StoreFromDir(taskKey, taskJSON, outputs, baseDir)
+// StoreFromDir stores outputs (and the directories of directory outputs) in
+// the cache and records the run in the task's history. Outputs stored from
+// the workspace are stamped with the digests the store computed, so
+// dependents don't hash them again. runDuration is recorded in the manifest
+// (see cacheManifest.RunDuration). It returns the bytes newly written to the
+// cache.
+func (s *BuildState) StoreFromDir(taskID TaskID, taskKey string, taskJSON []byte, outputs, dirs []Path, baseDir string, runDuration time.Duration) (int64, error) {
+	manifest, written, err := s.localCache.StoreTreeFromDir(taskKey, taskJSON, outputs, dirs, baseDir, runDuration)
+	if err != nil {
+		return 0, err
+	}
+	if baseDir == "." {
+		s.recordOutputStamps(manifest)
+	}
+	s.history.Record(taskID, TaskRun{TaskKey: taskKey, Time: time.Now(), Digests: manifest.Digests})
+	return written, nil
 }
 
 // UpdateOutputStamps hashes output files and records their stamps so that
@@ -1,23 +1,103 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/sync/errgroup"
 )
 
+// ErrCacheBudgetExceeded is returned by StoreFromDir when storing an entry
+// would exceed the LocalCache's byte budget.
+var ErrCacheBudgetExceeded = errors.New("cache byte budget exceeded")
+
+// ErrCorruptCacheEntry is returned by Restore, under LocalCache.Verify, for
+// an entry whose outputs directory doesn't hold exactly the files its
+// manifest lists, or whose outputs don't match their digests. CheckUnmodified
+// returns it for an entry whose outputs were written in place.
+var ErrCorruptCacheEntry = errors.New("corrupt cache entry")
+
 type LocalCache struct {
 	Root string
+	// MaxBytesWritten caps the output bytes stored through this LocalCache;
+	// once exceeded, further stores are refused. Zero means unlimited.
+	MaxBytesWritten int64
+	// Jobs limits parallel file operations across all restores. Zero means
+	// the number of CPUs.
+	Jobs int
+	// Verify makes Restore check that an entry's outputs directory holds
+	// exactly its manifest's files, catching e.g. stray files left by an
+	// interrupted gc, and that each output still matches its digest.
+	// Mismatches are ErrCorruptCacheEntry.
+	Verify bool
+	// PackBelow stores outputs smaller than this many bytes in a single pack
+	// file per entry instead of as separate files, so tasks emitting many
+	// tiny files don't cost the cache an inode each. Larger outputs are
+	// still stored as hardlinkable blobs. Zero disables packing.
+	PackBelow int64
+	// RestoreMode is how Restore places outputs in the workspace; empty
+	// means RestoreHardlink. Packed outputs are always unpacked as copies.
+	RestoreMode RestoreMode
+
+	ioOnce sync.Once
+	ioSem  chan struct{}
+
+	mu             sync.Mutex
+	bytesWritten   int64
+	budgetExceeded bool
 }
 
 func NewLocalCache(root string) *LocalCache {
 	return &LocalCache{Root: root}
 }
 
+// jobs returns the I/O parallelism limit, creating the shared semaphore
+// that enforces it on first use.
+func (c *LocalCache) jobs() int {
+	c.ioOnce.Do(func() {
+		n := c.Jobs
+		if n <= 0 {
+			n = runtime.NumCPU()
+		}
+		c.ioSem = make(chan struct{}, n)
+	})
+	return cap(c.ioSem)
+}
+
+// BytesWritten returns the output bytes stored through this LocalCache and
+// whether its budget was exceeded.
+func (c *LocalCache) BytesWritten() (n int64, exceeded bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytesWritten, c.budgetExceeded
+}
+
+// reserve accounts n bytes against the budget, refusing once it is exceeded.
+func (c *LocalCache) reserve(n int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.budgetExceeded || (c.MaxBytesWritten > 0 && c.bytesWritten+n > c.MaxBytesWritten) {
+		c.budgetExceeded = true
+		return ErrCacheBudgetExceeded
+	}
+	c.bytesWritten += n
+	return nil
+}
+
 func (c *LocalCache) taskDir(taskKey string) string {
 	return filepath.Join(c.Root, "tasks", taskKey)
 }
@@ -31,137 +111,1005 @@ func (c *LocalCache) Has(taskKey string) bool {
 	return err == nil
 }
 
-func (c *LocalCache) ReadManifestOutputs(taskKey string) ([]Path, error) {
-	manifestPath := c.manifestPath(taskKey)
-	data, err := os.ReadFile(manifestPath)
+// CacheStats summarizes the contents of a LocalCache.
+type CacheStats struct {
+	Entries    int       `json:"entries"`
+	TotalBytes int64     `json:"total_bytes"`
+	Oldest     time.Time `json:"oldest,omitzero"`
+	Newest     time.Time `json:"newest,omitzero"`
+}
+
+// Stats walks the cache and returns entry count, total bytes, and the
+// oldest/newest entry times (by manifest mtime). Entry outputs are hardlinks
+// to blobs that entries share, so total bytes counts each file of the
+// entries and the blob store once, however many links it has, as du does.
+// Entries that disappear while walking (e.g. a concurrent clean) are
+// skipped.
+func (c *LocalCache) Stats() (CacheStats, error) {
+	var stats CacheStats
+	seen := make(map[fileID]bool)
+
+	entries, err := os.ReadDir(filepath.Join(c.Root, "tasks"))
 	if err != nil {
-		return nil, err
+		if errors.Is(err, os.ErrNotExist) {
+			return stats, nil
+		}
+		return stats, err
+	}
+
+	for _, ent := range entries {
+		// Skip in-progress stores.
+		if !ent.IsDir() || strings.HasPrefix(ent.Name(), "tmp-task-") {
+			continue
+		}
+
+		mfi, err := os.Stat(c.manifestPath(ent.Name()))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return stats, err
+		}
+
+		size, err := dirSize(c.taskDir(ent.Name()), seen)
+		if err != nil {
+			return stats, err
+		}
+
+		stats.Entries++
+		stats.TotalBytes += size
+		t := mfi.ModTime()
+		if stats.Oldest.IsZero() || t.Before(stats.Oldest) {
+			stats.Oldest = t
+		}
+		if t.After(stats.Newest) {
+			stats.Newest = t
+		}
+	}
+
+	// Blobs no entry links any more still take space.
+	size, err := dirSize(c.blobsDir(), seen)
+	if err != nil {
+		return stats, err
+	}
+	stats.TotalBytes += size
+	return stats, nil
+}
+
+// dirSize sums the sizes of regular files under dir, ignoring files removed
+// during the walk and files already in seen, which it adds to. A missing dir
+// is empty.
+func dirSize(dir string, seen map[fileID]bool) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if id, ok := fileIDOf(info); ok {
+			if seen[id] {
+				return nil
+			}
+			seen[id] = true
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+// cacheManifest describes a stored task entry. Digests maps each output to its
+// content digest so restored outputs can be stamped without re-hashing; entries
+// written before digests were recorded have none. Dirs lists the directories
+// of directory outputs, so restore recreates them even when empty.
+type cacheManifest struct {
+	TaskKey string          `json:"task_key"`
+	Outputs []Path          `json:"outputs"`
+	Dirs    []Path          `json:"dirs,omitempty"`
+	Digests map[Path]string `json:"digests,omitempty"`
+	// Modes records the permission bits each output not in Pack was
+	// produced with: blobs are read-only, so restores can't take them from
+	// the blob. Older entries have none and restore the blob's mode.
+	Modes map[Path]fs.FileMode `json:"modes,omitempty"`
+	Task  json.RawMessage      `json:"task"`
+	Build *buildMetadata       `json:"build,omitempty"`
+	// Inputs lists the expanded inputs that fed the entry, so it can be
+	// audited without re-expanding globs. Older entries have none.
+	Inputs []CacheInput `json:"inputs,omitempty"`
+	// Pack lists the outputs stored in the entry's pack file (see
+	// LocalCache.PackBelow) rather than under outputs/. They are still
+	// listed in Outputs.
+	Pack []packedOutput `json:"pack,omitempty"`
+	// OutputBytes is the total size of Outputs and RunDuration how long the
+	// command ran to produce them (zero when unknown, e.g. for entries
+	// seeded by `cache warm`). They estimate what a hit saves. Older
+	// entries have neither.
+	OutputBytes int64         `json:"output_bytes,omitempty"`
+	RunDuration time.Duration `json:"run_duration,omitempty"`
+}
+
+// packedOutput locates one output within an entry's pack file.
+type packedOutput struct {
+	Path   Path        `json:"path"`
+	Offset int64       `json:"offset"`
+	Size   int64       `json:"size"`
+	Mode   fs.FileMode `json:"mode"`
+}
+
+// packTruncated reports whether a pack file of size bytes is too short to
+// hold every packed output of m.
+func (m *cacheManifest) packTruncated(size int64) bool {
+	for _, p := range m.Pack {
+		if p.Offset+p.Size > size {
+			return true
+		}
 	}
+	return false
+}
 
-	var manifest struct {
-		TaskKey string          `json:"task_key"`
-		Outputs []Path          `json:"outputs"`
-		Task    json.RawMessage `json:"task"`
+// packIndex maps each packed output of m to its location in the pack file.
+func (m *cacheManifest) packIndex() map[Path]packedOutput {
+	if len(m.Pack) == 0 {
+		return nil
+	}
+	index := make(map[Path]packedOutput, len(m.Pack))
+	for _, p := range m.Pack {
+		index[p.Path] = p
+	}
+	return index
+}
+
+// CacheInput is one expanded input file of a stored entry and its digest.
+type CacheInput struct {
+	Path   Path   `json:"path"`
+	Digest string `json:"digest"`
+}
+
+// manifestInputs extracts the expanded inputs from a task key payload.
+// Payloads that aren't task keys (e.g. in tests) have none.
+func manifestInputs(taskJSON []byte) []CacheInput {
+	var payload struct {
+		Inputs []CacheInput `json:"inputs"`
+	}
+	if err := json.Unmarshal(taskJSON, &payload); err != nil {
+		return nil
+	}
+	return payload.Inputs
+}
+
+// buildMetadata records who produced a cache entry, for auditing shared
+// caches. It is not part of the task key. Older entries have none.
+type buildMetadata struct {
+	ToolVersion string    `json:"tool_version"`
+	CreatedAt   time.Time `json:"created_at"`
+	Host        string    `json:"host,omitempty"`
+}
+
+func currentBuildMetadata() *buildMetadata {
+	host, _ := os.Hostname()
+	return &buildMetadata{
+		ToolVersion: toolVersion(),
+		CreatedAt:   time.Now().UTC(),
+		Host:        host,
+	}
+}
+
+func (c *LocalCache) readManifest(taskKey string) (cacheManifest, error) {
+	var manifest cacheManifest
+	data, err := os.ReadFile(c.manifestPath(taskKey))
+	if err != nil {
+		return manifest, err
 	}
 	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, err
+	}
+	return manifest, nil
+}
+
+// CacheEntryInfo describes a stored entry for `cache inspect`.
+type CacheEntryInfo struct {
+	TaskKey string          `json:"task_key"`
+	Format  string          `json:"format"`
+	Task    json.RawMessage `json:"task"`
+	Outputs []CacheOutput   `json:"outputs"`
+	Dirs    []Path          `json:"dirs,omitempty"`
+	Inputs  []CacheInput    `json:"inputs,omitempty"`
+	Build   *buildMetadata  `json:"build,omitempty"`
+}
+
+// CacheOutput is one output of a stored entry. Digest is empty for entries
+// written before digests were recorded; Size is -1 if the file is missing.
+type CacheOutput struct {
+	Path   Path   `json:"path"`
+	Digest string `json:"digest,omitempty"`
+	Size   int64  `json:"size"`
+}
+
+// Storage formats of an entry. With cacheFormatFiles each output is stored
+// as a plain file under <entry>/outputs/; with cacheFormatPacked the small
+// ones are in <entry>/outputs.pack instead.
+const (
+	cacheFormatFiles  = "files"
+	cacheFormatPacked = "packed"
+)
+
+func (c *LocalCache) packPath(taskKey string) string {
+	return filepath.Join(c.taskDir(taskKey), "outputs.pack")
+}
+
+// Inspect returns the manifest of the entry for taskKey along with the size
+// of each stored output.
+func (c *LocalCache) Inspect(taskKey string) (CacheEntryInfo, error) {
+	manifest, err := c.readManifest(taskKey)
+	if err != nil {
+		return CacheEntryInfo{}, err
+	}
+
+	info := CacheEntryInfo{
+		TaskKey: manifest.TaskKey,
+		Format:  cacheFormatFiles,
+		Task:    manifest.Task,
+		Outputs: make([]CacheOutput, 0, len(manifest.Outputs)),
+		Dirs:    manifest.Dirs,
+		Inputs:  manifest.Inputs,
+		Build:   manifest.Build,
+	}
+	if len(manifest.Pack) > 0 {
+		info.Format = cacheFormatPacked
+	}
+	pack := manifest.packIndex()
+	for _, out := range manifest.Outputs {
+		size := int64(-1)
+		if p, ok := pack[out]; ok {
+			size = p.Size
+		} else if fi, err := os.Stat(filepath.Join(c.taskDir(taskKey), "outputs", filepath.FromSlash(string(out)))); err == nil {
+			size = fi.Size()
+		}
+		info.Outputs = append(info.Outputs, CacheOutput{Path: out, Digest: manifest.Digests[out], Size: size})
+	}
+	return info, nil
+}
+
+func (c *LocalCache) ReadManifestOutputs(taskKey string) ([]Path, error) {
+	manifest, err := c.readManifest(taskKey)
+	if err != nil {
 		return nil, err
 	}
 	return manifest.Outputs, nil
 }
 
-func (c *LocalCache) Restore(taskKey string, outputs []Path) (bool, error) {
+// Restore links the cached outputs for taskKey into the workspace. It returns
+// the entry's manifest on a hit and nil on a miss.
+//
+// If only is non-nil, just the outputs matching one of its globs (or lying
+// under a directory it names) are restored, and the returned manifest lists
+// only those. Empty directories aren't recreated then.
+func (c *LocalCache) Restore(taskKey string, only []Path) (*cacheManifest, error) {
+	return c.restore(taskKey, only, "", false)
+}
+
+// RestoreChanged is Restore that leaves alone each output whose workspace
+// copy already has the content recorded in the manifest, so its mtime and
+// inode don't change. It hashes every output already in the workspace to
+// find out.
+func (c *LocalCache) RestoreChanged(taskKey string, only []Path) (*cacheManifest, error) {
+	return c.restore(taskKey, only, "", true)
+}
+
+// RestoreToDir is Restore into destDir instead of the workspace, e.g. to
+// compare two versions of a task's outputs. Outputs keep their paths
+// relative to destDir and are copied, since destDir may be on another
+// filesystem and a later edit there must not reach the cache.
+func (c *LocalCache) RestoreToDir(taskKey string, only []Path, destDir string) (*cacheManifest, error) {
+	if destDir == "" {
+		destDir = "."
+	}
+	return c.restore(taskKey, only, destDir, false)
+}
+
+// restore restores into destDir, or hardlinks into the workspace if
+// destDir is empty. keepUnchanged skips outputs already in place (see
+// RestoreChanged).
+func (c *LocalCache) restore(taskKey string, only []Path, destDir string, keepUnchanged bool) (*cacheManifest, error) {
 	tDir := c.taskDir(taskKey)
 
-	manifestPath := c.manifestPath(taskKey)
-	data, err := os.ReadFile(manifestPath)
+	manifest, err := c.readManifest(taskKey)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			return false, nil
+			return nil, nil
 		}
-		return false, err
+		return nil, err
 	}
-
-	var manifest struct {
-		TaskKey string          `json:"task_key"`
-		Outputs []Path          `json:"outputs"`
-		Task    json.RawMessage `json:"task"`
+	outputs := manifest.Outputs
+	if len(outputs) == 0 && len(manifest.Dirs) == 0 {
+		return nil, nil
 	}
-	if err := json.Unmarshal(data, &manifest); err != nil {
-		return false, err
+
+	pack := manifest.packIndex()
+	var files []Path
+	for _, out := range outputs {
+		if _, ok := pack[out]; !ok {
+			files = append(files, out)
+		}
 	}
-	outputs = manifest.Outputs
-	if len(outputs) == 0 {
-		return false, nil
+
+	if c.Verify {
+		if err := verifyEntryOutputs(tDir, files, manifest.Digests); err != nil {
+			return nil, fmt.Errorf("%w %s: %v", ErrCorruptCacheEntry, taskKey, err)
+		}
 	}
 
 	// Check all cached outputs exist before linking any, to avoid partial restores.
-	for _, out := range outputs {
+	var packFile *os.File
+	if pack != nil {
+		f, err := os.Open(c.packPath(taskKey))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		defer f.Close()
+		packFile = f
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if manifest.packTruncated(fi.Size()) {
+			return nil, fmt.Errorf("%w %s: pack file is truncated", ErrCorruptCacheEntry, taskKey)
+		}
+		if c.Verify {
+			if err := verifyPackedOutputs(packFile, manifest.Pack, manifest.Digests); err != nil {
+				return nil, fmt.Errorf("%w %s: %v", ErrCorruptCacheEntry, taskKey, err)
+			}
+		}
+	}
+	for _, out := range files {
 		src := filepath.Join(tDir, "outputs", filepath.FromSlash(string(out)))
 		if _, err := os.Stat(src); err != nil {
 			if errors.Is(err, os.ErrNotExist) {
-				return false, nil
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+
+	if only != nil {
+		outputs = matchingOutputs(outputs, only)
+		manifest.Outputs = outputs
+		manifest.Dirs = nil
+	}
+	// Outputs above the workspace would land outside destDir.
+	if destDir != "" {
+		for _, p := range append(slices.Clone(outputs), manifest.Dirs...) {
+			if !filepath.IsLocal(filepath.FromSlash(string(p))) {
+				return nil, fmt.Errorf("output %q is outside the workspace and can't be restored into %s", p, destDir)
 			}
-			return false, err
+		}
+	}
+
+	for _, dir := range manifest.Dirs {
+		if err := os.MkdirAll(filepath.Join(destDir, filepath.FromSlash(string(dir))), 0o755); err != nil {
+			return nil, err
 		}
 	}
 
 	// Hardlink cached outputs to their expected locations. Hardlinks share
 	// the same inode and metadata as the cached copy, so file stamps
-	// observed by downstream tasks remain stable across restores.
+	// observed by downstream tasks remain stable across restores. A link
+	// would also share the blob's read-only mode, so outputs the task
+	// produced with other permission bits (usually writable ones) are
+	// copied and given their recorded mode instead.
+	//
+	// Outputs are prepared in parallel, bounded by the I/O limit shared by
+	// all restores, under temp names next to their destinations. Only once
+	// every one is ready are they renamed into place, so a failed link or
+	// copy leaves the workspace's outputs as they were; only a failing
+	// rename, after that, can leave a mix of restored and stale outputs.
+	temps := make([]string, len(outputs))
+	removeTemps := func() {
+		for _, tmp := range temps {
+			if tmp != "" {
+				_ = os.Remove(tmp)
+			}
+		}
+	}
+	g := new(errgroup.Group)
+	g.SetLimit(c.jobs())
+	for i, out := range outputs {
+		g.Go(func() error {
+			c.ioSem <- struct{}{}
+			defer func() { <-c.ioSem }()
+
+			src := filepath.Join(tDir, "outputs", filepath.FromSlash(string(out)))
+			dst := filepath.Join(destDir, filepath.FromSlash(string(out)))
+
+			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+				return err
+			}
+
+			if d, ok := manifest.Digests[out]; keepUnchanged && ok && hasDigest(dst, d) {
+				return nil
+			}
+
+			tmp, err := unusedTempName(filepath.Dir(dst))
+			if err != nil {
+				return err
+			}
+			temps[i] = tmp
+
+			if p, ok := pack[out]; ok {
+				return unpackFile(packFile, p, tmp)
+			}
+
+			mode, hasMode := manifest.Modes[out]
+			copyOut := func() error {
+				if !hasMode {
+					return copyOutput(src, tmp)
+				}
+				return copyOutputMode(src, tmp, mode)
+			}
+			if destDir != "" || c.RestoreMode == RestoreCopy || hasMode && !fileHasMode(src, mode) {
+				return copyOut()
+			}
+			if err := os.Link(src, tmp); err != nil {
+				// E.g. a base cache mounted from another filesystem.
+				return copyOut()
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		removeTemps()
+		return nil, err
+	}
+	for i, tmp := range temps {
+		if tmp == "" {
+			continue
+		}
+		if err := os.Rename(tmp, filepath.Join(destDir, filepath.FromSlash(string(outputs[i])))); err != nil {
+			removeTemps()
+			return nil, err
+		}
+		// Renaming a link over another link to the same blob succeeds
+		// without removing it.
+		_ = os.Remove(tmp)
+		temps[i] = ""
+	}
+
+	return &manifest, nil
+}
+
+// unusedTempName returns a path in dir that no file has, for a restored
+// output to be prepared under before it is renamed into place.
+func unusedTempName(dir string) (string, error) {
+	f, err := os.CreateTemp(dir, ".tmp-restore-")
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	_ = f.Close()
+	return name, os.Remove(name)
+}
+
+// matchingOutputs returns the outputs matched by a glob in patterns or
+// lying under a directory one of them names.
+func matchingOutputs(outputs, patterns []Path) []Path {
+	var matched []Path
 	for _, out := range outputs {
-		src := filepath.Join(tDir, "outputs", filepath.FromSlash(string(out)))
-		dst := filepath.FromSlash(string(out))
+		for _, pat := range patterns {
+			if ok, _ := doublestar.Match(string(pat), string(out)); ok {
+				matched = append(matched, out)
+				break
+			}
+			if ok, _ := doublestar.Match(string(pat)+"/**", string(out)); ok {
+				matched = append(matched, out)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// fileHasMode reports whether the file at path has permission bits mode.
+func fileHasMode(path string, mode fs.FileMode) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().Perm() == mode.Perm()
+}
+
+// hasDigest reports whether the regular file at path has digest d.
+func hasDigest(path, d string) bool {
+	fi, err := os.Lstat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	got, err := hashFileContents(path)
+	return err == nil && got == d
+}
 
-		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
-			return false, err
+// verifyEntryOutputs reports the first difference between the files under
+// an entry's outputs directory and the outputs its manifest lists, including
+// a file whose content no longer matches its digest (e.g. bit rot). Outputs
+// without a digest (older entries) are only checked to exist.
+func verifyEntryOutputs(tDir string, outputs []Path, digests map[Path]string) error {
+	want := make(map[Path]bool, len(outputs))
+	for _, out := range outputs {
+		want[out] = true
+	}
+	root := filepath.Join(tDir, "outputs")
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		p := Path(filepath.ToSlash(rel))
+		if !want[p] {
+			return fmt.Errorf("stray file %s not in manifest", p)
+		}
+		delete(want, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, out := range outputs {
+		if want[out] {
+			return fmt.Errorf("output %s missing", out)
+		}
+	}
+	for _, out := range outputs {
+		d, ok := digests[out]
+		if !ok {
+			continue
+		}
+		got, err := hashFileContents(filepath.Join(root, filepath.FromSlash(string(out))))
+		if err != nil {
+			return err
+		}
+		if got != d {
+			return fmt.Errorf("output %s doesn't match its digest", out)
 		}
+	}
+	return nil
+}
 
-		// Remove any existing file so the link can be created.
-		_ = os.Remove(dst)
+// verifyPackedOutputs is verifyEntryOutputs for the outputs in pack.
+func verifyPackedOutputs(pack *os.File, packed []packedOutput, digests map[Path]string) error {
+	for _, p := range packed {
+		d, ok := digests[p.Path]
+		if !ok {
+			continue
+		}
+		data := make([]byte, p.Size)
+		if _, err := pack.ReadAt(data, p.Offset); err != nil {
+			return fmt.Errorf("read %s from pack: %w", p.Path, err)
+		}
+		if sum := blake2b.Sum256(data); hex.EncodeToString(sum[:]) != d {
+			return fmt.Errorf("output %s doesn't match its digest", p.Path)
+		}
+	}
+	return nil
+}
 
-		if err := os.Link(src, dst); err != nil {
-			return false, err
+// CheckUnmodified returns ErrCorruptCacheEntry if an output file of the
+// entry for taskKey was written after the entry was stored. The files are
+// hardlinks to blobs that hardlink restores also link into the workspace, so
+// an edit in place there changes the entry too; the blobs' read-only mode
+// doesn't stop root. StoreTreeFromDir writes the manifest after linking
+// every output, so no output of an intact entry is newer than it. It costs a
+// stat per output. Packed outputs are restored as copies, so only the pack
+// file's length is checked.
+func (c *LocalCache) CheckUnmodified(taskKey string) error {
+	mfi, err := os.Stat(c.manifestPath(taskKey))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
 		}
+		return err
 	}
+	if pfi, err := os.Stat(c.packPath(taskKey)); err == nil {
+		manifest, err := c.readManifest(taskKey)
+		if err != nil {
+			return err
+		}
+		if manifest.packTruncated(pfi.Size()) {
+			return fmt.Errorf("%w %s: pack file is truncated", ErrCorruptCacheEntry, taskKey)
+		}
+	}
+	root := filepath.Join(c.taskDir(taskKey), "outputs")
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.ModTime().After(mfi.ModTime()) {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("%w %s: output %s was modified after it was stored", ErrCorruptCacheEntry, taskKey, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+}
 
-	return true, nil
+// Evict removes the entry for taskKey.
+func (c *LocalCache) Evict(taskKey string) error {
+	return os.RemoveAll(c.taskDir(taskKey))
 }
 
-func (c *LocalCache) Store(taskKey string, taskJSON []byte, outputs []Path) error {
+// EvictCorrupt is Evict for an entry that failed verification. It also
+// removes the entry's blobs whose content no longer matches their digest:
+// Store links an existing blob rather than rewrite it, so a rotten one left
+// behind would poison the entry the task re-stores.
+func (c *LocalCache) EvictCorrupt(taskKey string) error {
+	if manifest, err := c.readManifest(taskKey); err == nil {
+		for out, d := range manifest.Digests {
+			// Packed outputs have no blob; hashing fails and skips them.
+			blob := c.blobPath(manifest.blobID(out))
+			if got, err := hashFileContents(blob); err == nil && got != d {
+				if err := os.Remove(blob); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return c.Evict(taskKey)
+}
+
+func (c *LocalCache) Store(taskKey string, taskJSON []byte, outputs []Path) (*cacheManifest, error) {
 	return c.StoreFromDir(taskKey, taskJSON, outputs, ".")
 }
 
-func (c *LocalCache) StoreFromDir(taskKey string, taskJSON []byte, outputs []Path, baseDir string) error {
+// StoreFromDir stores outputs (relative to baseDir) in the cache entry for
+// taskKey and returns the manifest written for it.
+func (c *LocalCache) StoreFromDir(taskKey string, taskJSON []byte, outputs []Path, baseDir string) (*cacheManifest, error) {
+	manifest, _, err := c.StoreTreeFromDir(taskKey, taskJSON, outputs, nil, baseDir, 0)
+	return manifest, err
+}
+
+// StoreTreeFromDir is StoreFromDir for tasks with directory outputs: dirs
+// (from ExpandOutputSpecsInDir) are recorded in the manifest so that restore
+// recreates them, including empty ones. runDuration is how long the task
+// took to produce the outputs, or zero if unknown. It also returns the bytes
+// newly written to the blob store.
+//
+// Output contents live in a content-addressed blob store shared by all
+// entries; an entry's outputs are hardlinks to their blobs, which are
+// read-only. Outputs whose content is already stored (e.g. a large output
+// that didn't change since the previous run) are linked to the existing
+// blob and don't count against the byte budget. Outputs below PackBelow go
+// into the entry's pack file instead.
+func (c *LocalCache) StoreTreeFromDir(taskKey string, taskJSON []byte, outputs, dirs []Path, baseDir string, runDuration time.Duration) (*cacheManifest, int64, error) {
+	toPack := make(map[Path]bool)
+	var size, total int64
+	for _, out := range outputs {
+		src := filepath.Join(baseDir, filepath.FromSlash(string(out)))
+		fi, err := os.Stat(src)
+		if err != nil {
+			return nil, 0, fmt.Errorf("output %q missing: %w", out, err)
+		}
+		total += fi.Size()
+		if fi.Mode().IsRegular() && fi.Size() < c.PackBelow {
+			toPack[out] = true
+			size += fi.Size()
+		}
+	}
+	// Each output is read once, copied and hashed together, before the
+	// budget is checked; only the blobs committed below reach the store.
+	staged := make(map[Path]stagedBlob)
+	defer func() {
+		for _, b := range staged {
+			_ = os.Remove(b.tmp)
+		}
+	}()
+	for _, out := range outputs {
+		if toPack[out] {
+			continue
+		}
+		b, err := c.stageBlob(filepath.Join(baseDir, filepath.FromSlash(string(out))))
+		if err != nil {
+			return nil, 0, fmt.Errorf("store output %q: %w", out, err)
+		}
+		staged[out] = b
+		if !c.hasBlob(b) {
+			size += b.size
+		}
+	}
+	if err := c.reserve(size); err != nil {
+		return nil, 0, err
+	}
+
 	tDir := c.taskDir(taskKey)
 	if err := os.MkdirAll(filepath.Dir(tDir), 0o755); err != nil {
-		return err
+		return nil, 0, err
 	}
 
 	tmpDir, err := os.MkdirTemp(filepath.Dir(tDir), "tmp-task-")
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	defer os.RemoveAll(tmpDir)
 
 	sortedOutputs := append([]Path(nil), outputs...)
 	sort.Slice(sortedOutputs, func(i, j int) bool { return string(sortedOutputs[i]) < string(sortedOutputs[j]) })
 
+	digests := make(map[Path]string, len(sortedOutputs))
+	modes := make(map[Path]fs.FileMode, len(staged))
+	var pack []packedOutput
+	if len(toPack) > 0 {
+		var packed []Path
+		for _, out := range sortedOutputs {
+			if toPack[out] {
+				packed = append(packed, out)
+			}
+		}
+		if pack, err = writePack(filepath.Join(tmpDir, "outputs.pack"), baseDir, packed, digests); err != nil {
+			return nil, 0, err
+		}
+	}
 	for _, out := range sortedOutputs {
-		src := filepath.Join(baseDir, filepath.FromSlash(string(out)))
-		if _, err := os.Stat(src); err != nil {
-			return fmt.Errorf("output %q missing: %w", out, err)
+		if toPack[out] {
+			continue
+		}
+		b := staged[out]
+		if err := c.commitBlob(b); err != nil {
+			return nil, 0, fmt.Errorf("store output %q: %w", out, err)
 		}
 
 		dst := filepath.Join(tmpDir, "outputs", filepath.FromSlash(string(out)))
-		if err := copyFile(src, dst); err != nil {
-			return err
+		if err := c.linkBlob(b.id(), dst); err != nil {
+			return nil, 0, fmt.Errorf("store output %q: %w", out, err)
 		}
+		digests[out] = b.digest
+		modes[out] = b.mode
 	}
 
-	manifest := struct {
-		TaskKey string          `json:"task_key"`
-		Outputs []Path          `json:"outputs"`
-		Task    json.RawMessage `json:"task"`
-	}{
+	manifest := cacheManifest{
 		TaskKey: taskKey,
 		Outputs: sortedOutputs,
+		Dirs:    dirs,
+		Digests: digests,
+		Modes:   modes,
+		Inputs:  manifestInputs(taskJSON),
 		Task:    json.RawMessage(taskJSON),
+		Build:   currentBuildMetadata(),
+		Pack:    pack,
+
+		OutputBytes: total,
+		RunDuration: runDuration,
 	}
 
 	manifestPath := filepath.Join(tmpDir, "manifest.json")
 	mb, err := json.Marshal(manifest)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	if err := os.WriteFile(manifestPath, mb, 0o644); err != nil {
-		return err
+		return nil, 0, err
 	}
 
 	// Best-effort replace.
 	_ = os.RemoveAll(tDir)
-	return os.Rename(tmpDir, tDir)
+	if err := os.Rename(tmpDir, tDir); err != nil {
+		return nil, 0, err
+	}
+	return &manifest, size, nil
+}
+
+// writePack concatenates outputs (relative to baseDir) into a new pack file
+// at path, recording each one's digest in digests.
+func writePack(path, baseDir string, outputs []Path, digests map[Path]string) ([]packedOutput, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pack := make([]packedOutput, 0, len(outputs))
+	var offset int64
+	for _, out := range outputs {
+		src := filepath.Join(baseDir, filepath.FromSlash(string(out)))
+		fi, err := os.Stat(src)
+		if err != nil {
+			return nil, fmt.Errorf("store output %q: %w", out, err)
+		}
+		// Read once and hash what was read, as stageBlob does.
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return nil, fmt.Errorf("store output %q: %w", out, err)
+		}
+		if _, err := f.Write(data); err != nil {
+			return nil, fmt.Errorf("store output %q: %w", out, err)
+		}
+		sum := blake2b.Sum256(data)
+		digests[out] = hex.EncodeToString(sum[:])
+		pack = append(pack, packedOutput{Path: out, Offset: offset, Size: int64(len(data)), Mode: fi.Mode().Perm()})
+		offset += int64(len(data))
+	}
+	return pack, f.Close()
+}
+
+// unpackFile writes the packed output p to dst, through a temp file that is
+// renamed into place as in copyFile.
+func unpackFile(pack *os.File, p packedOutput, dst string) error {
+	data := make([]byte, p.Size)
+	if _, err := pack.ReadAt(data, p.Offset); err != nil {
+		return fmt.Errorf("read %s from pack: %w", p.Path, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-unpack-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), p.Mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (c *LocalCache) blobsDir() string {
+	return filepath.Join(c.Root, "blobs")
+}
+
+// blobPath returns the path of the blob named id (see blobID).
+func (c *LocalCache) blobPath(id string) string {
+	return filepath.Join(c.blobsDir(), id[:2], id)
+}
+
+// blobID names the blob for content with digest produced with permission
+// bits mode. A hardlink shares its blob's mode, so outputs with the same
+// bytes but different modes (e.g. only one executable) get a blob each.
+func blobID(digest string, mode fs.FileMode) string {
+	return fmt.Sprintf("%s-%03o", digest, mode.Perm())
 }
 
+// blobID returns the name of the blob holding out, which isn't packed.
+// Entries stored before modes were recorded named blobs by digest alone.
+func (m *cacheManifest) blobID(out Path) string {
+	mode, ok := m.Modes[out]
+	if !ok {
+		return m.Digests[out]
+	}
+	return blobID(m.Digests[out], mode)
+}
+
+// stagedBlob is an output copied into the blob store's temp area by
+// stageBlob, not yet committed under its name.
+type stagedBlob struct {
+	tmp    string
+	digest string
+	mode   fs.FileMode // of the source, before blobWriteBits are cleared
+	size   int64
+}
+
+func (b stagedBlob) id() string {
+	return blobID(b.digest, b.mode)
+}
+
+// hasBlob reports whether the store already has b's content and mode. A
+// blob of the wrong size was written in place (see CheckUnmodified) and
+// doesn't count.
+func (c *LocalCache) hasBlob(b stagedBlob) bool {
+	fi, err := os.Stat(c.blobPath(b.id()))
+	return err == nil && fi.Size() == b.size
+}
+
+// stageBlob copies src into a temp file in the blob store, hashing the bytes
+// as they are copied, so a blob always matches its name even if src changes
+// concurrently. The copy is read-only (see blobWriteBits), keeping other
+// mode bits such as the executable ones.
+func (c *LocalCache) stageBlob(src string) (stagedBlob, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return stagedBlob{}, err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return stagedBlob{}, err
+	}
+	if !fi.Mode().IsRegular() {
+		return stagedBlob{}, fmt.Errorf("source is not a regular file: %s", src)
+	}
+
+	if err := os.MkdirAll(c.blobsDir(), 0o755); err != nil {
+		return stagedBlob{}, err
+	}
+	tmp, err := os.CreateTemp(c.blobsDir(), "tmp-blob-")
+	if err != nil {
+		return stagedBlob{}, err
+	}
+	defer tmp.Close()
+	b := stagedBlob{tmp: tmp.Name()}
+
+	hasher, err := blake2b.New256(nil)
+	if err != nil {
+		_ = os.Remove(b.tmp)
+		return stagedBlob{}, err
+	}
+	if b.size, err = io.Copy(io.MultiWriter(tmp, hasher), in); err != nil {
+		_ = os.Remove(b.tmp)
+		return stagedBlob{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(b.tmp)
+		return stagedBlob{}, err
+	}
+	// Best-effort, as for the executable bits it keeps.
+	b.mode = fi.Mode().Perm()
+	_ = os.Chmod(b.tmp, b.mode&^blobWriteBits)
+	b.digest = hex.EncodeToString(hasher.Sum(nil))
+	return b, nil
+}
+
+// commitBlob moves a staged blob under its name. A blob the store already
+// has is kept, so the entries sharing it go on sharing one inode; the
+// staged copy is left for the caller to remove.
+func (c *LocalCache) commitBlob(b stagedBlob) error {
+	if c.hasBlob(b) {
+		return nil
+	}
+	dst := c.blobPath(b.id())
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(b.tmp, dst)
+}
+
+// linkBlob hardlinks the blob named id to dst, copying if linking fails
+// (e.g. across filesystems).
+func (c *LocalCache) linkBlob(id string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if err := os.Link(c.blobPath(id), dst); err == nil {
+		return nil
+	}
+	return copyFile(c.blobPath(id), dst)
+}
+
+// copyFile copies src to dst through a temp file in dst's directory that is
+// renamed into place, so a concurrent reader (e.g. a downstream task) sees
+// either the old file or the complete new one, never a partial write. Mode
+// bits are preserved, and ownership best-effort on Unix.
 func copyFile(src, dst string) error {
 	sfi, err := os.Stat(src)
 	if err != nil {
@@ -181,22 +1129,64 @@ func copyFile(src, dst string) error {
 	}
 	defer in.Close()
 
-	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, sfi.Mode().Perm())
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-copy-")
 	if err != nil {
 		return err
 	}
-	defer func() {
-		_ = out.Close()
-	}()
+	// Both are no-ops once the temp file was closed and renamed.
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
 
-	if _, err := io.Copy(out, in); err != nil {
+	if _, err := io.Copy(tmp, in); err != nil {
 		return err
 	}
-	if err := out.Close(); err != nil {
+	if err := tmp.Close(); err != nil {
 		return err
 	}
 
-	// Preserve executable bits and other mode flags best-effort.
-	_ = os.Chmod(dst, sfi.Mode())
-	return nil
+	if err := os.Chmod(tmp.Name(), sfi.Mode()); err != nil {
+		return err
+	}
+	preserveOwner(tmp.Name(), sfi)
+	return os.Rename(tmp.Name(), dst)
+}
+
+// copyOutput copies a cached output to dst. Blobs are read-only, but a copy
+// is the caller's own, so it gets its owner's write permission back.
+func copyOutput(src, dst string) error {
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0o200 != 0 {
+		return nil
+	}
+	return os.Chmod(dst, fi.Mode()|0o200)
+}
+
+// copyOutputMode is copyOutput for an output recorded with mode: the copy
+// gets exactly those permission bits.
+func copyOutputMode(src, dst string, mode fs.FileMode) error {
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Chmod(dst, mode.Perm())
+}
+
+// checkWritableDir creates dir if needed and probes that files can be created
+// in it.
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".write-probe-")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_ = f.Close()
+	return os.Remove(name)
 }
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func runCacheCommand(cacheRoot string, configPath string, keyOpts KeyOptions, stampOpts StampCacheOptions, args []string) error {
+	if len(args) == 0 {
+		return usagef("usage: cache stats [--json] [--output file] | cache inspect [--json] [--output file] (<taskKey> | --task <id>) | cache warm <task>... | cache restore (<taskKey> | --tag <name>) --dest <dir> | cache tag <taskKey> <name>")
+	}
+
+	switch args[0] {
+	case "stats":
+		fs := flag.NewFlagSet("cache stats", flag.ContinueOnError)
+		asJSON := fs.Bool("json", false, "print stats as JSON")
+		out := reportOutputFlag(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			return withExitCode(exitUsage, err)
+		}
+
+		stats, err := NewLocalCache(cacheRoot).Stats()
+		if err != nil {
+			return withExitCode(exitInternal, fmt.Errorf("cache stats: %w", err))
+		}
+
+		if *asJSON {
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(stats); err != nil {
+				return err
+			}
+			return out.Close()
+		}
+
+		fmt.Fprintf(out, "Entries:    %d\n", stats.Entries)
+		fmt.Fprintf(out, "Total size: %s (%d bytes)\n", formatBytes(stats.TotalBytes), stats.TotalBytes)
+		if stats.Entries > 0 {
+			fmt.Fprintf(out, "Oldest:     %s\n", stats.Oldest.Format(time.RFC3339))
+			fmt.Fprintf(out, "Newest:     %s\n", stats.Newest.Format(time.RFC3339))
+		}
+		return out.Close()
+	case "inspect":
+		return runCacheInspectCommand(cacheRoot, configPath, keyOpts, stampOpts, args[1:])
+	case "warm":
+		return runCacheWarmCommand(cacheRoot, configPath, keyOpts, stampOpts, args[1:])
+	case "restore":
+		return runCacheRestoreCommand(cacheRoot, args[1:])
+	case "tag":
+		return runCacheTagCommand(cacheRoot, args[1:])
+	default:
+		return usagef("unknown cache command %q", args[0])
+	}
+}
+
+// runCacheInspectCommand prints the manifest of a cache entry, given either
+// its key or a task whose key is computed from the current workspace.
+func runCacheInspectCommand(cacheRoot string, configPath string, keyOpts KeyOptions, stampOpts StampCacheOptions, args []string) error {
+	fs := flag.NewFlagSet("cache inspect", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the entry as JSON")
+	taskID := fs.String("task", "", "inspect the entry for this task's current key")
+	out := reportOutputFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if (*taskID == "") == (fs.NArg() == 0) || fs.NArg() > 1 {
+		return usagef("usage: cache inspect [--json] [--output file] (<taskKey> | --task <id>)")
+	}
+
+	key := fs.Arg(0)
+	if *taskID != "" {
+		taskMap, err := LoadTaskMapFromConfig(configPath)
+		if err != nil {
+			return withExitCode(exitUsage, fmt.Errorf("load tasks from %q: %w", configPath, err))
+		}
+		stamps := NewFileStampCache(filepath.Join(cacheRoot, "stamps.json"), stampOpts)
+		if err := stamps.Load(); err != nil {
+			return err
+		}
+		key, err = resolveTaskKey(taskMap, TaskID(*taskID), stamps, keyOpts, make(map[TaskID]resolvedKey))
+		if err != nil {
+			return err
+		}
+	}
+
+	info, err := NewLocalCache(cacheRoot).Inspect(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no cache entry for key %s", key)
+	}
+	if err != nil {
+		return withExitCode(exitInternal, fmt.Errorf("inspect %s: %w", key, err))
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(info); err != nil {
+			return err
+		}
+		return out.Close()
+	}
+
+	fmt.Fprintf(out, "Key:     %s\n", info.TaskKey)
+	fmt.Fprintf(out, "Format:  %s\n", info.Format)
+	if b := info.Build; b != nil {
+		fmt.Fprintf(out, "Created: %s by build-tool %s", b.CreatedAt.Format(time.RFC3339), b.ToolVersion)
+		if b.Host != "" {
+			fmt.Fprintf(out, " on %s", b.Host)
+		}
+		fmt.Fprintf(out, "\n")
+	}
+	var task bytes.Buffer
+	if err := json.Indent(&task, info.Task, "  ", "  "); err != nil {
+		task.Reset()
+		task.Write(info.Task)
+	}
+	fmt.Fprintf(out, "Task:\n  %s\n", task.String())
+	fmt.Fprintf(out, "Outputs:\n")
+	for _, o := range info.Outputs {
+		size := "missing"
+		if o.Size >= 0 {
+			size = formatBytes(o.Size)
+		}
+		digest := o.Digest
+		if digest == "" {
+			digest = "-"
+		}
+		fmt.Fprintf(out, "  %s  %s  %s\n", o.Path, size, digest)
+	}
+	if len(info.Dirs) > 0 {
+		fmt.Fprintf(out, "Directories:\n")
+		for _, dir := range info.Dirs {
+			fmt.Fprintf(out, "  %s/\n", dir)
+		}
+	}
+	if len(info.Inputs) > 0 {
+		fmt.Fprintf(out, "Inputs:\n")
+		for _, in := range info.Inputs {
+			fmt.Fprintf(out, "  %s  %s\n", in.Path, in.Digest)
+		}
+	}
+	return out.Close()
+}
+
+// runCacheRestoreCommand copies a cache entry's outputs, given by key or
+// tag, into a directory outside the workspace.
+func runCacheRestoreCommand(cacheRoot string, args []string) error {
+	const usage = "usage: cache restore (<taskKey> | --tag <name>) --dest <dir>"
+	fs := flag.NewFlagSet("cache restore", flag.ContinueOnError)
+	dest := fs.String("dest", "", "directory to restore the outputs into")
+	tag := fs.String("tag", "", "restore the entry this tag points at (see cache tag)")
+	if err := fs.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	var key string
+	if fs.NArg() > 0 {
+		// Accept flags after the key too, as in "cache restore <key> --dest d".
+		key = fs.Arg(0)
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return withExitCode(exitUsage, err)
+		}
+	}
+	if fs.NArg() > 0 || *dest == "" || (key == "") == (*tag == "") {
+		return usagef("%s", usage)
+	}
+
+	cache := NewLocalCache(cacheRoot)
+	if *tag != "" {
+		var err error
+		if key, err = cache.ResolveTag(*tag); err != nil {
+			return err
+		}
+	}
+	destDir := invocationPath(*dest)
+	manifest, err := cache.RestoreToDir(key, nil, destDir)
+	if err != nil {
+		return withExitCode(exitInternal, fmt.Errorf("restore %s: %w", key, err))
+	}
+	if manifest == nil {
+		return fmt.Errorf("no cache entry with outputs for key %s", key)
+	}
+	fmt.Printf("Restored %d outputs to %s\n", len(manifest.Outputs), destDir)
+	return nil
+}
+
+// runCacheWarmCommand seeds the cache from outputs already in the
+// workspace, e.g. from a known-good manual build, without running anything.
+func runCacheWarmCommand(cacheRoot string, configPath string, keyOpts KeyOptions, stampOpts StampCacheOptions, args []string) error {
+	if len(args) == 0 {
+		return usagef("usage: cache warm <task>...")
+	}
+	taskMap, err := LoadTaskMapFromConfig(configPath)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("load tasks from %q: %w", configPath, err))
+	}
+	targets := make([]TaskID, len(args))
+	for i, arg := range args {
+		targets[i] = TaskID(arg)
+	}
+
+	stamps := NewFileStampCache(filepath.Join(cacheRoot, "stamps.json"), stampOpts)
+	if err := stamps.Load(); err != nil {
+		return err
+	}
+	err = WarmCache(NewLocalCache(cacheRoot), taskMap, targets, stamps, keyOpts, func(id TaskID, status string) {
+		fmt.Printf("%s: %s\n", id, status)
+	})
+	return errors.Join(err, stamps.Save())
+}
+
+// WarmCache stores the workspace outputs of targets and their dependencies
+// under their current keys without running their commands. Tasks that don't
+// store to the cache, have no outputs, or whose outputs are missing are
+// skipped; report is told what happened to each task, dependencies first.
+//
+// Nothing checks that the outputs match the inputs: warming from a stale
+// workspace caches stale outputs.
+func WarmCache(cache *LocalCache, taskMap TaskMap, targets []TaskID, stamps *FileStampCache, keyOpts KeyOptions, report func(id TaskID, status string)) error {
+	var order []TaskID
+	seen := make(map[TaskID]bool)
+	for _, target := range targets {
+		deps, err := TaskDeps(taskMap, target, true)
+		if err != nil {
+			return err
+		}
+		for _, id := range append(deps, target) {
+			if !seen[id] {
+				seen[id] = true
+				order = append(order, id)
+			}
+		}
+	}
+
+	resolved := make(map[TaskID]resolvedKey)
+	for _, id := range order {
+		task := taskMap[id]
+		key, err := resolveTaskKey(taskMap, id, stamps, keyOpts, resolved)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case !task.Cache || !task.CacheMode.Writes():
+			report(id, "skipped (not cached)")
+			continue
+		case len(task.Outputs) == 0:
+			report(id, "skipped (no outputs)")
+			continue
+		case cache.Has(key):
+			report(id, "already cached")
+			continue
+		}
+		files, dirs, err := expandOutputSpecs("", task.Outputs, keyOpts.Ignore)
+		if err != nil {
+			report(id, fmt.Sprintf("skipped (%v)", err))
+			continue
+		}
+		_, written, err := cache.StoreTreeFromDir(key, resolved[id].taskJSON, files, dirs, ".", 0)
+		if err != nil {
+			return withExitCode(exitInternal, fmt.Errorf("store outputs of task %s: %w", id, err))
+		}
+		report(id, fmt.Sprintf("stored %d output(s), %s", len(files), formatBytes(written)))
+	}
+	return nil
+}
+
+// resolvedKey is a task key computed by resolveTaskKey, with the payload it
+// hashes and, for a task with output_normalize, the key its dependents
+// chain (see normalizedDepKey).
+type resolvedKey struct {
+	key      string
+	taskJSON []byte
+	depKey   string
+}
+
+// resolveTaskKey computes the key of id (and, recursively, of its
+// dependencies) from the current workspace without running anything.
+// resolved memoizes keys across calls.
+func resolveTaskKey(taskMap TaskMap, id TaskID, stamps *FileStampCache, keyOpts KeyOptions, resolved map[TaskID]resolvedKey) (string, error) {
+	if r, ok := resolved[id]; ok {
+		return r.key, nil
+	}
+	task, ok := taskMap[id]
+	if !ok {
+		return "", usagef("task %s not found", id)
+	}
+	depKeys := make([]string, 0, len(task.Dependencies))
+	for _, dep := range task.Dependencies {
+		k, err := resolveTaskKey(taskMap, dep, stamps, keyOpts, resolved)
+		if err != nil {
+			return "", err
+		}
+		if d := resolved[dep].depKey; d != "" {
+			k = d
+		}
+		depKeys = append(depKeys, k)
+	}
+	key, taskJSON, _, err := ComputeTaskKeyWithStats(task, depKeys, stamps, keyOpts)
+	if err != nil {
+		return "", fmt.Errorf("compute task key for task %s: %w", id, err)
+	}
+	r := resolvedKey{key: key, taskJSON: taskJSON}
+	if task.OutputNormalize != "" {
+		// As a workspace build would see them.
+		outputs, _, err := expandOutputSpecs("", task.Outputs, keyOpts.Ignore)
+		if err != nil {
+			return "", fmt.Errorf("expand outputs for task %s: %w", id, err)
+		}
+		if r.depKey, err = normalizedDepKey(task, "", outputs); err != nil {
+			return "", fmt.Errorf("task %s: %w", id, err)
+		}
+	}
+	resolved[id] = r
+	return key, nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// runDiffOutputsCommand compares the outputs in the cache entry for a task's
+// current key with those of its previous recorded run.
+func runDiffOutputsCommand(cacheRoot string, configPath string, keyOpts KeyOptions, stampOpts StampCacheOptions, args []string) error {
+	fs := flag.NewFlagSet("diff-outputs", flag.ContinueOnError)
+	out := reportOutputFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if fs.NArg() != 1 {
+		return usagef("usage: diff-outputs [--output file] <task>")
+	}
+	taskID := TaskID(fs.Arg(0))
+
+	taskMap, err := LoadTaskMapFromConfig(configPath)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("load tasks from %q: %w", configPath, err))
+	}
+	stamps := NewFileStampCache(filepath.Join(cacheRoot, "stamps.json"), stampOpts)
+	if err := stamps.Load(); err != nil {
+		return err
+	}
+	key, err := resolveTaskKey(taskMap, taskID, stamps, keyOpts, make(map[TaskID]resolvedKey))
+	if err != nil {
+		return err
+	}
+	manifest, err := NewLocalCache(cacheRoot).readManifest(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("task %s: no cache entry for its current key %s; build it first", taskID, key)
+	}
+	if err != nil {
+		return withExitCode(exitInternal, fmt.Errorf("read manifest %s: %w", key, err))
+	}
+	newer := TaskRun{TaskKey: key, Digests: manifest.Digests}
+	if manifest.Build != nil {
+		newer.Time = manifest.Build.CreatedAt
+	}
+
+	history := NewTaskHistory(taskHistoryPath(cacheRoot))
+	if err := history.Load(); err != nil {
+		return err
+	}
+	older, ok := previousRun(history.Runs(taskID), key)
+	if !ok {
+		return fmt.Errorf("task %s: no earlier recorded run to compare with", taskID)
+	}
+
+	fmt.Fprintf(out, "Task %s\n", taskID)
+	fmt.Fprintf(out, "  old: %s (%s)\n", older.TaskKey, older.Time.Format(time.RFC3339))
+	fmt.Fprintf(out, "  new: %s (%s)\n", newer.TaskKey, newer.Time.Format(time.RFC3339))
+
+	d := DiffRuns(older, newer)
+	if d.Empty() {
+		fmt.Fprintf(out, "No output changes\n")
+		return out.Close()
+	}
+	for _, p := range d.Added {
+		fmt.Fprintf(out, "+ %s\n", p)
+	}
+	for _, p := range d.Removed {
+		fmt.Fprintf(out, "- %s\n", p)
+	}
+	for _, p := range d.Changed {
+		fmt.Fprintf(out, "~ %s\n", p)
+	}
+	return out.Close()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffOutputsCommand(t *testing.T) {
+	withTempWD(t, func() {
+		configPath := writeConfig(t, `{"tasks": {
+			// noise.txt isn't an input: it stands in for a nondeterministic compiler.
+			"gen": {
+				"command": "cat src.txt noise.txt > out.txt && echo same > stable.txt",
+				"inputs": ["src.txt"],
+				"outputs": ["out.txt", "stable.txt"],
+				"cache": true,
+			},
+		}}`)
+		taskMap, err := LoadTaskMapFromConfig(configPath)
+		if err != nil {
+			t.Fatalf("LoadTaskMapFromConfig: %v", err)
+		}
+		cacheRoot := filepath.Join(".build-tool", "cache")
+		diff := func() (string, error) {
+			t.Helper()
+			err := runDiffOutputsCommand(cacheRoot, configPath, keyOptions(false), StampCacheOptions{}, []string{"--output", "diff.txt", "gen"})
+			data, _ := os.ReadFile("diff.txt")
+			return string(data), err
+		}
+
+		writeFileContent(t, "src.txt", "a")
+		writeFileContent(t, "noise.txt", "1")
+		build(t, taskMap, TaskExecutorOptions{}, "gen")
+		if _, err := diff(); err == nil || !strings.Contains(err.Error(), "no earlier recorded run") {
+			t.Fatalf("diff-outputs after one run = %v, want no earlier run", err)
+		}
+
+		// Same key, different output.
+		writeFileContent(t, "noise.txt", "2")
+		build(t, taskMap, TaskExecutorOptions{Refresh: []TaskID{"gen"}}, "gen")
+		got, err := diff()
+		if err != nil {
+			t.Fatalf("diff-outputs: %v", err)
+		}
+		if !strings.Contains(got, "~ out.txt\n") || strings.Contains(got, "stable.txt") {
+			t.Errorf("diff-outputs =\n%s\nwant only out.txt changed", got)
+		}
+
+		// The current key has no entry yet: nothing to compare, whatever
+		// the history holds.
+		writeFileContent(t, "src.txt", "b")
+		if _, err := diff(); err == nil || !strings.Contains(err.Error(), "no cache entry for its current key") {
+			t.Errorf("diff-outputs for an unbuilt key = %v, want no cache entry", err)
+		}
+	})
+}
+
+func TestCacheWarmCommandUsesStampMode(t *testing.T) {
+	withTempWD(t, func() {
+		configPath := writeConfig(t, `{"tasks": {
+			"gen": {"command": "cp src.txt gen.txt", "inputs": ["src.txt"], "outputs": ["gen.txt"], "cache": true},
+		}}`)
+		writeFileContent(t, "src.txt", "a")
+		writeFileContent(t, "gen.txt", "a")
+		cacheRoot := filepath.Join(".build-tool", "cache")
+		stampOpts := StampCacheOptions{Mode: StampMTime}
+		if err := runCacheWarmCommand(cacheRoot, configPath, keyOptions(false), stampOpts, []string{"gen"}); err != nil {
+			t.Fatalf("cache warm: %v", err)
+		}
+		var file stampCacheFile
+		data, err := os.ReadFile(filepath.Join(cacheRoot, "stamps.json"))
+		if err == nil {
+			data, err = decompressStamps(data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			t.Fatal(err)
+		}
+		if file.Mode != StampMTime {
+			t.Errorf("stamps recorded in mode %q, want %q", file.Mode, StampMTime)
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// CacheMode says whether a task may restore from the cache, store to it,
+// both, or neither.
+type CacheMode string
+
+const (
+	CacheReadWrite CacheMode = "readwrite"
+	CacheRead      CacheMode = "read"  // restore, never store (e.g. untrusted CI lanes)
+	CacheWrite     CacheMode = "write" // always run, then store
+	CacheOff       CacheMode = "off"
+)
+
+func ParseCacheMode(s string) (CacheMode, error) {
+	switch m := CacheMode(s); m {
+	case CacheReadWrite, CacheRead, CacheWrite, CacheOff:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown cache mode %q (want read, readwrite, write or off)", s)
+}
+
+// Reads reports whether m allows restoring. The zero mode is readwrite.
+func (m CacheMode) Reads() bool {
+	return m == "" || m == CacheReadWrite || m == CacheRead
+}
+
+// Writes reports whether m allows storing. The zero mode is readwrite.
+func (m CacheMode) Writes() bool {
+	return m == "" || m == CacheReadWrite || m == CacheWrite
+}
+
+// cacheConfig is a task's "cache" setting: true, false, or a CacheMode.
+type cacheConfig struct {
+	Mode CacheMode
+}
+
+func (c *cacheConfig) UnmarshalJSON(data []byte) error {
+	var b bool
+	if err := json.Unmarshal(data, &b); err == nil {
+		c.Mode = CacheOff
+		if b {
+			c.Mode = CacheReadWrite
+		}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return &ConfigError{Field: "cache", Reason: "cache must be a bool or a cache mode"}
+	}
+	m, err := ParseCacheMode(s)
+	if err != nil {
+		return &ConfigError{Field: "cache", Reason: err.Error()}
+	}
+	c.Mode = m
+	return nil
+}
+
+// MarshalJSON writes the bool forms where they suffice, so configs edited by
+// add-task keep their usual shape.
+func (c cacheConfig) MarshalJSON() ([]byte, error) {
+	switch c.Mode {
+	case CacheReadWrite:
+		return json.Marshal(true)
+	case CacheOff:
+		return json.Marshal(false)
+	}
+	return json.Marshal(string(c.Mode))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Tags name cache entries, e.g. the build that was promoted to a release
+// candidate, so later jobs can restore exactly those outputs whatever key
+// the workspace computes now. Each tag is a file under <cache>/tags holding
+// the key; retagging moves the tag.
+
+var tagNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
+func (c *LocalCache) tagPath(name string) string {
+	return filepath.Join(c.Root, "tags", name)
+}
+
+// Tag points the tag name at the entry for taskKey, which must exist.
+func (c *LocalCache) Tag(name, taskKey string) error {
+	if !tagNamePattern.MatchString(name) {
+		return usagef("invalid tag name %q (want letters, digits, '.', '_' or '-', not starting with '.' or '-')", name)
+	}
+	if !c.Has(taskKey) {
+		return fmt.Errorf("no cache entry for key %s", taskKey)
+	}
+	path := c.tagPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-tag-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(taskKey + "\n"); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ResolveTag returns the key the tag name points at.
+func (c *LocalCache) ResolveTag(name string) (string, error) {
+	if !tagNamePattern.MatchString(name) {
+		return "", usagef("invalid tag name %q", name)
+	}
+	data, err := os.ReadFile(c.tagPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("no tag %q", name)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// runCacheTagCommand tags an existing entry.
+func runCacheTagCommand(cacheRoot string, args []string) error {
+	if len(args) != 2 {
+		return usagef("usage: cache tag <taskKey> <name>")
+	}
+	key, name := args[0], args[1]
+	if err := NewLocalCache(cacheRoot).Tag(name, key); err != nil {
+		return fmt.Errorf("tag %s: %w", key, err)
+	}
+	fmt.Printf("Tagged %s as %s\n", key, name)
+	return nil
+}
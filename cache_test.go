@@ -0,0 +1,752 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestStoreRecordsBuildMetadata(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "out.txt")
+		c := NewLocalCache("cache")
+
+		if _, err := c.Store("k1", []byte(`{}`), []Path{"out.txt"}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		m, err := c.readManifest("k1")
+		if err != nil {
+			t.Fatalf("readManifest: %v", err)
+		}
+		if m.Build == nil {
+			t.Fatal("manifest has no build metadata")
+		}
+		if m.Build.ToolVersion == "" || m.Build.CreatedAt.IsZero() {
+			t.Errorf("incomplete build metadata: %+v", *m.Build)
+		}
+	})
+}
+
+func TestStoreRecordsInputs(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "src/a.c", "a")
+		writeFileContent(t, "src/b.c", "b")
+		writeFile(t, "out.txt")
+		task := Task{ID: "gen", Inputs: []Path{"src/*.c"}, Outputs: []Path{"out.txt"}, Command: "gen"}
+		key, taskJSON, err := ComputeTaskKey(task, nil, nil)
+		if err != nil {
+			t.Fatalf("ComputeTaskKey: %v", err)
+		}
+
+		c := NewLocalCache("cache")
+		if _, err := c.Store(key, taskJSON, []Path{"out.txt"}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		info, err := c.Inspect(key)
+		if err != nil {
+			t.Fatalf("Inspect: %v", err)
+		}
+		da, _ := hashFileContents("src/a.c")
+		db, _ := hashFileContents("src/b.c")
+		want := []CacheInput{{Path: "src/a.c", Digest: da}, {Path: "src/b.c", Digest: db}}
+		if !slices.Equal(info.Inputs, want) {
+			t.Errorf("Inputs = %+v, want %+v", info.Inputs, want)
+		}
+
+		// Entries stored from other payloads, like older ones, have none.
+		if _, err := c.Store("k2", []byte(`{}`), []Path{"out.txt"}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		if info, err := c.Inspect("k2"); err != nil || info.Inputs != nil {
+			t.Errorf("Inspect(k2) Inputs = %+v, %v; want none", info.Inputs, err)
+		}
+	})
+}
+
+func TestRestoreManifestWithoutBuildMetadata(t *testing.T) {
+	withTempWD(t, func() {
+		c := NewLocalCache("cache")
+		dir := c.taskDir("old")
+		writeFileContent(t, filepath.Join(dir, "manifest.json"), `{"task_key":"old","outputs":["out.txt"],"task":{}}`)
+		writeFileContent(t, filepath.Join(dir, "outputs", "out.txt"), "cached")
+
+		m, err := c.Restore("old", []Path{"out.txt"})
+		if err != nil || m == nil {
+			t.Fatalf("Restore = %v, %v; want hit", m, err)
+		}
+		if m.Build != nil {
+			t.Errorf("Build = %+v, want nil", *m.Build)
+		}
+		data, err := os.ReadFile("out.txt")
+		if err != nil || string(data) != "cached" {
+			t.Errorf("restored out.txt = %q, %v", data, err)
+		}
+	})
+}
+
+func TestInspect(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "out/a.txt", "hello")
+		c := NewLocalCache("cache")
+		if _, err := c.Store("k1", []byte(`{"command":"gen"}`), []Path{"out/a.txt"}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+
+		info, err := c.Inspect("k1")
+		if err != nil {
+			t.Fatalf("Inspect: %v", err)
+		}
+		if info.TaskKey != "k1" || info.Format != cacheFormatFiles || string(info.Task) != `{"command":"gen"}` {
+			t.Errorf("Inspect = %+v", info)
+		}
+		want, _ := hashFileContents("out/a.txt")
+		if len(info.Outputs) != 1 || info.Outputs[0] != (CacheOutput{Path: "out/a.txt", Digest: want, Size: 5}) {
+			t.Errorf("Outputs = %+v", info.Outputs)
+		}
+
+		if _, err := c.Inspect("missing"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Inspect(missing) error = %v, want ErrNotExist", err)
+		}
+	})
+}
+
+func TestStats(t *testing.T) {
+	withTempWD(t, func() {
+		c := NewLocalCache("cache")
+		if stats, err := c.Stats(); err != nil || stats != (CacheStats{}) {
+			t.Fatalf("Stats of an empty cache = %+v, %v; want zero", stats, err)
+		}
+
+		writeFileContent(t, "out.txt", "output")
+		for _, key := range []string{"k1", "k2"} {
+			if _, err := c.Store(key, []byte(`{}`), []Path{"out.txt"}); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+		}
+		old := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		if err := os.Chtimes(c.manifestPath("k1"), old, old); err != nil {
+			t.Fatal(err)
+		}
+		// Neither an in-progress store nor a directory without a manifest
+		// is an entry.
+		writeFileContent(t, filepath.Join(c.Root, "tasks", "tmp-task-1", "outputs", "out.txt"), "partial")
+		writeFileContent(t, filepath.Join(c.taskDir("k3"), "outputs", "out.txt"), "orphan")
+
+		stats, err := c.Stats()
+		if err != nil {
+			t.Fatalf("Stats: %v", err)
+		}
+		if stats.Entries != 2 {
+			t.Errorf("Entries = %d, want 2", stats.Entries)
+		}
+		// Both entries link one blob, which is counted once.
+		want := int64(len("output"))
+		for _, key := range []string{"k1", "k2"} {
+			fi, err := os.Stat(c.manifestPath(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want += fi.Size()
+		}
+		fi, err := os.Stat("out.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fileIDOf(fi); !ok {
+			want += int64(len("output")) * 2 // no inodes to tell links apart
+		}
+		if stats.TotalBytes != want {
+			t.Errorf("TotalBytes = %d, want %d", stats.TotalBytes, want)
+		}
+		if !stats.Oldest.Equal(old) {
+			t.Errorf("Oldest = %v, want %v", stats.Oldest, old)
+		}
+		if !stats.Newest.After(old) {
+			t.Errorf("Newest = %v, want after %v", stats.Newest, old)
+		}
+	})
+}
+
+func TestStoreReusesUnchangedBlobs(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "big.bin", "large mostly unchanged output")
+		writeFileContent(t, "small.txt", "v1")
+		c := NewLocalCache("cache")
+		outputs := []Path{"big.bin", "small.txt"}
+
+		if _, err := c.Store("k1", []byte(`{}`), outputs); err != nil {
+			t.Fatalf("Store k1: %v", err)
+		}
+		first, _ := c.BytesWritten()
+
+		writeFileContent(t, "small.txt", "v2")
+		if _, err := c.Store("k2", []byte(`{}`), outputs); err != nil {
+			t.Fatalf("Store k2: %v", err)
+		}
+		total, _ := c.BytesWritten()
+
+		if got := total - first; got != int64(len("v2")) {
+			t.Errorf("second store wrote %d bytes, want only the changed output", got)
+		}
+
+		a, err := os.Stat(filepath.Join(c.taskDir("k1"), "outputs", "big.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.Stat(filepath.Join(c.taskDir("k2"), "outputs", "big.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(a, b) {
+			t.Errorf("unchanged output was copied instead of sharing its blob")
+		}
+	})
+}
+
+// BenchmarkStoreMostlyUnchangedOutput stores a task with one large output
+// that doesn't change between runs under a new key each iteration.
+func BenchmarkStoreMostlyUnchangedOutput(b *testing.B) {
+	dir := b.TempDir()
+	big := filepath.Join(dir, "big.bin")
+	if err := os.WriteFile(big, make([]byte, 32<<20), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	c := NewLocalCache(filepath.Join(dir, "cache"))
+
+	i := 0
+	for b.Loop() {
+		i++
+		if _, err := c.StoreFromDir(fmt.Sprintf("k%d", i), []byte(`{}`), []Path{"big.bin"}, dir); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRestoreRollsBackOnFailure(t *testing.T) {
+	withTempWD(t, func() {
+		c := NewLocalCache("cache")
+		dir := c.taskDir("k1")
+		writeFileContent(t, filepath.Join(dir, "manifest.json"), `{"task_key":"k1","outputs":["a.txt","blocked/b.txt"],"task":{}}`)
+		writeFileContent(t, filepath.Join(dir, "outputs", "a.txt"), "a")
+		writeFileContent(t, filepath.Join(dir, "outputs", "blocked", "b.txt"), "b")
+		// A file where a directory is needed makes the second link fail.
+		writeFileContent(t, "blocked", "not a dir")
+		writeFileContent(t, "a.txt", "stale")
+
+		if _, err := c.Restore("k1", nil); err == nil {
+			t.Fatal("Restore succeeded, want error")
+		}
+		if data, err := os.ReadFile("a.txt"); err != nil || string(data) != "stale" {
+			t.Errorf("a.txt = %q, %v after a failed restore; want it untouched", data, err)
+		}
+		if tmps, _ := filepath.Glob(".tmp-restore-*"); len(tmps) != 0 {
+			t.Errorf("temp files left behind: %v", tmps)
+		}
+
+		// Restoring over outputs already linked to the same blobs leaves
+		// no temp files either.
+		if err := os.Remove("blocked"); err != nil {
+			t.Fatal(err)
+		}
+		for range 2 {
+			if m, err := c.Restore("k1", nil); err != nil || m == nil {
+				t.Fatalf("Restore = %v, %v; want a hit", m, err)
+			}
+		}
+		if data, err := os.ReadFile("a.txt"); err != nil || string(data) != "a" {
+			t.Errorf("a.txt = %q, %v; want the restored content", data, err)
+		}
+		if tmps, _ := filepath.Glob(".tmp-restore-*"); len(tmps) != 0 {
+			t.Errorf("temp files left behind: %v", tmps)
+		}
+	})
+}
+
+// BenchmarkRestoreManyOutputs restores a single task with many outputs.
+func BenchmarkRestoreManyOutputs(b *testing.B) {
+	dir := b.TempDir()
+	c := NewLocalCache(filepath.Join(dir, "cache"))
+	outputs := make([]Path, 2000)
+	for i := range outputs {
+		outputs[i] = Path(fmt.Sprintf("out/%02d/f%d.txt", i%50, i))
+		p := filepath.Join(dir, filepath.FromSlash(string(outputs[i])))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(fmt.Sprint(i)), 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if _, err := c.StoreFromDir("k1", []byte(`{}`), outputs, dir); err != nil {
+		b.Fatal(err)
+	}
+
+	old, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+	chdirMu.Lock()
+	defer chdirMu.Unlock()
+	if err := os.Chdir(b.TempDir()); err != nil {
+		b.Fatal(err)
+	}
+	defer os.Chdir(old)
+
+	for b.Loop() {
+		if m, err := c.Restore("k1", outputs); err != nil || m == nil {
+			b.Fatalf("Restore = %v, %v", m, err)
+		}
+	}
+}
+
+func TestRestoreVerifyRejectsStrayOutputs(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "out.txt", "out")
+		state := NewBuildState("cache", filepath.Join("cache", "stamps.json"), StampCacheOptions{})
+		c := state.localCache
+		if _, err := c.Store("k", []byte(`{}`), []Path{"out.txt"}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+
+		c.Verify = true
+		if _, err := c.Restore("k", nil); err != nil {
+			t.Fatalf("Restore of an intact entry: %v", err)
+		}
+
+		writeFileContent(t, filepath.Join(c.taskDir("k"), "outputs", "stray.txt"), "junk")
+		c.Verify = false
+		if m, err := c.Restore("k", nil); err != nil || m == nil {
+			t.Fatalf("Restore without Verify = %v, %v; want a hit", m, err)
+		}
+
+		c.Verify = true
+		hit, err := state.Restore("k", nil, false)
+		if !errors.Is(err, ErrCorruptCacheEntry) || hit {
+			t.Fatalf("Restore = %v, %v; want ErrCorruptCacheEntry", hit, err)
+		}
+		if c.Has("k") {
+			t.Errorf("corrupt entry was not evicted")
+		}
+	})
+}
+
+func TestRestoreMode(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       RestoreMode
+		produced   fs.FileMode
+		wantShared bool
+	}{
+		{name: "default", mode: "", produced: 0o444, wantShared: true},
+		{name: "hardlink", mode: RestoreHardlink, produced: 0o555, wantShared: true},
+		{name: "copy", mode: RestoreCopy, produced: 0o444, wantShared: false},
+		// A link would give a writable output its blob's read-only mode.
+		{name: "hardlink writable", mode: RestoreHardlink, produced: 0o644, wantShared: blobWriteBits == 0},
+		{name: "copy writable", mode: RestoreCopy, produced: 0o644, wantShared: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempWD(t, func() {
+				writeFileContent(t, "out.txt", "cached")
+				if err := os.Chmod("out.txt", tt.produced); err != nil {
+					t.Fatal(err)
+				}
+				c := &LocalCache{Root: "cache", RestoreMode: tt.mode}
+				if _, err := c.Store("k", []byte(`{}`), []Path{"out.txt"}); err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+				if err := os.Remove("out.txt"); err != nil {
+					t.Fatal(err)
+				}
+				if m, err := c.Restore("k", nil); err != nil || m == nil {
+					t.Fatalf("Restore = %v, %v; want a hit", m, err)
+				}
+
+				restored, err := os.Stat("out.txt")
+				if err != nil {
+					t.Fatal(err)
+				}
+				cached, err := os.Stat(filepath.Join(c.taskDir("k"), "outputs", "out.txt"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if shared := os.SameFile(restored, cached); shared != tt.wantShared {
+					t.Errorf("restored output shares the cached inode = %v, want %v", shared, tt.wantShared)
+				}
+				if restored.Mode().Perm() != tt.produced {
+					t.Errorf("restored mode = %v, want %v as produced", restored.Mode().Perm(), tt.produced)
+				}
+			})
+		})
+	}
+}
+
+func TestCheckUnmodified(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "out.txt", "cached")
+		if err := os.Chmod("out.txt", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		c := NewLocalCache("cache")
+		if _, err := c.Store("k", []byte(`{}`), []Path{"out.txt"}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		stored := filepath.Join(c.taskDir("k"), "outputs", "out.txt")
+		if fi, err := os.Stat(stored); err != nil || fi.Mode().Perm() != 0o755&^blobWriteBits {
+			t.Errorf("stored output = %v, %v; want mode %v", fi, err, fs.FileMode(0o755&^blobWriteBits))
+		}
+		if err := c.CheckUnmodified("k"); err != nil {
+			t.Fatalf("CheckUnmodified of a fresh entry: %v", err)
+		}
+
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(stored, later, later); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.CheckUnmodified("k"); !errors.Is(err, ErrCorruptCacheEntry) {
+			t.Errorf("CheckUnmodified after a write = %v, want ErrCorruptCacheEntry", err)
+		}
+		if err := c.CheckUnmodified("missing"); err != nil {
+			t.Errorf("CheckUnmodified of a missing entry = %v, want nil", err)
+		}
+	})
+}
+
+func TestRestoreToDir(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, filepath.Join("bin", "app"), "app")
+		writeFileContent(t, filepath.Join("doc", "app.1"), "man")
+		c := NewLocalCache("cache")
+		if _, err := c.Store("k", []byte(`{}`), []Path{"bin/app", "doc/app.1"}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+
+		dest := t.TempDir()
+		m, err := c.RestoreToDir("k", nil, dest)
+		if err != nil || m == nil {
+			t.Fatalf("RestoreToDir = %v, %v; want a hit", m, err)
+		}
+		for path, want := range map[string]string{"bin/app": "app", "doc/app.1": "man"} {
+			got, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(path)))
+			if err != nil || string(got) != want {
+				t.Errorf("%s = %q, %v; want %q", path, got, err, want)
+			}
+		}
+
+		// A copy, not a link: editing it must not reach the cache.
+		writeFileContent(t, filepath.Join(dest, "bin", "app"), "edited")
+		if got, _ := os.ReadFile(filepath.Join(c.taskDir("k"), "outputs", "bin", "app")); string(got) != "app" {
+			t.Errorf("cached bin/app = %q after editing the restored copy", got)
+		}
+
+		if m, err := c.RestoreToDir("missing", nil, dest); m != nil || err != nil {
+			t.Errorf("RestoreToDir of a missing key = %v, %v; want a miss", m, err)
+		}
+
+		// An output above the workspace would escape dest.
+		writeFileContent(t, filepath.Join("..", "up.txt"), "up")
+		if _, err := c.Store("up", []byte(`{}`), []Path{"../up.txt"}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		escapeDir := filepath.Join(dest, "sub")
+		if _, err := c.RestoreToDir("up", nil, escapeDir); err == nil || !strings.Contains(err.Error(), "outside the workspace") {
+			t.Errorf("RestoreToDir of an output above the workspace = %v, want an error", err)
+		}
+		if _, err := os.Stat(filepath.Join(dest, "up.txt")); !os.IsNotExist(err) {
+			t.Errorf("output restored outside the destination: %v", err)
+		}
+	})
+}
+
+func TestCacheTags(t *testing.T) {
+	withTempWD(t, func() {
+		c := NewLocalCache("cache")
+		for key, content := range map[string]string{"k1": "v1", "k2": "v2"} {
+			writeFileContent(t, "out.txt", content)
+			if _, err := c.Store(key, []byte(`{}`), []Path{"out.txt"}); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+		}
+		restoreTag := func(name string) string {
+			t.Helper()
+			dest := t.TempDir()
+			if err := runCacheRestoreCommand("cache", []string{"--tag", name, "--dest", dest}); err != nil {
+				t.Fatalf("cache restore --tag %s: %v", name, err)
+			}
+			data, err := os.ReadFile(filepath.Join(dest, "out.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(data)
+		}
+
+		if err := runCacheTagCommand("cache", []string{"k1", "release-candidate"}); err != nil {
+			t.Fatalf("cache tag: %v", err)
+		}
+		if got := restoreTag("release-candidate"); got != "v1" {
+			t.Errorf("restored %q, want the tagged entry's v1", got)
+		}
+		// Retagging moves the tag.
+		if err := c.Tag("release-candidate", "k2"); err != nil {
+			t.Fatalf("Tag: %v", err)
+		}
+		if got := restoreTag("release-candidate"); got != "v2" {
+			t.Errorf("restored %q after retagging, want v2", got)
+		}
+
+		if err := c.Tag("rc", "missing"); err == nil {
+			t.Errorf("tagging a missing entry succeeded")
+		}
+		if err := c.Tag("../escape", "k1"); exitCode(err) != exitUsage {
+			t.Errorf("Tag with an invalid name err = %v, want usage error", err)
+		}
+		if _, err := c.ResolveTag("nope"); err == nil {
+			t.Errorf("ResolveTag of an unknown tag succeeded")
+		}
+		if err := runCacheRestoreCommand("cache", []string{"k1", "--tag", "rc", "--dest", t.TempDir()}); exitCode(err) != exitUsage {
+			t.Errorf("restore with both a key and --tag err = %v, want usage error", err)
+		}
+	})
+}
+
+func TestPackedStoreAndRestore(t *testing.T) {
+	withTempWD(t, func() {
+		files := map[string]struct {
+			content string
+			mode    os.FileMode
+		}{
+			"a.txt":      {"a", 0o644},
+			"bin/run.sh": {"#!/bin/sh\necho run\n", 0o755},
+			"empty":      {"", 0o600},
+			"big.bin":    {strings.Repeat("x", 2048), 0o644},
+		}
+		var outputs []Path
+		for path, f := range files {
+			writeFileContent(t, filepath.FromSlash(path), f.content)
+			if err := os.Chmod(filepath.FromSlash(path), f.mode); err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, Path(path))
+		}
+
+		c := NewLocalCache("cache")
+		c.PackBelow = 1024
+		c.Verify = true
+		m, err := c.Store("k", []byte(`{}`), outputs)
+		if err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		var packed []Path
+		for _, p := range m.Pack {
+			packed = append(packed, p.Path)
+		}
+		if want := []Path{"a.txt", "bin/run.sh", "empty"}; !slices.Equal(packed, want) {
+			t.Errorf("packed %v, want %v", packed, want)
+		}
+		// Only the large output is a file of its own.
+		var stored []string
+		err = filepath.WalkDir(filepath.Join(c.taskDir("k"), "outputs"), func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				stored = append(stored, d.Name())
+			}
+			return err
+		})
+		if err != nil || !slices.Equal(stored, []string{"big.bin"}) {
+			t.Errorf("files under outputs/ = %v, %v; want [big.bin]", stored, err)
+		}
+		if info, err := c.Inspect("k"); err != nil || info.Format != cacheFormatPacked {
+			t.Errorf("Inspect format = %q, %v; want %q", info.Format, err, cacheFormatPacked)
+		}
+
+		for path := range files {
+			if err := os.Remove(filepath.FromSlash(path)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if m, err := c.Restore("k", nil); err != nil || m == nil {
+			t.Fatalf("Restore = %v, %v; want a hit", m, err)
+		}
+		for path, f := range files {
+			fi, err := os.Stat(filepath.FromSlash(path))
+			if err != nil {
+				t.Errorf("%s not restored: %v", path, err)
+				continue
+			}
+			// Packed or not, outputs come back with the mode they
+			// were produced with.
+			if fi.Mode().Perm() != f.mode {
+				t.Errorf("%s mode = %v, want %v", path, fi.Mode().Perm(), f.mode)
+			}
+			got, _ := os.ReadFile(filepath.FromSlash(path))
+			if string(got) != f.content {
+				t.Errorf("%s = %q, want %q", path, got, f.content)
+			}
+			if d, err := hashFileContents(filepath.FromSlash(path)); err != nil || d != m.Digests[Path(path)] {
+				t.Errorf("%s digest = %s, %v; manifest has %s", path, d, err, m.Digests[Path(path)])
+			}
+		}
+	})
+}
+
+func TestEmptyOutputsRoundTrip(t *testing.T) {
+	sum := blake2b.Sum256(nil)
+	emptyDigest := fmt.Sprintf("%x", sum)
+
+	tests := []struct {
+		name       string
+		packBelow  int64
+		wantFormat string
+	}{
+		{name: "files", wantFormat: cacheFormatFiles},
+		{name: "packed", packBelow: 1 << 10, wantFormat: cacheFormatPacked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempWD(t, func() {
+				outputs := []Path{"done.marker", "sub/empty.txt", "full.txt"}
+				writeFileContent(t, "done.marker", "")
+				writeFileContent(t, filepath.Join("sub", "empty.txt"), "")
+				writeFileContent(t, "full.txt", "full")
+				c := NewLocalCache("cache")
+				c.PackBelow = tt.packBelow
+				c.Verify = true
+				m, err := c.Store("k", []byte(`{}`), outputs)
+				if err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+				for _, out := range []Path{"done.marker", "sub/empty.txt"} {
+					if m.Digests[out] != emptyDigest {
+						t.Errorf("digest of %s = %q, want the empty-content digest %q", out, m.Digests[out], emptyDigest)
+					}
+				}
+				if info, err := c.Inspect("k"); err != nil || info.Format != tt.wantFormat {
+					t.Fatalf("Inspect = %+v, %v; want format %s", info, err, tt.wantFormat)
+				}
+
+				for _, out := range outputs {
+					if err := os.Remove(filepath.FromSlash(string(out))); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if m, err := c.Restore("k", nil); err != nil || m == nil {
+					t.Fatalf("Restore = %v, %v; want a hit", m, err)
+				}
+				for out, want := range map[string]string{"done.marker": "", "sub/empty.txt": "", "full.txt": "full"} {
+					data, err := os.ReadFile(filepath.FromSlash(out))
+					if err != nil || string(data) != want {
+						t.Errorf("%s after restore = %q, %v; want %q", out, data, err, want)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestWarmCache(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "src.txt", "src")
+		// Outputs of an earlier manual build.
+		writeFileContent(t, "gen.txt", "src")
+		writeFileContent(t, "use.txt", "src")
+		taskMap := NewTaskMap([]Task{
+			{ID: "gen", Inputs: []Path{"src.txt"}, Outputs: []Path{"gen.txt"}, Command: "cp src.txt gen.txt && echo gen >> runs.log", Cache: true},
+			{ID: "use", Inputs: []Path{"gen.txt"}, Outputs: []Path{"use.txt"}, Dependencies: []TaskID{"gen", "docs", "lint"}, Command: "cp gen.txt use.txt && echo use >> runs.log", Cache: true},
+			{ID: "docs", Outputs: []Path{"docs.html"}, Command: "echo docs > docs.html", Cache: true},
+			{ID: "lint", Command: "true", Cache: true},
+		})
+		if err := normalizeDependencyInputs(taskMap); err != nil {
+			t.Fatalf("normalizeDependencyInputs: %v", err)
+		}
+
+		root := filepath.Join(".build-tool", "cache")
+		stamps := NewFileStampCache(filepath.Join(root, "stamps.json"), StampCacheOptions{})
+		got := make(map[TaskID]string)
+		err := WarmCache(NewLocalCache(root), taskMap, []TaskID{"use"}, stamps, KeyOptions{}, func(id TaskID, status string) {
+			got[id] = status
+		})
+		if err != nil {
+			t.Fatalf("WarmCache: %v", err)
+		}
+		for id, want := range map[TaskID]string{"gen": "stored 1", "use": "stored 1", "docs": "skipped", "lint": "skipped (no outputs)"} {
+			if !strings.HasPrefix(got[id], want) {
+				t.Errorf("task %s: %q, want %q...", id, got[id], want)
+			}
+		}
+
+		// The docs output doesn't exist, so that task runs; the rest are hits.
+		build(t, taskMap, TaskExecutorOptions{}, "use")
+		if _, err := os.Stat("runs.log"); !os.IsNotExist(err) {
+			data, _ := os.ReadFile("runs.log")
+			t.Errorf("warmed tasks ran again: %q", data)
+		}
+	})
+}
+
+func TestCopyFileNoPartialWrite(t *testing.T) {
+	withTempWD(t, func() {
+		const size = 4 << 20
+		oldData := strings.Repeat("a", size)
+		newData := strings.Repeat("b", size)
+		writeFileContent(t, "dst.bin", oldData)
+		writeFileContent(t, "src.bin", newData)
+
+		done := make(chan error, 1)
+		go func() {
+			for range 5 {
+				if err := copyFile("src.bin", "dst.bin"); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+
+		for {
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("copyFile: %v", err)
+				}
+				return
+			default:
+			}
+			data, err := os.ReadFile("dst.bin")
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if got := string(data); got != oldData && got != newData {
+				t.Fatalf("observed partial file: %d bytes", len(data))
+			}
+		}
+	})
+}
+
+func TestCopyFilePreservesMode(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "tool.sh", "#!/bin/sh\n")
+		if err := os.Chmod("tool.sh", 0o750); err != nil {
+			t.Fatalf("Chmod: %v", err)
+		}
+		if err := copyFile("tool.sh", filepath.Join("out", "tool.sh")); err != nil {
+			t.Fatalf("copyFile: %v", err)
+		}
+		fi, err := os.Stat(filepath.Join("out", "tool.sh"))
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if fi.Mode().Perm() != 0o750 {
+			t.Errorf("mode = %v, want 0750", fi.Mode().Perm())
+		}
+		if matches, _ := filepath.Glob(filepath.Join("out", ".tmp-copy-*")); len(matches) != 0 {
+			t.Errorf("temp files left behind: %v", matches)
+		}
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// CommandAllowlist is the set of executables tasks may run under
+// -command-allowlist, a guardrail for building configs from untrusted
+// sources. It is not a sandbox: an allowed executable can still do anything.
+type CommandAllowlist map[string]bool
+
+// LoadCommandAllowlist reads one executable per line (a name like "make" or
+// a path like "./build.sh", matched exactly). Blank lines and lines starting
+// with # are ignored.
+func LoadCommandAllowlist(path string) (CommandAllowlist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	allow := make(CommandAllowlist)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		allow[line] = true
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return allow, nil
+}
+
+// Check returns an error unless every command in a shell command line starts
+// with an allowed executable. Anything it can't resolve statically, such as
+// command substitution or an executable taken from a variable, is refused, as
+// is assigning a variable that changes what an allowed name runs (see
+// protectedEnv).
+func (a CommandAllowlist) Check(command, shell string) error {
+	if !isPOSIXShell(shell) {
+		return fmt.Errorf("command allowlist: can't check commands for non-POSIX shell %s", shell)
+	}
+	exes, err := commandExecutables(command)
+	if err != nil {
+		return fmt.Errorf("command allowlist: %w", err)
+	}
+	for _, exe := range exes {
+		if !a[exe] {
+			return fmt.Errorf("command allowlist: %q is not an allowed executable", exe)
+		}
+	}
+	return nil
+}
+
+// CheckEnv returns an error if env, a task's env or secret_env, sets a
+// protected variable.
+func (a CommandAllowlist) CheckEnv(env map[string]string) error {
+	for _, name := range slices.Sorted(maps.Keys(env)) {
+		if protectedEnv(name) {
+			return fmt.Errorf("command allowlist: setting %s is not allowed", name)
+		}
+	}
+	return nil
+}
+
+// protectedEnv reports whether setting name could make an allowed
+// executable name run something else (PATH) or load code into it (the
+// dynamic loaders' LD_* and DYLD_*, and the startup files of BASH_ENV and
+// ENV).
+func protectedEnv(name string) bool {
+	return name == "PATH" || name == "BASH_ENV" || name == "ENV" ||
+		strings.HasPrefix(name, "LD_") || strings.HasPrefix(name, "DYLD_")
+}
+
+var shellAssignment = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// shellKeywords may precede a command without being one.
+var shellKeywords = map[string]bool{
+	"!": true, "{": true, "}": true, "if": true, "then": true, "elif": true,
+	"else": true, "fi": true, "while": true, "until": true, "do": true, "done": true,
+}
+
+// commandExecutables returns the leading executable of every simple command
+// in a POSIX shell command line, in order. It is a deliberately small lexer:
+// quotes and operators are understood, and constructs that would hide what
+// runs are errors. So is any word assigning a protected variable, wherever it
+// appears: "PATH=. make", "export PATH=." and "make PATH=." (make exports it
+// to recipes) all change what later names resolve to.
+func commandExecutables(command string) ([]string, error) {
+	var (
+		exes     []string
+		word     strings.Builder
+		inWord   bool
+		literal  = true // word has no unquoted or double-quoted $
+		atStart  = true // next word is in command position
+		redirect bool   // next word is a redirection target
+		quote    rune
+	)
+	endWord := func() error {
+		if !inWord {
+			return nil
+		}
+		w := word.String()
+		if shellAssignment.MatchString(w) {
+			if name, _, _ := strings.Cut(w, "="); protectedEnv(name) {
+				return fmt.Errorf("setting %s is not allowed", name)
+			}
+		}
+		switch {
+		case redirect:
+			redirect = false
+		case !atStart:
+		case shellKeywords[w] && literal:
+		case shellAssignment.MatchString(w):
+		case !literal:
+			return fmt.Errorf("executable %q is not a literal name", w)
+		default:
+			exes = append(exes, w)
+			atStart = false
+		}
+		word.Reset()
+		inWord = false
+		literal = true
+		return nil
+	}
+
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		next := rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+			continue
+		case r == '`':
+			return nil, fmt.Errorf("command substitution is not allowed")
+		case r == '$' && next == '(':
+			return nil, fmt.Errorf("command substitution is not allowed")
+		case quote == '"':
+			switch {
+			case r == '"':
+				quote = 0
+			case r == '\\' && next != 0:
+				i++
+				word.WriteRune(next)
+			default:
+				if r == '$' {
+					literal = false
+				}
+				word.WriteRune(r)
+			}
+			continue
+		}
+
+		switch r {
+		case '\'', '"':
+			quote = r
+			inWord = true
+		case '\\':
+			if next != 0 {
+				i++
+				if next != '\n' {
+					word.WriteRune(next)
+					inWord = true
+				}
+			}
+		case ' ', '\t':
+			if err := endWord(); err != nil {
+				return nil, err
+			}
+		case '#':
+			// Only a # starting a word begins a comment.
+			if inWord {
+				word.WriteRune(r)
+				break
+			}
+			for i+1 < len(runes) && runes[i+1] != '\n' {
+				i++
+			}
+		case '\n', ';', '&', '|', '(', ')':
+			if r == '(' && next == '(' {
+				return nil, fmt.Errorf("arithmetic commands are not allowed")
+			}
+			if err := endWord(); err != nil {
+				return nil, err
+			}
+			atStart = true
+		case '<', '>':
+			if next == '(' {
+				return nil, fmt.Errorf("process substitution is not allowed")
+			}
+			// A digit directly before the operator is a file descriptor.
+			if w := word.String(); inWord && strings.Trim(w, "0123456789") == "" {
+				word.Reset()
+				inWord = false
+			}
+			if err := endWord(); err != nil {
+				return nil, err
+			}
+			// Consume the rest of the operator, e.g. ">>" or the "&" of ">&2".
+			for i+1 < len(runes) && (runes[i+1] == '<' || runes[i+1] == '>' || runes[i+1] == '&') {
+				i++
+			}
+			redirect = true
+		default:
+			if r == '$' {
+				literal = false
+			}
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if err := endWord(); err != nil {
+		return nil, err
+	}
+	return exes, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCommandExecutables(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+		wantErr string
+	}{
+		{command: "make all", want: []string{"make"}},
+		{command: "gcc -c a.c && gcc -o app a.o", want: []string{"gcc", "gcc"}},
+		{command: "cat in.txt | sort > out.txt 2>&1", want: []string{"cat", "sort"}},
+		{command: "CC=clang make\n# a comment; rm -rf /\n./build.sh 'arg; rm'", want: []string{"make", "./build.sh"}},
+		{command: "if test -f x; then echo yes >&2; fi", want: []string{"test", "echo"}},
+		{command: "(cd sub && make)", want: []string{"cd", "make"}},
+		{command: "'make' \"-j$N\"", want: []string{"make"}},
+		{command: "echo $(rm -rf /)", wantErr: "command substitution"},
+		{command: "echo `id`", wantErr: "command substitution"},
+		{command: "$CC -c a.c", wantErr: "not a literal name"},
+		{command: "diff <(ls a) b", wantErr: "process substitution"},
+		{command: "echo 'unterminated", wantErr: "unterminated"},
+		{command: "PATH=. make", wantErr: "setting PATH is not allowed"},
+		{command: "LD_PRELOAD=./evil.so make", wantErr: "setting LD_PRELOAD"},
+		{command: "export PATH=.; make", wantErr: "setting PATH"},
+		{command: "env DYLD_INSERT_LIBRARIES=x.dylib make", wantErr: "setting DYLD_INSERT_LIBRARIES"},
+		{command: "make 'PATH=.'", wantErr: "setting PATH"},
+		{command: "BASH_ENV=./evil bash build.sh", wantErr: "setting BASH_ENV"},
+		{command: "MYPATH=. LDFLAGS=-s make", want: []string{"make"}},
+	}
+	for _, tt := range tests {
+		got, err := commandExecutables(tt.command)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("commandExecutables(%q) error = %v, want %q", tt.command, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("commandExecutables(%q) = %q, %v; want %q", tt.command, got, err, tt.want)
+		}
+	}
+}
+
+func TestCommandAllowlist(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "allowlist.txt", "# build tools\necho\n\ntrue\n")
+		allow, err := LoadCommandAllowlist("allowlist.txt")
+		if err != nil {
+			t.Fatalf("LoadCommandAllowlist: %v", err)
+		}
+
+		tests := []struct {
+			name    string
+			command string
+			wantErr bool
+		}{
+			{name: "allowed", command: "echo hi > out.txt && true"},
+			{name: "denied", command: "echo hi > out.txt && touch ran.txt", wantErr: true},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				taskMap := NewTaskMap([]Task{{ID: "gen", Command: tt.command}})
+				e := newTestExecutor(t, TaskExecutorOptions{CommandAllowlist: allow})
+				err := e.ExecuteTasks(taskMap, []TaskID{"gen"})
+				if !tt.wantErr {
+					if err != nil {
+						t.Fatalf("ExecuteTasks: %v", err)
+					}
+					return
+				}
+				if err == nil || !strings.Contains(err.Error(), `"touch" is not an allowed executable`) {
+					t.Fatalf("ExecuteTasks error = %v, want touch refused", err)
+				}
+				if exitCode(err) != exitUsage {
+					t.Errorf("exit code = %d, want %d", exitCode(err), exitUsage)
+				}
+			})
+		}
+		if _, err := os.Stat("ran.txt"); !os.IsNotExist(err) {
+			t.Errorf("denied command ran (stat err %v)", err)
+		}
+
+		// The config's env (and so env_file) can't set PATH either.
+		taskMap := NewTaskMap([]Task{{ID: "gen", Command: "echo hi > ran.txt", Env: map[string]string{"PATH": "."}}})
+		e := newTestExecutor(t, TaskExecutorOptions{CommandAllowlist: allow})
+		err = e.ExecuteTasks(taskMap, []TaskID{"gen"})
+		if err == nil || !strings.Contains(err.Error(), "setting PATH is not allowed") || exitCode(err) != exitUsage {
+			t.Fatalf("ExecuteTasks with env PATH = %v, want a usage error", err)
+		}
+		if _, err := os.Stat("ran.txt"); !os.IsNotExist(err) {
+			t.Errorf("command with a protected env ran (stat err %v)", err)
+		}
+	})
+}
@@ -6,107 +6,803 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 
+	"github.com/bmatcuk/doublestar/v4"
 	"github.com/tailscale/hujson"
 )
 
 type buildConfig struct {
-	Tasks map[TaskID]taskConfig `json:"tasks"`
+	Image   string `json:"image,omitempty"`
+	EnvFile string `json:"env_file,omitempty"`
+	// Includes lists further config files, relative to this one, whose
+	// tasks are merged into the build graph.
+	Includes []string `json:"includes,omitempty"`
+	// FailFast is the default for tasks that don't set fail_fast.
+	FailFast bool `json:"fail_fast,omitempty"`
+	// Settings holds defaults for command-line flags; root config only.
+	Settings *Settings `json:"settings,omitempty"`
+	// Pools limits how many tasks naming each pool run at once, on top of
+	// -jobs (e.g. {"link": 2} for memory-hungry links); root config only.
+	Pools map[string]int `json:"pools,omitempty"`
+	Tasks taskConfigMap  `json:"tasks"`
+}
+
+// ConfigError is a validation problem in the build config. File is set when
+// the problem concerns a config file as a whole, TaskID when it concerns one
+// task, and Field names the offending config field if there is one. Reason
+// is the human-readable description.
+type ConfigError struct {
+	File   string
+	TaskID TaskID
+	Field  string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File + ": ")
+	}
+	if e.TaskID != "" {
+		b.WriteString("task " + string(e.TaskID) + ": ")
+	}
+	b.WriteString(e.Reason)
+	return b.String()
+}
+
+// taskConfigMap decodes each task strictly on its own so that errors (e.g.
+// a misspelled field) name the task they occur in.
+type taskConfigMap map[TaskID]taskConfig
+
+func (m *taskConfigMap) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var raw map[TaskID]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	tasks := make(taskConfigMap, len(raw))
+	for id, msg := range raw {
+		dec := json.NewDecoder(bytes.NewReader(msg))
+		dec.DisallowUnknownFields()
+
+		var tc taskConfig
+		if err := dec.Decode(&tc); err != nil {
+			var ce *ConfigError
+			if errors.As(err, &ce) {
+				ce.TaskID = id
+				return ce
+			}
+			msg := strings.TrimPrefix(err.Error(), "json: ")
+			if field, ok := strings.CutPrefix(msg, "unknown field "); ok {
+				return &ConfigError{TaskID: id, Field: strings.Trim(field, `"`), Reason: msg}
+			}
+			return fmt.Errorf("task %q: %s", id, msg)
+		}
+		tasks[id] = tc
+	}
+	*m = tasks
+	return nil
 }
 
 type taskConfig struct {
 	Inputs  []Path `json:"inputs,omitempty"`
 	Outputs []Path `json:"outputs,omitempty"`
 	Command string `json:"command"`
-	Cache   *bool  `json:"cache,omitempty"`
+	// Cache is true, false, or a CacheMode such as "read" (restore only).
+	Cache *cacheConfig `json:"cache,omitempty"`
+	// CacheSalt is folded into the task key: changing it invalidates the
+	// task's cache entry, e.g. after upgrading a system library the command
+	// uses but the tool can't see. Dependents rebuild too, since their keys
+	// include this one's.
+	CacheSalt string `json:"cache_salt,omitempty"`
+	// KeyCommands are commands whose stdout is part of the task key, for
+	// state that isn't a file (e.g. "node --version", "git rev-parse
+	// HEAD"). They run whenever the key is computed, so they must be fast
+	// and free of side effects.
+	KeyCommands []string `json:"key_commands,omitempty"`
+	Image       string   `json:"image,omitempty"`
+	// FailFast aborts the command at the first failing statement (`set -e`).
+	FailFast *bool `json:"fail_fast,omitempty"`
+	// Sandbox set to false runs the task in the real workspace even under
+	// -sandbox. Such tasks forfeit the sandbox's hermeticity guarantees.
+	Sandbox *bool `json:"sandbox,omitempty"`
+	// AllowFailure logs a failing command as a warning instead of failing
+	// the build. Dependents still run, but the task's outputs may be absent.
+	AllowFailure bool `json:"allow_failure,omitempty"`
+	// IgnoreExitCodes lists non-zero exit codes that count as success, e.g.
+	// 1 for a diff tool that found differences. Other codes still fail.
+	IgnoreExitCodes []int `json:"ignore_exit_codes,omitempty"`
+	// Idempotent marks a task without outputs (e.g. a deploy) as safe to
+	// skip while its key is unchanged: its success is recorded as an empty
+	// cache entry, which otherwise never counts as a hit. Changes made
+	// out-of-band (e.g. someone editing the deployed resources by hand) go
+	// unnoticed until the inputs change.
+	Idempotent bool `json:"idempotent,omitempty"`
+	// SerialDeps runs the task's dependencies one at a time, in the order
+	// they are declared (e.g. when they share a scratch directory).
+	SerialDeps bool `json:"serial_deps,omitempty"`
+	// WriteIfChanged leaves an output's workspace copy untouched when the
+	// tool would write identical content, keeping its mtime, so tools
+	// outside the build that compare mtimes see no change. The task runs in
+	// a sandbox even without -sandbox, so every output reaches the workspace
+	// through a restore or an export that can compare it first; only
+	// "sandbox": false makes the command write its outputs itself.
+	WriteIfChanged bool `json:"write_if_changed,omitempty"`
+	// ExpectOutputs maps each output the task must produce to its SHA-256
+	// (as sha256sum prints it), e.g. for release artifacts. After a run,
+	// a missing, extra or different output fails the task before it is
+	// cached. The map is part of the task key, so a cache hit is always a
+	// run checked against it. Paths are output paths, so the outputs must
+	// match them.
+	ExpectOutputs map[string]string `json:"expect_outputs,omitempty"`
+	// Pool names an entry of the root config's pools. The task then needs
+	// a free slot in that pool as well as one of the -jobs slots to start.
+	Pool string `json:"pool,omitempty"`
+	// OutputNormalize is a filter command (stdin to stdout) that strips
+	// non-determinism such as embedded timestamps from the task's outputs.
+	// Dependents key on the filtered outputs instead of the task's key, so
+	// a rerun that only changes what the filter strips keeps them cached.
+	// The stored outputs are left as they are.
+	OutputNormalize string `json:"output_normalize,omitempty"`
+	// Matrix expands the task into one task per combination of values, with
+	// ${matrix.<key>} substituted into its ID, command, inputs, outputs and
+	// env values (see expandMatrix).
+	Matrix map[string][]string `json:"matrix,omitempty"`
+
+	// Environment precedence, lowest to highest: the process environment,
+	// the top-level env_file, the task's env_file, then the task's env map.
+	Env     map[string]string `json:"env,omitempty"`
+	EnvFile string            `json:"env_file,omitempty"`
+	// EnvKeys names variables (typically from an env file) whose values are
+	// part of the task key. Variables set in env always are.
+	EnvKeys []string `json:"env_keys,omitempty"`
+	// SecretEnv maps variables to files holding their values, e.g. a token.
+	// The files are read when the task runs; the values never enter the key
+	// and are redacted from its output. Changing a secret therefore doesn't
+	// rerun the task or invalidate its cache entry.
+	SecretEnv map[string]string `json:"secret_env,omitempty"`
 }
 
-func LoadTaskMapFromConfig(configPath string) (TaskMap, error) {
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return nil, fmt.Errorf("config file not found: %w", err)
-		}
-		return nil, fmt.Errorf("read config file %q: %w", configPath, err)
-	}
+// decodeBuildConfig parses JSONC config data, rejecting unknown fields and
+// trailing data.
+func decodeBuildConfig(data []byte) (buildConfig, error) {
+	var cfg buildConfig
 
-	jsonData, err := hujson.Standardize(data)
+	// Standardize rewrites its input in place; leave the caller's bytes intact.
+	jsonData, err := hujson.Standardize(bytes.Clone(data))
 	if err != nil {
-		return nil, fmt.Errorf("standardize JSONC: %w", err)
+		return cfg, fmt.Errorf("standardize JSONC: %w", err)
 	}
 
 	dec := json.NewDecoder(bytes.NewReader(jsonData))
 	dec.DisallowUnknownFields()
 
-	var cfg buildConfig
 	if err := dec.Decode(&cfg); err != nil {
-		return nil, fmt.Errorf("decode JSON: %w", err)
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return cfg, fmt.Errorf("decode JSON: %w", &ConfigError{Field: strings.Trim(field, `"`), Reason: "unknown top-level field " + field})
+		}
+		return cfg, fmt.Errorf("decode JSON: %w", err)
 	}
 	if err := dec.Decode(&struct{}{}); err != io.EOF {
-		return nil, fmt.Errorf("decode JSON: trailing data")
+		return cfg, fmt.Errorf("decode JSON: trailing data")
 	}
+	return cfg, nil
+}
 
-	if cfg.Tasks == nil {
-		return nil, fmt.Errorf("missing required \"tasks\" object")
+// ProfileConfigPath returns the config file for profile, which sits next to
+// configPath with the profile name before the extension: profile "ci" of
+// build-tool.jsonc is build-tool.ci.jsonc.
+func ProfileConfigPath(configPath, profile string) (string, error) {
+	if profile == "" || strings.ContainsAny(profile, `/\.`) {
+		return "", &ConfigError{Field: "profile", Reason: fmt.Sprintf("invalid profile name %q", profile)}
+	}
+	ext := filepath.Ext(configPath)
+	p := strings.TrimSuffix(configPath, ext) + "." + profile + ext
+	if _, err := os.Stat(p); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", &ConfigError{File: p, Field: "profile", Reason: fmt.Sprintf("profile %q not found", profile)}
+		}
+		return "", err
+	}
+	return p, nil
+}
+
+// LoadTaskMapFromConfig loads the tasks in configPath and, recursively, in
+// any configs it includes. Paths in an included config are relative to that
+// file's directory, and its commands run there. Task IDs share one namespace
+// across all files.
+func LoadTaskMapFromConfig(configPath string) (TaskMap, error) {
+	l := &configLoader{
+		rootDir:    filepath.Dir(configPath),
+		taskMap:    make(TaskMap),
+		sources:    make(map[TaskID]string),
+		envFiles:   make(map[string]map[string]string),
+		matrixSets: make(map[TaskID][]TaskID),
+	}
+	if err := l.load(configPath, nil); err != nil {
+		return nil, err
 	}
 
-	taskMap := make(TaskMap, len(cfg.Tasks))
-	for id, tc := range cfg.Tasks {
-		if strings.TrimSpace(string(id)) == "" {
-			return nil, fmt.Errorf("task id must not be empty")
+	for id, task := range l.taskMap {
+		task.Dependencies = l.expandMatrixDeps(task.Dependencies)
+		l.taskMap[id] = task
+	}
+	for id, task := range l.taskMap {
+		for _, dep := range task.Dependencies {
+			if _, ok := l.taskMap[dep]; !ok {
+				return nil, &ConfigError{TaskID: id, Field: "inputs", Reason: fmt.Sprintf("depends on unknown task %s", dep)}
+			}
 		}
+	}
+
+	if err := normalizeDependencyInputs(l.taskMap); err != nil {
+		return nil, err
+	}
+
+	return l.taskMap, nil
+}
 
-		cmd := strings.TrimSpace(tc.Command)
-		if cmd == "" {
-			return nil, fmt.Errorf("task %s: command must not be empty", id)
+// normalizeDependencyInputs routes inputs that are also a dependency's
+// declared output through the dependency: the file is staged from the
+// dependency and covered by its key, so hashing the (possibly stale)
+// workspace copy as well would make hits depend on build order.
+//
+// Any task in the transitive dependency closure counts, and an output covers
+// what it would expand to: a literal output also covers the files under it
+// (it may be a directory), and a glob output what it matches. A literal input
+// so covered is dropped; a glob input gets exclusions for the outputs it may
+// reach. Dependencies that aren't direct are recorded in RoutedDeps so a
+// sandbox stages their outputs too. A literal input produced by a task
+// outside the closure is an error, since nothing orders the two.
+func normalizeDependencyInputs(taskMap TaskMap) error {
+	type outputSpec struct {
+		pat  string
+		glob bool
+		task TaskID
+	}
+	var producers []outputSpec
+	for _, id := range sortedTaskIDs(taskMap) {
+		for _, out := range taskMap[id].Outputs {
+			pat, neg, err := parseSpec(string(out))
+			if err != nil || neg {
+				continue
+			}
+			producers = append(producers, outputSpec{pat: pat, glob: hasGlobMeta(pat), task: id})
+		}
+	}
+	covers := func(out outputSpec, p string) bool {
+		if !out.glob {
+			return p == out.pat || strings.HasPrefix(p, out.pat+"/")
 		}
+		// A glob matching a directory covers the files under it.
+		for q := p; q != "."; q = path.Dir(q) {
+			if ok, _ := doublestar.Match(out.pat, q); ok {
+				return true
+			}
+		}
+		return false
+	}
 
-		cache := true
-		if tc.Cache != nil {
-			cache = *tc.Cache
+	for _, id := range sortedTaskIDs(taskMap) {
+		task := taskMap[id]
+		closure := dependencyClosure(taskMap, id)
+		direct := make(map[TaskID]bool)
+		for _, dep := range task.Dependencies {
+			direct[dep] = true
 		}
+		routed := make(map[TaskID]bool)
 
-		// Dependencies are declared inline in inputs by prefixing them with ':'
-		// e.g. ":compile".
-		inputs := make([]Path, 0, len(tc.Inputs))
-		deps := make([]TaskID, 0)
-		for _, in := range tc.Inputs {
-			raw := string(in)
-			if strings.HasPrefix(raw, "\\:") {
-				// Escaped leading ':'; treat as a literal file path beginning with ':'.
-				inputs = append(inputs, Path(strings.TrimPrefix(raw, "\\")))
+		var inputs, exclude []Path
+		for _, in := range task.Inputs {
+			pat, neg, err := parseSpec(string(in))
+			if err != nil || neg {
+				inputs = append(inputs, in)
 				continue
 			}
-			if strings.HasPrefix(raw, ":") {
-				dep := strings.TrimSpace(strings.TrimPrefix(raw, ":"))
-				if dep == "" {
-					return nil, fmt.Errorf("task %s: dependency input must not be empty", id)
+			if hasGlobMeta(pat) {
+				for _, out := range producers {
+					if !closure[out.task] {
+						continue
+					}
+					var ex []Path
+					if out.glob {
+						base, _ := doublestar.SplitPattern(out.pat)
+						if base == "." || globMayMatchBelow(pat, base) {
+							ex = []Path{Path("!" + out.pat), Path("!" + out.pat + "/**")}
+						}
+					} else {
+						if ok, _ := doublestar.Match(pat, out.pat); ok {
+							ex = append(ex, Path("!"+out.pat))
+						}
+						if globMayMatchBelow(pat, out.pat) {
+							ex = append(ex, Path("!"+out.pat+"/**"))
+						}
+					}
+					if len(ex) > 0 {
+						exclude = append(exclude, ex...)
+						routed[out.task] = true
+					}
 				}
-				deps = append(deps, TaskID(dep))
+				inputs = append(inputs, in)
 				continue
 			}
+			var producer TaskID
+			inClosure := false
+			for _, out := range producers {
+				if out.task == id || !covers(out, pat) {
+					continue
+				}
+				if closure[out.task] {
+					inClosure = true
+					routed[out.task] = true
+				} else if producer == "" {
+					producer = out.task
+				}
+			}
+			if inClosure {
+				continue
+			}
+			if producer != "" {
+				return &ConfigError{TaskID: id, Field: "inputs", Reason: fmt.Sprintf("input %q is an output of task %s, which it doesn't depend on; list \":%s\" as an input instead", in, producer, producer)}
+			}
 			inputs = append(inputs, in)
 		}
+		slices.Sort(exclude)
+		task.Inputs = append(inputs, slices.Compact(exclude)...)
+		task.RoutedDeps = nil
+		for _, dep := range sortedTaskIDs(taskMap) {
+			if routed[dep] && !direct[dep] {
+				task.RoutedDeps = append(task.RoutedDeps, dep)
+			}
+		}
+		taskMap[id] = task
+	}
+	return nil
+}
 
-		taskMap[id] = Task{
-			ID:           id,
-			Inputs:       inputs,
-			Outputs:      tc.Outputs,
-			Dependencies: deps,
-			Command:      cmd,
-			Cache:        cache,
+// dependencyClosure returns the tasks id depends on, directly or not.
+func dependencyClosure(taskMap TaskMap, id TaskID) map[TaskID]bool {
+	closure := make(map[TaskID]bool)
+	var visit func(TaskID)
+	visit = func(id TaskID) {
+		for _, dep := range taskMap[id].Dependencies {
+			if !closure[dep] {
+				closure[dep] = true
+				visit(dep)
+			}
 		}
 	}
+	visit(id)
+	return closure
+}
 
-	for id, task := range taskMap {
-		for _, dep := range task.Dependencies {
-			if _, ok := taskMap[dep]; !ok {
-				return nil, fmt.Errorf("task %s depends on unknown task %s", id, dep)
+// globMayMatchBelow reports whether pattern could match a path strictly
+// under dir, judged segment by segment: a "**" may reach anything.
+func globMayMatchBelow(pattern, dir string) bool {
+	ps := strings.Split(pattern, "/")
+	ds := strings.Split(dir, "/")
+	for i, seg := range ds {
+		if i == len(ps) {
+			return false
+		}
+		if ps[i] == "**" {
+			return true
+		}
+		if ok, _ := doublestar.Match(ps[i], seg); !ok {
+			return false
+		}
+	}
+	return len(ps) > len(ds)
+}
+
+// checkDeclaredOutputs fails if two of the planned tasks ids declare
+// overlapping outputs, before anything runs and whether or not they'll be
+// cache hits: the same spec, a literal path under another task's literal
+// (directory) output, or a literal another task's glob may produce. Two
+// different globs can only be compared once expanded (see claimOutputs).
+func checkDeclaredOutputs(taskMap TaskMap, ids []TaskID) error {
+	type outputSpec struct {
+		pat  string
+		glob bool
+		id   TaskID
+	}
+	var specs []outputSpec
+	for _, id := range ids {
+		for _, out := range taskMap[id].Outputs {
+			pat, neg, err := parseSpec(string(out))
+			if err != nil || neg {
+				continue
 			}
+			specs = append(specs, outputSpec{pat: pat, glob: hasGlobMeta(pat), id: id})
 		}
 	}
+	under := func(p, dir string) bool { return p == dir || strings.HasPrefix(p, dir+"/") }
+	globCovers := func(glob, lit string) bool {
+		for q := lit; q != "."; q = path.Dir(q) {
+			if ok, _ := doublestar.Match(glob, q); ok {
+				return true
+			}
+		}
+		return globMayMatchBelow(glob, lit)
+	}
+	for i, a := range specs {
+		for _, b := range specs[i+1:] {
+			if a.id == b.id {
+				continue
+			}
+			var overlap bool
+			switch {
+			case a.pat == b.pat:
+				overlap = true
+			case a.glob && b.glob:
+			case a.glob:
+				overlap = globCovers(a.pat, b.pat)
+			case b.glob:
+				overlap = globCovers(b.pat, a.pat)
+			default:
+				overlap = under(a.pat, b.pat) || under(b.pat, a.pat)
+			}
+			if overlap {
+				return usagef("task %s (output %s) and task %s (output %s) would write the same files", a.id, a.pat, b.id, b.pat)
+			}
+		}
+	}
+	return nil
+}
+
+func sortedTaskIDs(taskMap TaskMap) []TaskID {
+	ids := make([]TaskID, 0, len(taskMap))
+	for id := range taskMap {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+type configLoader struct {
+	rootDir  string
+	taskMap  TaskMap
+	sources  map[TaskID]string // task -> config file that defined it
+	envFiles map[string]map[string]string
+	// matrixSets maps the unexpanded ID of each matrix task to its instances.
+	matrixSets map[TaskID][]TaskID
+	shell      string // settings.shell of the root config
+	pools      map[string]int
+}
+
+func (l *configLoader) load(configPath string, stack []string) error {
+	absPath, err := filepath.Abs(configPath)
+	if err != nil {
+		return fmt.Errorf("resolve config path %q: %w", configPath, err)
+	}
+	if slices.Contains(stack, absPath) {
+		return &ConfigError{Field: "includes", Reason: "include cycle: " + strings.Join(append(stack, absPath), " -> ")}
+	}
+	stack = append(stack, absPath)
 
-	return taskMap, nil
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("config file not found: %w", err)
+		}
+		return fmt.Errorf("read config file %q: %w", configPath, err)
+	}
+
+	cfg, err := decodeBuildConfig(data)
+	if err != nil {
+		if len(stack) > 1 {
+			return fmt.Errorf("%s: %w", configPath, err)
+		}
+		return err
+	}
+
+	if cfg.Settings != nil {
+		if len(stack) > 1 {
+			return &ConfigError{File: configPath, Field: "settings", Reason: "settings are only allowed in the root config"}
+		}
+		l.shell = defaultShellAsEmpty(cfg.Settings.Shell)
+	}
+
+	if cfg.Pools != nil {
+		if len(stack) > 1 {
+			return &ConfigError{File: configPath, Field: "pools", Reason: "pools are only allowed in the root config"}
+		}
+		if err := validatePools(configPath, cfg.Pools); err != nil {
+			return err
+		}
+		l.pools = cfg.Pools
+	}
+
+	if cfg.Tasks == nil && len(cfg.Includes) == 0 {
+		return &ConfigError{File: configPath, Field: "tasks", Reason: `missing required "tasks" object`}
+	}
+
+	// Paths in the root config stay relative to the working directory,
+	// which main makes the root config's directory (see enterWorkspace);
+	// included configs are rebased onto their own directory.
+	base := ""
+	if len(stack) > 1 {
+		rel, err := filepath.Rel(l.rootDir, filepath.Dir(configPath))
+		if err != nil {
+			return fmt.Errorf("resolve directory of %q: %w", configPath, err)
+		}
+		if rel = filepath.ToSlash(rel); rel != "." {
+			base = rel
+		}
+	}
+
+	var globalEnv map[string]string
+	if cfg.EnvFile != "" {
+		globalEnv, err = l.loadEnvFile(rebasePath(base, cfg.EnvFile))
+		if err != nil {
+			return err
+		}
+	}
+
+	for templateID, tc := range cfg.Tasks {
+		instances, err := expandMatrix(templateID, tc)
+		if err != nil {
+			return err
+		}
+		for _, inst := range instances {
+			id := inst.id
+			task, err := l.taskFromConfig(id, inst.tc, cfg, base, globalEnv)
+			if err != nil {
+				return err
+			}
+			if src, ok := l.sources[id]; ok {
+				return &ConfigError{TaskID: id, Reason: fmt.Sprintf("defined in both %s and %s", src, configPath)}
+			}
+			l.sources[id] = configPath
+			l.taskMap[id] = task
+			if len(tc.Matrix) > 0 {
+				l.matrixSets[templateID] = append(l.matrixSets[templateID], id)
+			}
+		}
+	}
+
+	for _, inc := range cfg.Includes {
+		if strings.TrimSpace(inc) == "" {
+			return &ConfigError{File: configPath, Field: "includes", Reason: "include path must not be empty"}
+		}
+		incPath := inc
+		if !filepath.IsAbs(incPath) {
+			incPath = filepath.Join(filepath.Dir(configPath), filepath.FromSlash(inc))
+		}
+		if err := l.load(incPath, stack); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *configLoader) loadEnvFile(path string) (map[string]string, error) {
+	if env, ok := l.envFiles[path]; ok {
+		return env, nil
+	}
+	env, err := LoadEnvFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("load env file %q: %w", path, err)
+	}
+	l.envFiles[path] = env
+	return env, nil
+}
+
+// taskFromConfig builds a Task from its config. base is the directory (relative
+// to the root config) that the task's paths and command are relative to.
+func (l *configLoader) taskFromConfig(id TaskID, tc taskConfig, cfg buildConfig, base string, globalEnv map[string]string) (Task, error) {
+	if strings.TrimSpace(string(id)) == "" {
+		return Task{}, &ConfigError{Reason: "task id must not be empty"}
+	}
+
+	cmd := strings.TrimSpace(tc.Command)
+	if cmd == "" {
+		return Task{}, &ConfigError{TaskID: id, Field: "command", Reason: "command must not be empty"}
+	}
+
+	cacheMode := CacheReadWrite
+	if tc.Cache != nil {
+		cacheMode = tc.Cache.Mode
+	}
+	if tc.Idempotent {
+		if len(tc.Outputs) > 0 {
+			return Task{}, &ConfigError{TaskID: id, Field: "idempotent", Reason: "idempotent tasks must not declare outputs; cache them instead"}
+		}
+		if cacheMode != CacheReadWrite {
+			return Task{}, &ConfigError{TaskID: id, Field: "idempotent", Reason: "idempotent tasks cache their success; remove the cache setting"}
+		}
+	}
+
+	outputNormalize := strings.TrimSpace(tc.OutputNormalize)
+	if outputNormalize != "" && len(tc.Outputs) == 0 {
+		return Task{}, &ConfigError{TaskID: id, Field: "output_normalize", Reason: "output_normalize needs outputs to apply to"}
+	}
+
+	if tc.WriteIfChanged && len(tc.Outputs) == 0 {
+		return Task{}, &ConfigError{TaskID: id, Field: "write_if_changed", Reason: "write_if_changed needs outputs to apply to"}
+	}
+
+	var expectOutputs map[Path]string
+	if tc.ExpectOutputs != nil {
+		expectOutputs = make(map[Path]string, len(tc.ExpectOutputs))
+		for _, p := range slices.Sorted(maps.Keys(tc.ExpectOutputs)) {
+			sum := tc.ExpectOutputs[p]
+			if !sha256Pattern.MatchString(sum) {
+				return Task{}, &ConfigError{TaskID: id, Field: "expect_outputs", Reason: fmt.Sprintf("%s: %q is not a lowercase hex SHA-256", p, sum)}
+			}
+			if !specsMatch(tc.Outputs, Path(p)) {
+				return Task{}, &ConfigError{TaskID: id, Field: "expect_outputs", Reason: fmt.Sprintf("%s is not matched by the task's outputs", p)}
+			}
+			expectOutputs[Path(rebasePath(base, p))] = sum
+		}
+	}
+
+	if _, ok := l.pools[tc.Pool]; tc.Pool != "" && !ok {
+		return Task{}, &ConfigError{TaskID: id, Field: "pool", Reason: fmt.Sprintf("unknown pool %s; define it in the root config's pools", tc.Pool)}
+	}
+
+	var keyCommands []string
+	for _, c := range tc.KeyCommands {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			return Task{}, &ConfigError{TaskID: id, Field: "key_commands", Reason: "key command must not be empty"}
+		}
+		keyCommands = append(keyCommands, c)
+	}
+
+	for _, code := range tc.IgnoreExitCodes {
+		if code < 1 || code > 255 {
+			return Task{}, &ConfigError{TaskID: id, Field: "ignore_exit_codes", Reason: fmt.Sprintf("exit code %d is not between 1 and 255", code)}
+		}
+	}
+
+	sandbox := true
+	if tc.Sandbox != nil {
+		sandbox = *tc.Sandbox
+	}
+
+	failFast := cfg.FailFast
+	if tc.FailFast != nil {
+		failFast = *tc.FailFast
+	}
+
+	image := strings.TrimSpace(tc.Image)
+	if image == "" {
+		image = strings.TrimSpace(cfg.Image)
+	}
+
+	env := make(map[string]string)
+	for k, v := range globalEnv {
+		env[k] = v
+	}
+	if tc.EnvFile != "" {
+		fileEnv, err := l.loadEnvFile(rebasePath(base, tc.EnvFile))
+		if err != nil {
+			return Task{}, fmt.Errorf("task %s: %w", id, err)
+		}
+		for k, v := range fileEnv {
+			env[k] = v
+		}
+	}
+	envKeys := append([]string(nil), tc.EnvKeys...)
+	for k, v := range tc.Env {
+		env[k] = v
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+	envKeys = slices.Compact(envKeys)
+	var secretEnv map[string]string
+	for _, k := range sortedEnvKeys(tc.SecretEnv) {
+		if slices.Contains(envKeys, k) {
+			return Task{}, &ConfigError{TaskID: id, Field: "secret_env", Reason: fmt.Sprintf("%s is also in env or env_keys, which would put the secret in the task key", k)}
+		}
+		if strings.TrimSpace(tc.SecretEnv[k]) == "" {
+			return Task{}, &ConfigError{TaskID: id, Field: "secret_env", Reason: fmt.Sprintf("%s: secret file must not be empty", k)}
+		}
+		if secretEnv == nil {
+			secretEnv = make(map[string]string, len(tc.SecretEnv))
+		}
+		secretEnv[k] = rebasePath(base, tc.SecretEnv[k])
+	}
+	if len(env) == 0 {
+		env = nil
+	}
+
+	// Dependencies are declared inline in inputs by prefixing them with ':'
+	// e.g. ":compile".
+	inputs := make([]Path, 0, len(tc.Inputs))
+	deps := make([]TaskID, 0)
+	for _, in := range tc.Inputs {
+		raw := string(in)
+		if strings.HasPrefix(raw, "\\:") {
+			// Escaped leading ':'; treat as a literal file path beginning with ':'.
+			inputs = append(inputs, rebaseSpec(base, Path(strings.TrimPrefix(raw, "\\"))))
+			continue
+		}
+		if strings.HasPrefix(raw, ":") {
+			dep := strings.TrimSpace(strings.TrimPrefix(raw, ":"))
+			if dep == "" {
+				return Task{}, &ConfigError{TaskID: id, Field: "inputs", Reason: "dependency input must not be empty"}
+			}
+			deps = append(deps, TaskID(dep))
+			continue
+		}
+		inputs = append(inputs, rebaseSpec(base, in))
+	}
+
+	var outputs []Path
+	for _, out := range tc.Outputs {
+		outputs = append(outputs, rebaseSpec(base, out))
+	}
+
+	return Task{
+		ID:              id,
+		Inputs:          inputs,
+		Outputs:         outputs,
+		Dependencies:    deps,
+		Command:         cmd,
+		Cache:           cacheMode != CacheOff,
+		CacheMode:       cacheMode,
+		CacheSalt:       tc.CacheSalt,
+		Image:           image,
+		Shell:           l.shell,
+		Env:             env,
+		EnvKeys:         envKeys,
+		SecretEnv:       secretEnv,
+		FailFast:        failFast,
+		Dir:             base,
+		Sandbox:         sandbox,
+		AllowFailure:    tc.AllowFailure,
+		IgnoreExitCodes: tc.IgnoreExitCodes,
+		Idempotent:      tc.Idempotent,
+		SerialDeps:      tc.SerialDeps,
+		OutputNormalize: outputNormalize,
+		Pool:            tc.Pool,
+		KeyCommands:     keyCommands,
+		WriteIfChanged:  tc.WriteIfChanged,
+		ExpectOutputs:   expectOutputs,
+	}, nil
+}
+
+// rebasePath joins a slash-separated relative path onto base.
+func rebasePath(base string, p string) string {
+	if base == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.FromSlash(path.Join(base, filepath.ToSlash(p)))
+}
+
+// rebaseSpec rebases an input/output spec onto base, keeping a leading '!'
+// (negation) in front. An escaped "\\!" belongs to the file name, so it moves
+// with it: "\\!x" in pkg becomes "pkg/\\!x", which parseSpec unescapes.
+func rebaseSpec(base string, spec Path) Path {
+	if base == "" {
+		return spec
+	}
+	raw := string(spec)
+	prefix := ""
+	switch {
+	case strings.HasPrefix(raw, "\\!"):
+		if raw == "\\!" {
+			return spec
+		}
+		return Path(path.Join(base, filepath.ToSlash(raw)))
+	case strings.HasPrefix(raw, "!"):
+		prefix, raw = "!", raw[1:]
+	}
+	if raw == "" || filepath.IsAbs(filepath.FromSlash(raw)) {
+		return spec
+	}
+	return Path(prefix + path.Join(base, filepath.ToSlash(raw)))
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// stringsFlag collects repeated occurrences of a flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// runExportCommand writes the config reformatted with comments preserved, to
+// stdout or to the file given by -o.
+func runExportCommand(configPath string, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	outPath := fs.String("o", "", "write to this file instead of stdout (may be the config itself)")
+	if err := fs.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("read config file %q: %w", configPath, err))
+	}
+	out, err := FormatConfig(data)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("format %q: %w", configPath, err))
+	}
+
+	if *outPath == "" {
+		_, err := os.Stdout.Write(out)
+		return err
+	}
+	if err := writeFileAtomic(invocationPath(*outPath), out); err != nil {
+		return fmt.Errorf("write %q: %w", *outPath, err)
+	}
+	return nil
+}
+
+// runFmtCommand rewrites the config in canonical form (see
+// CanonicalizeConfig), or with --check only reports whether it is.
+func runFmtCommand(configPath string, args []string) error {
+	fs := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	check := fs.Bool("check", false, "don't write; fail if the config isn't formatted")
+	if err := fs.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if fs.NArg() > 0 {
+		return usagef("usage: fmt [--check]")
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("read config file %q: %w", configPath, err))
+	}
+	out, err := CanonicalizeConfig(data)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("format %q: %w", configPath, err))
+	}
+	if bytes.Equal(out, data) {
+		return nil
+	}
+	if *check {
+		return fmt.Errorf("%s is not formatted; run fmt", configPath)
+	}
+	if err := writeFileAtomic(configPath, out); err != nil {
+		return fmt.Errorf("write %q: %w", configPath, err)
+	}
+	return nil
+}
+
+// runAddTaskCommand adds a task to the config file in place, preserving
+// comments and formatting.
+func runAddTaskCommand(configPath string, args []string) error {
+	fs := flag.NewFlagSet("add-task", flag.ContinueOnError)
+	var inputs, outputs stringsFlag
+	fs.Var(&inputs, "input", "task input (repeatable; prefix with ':' for a dependency)")
+	fs.Var(&outputs, "output", "task output (repeatable)")
+	noCache := fs.Bool("no-cache", false, "mark the task as not cacheable")
+	if err := fs.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if fs.NArg() != 2 {
+		return usagef("usage: add-task [-input path]... [-output path]... [-no-cache] <task> <command>")
+	}
+
+	id := TaskID(fs.Arg(0))
+	tc := taskConfig{Command: fs.Arg(1)}
+	for _, in := range inputs {
+		tc.Inputs = append(tc.Inputs, Path(in))
+	}
+	for _, out := range outputs {
+		tc.Outputs = append(tc.Outputs, Path(out))
+	}
+	if *noCache {
+		tc.Cache = &cacheConfig{Mode: CacheOff}
+	}
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("read config file %q: %w", configPath, err))
+	}
+	out, err := AddTaskToConfig(data, id, tc)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if err := writeFileAtomic(configPath, out); err != nil {
+		return fmt.Errorf("write %q: %w", configPath, err)
+	}
+	fmt.Printf("Added task %s to %s\n", id, configPath)
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/tailscale/hujson"
+)
+
+// FormatConfig reformats JSONC config data while preserving comments.
+func FormatConfig(data []byte) ([]byte, error) {
+	v, err := hujson.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse JSONC: %w", err)
+	}
+	v.Format()
+	return v.Pack(), nil
+}
+
+// CanonicalizeConfig is FormatConfig that also sorts tasks by ID, and the
+// fields of the config and of each task into the order buildConfig and
+// taskConfig declare them (unknown fields last, by name). Only those object
+// members move, together with the comments before them: arrays such as
+// inputs, whose order matters for negations, and maps such as env are left
+// as they are.
+func CanonicalizeConfig(data []byte) ([]byte, error) {
+	v, err := hujson.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse JSONC: %w", err)
+	}
+	root, ok := v.Value.(*hujson.Object)
+	if !ok {
+		return nil, fmt.Errorf("config must be a JSON object")
+	}
+	sortMembers(root, jsonFieldRanks(reflect.TypeFor[buildConfig]()))
+	if tasks := v.Find("/tasks"); tasks != nil {
+		if obj, ok := tasks.Value.(*hujson.Object); ok {
+			sortMembers(obj, nil)
+			taskRanks := jsonFieldRanks(reflect.TypeFor[taskConfig]())
+			for _, m := range obj.Members {
+				if task, ok := m.Value.Value.(*hujson.Object); ok {
+					sortMembers(task, taskRanks)
+				}
+			}
+		}
+	}
+	v.Format()
+	return v.Pack(), nil
+}
+
+// jsonFieldRanks maps the JSON names of t's fields to their declaration
+// order.
+func jsonFieldRanks(t reflect.Type) map[string]int {
+	ranks := make(map[string]int)
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			ranks[name] = i
+		}
+	}
+	return ranks
+}
+
+// sortMembers orders obj's members by ranks, then by name. Members not in
+// ranks (all of them if ranks is nil) sort after the ranked ones.
+//
+// hujson keeps a comment at the end of a member's line ("x": 1, // why) at
+// the start of what follows it: the next member's BeforeExtra, or the
+// object's AfterExtra after the last one. Such comments are detached before
+// sorting and put back after their own member.
+func sortMembers(obj *hujson.Object, ranks map[string]int) {
+	n := len(obj.Members)
+	if n == 0 {
+		return
+	}
+	type member struct {
+		hujson.ObjectMember
+		lineComment hujson.Extra
+	}
+	// The first member's line comment is the opening brace's; it stays.
+	open, rest := splitLineComment(obj.Members[0].Name.BeforeExtra)
+	obj.Members[0].Name.BeforeExtra = rest
+	members := make([]member, n)
+	for i := range obj.Members {
+		next := &obj.AfterExtra
+		if i+1 < n {
+			next = &obj.Members[i+1].Name.BeforeExtra
+		}
+		members[i].lineComment, *next = splitLineComment(*next)
+		members[i].ObjectMember = obj.Members[i]
+	}
+
+	rank := func(m member) (int, string) {
+		name := m.Name.Value.(hujson.Literal).String()
+		if r, ok := ranks[name]; ok {
+			return r, name
+		}
+		return len(ranks), name
+	}
+	slices.SortStableFunc(members, func(a, b member) int {
+		ra, na := rank(a)
+		rb, nb := rank(b)
+		if ra != rb {
+			return ra - rb
+		}
+		return strings.Compare(na, nb)
+	})
+
+	for i, m := range members {
+		obj.Members[i] = m.ObjectMember
+	}
+	for i, m := range members {
+		next := &obj.AfterExtra
+		if i+1 < n {
+			next = &obj.Members[i+1].Name.BeforeExtra
+		}
+		*next = slices.Concat(m.lineComment, *next)
+	}
+	obj.Members[0].Name.BeforeExtra = slices.Concat(open, obj.Members[0].Name.BeforeExtra)
+}
+
+// splitLineComment splits a comment that ends the line extra starts on
+// (with the spaces before it) from the rest of extra.
+func splitLineComment(extra hujson.Extra) (comment, rest hujson.Extra) {
+	i := bytes.IndexByte(extra, '\n')
+	if i < 0 {
+		return nil, extra
+	}
+	c := bytes.TrimSpace(extra[:i])
+	if !bytes.HasPrefix(c, []byte("//")) && !(bytes.HasPrefix(c, []byte("/*")) && bytes.HasSuffix(c, []byte("*/"))) {
+		return nil, extra
+	}
+	return extra[:i:i], extra[i:]
+}
+
+// AddTaskToConfig adds a task to JSONC config data. The edit is applied to the
+// hujson AST so comments and formatting elsewhere in the file survive.
+func AddTaskToConfig(data []byte, id TaskID, tc taskConfig) ([]byte, error) {
+	if strings.TrimSpace(string(id)) == "" {
+		return nil, &ConfigError{Reason: "task id must not be empty"}
+	}
+	if strings.TrimSpace(tc.Command) == "" {
+		return nil, &ConfigError{TaskID: id, Field: "command", Reason: "command must not be empty"}
+	}
+
+	v, err := hujson.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse JSONC: %w", err)
+	}
+
+	taskPtr := "/tasks/" + escapeJSONPointer(string(id))
+	if v.Find(taskPtr) != nil {
+		return nil, &ConfigError{TaskID: id, Reason: "already exists"}
+	}
+
+	taskJSON, err := json.Marshal(tc)
+	if err != nil {
+		return nil, fmt.Errorf("marshal task %s: %w", id, err)
+	}
+
+	var ops []map[string]any
+	if v.Find("/tasks") == nil {
+		ops = append(ops, map[string]any{"op": "add", "path": "/tasks", "value": json.RawMessage("{}")})
+	}
+	ops = append(ops, map[string]any{"op": "add", "path": taskPtr, "value": json.RawMessage(taskJSON)})
+
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.Patch(patch); err != nil {
+		return nil, fmt.Errorf("add task %s: %w", id, err)
+	}
+	v.Format()
+	out := v.Pack()
+
+	// Guard against producing a config the loader would reject.
+	if _, err := decodeBuildConfig(out); err != nil {
+		return nil, fmt.Errorf("edited config is invalid: %w", err)
+	}
+	return out, nil
+}
+
+// escapeJSONPointer escapes a single RFC 6901 reference token.
+func escapeJSONPointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it into
+// place, keeping the existing file's permissions.
+func writeFileAtomic(path string, data []byte) error {
+	perm := os.FileMode(0o644)
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAddTaskToConfigPreservesComments(t *testing.T) {
+	src := `{
+    // top-level comment
+    "tasks": {
+        "a": {
+            "command": "echo a", // trailing comment
+        },
+    },
+}
+`
+	out, err := AddTaskToConfig([]byte(src), "b", taskConfig{Inputs: []Path{":a"}, Command: "echo b"})
+	if err != nil {
+		t.Fatalf("AddTaskToConfig: %v", err)
+	}
+	for _, want := range []string{"// top-level comment", "// trailing comment", `"b": {`} {
+		if !strings.Contains(string(out), want) {
+			t.Fatalf("output missing %q:\n%s", want, out)
+		}
+	}
+
+	cfg, err := decodeBuildConfig(out)
+	if err != nil {
+		t.Fatalf("decode edited config: %v", err)
+	}
+	if got := cfg.Tasks["b"].Command; got != "echo b" {
+		t.Fatalf("task b command = %q, want %q", got, "echo b")
+	}
+
+	if _, err := AddTaskToConfig(out, "b", taskConfig{Command: "echo b"}); err == nil {
+		t.Fatalf("expected error adding duplicate task")
+	}
+}
+
+func TestCanonicalizeConfig(t *testing.T) {
+	src := `{
+    "tasks": {
+        // zed comes last
+        "zed": {"outputs": ["z"], "command": "echo z > z", "inputs": ["b.txt", "!a.txt", "a.txt"]},
+        "app": {
+            "env": {"Z": "1", "A": "2"},
+            // the build
+            "command": "go build",
+        },
+    },
+    "fail_fast": true,
+}
+`
+	out, err := CanonicalizeConfig([]byte(src))
+	if err != nil {
+		t.Fatalf("CanonicalizeConfig: %v", err)
+	}
+	s := string(out)
+	order := []string{`"fail_fast"`, `"tasks"`, `"app"`, "// the build", `"command": "go build"`, `"env"`, "// zed comes last", `"zed"`, `"inputs"`, `"outputs"`, `"command": "echo z > z"`}
+	for i := 1; i < len(order); i++ {
+		if a, b := strings.Index(s, order[i-1]), strings.Index(s, order[i]); a < 0 || b < 0 || a > b {
+			t.Errorf("%s doesn't come before %s:\n%s", order[i-1], order[i], s)
+		}
+	}
+	// Arrays and maps keep their order.
+	for _, want := range []string{`["b.txt", "!a.txt", "a.txt"]`, `{"Z": "1", "A": "2"}`} {
+		if !strings.Contains(s, want) {
+			t.Errorf("output missing %s:\n%s", want, s)
+		}
+	}
+
+	again, err := CanonicalizeConfig(out)
+	if err != nil {
+		t.Fatalf("CanonicalizeConfig again: %v", err)
+	}
+	if string(again) != s {
+		t.Errorf("second run changed the config:\n%s\nthen:\n%s", s, again)
+	}
+}
+
+func TestCanonicalizeConfigKeepsLineComments(t *testing.T) {
+	src := `{
+    "tasks": { // by ID
+        "b": {
+            "command": "gen > b.txt", // the command
+            "outputs": ["b.txt"] // produced by gen
+        }, // task b
+        "a": {"command": "true"}, // task a
+    },
+}
+`
+	out, err := CanonicalizeConfig([]byte(src))
+	if err != nil {
+		t.Fatalf("CanonicalizeConfig: %v", err)
+	}
+	s := string(out)
+	for _, want := range []string{
+		`"tasks": { // by ID`,
+		`"a": {"command": "true"}, // task a`,
+		`"command": "gen > b.txt", // the command`,
+		`"outputs": ["b.txt"], // produced by gen`,
+		`}, // task b`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("output missing %s:\n%s", want, s)
+		}
+	}
+	if strings.Index(s, `"a"`) > strings.Index(s, `"b"`) || strings.Index(s, `"outputs"`) > strings.Index(s, `"command": "gen`) {
+		t.Errorf("members not sorted:\n%s", s)
+	}
+
+	again, err := CanonicalizeConfig(out)
+	if err != nil {
+		t.Fatalf("CanonicalizeConfig again: %v", err)
+	}
+	if string(again) != s {
+		t.Errorf("second run changed the config:\n%s\nthen:\n%s", s, again)
+	}
+}
+
+func TestFmtCommandCheck(t *testing.T) {
+	withTempWD(t, func() {
+		configPath := writeConfig(t, `{"tasks": {"b": {"command": "true"}, "a": {"command": "true"}}}`)
+		if err := runFmtCommand(configPath, []string{"--check"}); exitCode(err) != exitTaskFailure {
+			t.Errorf("fmt --check on an unformatted config: err = %v, want exit %d", err, exitTaskFailure)
+		}
+		before, err := os.ReadFile(configPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := runFmtCommand(configPath, nil); err != nil {
+			t.Fatalf("fmt: %v", err)
+		}
+		after, err := os.ReadFile(configPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(after) == string(before) {
+			t.Error("fmt didn't rewrite the config")
+		}
+		if err := runFmtCommand(configPath, []string{"--check"}); err != nil {
+			t.Errorf("fmt --check after fmt: %v", err)
+		}
+		if err := runFmtCommand(configPath, nil); err != nil {
+			t.Fatalf("second fmt: %v", err)
+		}
+		if again, _ := os.ReadFile(configPath); string(again) != string(after) {
+			t.Errorf("second fmt changed the config:\n%s\nthen:\n%s", after, again)
+		}
+	})
+}
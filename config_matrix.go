@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+const matrixPlaceholder = "${matrix."
+
+// matrixInstance is one concrete task expanded from a task with a matrix.
+type matrixInstance struct {
+	id TaskID
+	tc taskConfig
+}
+
+// expandMatrix expands a task with a matrix into one task per combination of
+// matrix values, substituting ${matrix.<key>} into its ID, command, inputs,
+// outputs and env values. Keys vary in sorted order (the last fastest), values
+// in the order given. A task without a matrix expands to itself.
+//
+// Every key with more than one value must appear in the ID so instances get
+// distinct IDs. A dependency input may keep a placeholder this matrix doesn't
+// define: it then names another matrix task's whole set of instances (see
+// configLoader.expandMatrixDeps).
+func expandMatrix(id TaskID, tc taskConfig) ([]matrixInstance, error) {
+	if len(tc.Matrix) == 0 {
+		return []matrixInstance{{id: id, tc: tc}}, nil
+	}
+
+	keys := slices.Sorted(maps.Keys(tc.Matrix))
+	for _, k := range keys {
+		n := len(tc.Matrix[k])
+		if n == 0 {
+			return nil, &ConfigError{TaskID: id, Field: "matrix", Reason: fmt.Sprintf("matrix key %q has no values", k)}
+		}
+		if n > 1 && !strings.Contains(string(id), matrixPlaceholder+k+"}") {
+			return nil, &ConfigError{TaskID: id, Field: "matrix", Reason: fmt.Sprintf("task id must contain %s%s} so each instance gets a unique id", matrixPlaceholder, k)}
+		}
+	}
+
+	combos := [][]string{nil}
+	for _, k := range keys {
+		var next [][]string
+		for _, combo := range combos {
+			for _, v := range tc.Matrix[k] {
+				next = append(next, append(slices.Clone(combo), matrixPlaceholder+k+"}", v))
+			}
+		}
+		combos = next
+	}
+
+	instances := make([]matrixInstance, 0, len(combos))
+	seen := make(map[TaskID]bool, len(combos))
+	for _, combo := range combos {
+		r := strings.NewReplacer(combo...)
+		instID := TaskID(r.Replace(string(id)))
+		if seen[instID] {
+			return nil, &ConfigError{TaskID: id, Field: "matrix", Reason: fmt.Sprintf("matrix expands to task %s more than once", instID)}
+		}
+		seen[instID] = true
+
+		var err error
+		subst := func(field, s string) string {
+			out := r.Replace(s)
+			if err == nil && strings.Contains(out, matrixPlaceholder) {
+				err = &ConfigError{TaskID: instID, Field: field, Reason: fmt.Sprintf("%q refers to a key not in the task's matrix", s)}
+			}
+			return out
+		}
+
+		inst := tc
+		inst.Matrix = nil
+		inst.Command = subst("command", tc.Command)
+		inst.Inputs = make([]Path, len(tc.Inputs))
+		for i, in := range tc.Inputs {
+			if strings.HasPrefix(string(in), ":") {
+				// May still name a whole matrix set.
+				inst.Inputs[i] = Path(r.Replace(string(in)))
+				continue
+			}
+			inst.Inputs[i] = Path(subst("inputs", string(in)))
+		}
+		inst.Outputs = make([]Path, len(tc.Outputs))
+		for i, out := range tc.Outputs {
+			inst.Outputs[i] = Path(subst("outputs", string(out)))
+		}
+		if tc.Env != nil {
+			inst.Env = make(map[string]string, len(tc.Env))
+			for k, v := range tc.Env {
+				inst.Env[k] = subst("env", v)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, matrixInstance{id: instID, tc: inst})
+	}
+	return instances, nil
+}
+
+// expandMatrixDeps replaces dependencies on a matrix task's unexpanded ID
+// (e.g. ":build-${matrix.target}") with all of its instances.
+func (l *configLoader) expandMatrixDeps(deps []TaskID) []TaskID {
+	var out []TaskID
+	for _, dep := range deps {
+		set, ok := l.matrixSets[dep]
+		if !ok {
+			set = []TaskID{dep}
+		}
+		for _, id := range set {
+			if !slices.Contains(out, id) {
+				out = append(out, id)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	const path = "build-tool.jsonc"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestLoadTaskMapFromConfigErrors(t *testing.T) {
+	withTempWD(t, func() {
+		tests := []struct {
+			name    string
+			config  string
+			want    ConfigError
+			wantMsg string
+		}{
+			{
+				name:    "task-level-unknown-field",
+				config:  `{"tasks": {"ok": {"command": "true"}, "build": {"comand": "make"}}}`,
+				want:    ConfigError{TaskID: "build", Field: "comand"},
+				wantMsg: `task build: unknown field "comand"`,
+			},
+			{
+				name:    "top-level-unknown-field",
+				config:  `{"taks": {}, "tasks": {}}`,
+				want:    ConfigError{Field: "taks"},
+				wantMsg: `unknown top-level field "taks"`,
+			},
+			{
+				name:    "empty-command",
+				config:  `{"tasks": {"build": {"command": " "}}}`,
+				want:    ConfigError{TaskID: "build", Field: "command"},
+				wantMsg: "task build: command must not be empty",
+			},
+			{
+				name:    "unknown-dependency",
+				config:  `{"tasks": {"build": {"command": "true", "inputs": [":gen"]}}}`,
+				want:    ConfigError{TaskID: "build", Field: "inputs"},
+				wantMsg: "task build: depends on unknown task gen",
+			},
+			{
+				name:    "unknown-cache-mode",
+				config:  `{"tasks": {"build": {"command": "true", "cache": "readonly"}}}`,
+				want:    ConfigError{TaskID: "build", Field: "cache"},
+				wantMsg: `task build: unknown cache mode "readonly"`,
+			},
+			{
+				name:    "idempotent-with-outputs",
+				config:  `{"tasks": {"deploy": {"command": "true", "outputs": ["x"], "idempotent": true}}}`,
+				want:    ConfigError{TaskID: "deploy", Field: "idempotent"},
+				wantMsg: "task deploy: idempotent tasks must not declare outputs",
+			},
+			{
+				name:    "secret-in-env-keys",
+				config:  `{"tasks": {"publish": {"command": "true", "env_keys": ["TOKEN"], "secret_env": {"TOKEN": "token.txt"}}}}`,
+				want:    ConfigError{TaskID: "publish", Field: "secret_env"},
+				wantMsg: "task publish: TOKEN is also in env or env_keys",
+			},
+			{
+				name:    "output-normalize-without-outputs",
+				config:  `{"tasks": {"gen": {"command": "date > /dev/null", "output_normalize": "cat"}}}`,
+				want:    ConfigError{TaskID: "gen", Field: "output_normalize"},
+				wantMsg: "task gen: output_normalize needs outputs to apply to",
+			},
+			{
+				// Entries are checked in path order, so the error is the same
+				// on every load.
+				name:    "expect-outputs-bad-digest",
+				config:  `{"tasks": {"release": {"command": "true", "outputs": ["dist"], "expect_outputs": {"dist/c": "ccc", "dist/app": "abc", "dist/b": "bbb"}}}}`,
+				want:    ConfigError{TaskID: "release", Field: "expect_outputs"},
+				wantMsg: `task release: dist/app: "abc" is not a lowercase hex SHA-256`,
+			},
+			{
+				name:    "expect-outputs-not-an-output",
+				config:  `{"tasks": {"release": {"command": "true", "outputs": ["dist"], "expect_outputs": {"app": "` + strings.Repeat("0", 64) + `"}}}}`,
+				want:    ConfigError{TaskID: "release", Field: "expect_outputs"},
+				wantMsg: "task release: app is not matched by the task's outputs",
+			},
+			{
+				name:    "write-if-changed-without-outputs",
+				config:  `{"tasks": {"gen": {"command": "true", "write_if_changed": true}}}`,
+				want:    ConfigError{TaskID: "gen", Field: "write_if_changed"},
+				wantMsg: "task gen: write_if_changed needs outputs to apply to",
+			},
+			{
+				name:    "empty-key-command",
+				config:  `{"tasks": {"build": {"command": "true", "key_commands": [" "]}}}`,
+				want:    ConfigError{TaskID: "build", Field: "key_commands"},
+				wantMsg: "task build: key command must not be empty",
+			},
+			{
+				name:    "unknown-pool",
+				config:  `{"pools": {"link": 2}, "tasks": {"app": {"command": "true", "pool": "lnk"}}}`,
+				want:    ConfigError{TaskID: "app", Field: "pool"},
+				wantMsg: "task app: unknown pool lnk; define it in the root config's pools",
+			},
+			{
+				name:    "empty-pool",
+				config:  `{"pools": {"link": 0}, "tasks": {}}`,
+				want:    ConfigError{File: "build-tool.jsonc", Field: "pools"},
+				wantMsg: "build-tool.jsonc: pool link must allow at least 1 task, not 0",
+			},
+			{
+				name:    "ignore-exit-code-zero",
+				config:  `{"tasks": {"diff": {"command": "diff a b", "ignore_exit_codes": [0]}}}`,
+				want:    ConfigError{TaskID: "diff", Field: "ignore_exit_codes"},
+				wantMsg: "task diff: exit code 0 is not between 1 and 255",
+			},
+			{
+				name:    "missing-tasks",
+				config:  `{}`,
+				want:    ConfigError{File: "build-tool.jsonc", Field: "tasks"},
+				wantMsg: `missing required "tasks" object`,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := LoadTaskMapFromConfig(writeConfig(t, tt.config))
+				var cerr *ConfigError
+				if !errors.As(err, &cerr) {
+					t.Fatalf("error = %v, want a *ConfigError", err)
+				}
+				if cerr.File != tt.want.File || cerr.TaskID != tt.want.TaskID || cerr.Field != tt.want.Field {
+					t.Errorf("ConfigError = %+v, want file %q task %q field %q", *cerr, tt.want.File, tt.want.TaskID, tt.want.Field)
+				}
+				if !strings.Contains(err.Error(), tt.wantMsg) {
+					t.Errorf("error %q does not contain %q", err, tt.wantMsg)
+				}
+			})
+		}
+	})
+}
+
+func TestLoadTaskMapFromConfigEnvPrecedence(t *testing.T) {
+	withTempWD(t, func() {
+		if err := os.WriteFile(".env", []byte("# shared\nA=global\nB=global\nexport C=\"global\"\n"), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		if err := os.WriteFile("task.env", []byte("B=task-file\nC=task-file\n"), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+
+		taskMap, err := LoadTaskMapFromConfig(writeConfig(t, `{
+			"env_file": ".env",
+			"tasks": {
+				"build": {
+					"command": "true",
+					"env_file": "task.env",
+					"env": {"C": "task"},
+					"env_keys": ["A"],
+				},
+			},
+		}`))
+		if err != nil {
+			t.Fatalf("LoadTaskMapFromConfig: %v", err)
+		}
+
+		task := taskMap["build"]
+		want := map[string]string{"A": "global", "B": "task-file", "C": "task"}
+		for k, v := range want {
+			if got := task.Env[k]; got != v {
+				t.Errorf("Env[%s] = %q, want %q", k, got, v)
+			}
+		}
+		if got, want := strings.Join(task.EnvKeys, ","), "A,C"; got != want {
+			t.Errorf("EnvKeys = %q, want %q", got, want)
+		}
+
+		key := func(env map[string]string) string {
+			t.Helper()
+			task := task
+			task.Env = env
+			k, _, err := ComputeTaskKey(task, nil, nil)
+			if err != nil {
+				t.Fatalf("ComputeTaskKey: %v", err)
+			}
+			return k
+		}
+		base := key(map[string]string{"A": "global", "B": "task-file", "C": "task"})
+		if key(map[string]string{"A": "global", "B": "changed", "C": "task"}) != base {
+			t.Errorf("key changed for a variable not in env_keys")
+		}
+		if key(map[string]string{"A": "changed", "B": "task-file", "C": "task"}) == base {
+			t.Errorf("key unchanged for a variable in env_keys")
+		}
+	})
+}
+
+func TestLoadTaskMapFromConfigIncludes(t *testing.T) {
+	withTempWD(t, func() {
+		write := func(path, content string) {
+			t.Helper()
+			writeFile(t, path)
+			if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+		}
+
+		t.Run("merge-and-rebase", func(t *testing.T) {
+			write("pkg/a/build.jsonc", `{
+				"tasks": {
+					"a": {"inputs": ["src/*.c", "!src/skip.c", "\\!bang"], "outputs": ["a.o"], "command": "cc -c src/*.c"},
+				},
+			}`)
+			path := writeConfig(t, `{
+				"includes": ["pkg/a/build.jsonc"],
+				"tasks": {"app": {"inputs": [":a", "main.c"], "command": "cc main.c pkg/a/a.o"}},
+			}`)
+
+			taskMap, err := LoadTaskMapFromConfig(path)
+			if err != nil {
+				t.Fatalf("LoadTaskMapFromConfig: %v", err)
+			}
+			a := taskMap["a"]
+			wantInputs := []Path{"pkg/a/src/*.c", "!pkg/a/src/skip.c", "pkg/a/\\!bang"}
+			if strings.Join(pathStrings(a.Inputs), " ") != strings.Join(pathStrings(wantInputs), " ") {
+				t.Errorf("inputs = %q, want %q", a.Inputs, wantInputs)
+			}
+			// The escape still names the file with a leading '!'.
+			writeFile(t, "pkg/a/!bang")
+			if got, err := ExpandFileSpecs(a.Inputs[2:]); err != nil || len(got) != 1 || got[0] != "pkg/a/!bang" {
+				t.Errorf("ExpandFileSpecs(%q) = %q, %v; want [pkg/a/!bang]", a.Inputs[2:], got, err)
+			}
+			if len(a.Outputs) != 1 || a.Outputs[0] != "pkg/a/a.o" {
+				t.Errorf("outputs = %q, want [pkg/a/a.o]", a.Outputs)
+			}
+			if a.Dir != "pkg/a" {
+				t.Errorf("dir = %q, want %q", a.Dir, "pkg/a")
+			}
+			if app := taskMap["app"]; app.Dir != "" || app.Inputs[0] != "main.c" {
+				t.Errorf("root task rebased: dir=%q inputs=%q", app.Dir, app.Inputs)
+			}
+		})
+
+		t.Run("duplicate-task", func(t *testing.T) {
+			write("dup/build.jsonc", `{"tasks": {"app": {"command": "true"}}}`)
+			path := writeConfig(t, `{"includes": ["dup/build.jsonc"], "tasks": {"app": {"command": "true"}}}`)
+			_, err := LoadTaskMapFromConfig(path)
+			var cerr *ConfigError
+			if !errors.As(err, &cerr) || cerr.TaskID != "app" || !strings.Contains(cerr.Reason, "defined in both") {
+				t.Fatalf("err = %v, want duplicate task error", err)
+			}
+		})
+
+		t.Run("cycle", func(t *testing.T) {
+			write("cyc/a.jsonc", `{"includes": ["b.jsonc"], "tasks": {"ca": {"command": "true"}}}`)
+			write("cyc/b.jsonc", `{"includes": ["a.jsonc"], "tasks": {"cb": {"command": "true"}}}`)
+			path := writeConfig(t, `{"includes": ["cyc/a.jsonc"], "tasks": {}}`)
+			_, err := LoadTaskMapFromConfig(path)
+			var cerr *ConfigError
+			if !errors.As(err, &cerr) || cerr.Field != "includes" || !strings.Contains(cerr.Reason, "include cycle") {
+				t.Fatalf("err = %v, want include cycle error", err)
+			}
+		})
+	})
+}
+
+func pathStrings(ps []Path) []string {
+	out := make([]string, len(ps))
+	for i, p := range ps {
+		out[i] = string(p)
+	}
+	return out
+}
+
+func TestLoadTaskMapFromConfigDependencyInputs(t *testing.T) {
+	withTempWD(t, func() {
+		tests := []struct {
+			name       string
+			config     string
+			wantInputs []string // inputs of task b
+			wantRouted []TaskID // RoutedDeps of task b
+			wantErr    string
+		}{
+			{
+				name:       "literal-routed-through-dependency",
+				config:     `{"tasks": {"a": {"outputs": ["foo.o"], "command": "cc"}, "b": {"inputs": [":a", "./foo.o", "b.c"], "command": "ld"}}}`,
+				wantInputs: []string{"b.c"},
+			},
+			{
+				name:       "glob-excludes-dependency-output",
+				config:     `{"tasks": {"a": {"outputs": ["foo.o"], "command": "cc"}, "b": {"inputs": [":a", "*.o"], "command": "ld"}}}`,
+				wantInputs: []string{"*.o", "!foo.o"},
+			},
+			{
+				name:       "routed-through-indirect-dependency",
+				config:     `{"tasks": {"a": {"outputs": ["foo.o"], "command": "cc"}, "c": {"inputs": [":a"], "outputs": ["lib.a"], "command": "ar"}, "b": {"inputs": [":c", "foo.o", "*.o", "b.c"], "command": "ld"}}}`,
+				wantInputs: []string{"*.o", "b.c", "!foo.o"},
+				wantRouted: []TaskID{"a"},
+			},
+			{
+				name:       "directory-output-covers-files-under-it",
+				config:     `{"tasks": {"a": {"outputs": ["gen"], "command": "gen"}, "b": {"inputs": [":a", "gen/x.h", "**/*.h"], "command": "cc"}}}`,
+				wantInputs: []string{"**/*.h", "!gen/**"},
+			},
+			{
+				name:       "glob-output",
+				config:     `{"tasks": {"a": {"outputs": ["out/*.o"], "command": "cc"}, "b": {"inputs": [":a", "out/x.o", "**/*.o", "src/*.c"], "command": "ld"}}}`,
+				wantInputs: []string{"**/*.o", "src/*.c", "!out/*.o", "!out/*.o/**"},
+			},
+			{
+				name:    "output-of-non-dependency",
+				config:  `{"tasks": {"a": {"outputs": ["foo.o"], "command": "cc"}, "b": {"inputs": ["foo.o"], "command": "ld"}}}`,
+				wantErr: `task b: input "foo.o" is an output of task a, which it doesn't depend on`,
+			},
+			{
+				name:    "under-directory-output-of-non-dependency",
+				config:  `{"tasks": {"a": {"outputs": ["gen"], "command": "gen"}, "b": {"inputs": ["gen/x.h"], "command": "cc"}}}`,
+				wantErr: `task b: input "gen/x.h" is an output of task a, which it doesn't depend on`,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				taskMap, err := LoadTaskMapFromConfig(writeConfig(t, tt.config))
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Fatalf("error = %v, want %q", err, tt.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("LoadTaskMapFromConfig: %v", err)
+				}
+				if got := pathStrings(taskMap["b"].Inputs); !slices.Equal(got, tt.wantInputs) {
+					t.Errorf("b inputs = %v, want %v", got, tt.wantInputs)
+				}
+				if got := taskMap["b"].RoutedDeps; !slices.Equal(got, tt.wantRouted) {
+					t.Errorf("b RoutedDeps = %v, want %v", got, tt.wantRouted)
+				}
+			})
+		}
+	})
+}
+
+// The task map comes from the config alone; the bundled C example's tasks
+// (util.o, main.o, main, run, clean) must not leak into other projects.
+func TestLoadTaskMapFromConfigOnlyConfiguredTasks(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap, err := LoadTaskMapFromConfig(writeConfig(t, `{"tasks": {"lint": {"command": "true", "cache": false}}}`))
+		if err != nil {
+			t.Fatalf("LoadTaskMapFromConfig: %v", err)
+		}
+		if got := sortedTaskIDs(taskMap); !slices.Equal(got, []TaskID{"lint"}) {
+			t.Errorf("tasks = %v, want [lint]", got)
+		}
+	})
+}
+
+func TestLoadTaskMapFromConfigCacheModes(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap, err := LoadTaskMapFromConfig(writeConfig(t, `{"tasks": {
+			"default": {"command": "true"},
+			"on": {"command": "true", "cache": true},
+			"off": {"command": "true", "cache": false},
+			"read": {"command": "true", "cache": "read"},
+			"write": {"command": "true", "cache": "write"},
+		}}`))
+		if err != nil {
+			t.Fatalf("LoadTaskMapFromConfig: %v", err)
+		}
+		want := map[TaskID]CacheMode{"default": CacheReadWrite, "on": CacheReadWrite, "off": CacheOff, "read": CacheRead, "write": CacheWrite}
+		for id, mode := range want {
+			task := taskMap[id]
+			if task.CacheMode != mode || task.Cache != (mode != CacheOff) {
+				t.Errorf("task %s: Cache = %v, CacheMode = %q; want mode %q", id, task.Cache, task.CacheMode, mode)
+			}
+		}
+	})
+}
+
+func TestLoadTaskMapFromConfigMatrix(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "main.c")
+		taskMap, err := LoadTaskMapFromConfig(writeConfig(t, `{"tasks": {
+			"build-${matrix.target}": {
+				"matrix": {"target": ["linux", "darwin"]},
+				"inputs": ["main.c"],
+				"outputs": ["out/${matrix.target}/app"],
+				"command": "cc -o out/${matrix.target}/app --target=${matrix.target} main.c",
+			},
+			"test-${matrix.target}": {
+				"matrix": {"target": ["linux", "darwin"]},
+				"inputs": [":build-${matrix.target}"],
+				"command": "out/${matrix.target}/app --self-test",
+			},
+			"package": {
+				"inputs": [":build-${matrix.target}"],
+				"command": "tar cf app.tar out",
+			},
+		}}`))
+		if err != nil {
+			t.Fatalf("LoadTaskMapFromConfig: %v", err)
+		}
+
+		want := []TaskID{"build-darwin", "build-linux", "package", "test-darwin", "test-linux"}
+		if got := sortedTaskIDs(taskMap); !slices.Equal(got, want) {
+			t.Fatalf("tasks = %v, want %v", got, want)
+		}
+
+		linux := taskMap["build-linux"]
+		if linux.Command != "cc -o out/linux/app --target=linux main.c" || !slices.Equal(linux.Outputs, []Path{"out/linux/app"}) {
+			t.Errorf("build-linux = %q, outputs %v", linux.Command, linux.Outputs)
+		}
+		if deps := taskMap["test-darwin"].Dependencies; !slices.Equal(deps, []TaskID{"build-darwin"}) {
+			t.Errorf("test-darwin deps = %v, want the matching instance", deps)
+		}
+		deps := slices.Sorted(slices.Values(taskMap["package"].Dependencies))
+		if !slices.Equal(deps, []TaskID{"build-darwin", "build-linux"}) {
+			t.Errorf("package deps = %v, want the whole set", deps)
+		}
+
+		k1, _, err := ComputeTaskKey(taskMap["build-linux"], nil, nil)
+		if err != nil {
+			t.Fatalf("ComputeTaskKey: %v", err)
+		}
+		k2, _, err := ComputeTaskKey(taskMap["build-darwin"], nil, nil)
+		if err != nil {
+			t.Fatalf("ComputeTaskKey: %v", err)
+		}
+		if k1 == k2 {
+			t.Error("matrix instances share a task key")
+		}
+	})
+}
+
+func TestLoadTaskMapFromConfigMatrixErrors(t *testing.T) {
+	withTempWD(t, func() {
+		tests := []struct {
+			name    string
+			config  string
+			wantMsg string
+		}{
+			{
+				name:    "id-without-key",
+				config:  `{"tasks": {"build": {"matrix": {"target": ["a", "b"]}, "command": "make ${matrix.target}"}}}`,
+				wantMsg: "task id must contain ${matrix.target}",
+			},
+			{
+				name:    "unknown-key",
+				config:  `{"tasks": {"build-${matrix.target}": {"matrix": {"target": ["a"]}, "command": "make ${matrix.arch}"}}}`,
+				wantMsg: "refers to a key not in the task's matrix",
+			},
+			{
+				name:    "no-values",
+				config:  `{"tasks": {"build": {"matrix": {"target": []}, "command": "make"}}}`,
+				wantMsg: `matrix key "target" has no values`,
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := LoadTaskMapFromConfig(writeConfig(t, tt.config))
+				var cerr *ConfigError
+				if !errors.As(err, &cerr) || !strings.Contains(cerr.Reason, tt.wantMsg) {
+					t.Fatalf("err = %v, want ConfigError containing %q", err, tt.wantMsg)
+				}
+			})
+		}
+	})
+}
+
+func TestProfileConfigPath(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "build-tool.ci.jsonc")
+		writeFile(t, "conf/build.dev.jsonc")
+
+		tests := []struct {
+			config  string
+			profile string
+			want    string
+			wantErr string
+		}{
+			{config: "build-tool.jsonc", profile: "ci", want: "build-tool.ci.jsonc"},
+			{config: filepath.Join("conf", "build.jsonc"), profile: "dev", want: filepath.Join("conf", "build.dev.jsonc")},
+			{config: "build-tool.jsonc", profile: "prod", wantErr: `build-tool.prod.jsonc: profile "prod" not found`},
+			{config: "build-tool.jsonc", profile: "../ci", wantErr: "invalid profile name"},
+		}
+		for _, tt := range tests {
+			got, err := ProfileConfigPath(tt.config, tt.profile)
+			if tt.wantErr != "" {
+				var cerr *ConfigError
+				if !errors.As(err, &cerr) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ProfileConfigPath(%q, %q) error = %v, want ConfigError %q", tt.config, tt.profile, err, tt.wantErr)
+				}
+				continue
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("ProfileConfigPath(%q, %q) = %q, %v; want %q", tt.config, tt.profile, got, err, tt.want)
+			}
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+)
+
+// TaskDep is one entry of a deps listing. Files is only set when input files
+// were requested.
+type TaskDep struct {
+	ID    TaskID `json:"id"`
+	Files []Path `json:"files,omitempty"`
+}
+
+// TaskDeps returns the tasks id depends on, dependencies before their
+// dependents and otherwise in declared order. Without transitive it returns
+// only the direct dependencies.
+func TaskDeps(taskMap TaskMap, id TaskID, transitive bool) ([]TaskID, error) {
+	task, ok := taskMap[id]
+	if !ok {
+		return nil, usagef("task %s not found", id)
+	}
+	if !transitive {
+		for _, dep := range task.Dependencies {
+			if _, ok := taskMap[dep]; !ok {
+				return nil, usagef("task %s: dependency %s not found", id, dep)
+			}
+		}
+		return append([]TaskID(nil), task.Dependencies...), nil
+	}
+
+	var order []TaskID
+	done := make(map[TaskID]bool)
+	visiting := map[TaskID]bool{id: true}
+	var visit func(from, dep TaskID) error
+	visit = func(from, dep TaskID) error {
+		if done[dep] {
+			return nil
+		}
+		if visiting[dep] {
+			return fmt.Errorf("%w through task %s", ErrDependencyCycle, dep)
+		}
+		t, ok := taskMap[dep]
+		if !ok {
+			return usagef("task %s: dependency %s not found", from, dep)
+		}
+		visiting[dep] = true
+		for _, next := range t.Dependencies {
+			if err := visit(dep, next); err != nil {
+				return err
+			}
+		}
+		visiting[dep] = false
+		done[dep] = true
+		order = append(order, dep)
+		return nil
+	}
+	for _, dep := range task.Dependencies {
+		if err := visit(id, dep); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// runDepsCommand lists what a task depends on: "what feeds this artifact".
+func runDepsCommand(configPath string, args []string) error {
+	const usage = "usage: deps [--transitive] [--files] [--json] [--output file] <task>"
+	fs := flag.NewFlagSet("deps", flag.ContinueOnError)
+	transitive := fs.Bool("transitive", false, "list indirect dependencies too")
+	files := fs.Bool("files", false, "list each dependency's expanded input files")
+	asJSON := fs.Bool("json", false, "print the listing as JSON")
+	out := reportOutputFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if fs.NArg() == 0 {
+		return usagef("%s", usage)
+	}
+	// Accept flags after the task too, as in "deps app --transitive".
+	id := TaskID(fs.Arg(0))
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if fs.NArg() > 0 {
+		return usagef("%s", usage)
+	}
+
+	taskMap, err := LoadTaskMapFromConfig(configPath)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("load tasks from %q: %w", configPath, err))
+	}
+	ids, err := TaskDeps(taskMap, id, *transitive)
+	if err != nil {
+		return err
+	}
+
+	var ignore *IgnoreRules
+	if *files {
+		if ignore, err = LoadIgnoreRules(ignoreFilePath); err != nil {
+			return fmt.Errorf("load ignore file: %w", err)
+		}
+	}
+	deps := make([]TaskDep, 0, len(ids))
+	for _, dep := range ids {
+		d := TaskDep{ID: dep}
+		if *files {
+			if d.Files, err = ExpandFileSpecsWithOptions("", taskMap[dep].Inputs, inputExpandOptions(ignore)); err != nil {
+				return fmt.Errorf("expand inputs for task %s: %w", dep, err)
+			}
+		}
+		deps = append(deps, d)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(struct {
+			Task TaskID    `json:"task"`
+			Deps []TaskDep `json:"deps"`
+		}{id, deps}); err != nil {
+			return err
+		}
+		return out.Close()
+	}
+	for _, d := range deps {
+		fmt.Fprintf(out, "%s\n", d.ID)
+		for _, f := range d.Files {
+			fmt.Fprintf(out, "  %s\n", f)
+		}
+	}
+	return out.Close()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestTaskDeps(t *testing.T) {
+	// app -> (lib, gen); lib -> (base, gen); gen -> base
+	taskMap := NewTaskMap([]Task{
+		{ID: "base"},
+		{ID: "gen", Dependencies: []TaskID{"base"}},
+		{ID: "lib", Dependencies: []TaskID{"base", "gen"}},
+		{ID: "app", Dependencies: []TaskID{"lib", "gen"}},
+		{ID: "loop-a", Dependencies: []TaskID{"loop-b"}},
+		{ID: "loop-b", Dependencies: []TaskID{"loop-a"}},
+		{ID: "broken", Dependencies: []TaskID{"missing"}},
+	})
+
+	tests := []struct {
+		name       string
+		id         TaskID
+		transitive bool
+		want       []TaskID
+		wantErr    bool
+		wantCycle  bool
+	}{
+		{name: "direct", id: "app", want: []TaskID{"lib", "gen"}},
+		{name: "transitive", id: "app", transitive: true, want: []TaskID{"base", "gen", "lib"}},
+		{name: "middle", id: "lib", transitive: true, want: []TaskID{"base", "gen"}},
+		{name: "leaf", id: "base", transitive: true, want: []TaskID{}},
+		{name: "unknown task", id: "nope", wantErr: true},
+		{name: "unknown dependency", id: "broken", transitive: true, wantErr: true},
+		{name: "cycle", id: "loop-a", transitive: true, wantErr: true, wantCycle: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := TaskDeps(taskMap, tt.id, tt.transitive)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("TaskDeps = %v, want error", got)
+				}
+				if tt.wantCycle != errors.Is(err, ErrDependencyCycle) {
+					t.Errorf("err = %v, cycle error = %v", err, tt.wantCycle)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("TaskDeps: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("TaskDeps = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDepsCommandOutputFile(t *testing.T) {
+	withTempWD(t, func() {
+		configPath := writeConfig(t, `{
+			"tasks": {
+				"base": {"command": "true"},
+				"app": {"command": "true", "inputs": [":base"]}
+			}
+		}`)
+		for _, args := range [][]string{
+			{"-output", "deps.txt", "app"},
+			{"app", "-output", "deps.txt"},
+		} {
+			if err := os.Remove("deps.txt"); err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if err := runDepsCommand(configPath, args); err != nil {
+				t.Fatalf("runDepsCommand(%q): %v", args, err)
+			}
+			data, err := os.ReadFile("deps.txt")
+			if err != nil {
+				t.Fatalf("runDepsCommand(%q) wrote no file: %v", args, err)
+			}
+			if got, want := string(data), "base\n"; got != want {
+				t.Errorf("runDepsCommand(%q) wrote %q, want %q", args, got, want)
+			}
+		}
+	})
+}
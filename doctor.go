@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// DoctorCheck is one finding of the doctor command. Err is nil if the check
+// passed; Hint says how to fix it otherwise.
+type DoctorCheck struct {
+	Name string
+	Err  error
+	Hint string
+}
+
+// doctorOptions are the settings the doctor command checks, as resolved
+// from flags and the config's settings block.
+type doctorOptions struct {
+	ConfigPath string
+	CacheDir   string
+	SandboxDir string
+	Shell      string
+}
+
+// maxClockSkew is how far a new file's mtime may be from the local clock
+// before stamps are considered unreliable.
+const maxClockSkew = 2 * time.Second
+
+// RunDoctorChecks checks the setup for problems that otherwise surface as
+// confusing build failures. Every check runs, whatever the others find.
+func RunDoctorChecks(opts doctorOptions) []DoctorCheck {
+	return []DoctorCheck{
+		{
+			Name: "config " + opts.ConfigPath,
+			Err:  checkConfigLoads(opts.ConfigPath),
+			Hint: "run from inside the workspace or pass -config",
+		},
+		{
+			Name: "cache dir " + opts.CacheDir + " is writable",
+			Err:  checkWritableDir(opts.CacheDir),
+			Hint: "fix its permissions or pass -cache-dir",
+		},
+		{
+			Name: "file times in " + opts.CacheDir + " match the clock",
+			Err:  checkClockSkew(opts.CacheDir),
+			Hint: "stamps may miss changes; sync the clock or build with -stamp-verify",
+		},
+		{
+			Name: "sandbox dir " + opts.SandboxDir + " is writable",
+			Err:  checkWritableDir(opts.SandboxDir),
+			Hint: "fix its permissions or pass -sandbox-dir",
+		},
+		{
+			Name: "symlinks work in " + opts.SandboxDir,
+			Err:  checkSymlinks(opts.SandboxDir),
+			Hint: "sandboxes copy every input instead; -sandbox-stage-mode hardlink is faster",
+		},
+		{
+			Name: "shell " + opts.Shell,
+			Err:  checkShell(opts.Shell),
+			Hint: "install it or pass -shell",
+		},
+	}
+}
+
+func checkConfigLoads(configPath string) error {
+	if _, err := os.Stat(configPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return errors.New("not found here or in a parent directory")
+		}
+		return err
+	}
+	_, err := LoadTaskMapFromConfig(configPath)
+	return err
+}
+
+// checkClockSkew compares the mtime of a file created in dir with the local
+// clock; they differ on e.g. network filesystems with a skewed server.
+func checkClockSkew(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".clock-probe-")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	defer os.Remove(f.Name())
+	fi, err := f.Stat()
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	if skew := fi.ModTime().Sub(now); skew > maxClockSkew || skew < -maxClockSkew {
+		return fmt.Errorf("file times are off by %s", skew.Round(time.Second))
+	}
+	return nil
+}
+
+// checkSymlinks probes that symlinks, which sandboxes stage inputs with by
+// default, can be created in dir.
+func checkSymlinks(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(dir, ".symlink-probe-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	return os.Symlink("target", filepath.Join(tmp, "link"))
+}
+
+func checkShell(shell string) error {
+	_, err := exec.LookPath(shell)
+	return err
+}
+
+// printDoctorReport writes one line per check, with a hint under each
+// failure, and returns the number of failures.
+func printDoctorReport(w io.Writer, checks []DoctorCheck, color bool) int {
+	failed := 0
+	for _, c := range checks {
+		if c.Err == nil {
+			fmt.Fprintf(w, "%s %s\n", doctorLabel("ok  ", "\x1b[32m", color), c.Name)
+			continue
+		}
+		failed++
+		fmt.Fprintf(w, "%s %s: %v\n", doctorLabel("FAIL", "\x1b[31m", color), c.Name, c.Err)
+		fmt.Fprintf(w, "     hint: %s\n", c.Hint)
+	}
+	return failed
+}
+
+func doctorLabel(label, ansiColor string, color bool) string {
+	if !color {
+		return label
+	}
+	return ansiColor + label + ansiReset
+}
+
+// runDoctorCommand prints the doctor report. It fails if any check does.
+func runDoctorCommand(opts doctorOptions, args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if fs.NArg() > 0 {
+		return usagef("usage: doctor")
+	}
+	if n := printDoctorReport(os.Stdout, RunDoctorChecks(opts), DetectColorEnabled()); n > 0 {
+		return fmt.Errorf("doctor found %d problem(s)", n)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDoctorChecks(t *testing.T) {
+	withTempWD(t, func() {
+		configPath := writeConfig(t, `{"tasks": {"a": {"command": "true"}}}`)
+		// A dir below a regular file can't be created, even as root.
+		writeFile(t, "file")
+		good := doctorOptions{ConfigPath: configPath, CacheDir: "cache", SandboxDir: "sandboxes", Shell: "sh"}
+
+		tests := []struct {
+			name       string
+			edit       func(o *doctorOptions)
+			wantFailed []string // name prefixes of failed checks
+		}{
+			{name: "all good", edit: func(o *doctorOptions) {}},
+			{
+				name:       "unwritable cache dir",
+				edit:       func(o *doctorOptions) { o.CacheDir = filepath.Join("file", "cache") },
+				wantFailed: []string{"cache dir", "file times"},
+			},
+			{
+				name:       "missing shell",
+				edit:       func(o *doctorOptions) { o.Shell = "no-such-shell" },
+				wantFailed: []string{"shell"},
+			},
+			{
+				name:       "missing config",
+				edit:       func(o *doctorOptions) { o.ConfigPath = "missing.jsonc" },
+				wantFailed: []string{"config"},
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				opts := good
+				tt.edit(&opts)
+				checks := RunDoctorChecks(opts)
+				var failed []string
+				for _, c := range checks {
+					if c.Err != nil {
+						failed = append(failed, c.Name)
+					}
+				}
+				if len(failed) != len(tt.wantFailed) {
+					t.Fatalf("failed checks = %q, want ones starting with %q", failed, tt.wantFailed)
+				}
+				for i, prefix := range tt.wantFailed {
+					if !strings.HasPrefix(failed[i], prefix) {
+						t.Errorf("failed checks = %q, want ones starting with %q", failed, tt.wantFailed)
+					}
+				}
+
+				var out bytes.Buffer
+				if n := printDoctorReport(&out, checks, false); n != len(tt.wantFailed) {
+					t.Errorf("printDoctorReport = %d, want %d", n, len(tt.wantFailed))
+				}
+				if got := strings.Count(out.String(), "hint:"); got != len(tt.wantFailed) {
+					t.Errorf("report has %d hints, want one per failure:\n%s", got, out.String())
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LoadEnvFile parses a dotenv-style file: KEY=VALUE lines, blank lines and
+// '#' comments ignored, an optional leading "export ", and values optionally
+// wrapped in single or double quotes.
+func LoadEnvFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	env := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineNo)
+		}
+
+		value = strings.TrimSpace(value)
+		if n := len(value); n >= 2 && (value[0] == '"' || value[0] == '\'') && value[n-1] == value[0] {
+			value = value[1 : n-1]
+		}
+		env[key] = value
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// taskEnviron returns the process environment for task: the current
+// environment with the task's variables, then its secrets, layered on top.
+func taskEnviron(task Task, secrets map[string]string) []string {
+	environ := os.Environ()
+	for _, k := range sortedEnvKeys(task.Env) {
+		environ = append(environ, k+"="+task.Env[k])
+	}
+	for _, k := range sortedEnvKeys(secrets) {
+		environ = append(environ, k+"="+secrets[k])
+	}
+	return environ
+}
+
+// loadSecretEnv reads the values of task.SecretEnv from their files. A
+// trailing newline, as most editors leave, is not part of the value.
+func loadSecretEnv(task Task) (map[string]string, error) {
+	if len(task.SecretEnv) == 0 {
+		return nil, nil
+	}
+	secrets := make(map[string]string, len(task.SecretEnv))
+	for k, path := range task.SecretEnv {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("secret_env %s: %w", k, err)
+		}
+		secrets[k] = strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+	}
+	return secrets, nil
+}
+
+// secretRedactor returns a replacer that masks the values of secrets, or nil
+// if there is nothing to mask. Output is masked a line at a time, so each
+// line of a multi-line secret (e.g. a PEM key) is masked on its own too.
+func secretRedactor(secrets map[string]string) *strings.Replacer {
+	seen := make(map[string]bool)
+	var values []string
+	for _, v := range secrets {
+		for _, s := range append([]string{v}, strings.Split(v, "\n")...) {
+			s = strings.TrimSpace(s)
+			if s != "" && !seen[s] {
+				seen[s] = true
+				values = append(values, s)
+			}
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	// The replacer tries them in order: longest first, so a line of a
+	// secret doesn't split a longer one.
+	sort.Slice(values, func(i, j int) bool {
+		if len(values[i]) != len(values[j]) {
+			return len(values[i]) > len(values[j])
+		}
+		return values[i] < values[j]
+	})
+	oldnew := make([]string, 0, 2*len(values))
+	for _, s := range values {
+		oldnew = append(oldnew, s, "***")
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+// taskKeyEnv returns the values of task.EnvKeys, resolved against the task's
+// environment and falling back to the process environment.
+func taskKeyEnv(task Task) map[string]string {
+	if len(task.EnvKeys) == 0 {
+		return nil
+	}
+	env := make(map[string]string, len(task.EnvKeys))
+	for _, k := range task.EnvKeys {
+		if v, ok := task.Env[k]; ok {
+			env[k] = v
+			continue
+		}
+		env[k] = os.Getenv(k)
+	}
+	return env
+}
+
+func sortedEnvKeys(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// envBool reports whether the environment variable key is set to a true
+// value ("1", "true", ...). Used for boolean flag defaults.
+func envBool(key string) bool {
+	v, _ := strconv.ParseBool(os.Getenv(key))
+	return v
+}
+
+// envOr returns the environment variable key, or def if it is unset or empty.
+// Used for flag defaults that can also be set from the environment.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// recordedEnv lists the variables RecordEnv always records: those that
+// commonly make a build behave differently between shells. LC_* variables
+// are recorded too.
+var recordedEnv = []string{"PATH", "LANG"}
+
+// RecordEnv writes the part of the process environment that affects builds
+// to path as a JSON object, for ReplayEnv to reproduce the build's
+// conditions elsewhere. Only recordedEnv, LC_* and the tasks' env_keys are
+// recorded, plus the names in extra; the file is meant to move between
+// machines, so other variables, which may hold tokens, are left out.
+// secret_env names are never recorded, even if listed. The file is still
+// private to the user.
+func RecordEnv(path string, taskMap TaskMap, extra []string) error {
+	names := make(map[string]bool)
+	for _, k := range append(slices.Clone(recordedEnv), extra...) {
+		names[k] = true
+	}
+	secret := make(map[string]bool)
+	for _, task := range taskMap {
+		for _, k := range task.EnvKeys {
+			names[k] = true
+		}
+		for k := range task.SecretEnv {
+			secret[k] = true
+		}
+	}
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" || secret[k] {
+			continue
+		}
+		if names[k] || strings.HasPrefix(k, "LC_") {
+			env[k] = v
+		}
+	}
+	data, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o600)
+}
+
+// ReplayEnv replaces the process environment with the one RecordEnv wrote to
+// path. It applies to everything the build runs (tasks, key commands, the
+// docker client) and to env_keys, which read it.
+func ReplayEnv(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var env map[string]string
+	if err := json.Unmarshal(data, &env); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	os.Clearenv()
+	for _, k := range sortedEnvKeys(env) {
+		if err := os.Setenv(k, env[k]); err != nil {
+			return fmt.Errorf("set %s: %w", k, err)
+		}
+	}
+	return nil
+}
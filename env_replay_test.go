@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplayEnv(t *testing.T) {
+	withTempWD(t, func() {
+		saved := os.Environ()
+		t.Cleanup(func() {
+			os.Clearenv()
+			for _, kv := range saved {
+				k, v, _ := strings.Cut(kv, "=")
+				os.Setenv(k, v)
+			}
+		})
+
+		taskMap := NewTaskMap([]Task{{
+			ID:        "show",
+			EnvKeys:   []string{"BUILD_TOOL_TEST_LANG"},
+			SecretEnv: map[string]string{"BUILD_TOOL_TEST_SECRET": "secret.txt"},
+			Outputs:   []Path{"env.txt"},
+			Command:   `echo "$BUILD_TOOL_TEST_LANG ${BUILD_TOOL_TEST_EXTRA:-unset} ${BUILD_TOOL_TEST_OPT:-unset}" > env.txt`,
+		}})
+
+		writeFileContent(t, "secret.txt", "hunter2")
+		t.Setenv("BUILD_TOOL_TEST_LANG", "C")
+		t.Setenv("BUILD_TOOL_TEST_OPT", "on")
+		t.Setenv("BUILD_TOOL_TEST_SECRET", "hunter2")
+		t.Setenv("BUILD_TOOL_TEST_TOKEN", "abc123")
+		t.Setenv("LC_ALL", "C")
+		if err := RecordEnv("env.json", taskMap, []string{"BUILD_TOOL_TEST_OPT", "BUILD_TOOL_TEST_SECRET"}); err != nil {
+			t.Fatalf("RecordEnv: %v", err)
+		}
+		if fi, err := os.Stat("env.json"); err != nil || fi.Mode().Perm() != 0o600 {
+			t.Errorf("env.json: %v, %v; want mode 0600", fi, err)
+		}
+		data, err := os.ReadFile("env.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var recorded map[string]string
+		if err := json.Unmarshal(data, &recorded); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"PATH", "LC_ALL", "BUILD_TOOL_TEST_LANG", "BUILD_TOOL_TEST_OPT"} {
+			if _, ok := recorded[k]; !ok {
+				t.Errorf("%s not recorded", k)
+			}
+		}
+		// Neither a secret_env name, even when asked for, nor a variable
+		// nothing asked for.
+		for _, k := range []string{"BUILD_TOOL_TEST_SECRET", "BUILD_TOOL_TEST_TOKEN"} {
+			if _, ok := recorded[k]; ok {
+				t.Errorf("%s recorded", k)
+			}
+		}
+
+		// Another shell: the variable differs and there's an extra one.
+		os.Setenv("BUILD_TOOL_TEST_LANG", "en_US.UTF-8")
+		os.Setenv("BUILD_TOOL_TEST_EXTRA", "1")
+		if err := ReplayEnv("env.json"); err != nil {
+			t.Fatalf("ReplayEnv: %v", err)
+		}
+
+		build(t, taskMap, TaskExecutorOptions{}, "show")
+		if data, err = os.ReadFile("env.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(data), "C unset on\n"; got != want {
+			t.Errorf("task saw %q, want the recorded environment %q", got, want)
+		}
+		if got := taskKeyEnv(taskMap["show"]); got["BUILD_TOOL_TEST_LANG"] != "C" {
+			t.Errorf("env_keys resolved to %v, want the recorded value", got)
+		}
+	})
+}
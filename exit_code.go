@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Exit codes returned by the build tool, so CI scripts can branch on the
+// class of failure.
+const (
+	exitTaskFailure = 1   // a task command failed (also unclassified errors)
+	exitUsage       = 2   // bad flags, arguments, or config
+	exitCycle       = 3   // dependency cycle in the task graph
+	exitInternal    = 4   // cache or other build-tool I/O error
+	exitTimeout     = 5   // -build-timeout expired
+	exitInterrupted = 130 // SIGINT or SIGTERM, as a shell would report it
+)
+
+// ErrDependencyCycle is returned when the requested tasks can't be ordered
+// because their dependencies form a cycle.
+var ErrDependencyCycle = errors.New("dependency cycle")
+
+// ErrBuildTimedOut is returned when -build-timeout expires before the build
+// finishes.
+var ErrBuildTimedOut = errors.New("build timed out")
+
+// ErrBuildInterrupted is returned when build-tool gets SIGINT or SIGTERM
+// while building.
+var ErrBuildInterrupted = errors.New("build interrupted")
+
+// exitError attaches an exit code to an error.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// usagef returns a usage error (exit code 2).
+func usagef(format string, args ...any) error {
+	return withExitCode(exitUsage, fmt.Errorf(format, args...))
+}
+
+// exitCode maps an error returned by run to the process exit code.
+func exitCode(err error) int {
+	if errors.Is(err, ErrDependencyCycle) {
+		return exitCycle
+	}
+	if errors.Is(err, ErrBuildTimedOut) {
+		return exitTimeout
+	}
+	if errors.Is(err, ErrBuildInterrupted) {
+		return exitInterrupted
+	}
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	var ce *ConfigError
+	if errors.As(err, &ce) {
+		return exitUsage
+	}
+	return exitTaskFailure
+}
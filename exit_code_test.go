@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	withTempWD(t, func() {
+		execute := func(tasks []Task, ids ...TaskID) error {
+			return newTestExecutor(t, TaskExecutorOptions{}).ExecuteTasks(NewTaskMap(tasks), ids)
+		}
+
+		tests := []struct {
+			name string
+			err  error
+			want int
+		}{
+			{
+				name: "task-failure",
+				err:  execute([]Task{{ID: "a", Command: "exit 3"}}, "a"),
+				want: exitTaskFailure,
+			},
+			{
+				name: "unknown-task",
+				err:  execute([]Task{{ID: "a", Command: "true"}}, "b"),
+				want: exitUsage,
+			},
+			{
+				name: "cycle",
+				err: execute([]Task{
+					{ID: "a", Dependencies: []TaskID{"b"}, Command: "true"},
+					{ID: "b", Dependencies: []TaskID{"a"}, Command: "true"},
+				}, "a"),
+				want: exitCycle,
+			},
+			{
+				name: "config",
+				err:  runExportCommand("missing.jsonc", nil),
+				want: exitUsage,
+			},
+			{
+				name: "bad-subcommand-args",
+				err:  runCacheCommand(".build-tool", "build-tool.jsonc", KeyOptions{}, StampCacheOptions{}, []string{"inspect"}),
+				want: exitUsage,
+			},
+			{
+				name: "config-error",
+				err:  fmt.Errorf("load tasks: %w", &ConfigError{TaskID: "a", Field: "command", Reason: "command must not be empty"}),
+				want: exitUsage,
+			},
+			{
+				name: "wrapped-internal",
+				err:  fmt.Errorf("build: %w", withExitCode(exitInternal, errors.New("disk full"))),
+				want: exitInternal,
+			},
+			{
+				name: "unclassified",
+				err:  errors.New("boom"),
+				want: exitTaskFailure,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if tt.err == nil {
+					t.Fatal("expected an error")
+				}
+				if got := exitCode(tt.err); got != tt.want {
+					t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+)
+
+// sha256Pattern matches what sha256sum prints for a file's digest.
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// checkExpectedOutputs compares the outputs task produced in dir (the
+// workspace if empty) with its expect_outputs: each expected file must exist
+// with its SHA-256, and no other output may exist. Every difference is
+// logged before the task fails, so one run shows them all.
+func (e *TaskExecutor) checkExpectedOutputs(task Task, dir string) error {
+	produced, err := producedOutputs(dir, task.Outputs, e.ignore)
+	if err != nil {
+		return fmt.Errorf("expand outputs for task %s: %w", task.ID, err)
+	}
+	problems := 0
+	seen := make(map[Path]bool, len(produced))
+	for _, out := range produced {
+		want, ok := task.ExpectOutputs[out]
+		if !ok {
+			e.log.Taskf(task.ID, "expect_outputs: unexpected output %s", out)
+			problems++
+			continue
+		}
+		seen[out] = true
+		got, err := sha256File(filepath.Join(dir, filepath.FromSlash(string(out))))
+		if err != nil {
+			return fmt.Errorf("hash output %s of task %s: %w", out, task.ID, err)
+		}
+		if got != want {
+			e.log.Taskf(task.ID, "expect_outputs: %s has sha256 %s, want %s", out, got, want)
+			problems++
+		}
+	}
+	for _, p := range slices.Sorted(maps.Keys(task.ExpectOutputs)) {
+		if !seen[p] {
+			e.log.Taskf(task.ID, "expect_outputs: missing output %s", p)
+			problems++
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("task %s: %d output(s) don't match expect_outputs", task.ID, problems)
+	}
+	return nil
+}
+
+// producedOutputs expands specs in dir like expandOutputSpecs, except that
+// a glob matching nothing or a literal output that doesn't exist is
+// skipped rather than an error, so checkExpectedOutputs can report the
+// expected files as missing.
+func producedOutputs(dir string, specs []Path, ignore *IgnoreRules) ([]Path, error) {
+	var present []Path
+	for _, spec := range specs {
+		pat, neg, err := parseSpec(string(spec))
+		if err == nil && !neg && !hasGlobMeta(pat) {
+			if _, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(pat))); errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+		}
+		present = append(present, spec)
+	}
+	files, _, _, err := expandSpecsFS(newWorkspaceFS(dir), present, ExpandOptions{Ignore: ignore, ExpandDirs: true, AllowParent: true, AllowEmpty: true}, false)
+	return files, err
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
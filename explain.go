@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cacheExplanation is the -explain record for one task. Layers are "hit",
+// "miss", "error", or "-" when not configured or not consulted (the remote is
+// only asked when neither the local nor the base cache has the key).
+type cacheExplanation struct {
+	Key    string
+	Stats  KeyStats
+	Local  string
+	Base   string
+	Remote string
+}
+
+func (x cacheExplanation) format(decision string) string {
+	return fmt.Sprintf("explain: key=%s local=%s base=%s remote=%s decision=%q inputs=%d hashed=%d stamped=%d",
+		x.Key, x.Local, x.Base, x.Remote, decision, x.Stats.Inputs, x.Stats.Hashed, x.Stats.Stamped)
+}
+
+func (e *TaskExecutor) explain(task Task, x cacheExplanation, decision string) {
+	if e.explainCache {
+		e.log.Taskf(task.ID, "%s", x.format(decision))
+	}
+}
+
+// dumpKeyPayload writes taskJSON, the exact bytes hashed into the task's
+// key, to <dir>/<task>.json for -dump-key-payload, the task ID encoded by
+// keyPayloadFileName. Diffing the files from two machines shows which field
+// or input digest made their keys diverge.
+func (e *TaskExecutor) dumpKeyPayload(id TaskID, taskJSON []byte) error {
+	if e.keyPayloadDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(e.keyPayloadDir, 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(e.keyPayloadDir, keyPayloadFileName(id)), taskJSON)
+}
+
+// keyPayloadFileName returns the file name of id's dumped key payload. Bytes
+// other than ASCII letters, digits, '-' and '_' are written as %XX, so
+// every task gets its own file ("a:b" is a%3Ab.json, "a/b" a%2Fb.json).
+func keyPayloadFileName(id TaskID) string {
+	var b strings.Builder
+	for _, c := range []byte(id) {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String() + ".json"
+}
+
+func hitOrMiss(hit bool) string {
+	if hit {
+		return "hit"
+	}
+	return "miss"
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// cachedFailure is what -cache-failures records for a command that exited
+// with a non-zero status, so an unchanged rerun can report it again.
+type cachedFailure struct {
+	ExitCode int      `json:"exit_code"`
+	Output   []string `json:"output,omitempty"`
+	// Omitted counts the earlier lines dropped to keep Output to the last
+	// failureOutputLines.
+	Omitted int `json:"omitted,omitempty"`
+}
+
+// failureOutputLines is how many of a failing command's last output lines
+// -cache-failures records.
+const failureOutputLines = 1000
+
+// errCachedFailure is the cause of a TaskFailedError replayed from the cache.
+var errCachedFailure = errors.New("failure replayed from cache")
+
+func (c *LocalCache) failurePath(taskKey string) string {
+	return filepath.Join(c.Root, "failures", taskKey+".json")
+}
+
+// StoreFailure records a failure sentinel for taskKey.
+func (c *LocalCache) StoreFailure(taskKey string, f cachedFailure) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	path := c.failurePath(taskKey)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-failure-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadFailure returns the failure recorded for taskKey, or nil if there is
+// none (or it can't be read, which only costs a rerun).
+func (c *LocalCache) LoadFailure(taskKey string) *cachedFailure {
+	data, err := os.ReadFile(c.failurePath(taskKey))
+	if err != nil {
+		return nil
+	}
+	var f cachedFailure
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil
+	}
+	return &f
+}
+
+// RemoveFailure forgets the failure recorded for taskKey, if any.
+func (c *LocalCache) RemoveFailure(taskKey string) {
+	_ = os.Remove(c.failurePath(taskKey))
+}
@@ -0,0 +1,46 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// preserveOwner gives path the uid/gid of fi, best-effort: unprivileged
+// users can usually only chown to their own uid, so failures are ignored.
+func preserveOwner(path string, fi os.FileInfo) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st == nil {
+		return
+	}
+	_ = os.Chown(path, int(st.Uid), int(st.Gid))
+}
+
+// blobWriteBits are cleared from a blob's mode, so a command writing to an
+// output hardlinked to it fails instead of changing every entry that shares
+// it. Root still can; CheckUnmodified catches that.
+const blobWriteBits = 0o222
+
+// fileID identifies a file across its hardlinks.
+type fileID struct {
+	dev, ino uint64
+}
+
+// fileIDOf returns the device and inode of the file fi describes.
+func fileIDOf(fi os.FileInfo) (fileID, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st == nil {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// linkCount returns the number of hardlinks to the file fi describes.
+func linkCount(fi os.FileInfo) uint64 {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st == nil {
+		return 1
+	}
+	return uint64(st.Nlink)
+}
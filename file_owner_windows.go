@@ -0,0 +1,21 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// preserveOwner is a no-op on Windows, which has no uid/gid ownership.
+func preserveOwner(path string, fi os.FileInfo) {}
+
+// blobWriteBits is zero on Windows: it refuses to delete or replace
+// read-only files, which restores do, so blobs keep their mode.
+const blobWriteBits = 0
+
+// fileID identifies a file across its hardlinks; Windows has none here.
+type fileID struct{}
+
+// fileIDOf reports no ID on Windows, so every link is counted.
+func fileIDOf(fi os.FileInfo) (fileID, bool) { return fileID{}, false }
+
+// linkCount reports one link on Windows, where outputs are never unshared.
+func linkCount(fi os.FileInfo) uint64 { return 1 }
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 
@@ -36,145 +38,270 @@ func parseSpec(raw string) (pat string, neg bool, err error) {
 
 	pat = filepath.ToSlash(raw)
 	pat = strings.TrimPrefix(pat, "./")
+	// An escaped '!' rebased under an included config's dir (see rebaseSpec).
+	pat = strings.ReplaceAll(pat, "/\\!", "/!")
 	if pat == "" {
 		return "", false, fmt.Errorf("path must not be empty")
 	}
 	return pat, neg, nil
 }
 
+// NormalizeFileSpecs returns specs in the canonical form used by
+// ExpandFileSpecs: slash-separated, without a leading "./", negations written
+// as "!pat" and literal leading '!' escaped as "\\!pat". Order is preserved
+// because later negations only exclude what earlier specs matched.
+func NormalizeFileSpecs(specs []Path) ([]string, error) {
+	out := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		pat, neg, err := parseSpec(string(spec))
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case neg:
+			pat = "!" + pat
+		case strings.HasPrefix(pat, "!"):
+			pat = "\\" + pat
+		}
+		out = append(out, pat)
+	}
+	return out, nil
+}
+
+// ExpandOptions controls how ExpandFileSpecsWithOptions treats specs that
+// match nothing.
+type ExpandOptions struct {
+	// AllowEmpty lets a positive glob match no files instead of failing with
+	// "matched no files". Useful for optional input sets. Literal paths must
+	// still exist.
+	AllowEmpty bool
+	// Ignore excludes matching files from glob results. Literal paths, and
+	// globs whose literal prefix is itself ignored (e.g. "node_modules/**"
+	// when node_modules is ignored), are explicit and not filtered.
+	Ignore *IgnoreRules
+	// ExpandDirs lets a literal directory path stand for every regular file
+	// under it, recursively, instead of failing. Used for outputs, where
+	// "dist" means the whole tree a task produced; the directories themselves
+	// are reported separately so empty ones can be recreated.
+	ExpandDirs bool
+	// AllowParent accepts relative specs that reach above the working
+	// directory (e.g. "../shared/*.h"); globs are then expanded from that
+	// parent. Without it such specs are an error.
+	AllowParent bool
+	// Warn, if set, is told about positive globs that matched files which
+	// later negations then all removed, for debugging overly broad excludes.
+	Warn func(msg string)
+}
+
 // ExpandFileSpecs expands any glob patterns in specs (including doublestar **)
 // into a sorted, de-duplicated list of slash-separated relative file paths.
 //
 // Non-glob entries are passed through (also normalized to slash separators).
 // Glob patterns must be relative to the current working directory.
+//
+// Specs are applied in order: positive specs add files and negated ("!")
+// specs only remove files added by earlier specs, so they never fail. By
+// default every positive glob must match at least one file and every literal
+// path must exist. The result may still be empty, e.g. for an exclude-only
+// list or when excludes remove everything; it is never nil on success.
+//
+// Glob matches are also filtered by the workspace ignore file
+// (.build-tool/ignore), read on every call; see ExpandOptions.Ignore. Code
+// expanding many spec lists loads it once and uses inputExpandOptions.
 func ExpandFileSpecs(specs []Path) ([]Path, error) {
-	fsys := os.DirFS(".")
+	ignore, err := LoadIgnoreRules(ignoreFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("load ignore file: %w", err)
+	}
+	return ExpandFileSpecsWithOptions("", specs, inputExpandOptions(ignore))
+}
 
-	seen := make(map[string]struct{})
+// SpecExpansion is what one spec contributed to an expansion, for
+// diagnostics such as "pattern X matched 0 files after exclusions".
+type SpecExpansion struct {
+	Spec    Path
+	Negated bool
+	// Matched lists the files a positive spec matched, sorted, including
+	// ones an earlier spec already added.
+	Matched []Path
+	// Kept counts the Matched files still in the result after later
+	// exclusions.
+	Kept int
+	// Removed counts the files a negated spec removed from what earlier
+	// specs added.
+	Removed int
+}
 
-	for _, spec := range specs {
-		raw := string(spec)
-		pat, neg, err := parseSpec(raw)
-		if err != nil {
-			return nil, err
-		}
+// ExpandFileSpecsDetailed is ExpandFileSpecs that also reports, in spec
+// order, what each spec contributed.
+func ExpandFileSpecsDetailed(specs []Path) ([]Path, []SpecExpansion, error) {
+	ignore, err := LoadIgnoreRules(ignoreFilePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load ignore file: %w", err)
+	}
+	files, _, details, err := expandSpecsFS(newWorkspaceFS(""), specs, inputExpandOptions(ignore), true)
+	return files, details, err
+}
 
-		// Only glob relative patterns (matches Go's existing behavior where paths
-		// are interpreted relative to the current working directory).
-		if hasGlobMeta(pat) {
-			if filepath.IsAbs(filepath.FromSlash(pat)) {
-				return nil, fmt.Errorf("glob pattern must be relative: %q", raw)
-			}
+// ExpandFileSpecsInDir expands specs relative to baseDir.
+//
+// It mirrors ExpandFileSpecs, but evaluates globs and non-glob paths against
+// baseDir instead of the current working directory.
+func ExpandFileSpecsInDir(baseDir string, specs []Path) ([]Path, error) {
+	return expandWorkspaceSpecs(baseDir, specs)
+}
 
-			matches, err := doublestar.Glob(fsys, pat)
-			if err != nil {
-				return nil, fmt.Errorf("glob %q: %w", raw, err)
-			}
+// allowParentInputs is set by -allow-parent-inputs before anything is
+// expanded; see ExpandOptions.AllowParent.
+var allowParentInputs bool
 
-			sort.Strings(matches)
-			added := 0
-			for _, m := range matches {
-				m = filepath.ToSlash(m)
-				m = strings.TrimPrefix(m, "./")
-				if m == "" {
-					continue
-				}
+// expandWorkspaceSpecs expands specs relative to baseDir with the workspace
+// ignore file applied.
+func expandWorkspaceSpecs(baseDir string, specs []Path) ([]Path, error) {
+	ignore, err := LoadIgnoreRules(ignoreFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("load ignore file: %w", err)
+	}
+	return ExpandFileSpecsWithOptions(baseDir, specs, inputExpandOptions(ignore))
+}
 
-				if neg {
-					delete(seen, m)
-					continue
-				}
+// inputExpandOptions are the options task inputs are expanded with, given
+// the workspace ignore rules loaded for the build.
+func inputExpandOptions(ignore *IgnoreRules) ExpandOptions {
+	return ExpandOptions{Ignore: ignore, AllowParent: allowParentInputs}
+}
 
-				if _, ok := seen[m]; ok {
-					continue
-				}
-				info, err := fs.Stat(fsys, m)
-				if err != nil {
-					return nil, fmt.Errorf("stat %q (from %q): %w", m, raw, err)
-				}
-				if info.IsDir() {
-					continue
-				}
-				if !info.Mode().IsRegular() {
-					return nil, fmt.Errorf("glob %q matched non-regular path %q", raw, m)
-				}
+// ExpandOutputSpecsInDir expands task output specs relative to baseDir (the
+// current working directory if empty). Unlike inputs, an output may name a
+// directory: it contributes every regular file under it to files, and itself
+// and all its subdirectories (including empty ones) to dirs. Both are sorted.
+// As with inputs, a glob matching no files is an error, so a cache entry
+// never records an empty expansion that would not restore.
+func ExpandOutputSpecsInDir(baseDir string, specs []Path) (files, dirs []Path, err error) {
+	ignore, err := LoadIgnoreRules(ignoreFilePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load ignore file: %w", err)
+	}
+	return expandOutputSpecs(baseDir, specs, ignore)
+}
 
-				seen[m] = struct{}{}
-				added++
-			}
-			if !neg && added == 0 {
-				return nil, fmt.Errorf("glob %q matched no files", raw)
-			}
-			continue
-		}
+// expandOutputSpecs is ExpandOutputSpecsInDir with the ignore rules already
+// loaded.
+func expandOutputSpecs(baseDir string, specs []Path, ignore *IgnoreRules) (files, dirs []Path, err error) {
+	// Outputs outside the workspace were always accepted as literal paths.
+	files, dirs, _, err = expandSpecsFS(newWorkspaceFS(baseDir), specs, ExpandOptions{Ignore: ignore, ExpandDirs: true, AllowParent: true}, false)
+	return files, dirs, err
+}
 
-		// Non-glob path.
-		p := pat
-		if neg {
-			fi, err := os.Stat(filepath.FromSlash(p))
-			if err == nil && fi.IsDir() {
-				prefix := strings.TrimSuffix(p, "/") + "/"
-				for k := range seen {
-					if strings.HasPrefix(k, prefix) {
-						delete(seen, k)
-					}
-				}
-				continue
-			}
-			delete(seen, p)
-			continue
-		}
+// ExpandFileSpecsWithOptions is ExpandFileSpecs relative to baseDir (the
+// current working directory if empty) with opts applied.
+func ExpandFileSpecsWithOptions(baseDir string, specs []Path, opts ExpandOptions) ([]Path, error) {
+	return expandFileSpecsFS(newWorkspaceFS(baseDir), specs, opts)
+}
 
-		info, err := os.Stat(filepath.FromSlash(p))
-		if err != nil {
-			return nil, fmt.Errorf("stat %q: %w", raw, err)
-		}
-		if info.IsDir() {
-			return nil, fmt.Errorf("path %q is a directory; use a glob like %q", raw, filepath.ToSlash(filepath.Join(p, "**", "*")))
-		}
-		if !info.Mode().IsRegular() {
-			return nil, fmt.Errorf("path %q is not a regular file", raw)
-		}
+// ExpandFileSpecsFS expands specs against fsys. It is the core of
+// ExpandFileSpecs and ExpandFileSpecsInDir, and lets expansion be rooted
+// anywhere (e.g. an fstest.MapFS in tests).
+func ExpandFileSpecsFS(fsys fs.FS, specs []Path) ([]Path, error) {
+	return expandFileSpecsFS(fsys, specs, ExpandOptions{})
+}
 
-		seen[p] = struct{}{}
+// workspaceFS is os.DirFS(dir) that also stats literal paths fs.FS can't
+// name, such as absolute paths or paths with "..", relative to dir. Specs
+// may contain those (globs must be relative), so the OS-backed expanders keep
+// accepting them.
+type workspaceFS struct {
+	fs.FS
+	dir string
+}
+
+func newWorkspaceFS(dir string) workspaceFS {
+	if dir == "" {
+		dir = "."
 	}
+	return workspaceFS{FS: os.DirFS(dir), dir: dir}
+}
 
-	keys := make([]string, 0, len(seen))
-	for k := range seen {
-		keys = append(keys, k)
+// ReadDir keeps os.DirFS's fast directory listing visible through the
+// embedding.
+func (w workspaceFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(w.FS, name)
+}
+
+func (w workspaceFS) Stat(name string) (fs.FileInfo, error) {
+	if fs.ValidPath(name) {
+		return fs.Stat(w.FS, name)
 	}
-	sort.Strings(keys)
-	out := make([]Path, len(keys))
-	for i, p := range keys {
-		out[i] = Path(p)
+	p := filepath.FromSlash(name)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(w.dir, p)
 	}
-	return out, nil
+	return os.Stat(p)
 }
 
-// ExpandFileSpecsInDir expands specs relative to baseDir.
-//
-// It mirrors ExpandFileSpecs, but evaluates globs and non-glob paths against
-// baseDir instead of the current working directory.
-func ExpandFileSpecsInDir(baseDir string, specs []Path) ([]Path, error) {
-	fsys := os.DirFS(baseDir)
+func expandFileSpecsFS(fsys fs.FS, specs []Path, opts ExpandOptions) ([]Path, error) {
+	files, _, _, err := expandSpecsFS(fsys, specs, opts, false)
+	return files, err
+}
 
+// expandSpecsFS is expandFileSpecsFS that also returns the directories
+// covered by directory specs when opts.ExpandDirs is set, and with detailed
+// what each spec contributed.
+func expandSpecsFS(fsys fs.FS, specs []Path, opts ExpandOptions, detailed bool) (files, dirs []Path, details []SpecExpansion, err error) {
 	seen := make(map[string]struct{})
+	seenDirs := make(map[string]struct{})
+	if detailed {
+		details = make([]SpecExpansion, len(specs))
+	}
+	// match records that specs[i] matched m, or removed it if negated.
+	match := func(i int, m string, neg bool) {
+		if !detailed {
+			return
+		}
+		if neg {
+			details[i].Removed++
+		} else {
+			details[i].Matched = append(details[i].Matched, Path(m))
+		}
+	}
+	// contributed[i] is what positive glob specs[i] added; only tracked
+	// for opts.Warn.
+	var contributed map[int][]string
+	if opts.Warn != nil {
+		contributed = make(map[int][]string)
+	}
 
-	for _, spec := range specs {
+	for i, spec := range specs {
 		raw := string(spec)
 		pat, neg, err := parseSpec(raw)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
+		}
+		if detailed {
+			details[i] = SpecExpansion{Spec: spec, Negated: neg}
 		}
 
+		if !neg && !opts.AllowParent && outsideWorkspace(fsys, pat) {
+			return nil, nil, nil, fmt.Errorf("%q is outside the workspace; move it into the workspace or pass -allow-parent-inputs", raw)
+		}
+
+		// Only glob relative patterns (matches Go's existing behavior where paths
+		// are interpreted relative to the current working directory).
 		if hasGlobMeta(pat) {
 			if filepath.IsAbs(filepath.FromSlash(pat)) {
-				return nil, fmt.Errorf("glob pattern must be relative: %q", raw)
+				return nil, nil, nil, fmt.Errorf("glob pattern must be relative: %q", raw)
 			}
 
-			matches, err := doublestar.Glob(fsys, pat)
+			matches, err := globFS(fsys, pat)
 			if err != nil {
-				return nil, fmt.Errorf("glob %q: %w", raw, err)
+				return nil, nil, nil, fmt.Errorf("glob %q: %w", raw, err)
+			}
+
+			// A glob that reaches into an ignored directory by name wants
+			// what's there.
+			filter := !neg && opts.Ignore != nil
+			if prefix := globLiteralPrefix(pat); filter && prefix != "" && opts.Ignore.Match(prefix, true) {
+				filter = false
 			}
 
 			sort.Strings(matches)
@@ -187,66 +314,178 @@ func ExpandFileSpecsInDir(baseDir string, specs []Path) ([]Path, error) {
 				}
 
 				if neg {
+					if _, ok := seen[m]; ok {
+						match(i, m, true)
+					}
 					delete(seen, m)
+					delete(seenDirs, m)
 					continue
 				}
 
 				if _, ok := seen[m]; ok {
+					match(i, m, false)
+					continue
+				}
+				if filter && opts.Ignore.Match(m, false) {
 					continue
 				}
 				info, err := fs.Stat(fsys, m)
 				if err != nil {
-					return nil, fmt.Errorf("stat %q (from %q): %w", m, raw, err)
+					return nil, nil, nil, fmt.Errorf("stat %q (from %q): %w", m, raw, err)
 				}
 				if info.IsDir() {
 					continue
 				}
 				if !info.Mode().IsRegular() {
-					return nil, fmt.Errorf("glob %q matched non-regular path %q", raw, m)
+					return nil, nil, nil, fmt.Errorf("glob %q matched non-regular path %q", raw, m)
 				}
 
 				seen[m] = struct{}{}
+				match(i, m, false)
 				added++
+				if contributed != nil {
+					contributed[i] = append(contributed[i], m)
+				}
 			}
-			if !neg && added == 0 {
-				return nil, fmt.Errorf("glob %q matched no files", raw)
+			if !neg && added == 0 && !opts.AllowEmpty {
+				return nil, nil, nil, fmt.Errorf("glob %q matched no files", raw)
 			}
 			continue
 		}
 
+		// Non-glob path.
 		p := pat
-		absPath := filepath.Join(baseDir, filepath.FromSlash(p))
 		if neg {
-			fi, err := os.Stat(absPath)
+			fi, err := fs.Stat(fsys, p)
 			if err == nil && fi.IsDir() {
 				prefix := strings.TrimSuffix(p, "/") + "/"
 				for k := range seen {
 					if strings.HasPrefix(k, prefix) {
+						match(i, k, true)
 						delete(seen, k)
 					}
 				}
+				for k := range seenDirs {
+					if k == strings.TrimSuffix(p, "/") || strings.HasPrefix(k, prefix) {
+						delete(seenDirs, k)
+					}
+				}
 				continue
 			}
+			if _, ok := seen[p]; ok {
+				match(i, p, true)
+			}
 			delete(seen, p)
 			continue
 		}
 
-		info, err := os.Stat(absPath)
+		info, err := fs.Stat(fsys, p)
 		if err != nil {
-			return nil, fmt.Errorf("stat %q: %w", raw, err)
+			if errors.Is(err, fs.ErrNotExist) {
+				if suggestion, ok := closestSibling(fsys, p); ok {
+					return nil, nil, nil, fmt.Errorf("stat %q: %w; did you mean %q?", raw, err, suggestion)
+				}
+			}
+			return nil, nil, nil, fmt.Errorf("stat %q: %w", raw, err)
+		}
+		if info.IsDir() && opts.ExpandDirs {
+			found := make(map[string]struct{})
+			if err := walkOutputDir(fsys, strings.TrimSuffix(p, "/"), found, seenDirs); err != nil {
+				return nil, nil, nil, fmt.Errorf("expand directory %q: %w", raw, err)
+			}
+			for _, f := range sortedPaths(found) {
+				seen[string(f)] = struct{}{}
+				match(i, string(f), false)
+			}
+			continue
 		}
 		if info.IsDir() {
-			return nil, fmt.Errorf("path %q is a directory; use a glob like %q", raw, filepath.ToSlash(filepath.Join(p, "**", "*")))
+			return nil, nil, nil, fmt.Errorf("path %q is a directory; use a glob like %q", raw, filepath.ToSlash(filepath.Join(p, "**", "*")))
 		}
 		if !info.Mode().IsRegular() {
-			return nil, fmt.Errorf("path %q is not a regular file", raw)
+			return nil, nil, nil, fmt.Errorf("path %q is not a regular file", raw)
 		}
 
 		seen[p] = struct{}{}
+		match(i, p, false)
 	}
 
-	keys := make([]string, 0, len(seen))
-	for k := range seen {
+	for i := range specs {
+		paths, ok := contributed[i]
+		if ok && !slices.ContainsFunc(paths, func(p string) bool { _, ok := seen[p]; return ok }) {
+			opts.Warn(fmt.Sprintf("glob %q matched %d file(s), all removed by later exclusions", specs[i], len(paths)))
+		}
+	}
+
+	for i := range details {
+		slices.Sort(details[i].Matched)
+		for _, m := range details[i].Matched {
+			if _, ok := seen[string(m)]; ok {
+				details[i].Kept++
+			}
+		}
+	}
+
+	return sortedPaths(seen), sortedPaths(seenDirs), details, nil
+}
+
+// outsideWorkspace reports whether the relative spec pat, evaluated in a
+// workspace directory, names a path above the working directory.
+func outsideWorkspace(fsys fs.FS, pat string) bool {
+	w, ok := fsys.(workspaceFS)
+	if !ok || filepath.IsAbs(w.dir) || filepath.IsAbs(filepath.FromSlash(pat)) {
+		return false
+	}
+	return !filepath.IsLocal(filepath.Join(w.dir, filepath.FromSlash(pat)))
+}
+
+// globFS globs pat in fsys. fs.FS can't name parent directories, so a
+// pattern starting with "../" is globbed from the corresponding parent of a
+// workspace directory, and its matches keep the prefix so they name the same
+// files the pattern does.
+func globFS(fsys fs.FS, pat string) ([]string, error) {
+	rest := pat
+	for strings.HasPrefix(rest, "../") {
+		rest = strings.TrimPrefix(rest, "../")
+	}
+	if rest == pat {
+		return doublestar.Glob(fsys, pat)
+	}
+	prefix := pat[:len(pat)-len(rest)]
+	w, ok := fsys.(workspaceFS)
+	if !ok {
+		return nil, fmt.Errorf("pattern reaches above the root")
+	}
+	matches, err := doublestar.Glob(newWorkspaceFS(filepath.Join(w.dir, filepath.FromSlash(prefix))), rest)
+	for i, m := range matches {
+		matches[i] = prefix + m
+	}
+	return matches, err
+}
+
+// walkOutputDir adds every regular file under dir to files and every
+// directory (dir included) to dirs. Anything else, e.g. a symlink, is an
+// error, as it is for globs.
+func walkOutputDir(fsys fs.FS, dir string, files, dirs map[string]struct{}) error {
+	return fs.WalkDir(fsys, dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			dirs[p] = struct{}{}
+		case d.Type().IsRegular():
+			files[p] = struct{}{}
+		default:
+			return fmt.Errorf("non-regular path %q", p)
+		}
+		return nil
+	})
+}
+
+func sortedPaths(set map[string]struct{}) []Path {
+	keys := make([]string, 0, len(set))
+	for k := range set {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
@@ -254,5 +493,5 @@ func ExpandFileSpecsInDir(baseDir string, specs []Path) ([]Path, error) {
 	for i, p := range keys {
 		out[i] = Path(p)
 	}
-	return out, nil
+	return out
 }
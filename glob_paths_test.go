@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
+	"testing/fstest"
 )
 
 var chdirMu sync.Mutex
@@ -165,3 +169,415 @@ func TestExpandFileSpecs(t *testing.T) {
 		}
 	})
 }
+
+func TestExpandFileSpecsSuggestsNearMiss(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "README.md")
+		writeFile(t, "src/util.c")
+		writeFile(t, "src/main.c")
+
+		tests := []struct {
+			spec string
+			want string // "" means no suggestion
+		}{
+			{spec: "src/utils.c", want: `did you mean "src/util.c"?`},
+			{spec: "src/utl.c", want: `did you mean "src/util.c"?`},
+			{spec: "REDME.md", want: `did you mean "README.md"?`},
+			{spec: "src/parser.c"},
+			{spec: "lib/util.c"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.spec, func(t *testing.T) {
+				_, err := ExpandFileSpecs([]Path{Path(tt.spec)})
+				if err == nil || !errors.Is(err, os.ErrNotExist) {
+					t.Fatalf("ExpandFileSpecs err = %v, want a not-exist error", err)
+				}
+				if tt.want == "" {
+					if strings.Contains(err.Error(), "did you mean") {
+						t.Errorf("err = %v, want no suggestion", err)
+					}
+				} else if !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("err = %v, want it to contain %s", err, tt.want)
+				}
+			})
+		}
+	})
+}
+
+func TestExpandFileSpecsAllowEmpty(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "a.txt")
+		writeFile(t, "dir/c.txt")
+
+		tests := []struct {
+			name  string
+			specs []Path
+			// want is the result in both modes unless strictErr is set, in
+			// which case only AllowEmpty succeeds.
+			want      []Path
+			strictErr bool
+		}{
+			{
+				name:  "positive-only-matches",
+				specs: []Path{"*.txt"},
+				want:  []Path{"a.txt"},
+			},
+			{
+				name:      "positive-only-no-matches",
+				specs:     []Path{"*.go"},
+				want:      []Path{},
+				strictErr: true,
+			},
+			{
+				name:  "exclude-only",
+				specs: []Path{"!dir/**"},
+				want:  []Path{},
+			},
+			{
+				name:  "mixed-excludes-everything",
+				specs: []Path{"**/*.txt", "!**/*.txt"},
+				want:  []Path{},
+			},
+			{
+				name:      "mixed-with-empty-positive",
+				specs:     []Path{"a.txt", "gen/**/*.txt", "!dir/**"},
+				want:      []Path{"a.txt"},
+				strictErr: true,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, err := ExpandFileSpecsWithOptions("", tt.specs, ExpandOptions{})
+				if tt.strictErr {
+					if err == nil {
+						t.Errorf("strict: expected error, got %v", got)
+					}
+				} else if err != nil || !slices.Equal(got, tt.want) {
+					t.Errorf("strict: got %v, %v; want %v", got, err, tt.want)
+				}
+
+				got, err = ExpandFileSpecsWithOptions("", tt.specs, ExpandOptions{AllowEmpty: true})
+				if err != nil || !slices.Equal(got, tt.want) {
+					t.Errorf("AllowEmpty: got %v, %v; want %v", got, err, tt.want)
+				}
+				if err == nil && got == nil {
+					t.Errorf("AllowEmpty: got nil slice, want non-nil")
+				}
+			})
+		}
+
+		// Literal paths must exist even with AllowEmpty.
+		if _, err := ExpandFileSpecsWithOptions("", []Path{"missing.txt"}, ExpandOptions{AllowEmpty: true}); err == nil {
+			t.Errorf("AllowEmpty: expected error for missing literal path")
+		}
+	})
+}
+
+func TestExpandFileSpecsFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.txt":             {Data: []byte("x")},
+		"b.md":              {Data: []byte("x")},
+		"dir/c.txt":         {Data: []byte("x")},
+		"node_modules/n.js": {Data: []byte("x")},
+	}
+
+	tests := []struct {
+		name    string
+		specs   []Path
+		want    []Path
+		wantErr bool
+	}{
+		{name: "literal", specs: []Path{"a.txt"}, want: []Path{"a.txt"}},
+		{name: "doublestar", specs: []Path{"**/*.txt"}, want: []Path{"a.txt", "dir/c.txt"}},
+		{name: "exclude-dir", specs: []Path{"**/*", "!node_modules"}, want: []Path{"a.txt", "b.md", "dir/c.txt"}},
+		{name: "exclude-only", specs: []Path{"!dir/**"}, want: []Path{}},
+		{name: "missing-literal", specs: []Path{"missing.txt"}, wantErr: true},
+		{name: "directory-literal", specs: []Path{"dir"}, wantErr: true},
+		{name: "glob-no-matches", specs: []Path{"*.go"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExpandFileSpecsFS(fsys, tt.specs)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil || !slices.Equal(got, tt.want) {
+				t.Fatalf("got %v, %v; want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandFileSpecsOutsideDir(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "shared/x.h")
+		writeFile(t, "pkg/y.c")
+		abs, err := filepath.Abs("shared/x.h")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ExpandFileSpecsInDir("pkg", []Path{"y.c", "../shared/x.h", Path(abs)})
+		if err != nil {
+			t.Fatalf("ExpandFileSpecsInDir: %v", err)
+		}
+		want := []Path{"../shared/x.h", Path(filepath.ToSlash(abs)), "y.c"}
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	})
+}
+
+func TestExpandFileSpecsIgnoreFile(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "a.txt")
+		writeFile(t, "app.log")
+		writeFile(t, "node_modules/dep/index.txt")
+		writeFile(t, "pkg/node_modules/x.txt")
+		writeFile(t, "pkg/b.txt")
+		writeFileContent(t, ignoreFilePath, "node_modules/\n*.log\n")
+
+		tests := []struct {
+			name  string
+			specs []Path
+			want  []Path
+		}{
+			{
+				name:  "nested-ignored",
+				specs: []Path{"**/*"},
+				want:  []Path{".build-tool/ignore", "a.txt", "pkg/b.txt"},
+			},
+			{
+				name:  "re-included-by-glob-into-ignored-dir",
+				specs: []Path{"node_modules/**"},
+				want:  []Path{"node_modules/dep/index.txt"},
+			},
+			{
+				name:  "re-included-by-literal",
+				specs: []Path{"*.txt", "app.log"},
+				want:  []Path{"a.txt", "app.log"},
+			},
+			{
+				name:  "composes-with-negation",
+				specs: []Path{"**/*.txt", "!pkg/**"},
+				want:  []Path{"a.txt"},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, err := ExpandFileSpecs(tt.specs)
+				if err != nil || !slices.Equal(got, tt.want) {
+					t.Fatalf("got %v, %v; want %v", got, err, tt.want)
+				}
+			})
+		}
+	})
+}
+
+func TestExpandOutputSpecsDirectory(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "dist/a.txt")
+		writeFile(t, "dist/sub/b.txt")
+		writeFile(t, "dist/tmp/c.txt")
+		if err := os.MkdirAll(filepath.Join("dist", "sub", "empty"), 0o755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+
+		tests := []struct {
+			name      string
+			specs     []Path
+			wantFiles []Path
+			wantDirs  []Path
+		}{
+			{
+				name:      "whole-tree",
+				specs:     []Path{"dist"},
+				wantFiles: []Path{"dist/a.txt", "dist/sub/b.txt", "dist/tmp/c.txt"},
+				wantDirs:  []Path{"dist", "dist/sub", "dist/sub/empty", "dist/tmp"},
+			},
+			{
+				name:      "negated-subdir",
+				specs:     []Path{"dist/", "!dist/tmp"},
+				wantFiles: []Path{"dist/a.txt", "dist/sub/b.txt"},
+				wantDirs:  []Path{"dist", "dist/sub", "dist/sub/empty"},
+			},
+			{
+				name:      "files-only",
+				specs:     []Path{"dist/*.txt"},
+				wantFiles: []Path{"dist/a.txt"},
+				wantDirs:  []Path{},
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				files, dirs, err := ExpandOutputSpecsInDir("", tt.specs)
+				if err != nil {
+					t.Fatalf("ExpandOutputSpecsInDir: %v", err)
+				}
+				if !slices.Equal(files, tt.wantFiles) {
+					t.Errorf("files = %v, want %v", files, tt.wantFiles)
+				}
+				if !slices.Equal(dirs, tt.wantDirs) {
+					t.Errorf("dirs = %v, want %v", dirs, tt.wantDirs)
+				}
+			})
+		}
+
+		// Inputs keep rejecting directories.
+		if _, err := ExpandFileSpecs([]Path{"dist"}); err == nil {
+			t.Error("ExpandFileSpecs accepted a directory input")
+		}
+	})
+}
+
+func TestExpandFileSpecsWarnNegatedAway(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "src/a.c")
+		writeFile(t, "src/b.c")
+		writeFile(t, "gen/x.c")
+
+		tests := []struct {
+			name  string
+			specs []Path
+			want  []string
+		}{
+			{
+				name:  "all-removed",
+				specs: []Path{"src/*.c", "gen/*.c", "!src/**"},
+				want:  []string{`glob "src/*.c" matched 2 file(s), all removed by later exclusions`},
+			},
+			{
+				name:  "partly-removed",
+				specs: []Path{"src/*.c", "!src/a.c"},
+			},
+			{
+				name:  "literal-removed",
+				specs: []Path{"src/a.c", "!src/a.c"},
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var got []string
+				opts := ExpandOptions{Warn: func(msg string) { got = append(got, msg) }}
+				if _, err := ExpandFileSpecsWithOptions("", tt.specs, opts); err != nil {
+					t.Fatalf("ExpandFileSpecsWithOptions: %v", err)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("warnings = %q, want %q", got, tt.want)
+				}
+			})
+		}
+	})
+}
+
+func TestExpandFileSpecsDetailed(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "src/a.c")
+		writeFile(t, "src/b.c")
+		writeFile(t, "src/gen/x.c")
+
+		tests := []struct {
+			name      string
+			specs     []Path
+			wantFiles []Path
+			want      []SpecExpansion
+		}{
+			{
+				name:      "positive",
+				specs:     []Path{"src/*.c", "src/gen/x.c"},
+				wantFiles: []Path{"src/a.c", "src/b.c", "src/gen/x.c"},
+				want: []SpecExpansion{
+					{Spec: "src/*.c", Matched: []Path{"src/a.c", "src/b.c"}, Kept: 2},
+					{Spec: "src/gen/x.c", Matched: []Path{"src/gen/x.c"}, Kept: 1},
+				},
+			},
+			{
+				name:      "negated",
+				specs:     []Path{"src/**/*.c", "!src/gen", "!src/a.c", "!src/missing.c"},
+				wantFiles: []Path{"src/b.c"},
+				want: []SpecExpansion{
+					{Spec: "src/**/*.c", Matched: []Path{"src/a.c", "src/b.c", "src/gen/x.c"}, Kept: 1},
+					{Spec: "!src/gen", Negated: true, Removed: 1},
+					{Spec: "!src/a.c", Negated: true, Removed: 1},
+					{Spec: "!src/missing.c", Negated: true},
+				},
+			},
+			{
+				name:      "overlapping",
+				specs:     []Path{"src/*.c", "src/a.c", "!src/*.c"},
+				wantFiles: []Path{},
+				want: []SpecExpansion{
+					{Spec: "src/*.c", Matched: []Path{"src/a.c", "src/b.c"}},
+					{Spec: "src/a.c", Matched: []Path{"src/a.c"}},
+					{Spec: "!src/*.c", Negated: true, Removed: 2},
+				},
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				files, details, err := ExpandFileSpecsDetailed(tt.specs)
+				if err != nil {
+					t.Fatalf("ExpandFileSpecsDetailed: %v", err)
+				}
+				if !slices.Equal(files, tt.wantFiles) {
+					t.Errorf("files = %v, want %v", files, tt.wantFiles)
+				}
+				if !slices.EqualFunc(details, tt.want, func(a, b SpecExpansion) bool {
+					return a.Spec == b.Spec && a.Negated == b.Negated && slices.Equal(a.Matched, b.Matched) && a.Kept == b.Kept && a.Removed == b.Removed
+				}) {
+					t.Errorf("details = %+v\nwant %+v", details, tt.want)
+				}
+			})
+		}
+	})
+}
+
+func TestExpandFileSpecsParentDir(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "shared/x.h")
+		writeFile(t, "shared/y.h")
+		writeFile(t, "ws/pkg/main.c")
+		if err := os.Chdir("ws"); err != nil {
+			t.Fatalf("Chdir: %v", err)
+		}
+
+		tests := []struct {
+			name        string
+			baseDir     string
+			specs       []Path
+			allowParent bool
+			want        []Path
+			wantErr     bool
+		}{
+			{name: "literal-rejected", specs: []Path{"../shared/x.h"}, wantErr: true},
+			{name: "glob-rejected", specs: []Path{"../shared/*.h"}, wantErr: true},
+			{name: "literal-allowed", specs: []Path{"../shared/x.h"}, allowParent: true, want: []Path{"../shared/x.h"}},
+			{name: "glob-allowed", specs: []Path{"../shared/*.h", "!../shared/y.h"}, allowParent: true, want: []Path{"../shared/x.h"}},
+			{name: "inside-workspace-from-subdir", baseDir: "pkg", specs: []Path{"../pkg/*.c"}, want: []Path{"../pkg/main.c"}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, err := ExpandFileSpecsWithOptions(tt.baseDir, tt.specs, ExpandOptions{AllowParent: tt.allowParent})
+				if tt.wantErr {
+					if err == nil || !strings.Contains(err.Error(), "-allow-parent-inputs") {
+						t.Fatalf("err = %v, want a pointer to -allow-parent-inputs", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("ExpandFileSpecsWithOptions: %v", err)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			})
+		}
+	})
+}
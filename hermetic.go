@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// fileSnapshot is the observable state of one file in a sandbox work dir.
+// Staged inputs are usually symlinks, so the target is stat'ed to catch
+// writes made through them.
+type fileSnapshot struct {
+	mtimeUnixNano int64
+	size          int64
+	mode          fs.FileMode
+	linkTarget    string
+}
+
+// snapshotDir records every non-directory entry under dir, keyed by
+// slash-separated relative path.
+func snapshotDir(dir string) (map[string]fileSnapshot, error) {
+	return snapshotTree(dir, nil)
+}
+
+// snapshotTree is snapshotDir leaving out the files and directories whose
+// relative paths are in skip.
+func snapshotTree(dir string, skip map[string]bool) (map[string]fileSnapshot, error) {
+	snap := make(map[string]fileSnapshot)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if skip[filepath.ToSlash(rel)] {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		var s fileSnapshot
+		if d.Type()&fs.ModeSymlink != 0 {
+			if s.linkTarget, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		fi, err := os.Stat(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if fi != nil {
+			s.mtimeUnixNano = fi.ModTime().UnixNano()
+			s.size = fi.Size()
+			s.mode = fi.Mode()
+		}
+		snap[filepath.ToSlash(rel)] = s
+		return nil
+	})
+	return snap, err
+}
+
+// hermeticViolation is a file a task wrote without declaring it as an output.
+type hermeticViolation struct {
+	Path string
+	Kind string // "created", "modified" or "deleted"
+}
+
+// undeclaredWrites compares work dir snapshots taken before and after a task
+// ran and returns created or modified files not among outputs.
+//
+// Undeclared reads aren't checked: the sandbox only contains declared inputs
+// and dependency outputs, so relative reads of anything else already fail, and
+// access times are too unreliable (relatime/noatime) to detect the rest.
+func undeclaredWrites(before, after map[string]fileSnapshot, outputs []Path) []hermeticViolation {
+	declared := make(map[string]struct{}, len(outputs))
+	for _, out := range outputs {
+		declared[string(out)] = struct{}{}
+	}
+
+	var violations []hermeticViolation
+	for p, a := range after {
+		if _, ok := declared[p]; ok {
+			continue
+		}
+		b, existed := before[p]
+		switch {
+		case !existed:
+			violations = append(violations, hermeticViolation{Path: p, Kind: "created"})
+		case a != b:
+			violations = append(violations, hermeticViolation{Path: p, Kind: "modified"})
+		}
+	}
+	sort.Slice(violations, func(i, j int) bool { return violations[i].Path < violations[j].Path })
+	return violations
+}
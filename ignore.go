@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// ignoreFilePath is the workspace-level ignore file. Its patterns are applied
+// as implicit exclusions to every glob expansion.
+var ignoreFilePath = filepath.Join(".build-tool", "ignore")
+
+type ignoreRule struct {
+	pattern string // doublestar pattern, anchored at the workspace root
+	negate  bool
+	dirOnly bool
+}
+
+// IgnoreRules is a parsed gitignore-style pattern list:
+//   - blank lines and lines starting with '#' are skipped;
+//   - a leading '!' re-includes paths excluded by an earlier pattern;
+//   - a trailing '/' matches directories only;
+//   - a pattern containing no other '/' matches at any depth, otherwise it is
+//     relative to the workspace root (a leading '/' just anchors it).
+//
+// A path is ignored if it or any of its parent directories matches; the last
+// matching pattern wins.
+type IgnoreRules struct {
+	rules []ignoreRule
+}
+
+func ParseIgnoreRules(data []byte) *IgnoreRules {
+	var r IgnoreRules
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\") {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		if strings.Contains(line, "/") {
+			line = strings.TrimPrefix(line, "/")
+		} else {
+			line = "**/" + line
+		}
+		rule.pattern = line
+		r.rules = append(r.rules, rule)
+	}
+	return &r
+}
+
+// LoadIgnoreRules reads the workspace ignore file. A missing file yields nil
+// rules, which ignore nothing.
+func LoadIgnoreRules(path string) (*IgnoreRules, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseIgnoreRules(data), nil
+}
+
+// Match reports whether the slash-separated relative path p is ignored.
+// isDir says whether p itself is a directory.
+func (r *IgnoreRules) Match(p string, isDir bool) bool {
+	if r == nil || len(r.rules) == 0 {
+		return false
+	}
+	ignored := false
+	for _, rule := range r.rules {
+		if rule.matches(p, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+func (rule ignoreRule) matches(p string, isDir bool) bool {
+	if (isDir || !rule.dirOnly) && matchPattern(rule.pattern, p) {
+		return true
+	}
+	// Matching a parent directory excludes everything beneath it.
+	for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if matchPattern(rule.pattern, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPattern(pattern, p string) bool {
+	ok, err := doublestar.Match(pattern, p)
+	return err == nil && ok
+}
+
+// globLiteralPrefix returns the leading path segments of pat that contain no
+// glob metacharacters.
+func globLiteralPrefix(pat string) string {
+	segs := strings.Split(pat, "/")
+	for i, seg := range segs {
+		if hasGlobMeta(seg) {
+			return strings.Join(segs[:i], "/")
+		}
+	}
+	return pat
+}
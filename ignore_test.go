@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestIgnoreRulesMatch(t *testing.T) {
+	rules := ParseIgnoreRules([]byte(`
+# dependencies
+node_modules/
+*.log
+!keep.log
+/build
+docs/**/*.tmp
+`))
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{path: "node_modules", isDir: true, want: true},
+		{path: "node_modules/a.js", want: true},
+		{path: "pkg/node_modules/deep/b.js", want: true},
+		{path: "node_modules", want: false}, // dir-only pattern, file path
+		{path: "a.log", want: true},
+		{path: "sub/dir/a.log", want: true},
+		{path: "keep.log", want: false},
+		{path: "sub/keep.log", want: false},
+		{path: "build/out.o", want: true},
+		{path: "pkg/build/out.o", want: false}, // anchored at the root
+		{path: "docs/a/b/c.tmp", want: true},
+		{path: "src/c.tmp", want: false},
+		{path: "src/main.go", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := rules.Match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("Match(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+
+	var none *IgnoreRules
+	if none.Match("a.log", false) {
+		t.Errorf("nil rules matched")
+	}
+}
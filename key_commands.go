@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// taskKeyCommand is one of a task's key_commands in its key payload. Output
+// is the digest of the command's stdout, so a long or sensitive output
+// doesn't end up in manifests.
+type taskKeyCommand struct {
+	Command string `json:"command"`
+	Output  string `json:"output"`
+}
+
+// runKeyCommands runs task's key_commands on the host, in the task's
+// directory and environment, and digests what each writes to stdout. They
+// run every time the key is computed, so they must be fast and must not
+// change anything; a failing one fails the key.
+func runKeyCommands(task Task) ([]taskKeyCommand, error) {
+	var out []taskKeyCommand
+	for _, command := range task.KeyCommands {
+		cmd, err := ShellRunner{Shell: task.Shell}.Command(Task{Command: command, Dir: task.Dir, Shell: task.Shell}, "")
+		if err != nil {
+			return nil, err
+		}
+		cmd.Env = taskEnviron(task, nil)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+				return nil, fmt.Errorf("key command %q: %w: %s", command, err, msg)
+			}
+			return nil, fmt.Errorf("key command %q: %w", command, err)
+		}
+		sum := blake2b.Sum256(stdout.Bytes())
+		out = append(out, taskKeyCommand{Command: command, Output: hex.EncodeToString(sum[:])})
+	}
+	return out, nil
+}
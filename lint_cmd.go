@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+)
+
+// LintWarning is one finding of the lint command.
+type LintWarning struct {
+	Task    TaskID
+	Message string
+}
+
+func (w LintWarning) String() string {
+	return fmt.Sprintf("warning: task %s: %s", w.Task, w.Message)
+}
+
+// LintTasks checks taskMap for likely mistakes, given the tasks that are
+// built directly. Warnings are sorted by task ID.
+func LintTasks(taskMap TaskMap, targets []TaskID) ([]LintWarning, error) {
+	for _, id := range targets {
+		if _, ok := taskMap[id]; !ok {
+			return nil, usagef("task %s not found", id)
+		}
+	}
+	return unconsumedOutputs(taskMap, targets), nil
+}
+
+// unconsumedOutputs flags tasks that produce outputs although no task depends
+// on them and they aren't a target: nothing ever reads what they build.
+func unconsumedOutputs(taskMap TaskMap, targets []TaskID) []LintWarning {
+	dependents := make(map[TaskID][]TaskID)
+	for id, task := range taskMap {
+		for _, dep := range task.Dependencies {
+			dependents[dep] = append(dependents[dep], id)
+		}
+	}
+
+	var warnings []LintWarning
+	for _, id := range sortedTaskIDs(taskMap) {
+		if len(taskMap[id].Outputs) == 0 || len(dependents[id]) > 0 || slices.Contains(targets, id) {
+			continue
+		}
+		warnings = append(warnings, LintWarning{
+			Task:    id,
+			Message: "outputs are never consumed: no task depends on it and it isn't a target",
+		})
+	}
+	return warnings
+}
+
+// runLintCommand prints warnings about the config. Targets are the tasks the
+// user builds directly; their outputs count as consumed.
+func runLintCommand(configPath string, args []string) error {
+	fs := flag.NewFlagSet("lint", flag.ContinueOnError)
+	out := reportOutputFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	var targets []TaskID
+	// Accept flags after the targets too, as in "lint app --output lint.txt".
+	for fs.NArg() > 0 {
+		targets = append(targets, TaskID(fs.Arg(0)))
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return withExitCode(exitUsage, err)
+		}
+	}
+
+	taskMap, err := LoadTaskMapFromConfig(configPath)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("load tasks from %q: %w", configPath, err))
+	}
+	warnings, err := LintTasks(taskMap, targets)
+	if err != nil {
+		return err
+	}
+	for _, w := range warnings {
+		fmt.Fprintln(out, w)
+	}
+	return out.Close()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLintUnconsumedOutputs(t *testing.T) {
+	withTempWD(t, func() {
+		configPath := writeConfig(t, `{
+			"tasks": {
+				"gen": {"command": "echo gen > gen.txt", "outputs": ["gen.txt"]},
+				"app": {"command": "cp gen.txt app", "inputs": [":gen"], "outputs": ["app"]},
+				"docs": {"command": "echo docs > docs.html", "outputs": ["docs.html"]},
+				"test": {"command": "true", "cache": false}
+			}
+		}`)
+		taskMap, err := LoadTaskMapFromConfig(configPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name    string
+			targets []TaskID
+			want    []TaskID
+			wantErr bool
+		}{
+			// gen is consumed by app; test produces nothing.
+			{name: "app built", targets: []TaskID{"app"}, want: []TaskID{"docs"}},
+			{name: "app and docs built", targets: []TaskID{"app", "docs"}, want: nil},
+			{name: "no targets", want: []TaskID{"app", "docs"}},
+			{name: "unknown target", targets: []TaskID{"typo"}, wantErr: true},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				warnings, err := LintTasks(taskMap, tt.targets)
+				if tt.wantErr {
+					if exitCode(err) != exitUsage {
+						t.Fatalf("LintTasks err = %v, want usage error", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("LintTasks: %v", err)
+				}
+				var got []TaskID
+				for _, w := range warnings {
+					got = append(got, w.Task)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("warned about %v, want %v", got, tt.want)
+				}
+			})
+		}
+
+		if err := runLintCommand(configPath, []string{"app", "--output", "lint.txt"}); err != nil {
+			t.Fatalf("runLintCommand: %v", err)
+		}
+		data, err := os.ReadFile("lint.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "warning: task docs: outputs are never consumed"; !strings.HasPrefix(string(data), want) {
+			t.Errorf("lint output = %q, want it to start with %q", data, want)
+		}
+	})
+}
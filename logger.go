@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"hash/fnv"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
 	"sync"
 )
 
@@ -13,13 +16,25 @@ type Logger struct {
 	err          io.Writer
 	colorEnabled bool
 	prefixWidth  int
+	taskLogDir   string
 
-	mu sync.Mutex
+	mu       sync.Mutex
+	taskLogs map[TaskID]io.Writer
+	buffered map[TaskID]*lineRing // output held back by BufferTaskOutput
+
+	// Set by GroupTaskLines: each task's lines are held in groups until
+	// every task before it in groupOrder has finished.
+	groupOrder []TaskID
+	groups     map[TaskID]*bytes.Buffer
+	groupDone  map[TaskID]bool
 }
 
 type LoggerOptions struct {
 	ColorEnabled bool
 	PrefixWidth  int
+	// TaskLogDir, if set, is where OpenTaskLog keeps one <task>.log file per
+	// task with a copy of its output lines, for debugging after the build.
+	TaskLogDir string
 }
 
 func NewLogger(out io.Writer, err io.Writer, opts LoggerOptions) *Logger {
@@ -28,9 +43,39 @@ func NewLogger(out io.Writer, err io.Writer, opts LoggerOptions) *Logger {
 		err:          err,
 		colorEnabled: opts.ColorEnabled,
 		prefixWidth:  opts.PrefixWidth,
+		taskLogDir:   opts.TaskLogDir,
+		taskLogs:     make(map[TaskID]io.Writer),
+		buffered:     make(map[TaskID]*lineRing),
 	}
 }
 
+// OpenTaskLog truncates the log file for taskID and tees its task lines into
+// it until the returned close func is called. It does nothing unless
+// LoggerOptions.TaskLogDir is set.
+func (l *Logger) OpenTaskLog(taskID TaskID) (func() error, error) {
+	if l.taskLogDir == "" {
+		return func() error { return nil }, nil
+	}
+	if err := os.MkdirAll(l.taskLogDir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(l.taskLogDir, sanitizeSandboxName(string(taskID))+".log"))
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	l.taskLogs[taskID] = f
+	l.mu.Unlock()
+
+	return func() error {
+		l.mu.Lock()
+		delete(l.taskLogs, taskID)
+		l.mu.Unlock()
+		return f.Close()
+	}, nil
+}
+
 func DetectColorEnabled() bool {
 	fi, err := os.Stdout.Stat()
 	if err != nil {
@@ -57,32 +102,194 @@ func (l *Logger) Taskf(taskID TaskID, format string, args ...any) {
 }
 
 func (l *Logger) TaskLine(taskID TaskID, line string) {
-	prefix := l.taskPrefix(taskID)
+	l.taskLine(taskID, "|", "", line)
+}
+
+// TaskOutput logs a line the task's command printed. Between
+// BufferTaskOutput and EndTaskOutput it is held back instead (log files
+// still get it right away).
+func (l *Logger) TaskOutput(taskID TaskID, line string) {
+	l.mu.Lock()
+	ring, ok := l.buffered[taskID]
+	if ok {
+		ring.add(line)
+		if w, ok := l.taskLogs[taskID]; ok {
+			fmt.Fprintf(w, "%s\n", line)
+		}
+	}
+	l.mu.Unlock()
+	if !ok {
+		l.TaskLine(taskID, line)
+	}
+}
 
+// BufferTaskOutput starts holding back taskID's output lines, keeping only
+// the last tail of them.
+func (l *Logger) BufferTaskOutput(taskID TaskID, tail int) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	l.buffered[taskID] = newLineRing(tail)
+}
+
+// EndTaskOutput stops buffering taskID's output. After a success only a
+// one-line summary is logged; after a failure the lines kept are.
+func (l *Logger) EndTaskOutput(taskID TaskID, failed bool) {
+	l.mu.Lock()
+	ring := l.buffered[taskID]
+	delete(l.buffered, taskID)
+	l.mu.Unlock()
+	if ring == nil {
+		return
+	}
+
+	if !failed {
+		if ring.total > 0 {
+			l.TaskDimf(taskID, "(%d line(s) of output hidden)", ring.total)
+		}
+		return
+	}
+	lines := ring.tail()
+	if n := ring.total - len(lines); n > 0 {
+		l.TaskDimf(taskID, "(%d earlier line(s) of output omitted)", n)
+	}
+	for _, line := range lines {
+		l.TaskLine(taskID, line)
+	}
+}
+
+// lineRing keeps the last max lines added to it and counts all of them, so
+// holding back a chatty task's output takes bounded memory.
+type lineRing struct {
+	max   int
+	lines []string
+	next  int // where the next line goes once lines is full
+	total int
+}
+
+func newLineRing(max int) *lineRing {
+	return &lineRing{max: max}
+}
+
+func (r *lineRing) add(line string) {
+	r.total++
+	switch {
+	case r.max <= 0:
+	case len(r.lines) < r.max:
+		r.lines = append(r.lines, line)
+	default:
+		r.lines[r.next] = line
+		r.next = (r.next + 1) % r.max
+	}
+}
+
+// tail returns the lines kept, oldest first.
+func (r *lineRing) tail() []string {
+	return append(slices.Clone(r.lines[r.next:]), r.lines[:r.next]...)
+}
+
+// GroupTaskLines holds back the lines of the tasks in order and writes each
+// task's lines in one block once it and every task before it have finished
+// (see EndTaskLines), so the log doesn't depend on how tasks interleaved.
+func (l *Logger) GroupTaskLines(order []TaskID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.groupOrder = order
+	l.groups = make(map[TaskID]*bytes.Buffer, len(order))
+	l.groupDone = make(map[TaskID]bool, len(order))
+	for _, id := range order {
+		l.groups[id] = new(bytes.Buffer)
+	}
+}
+
+// EndTaskLines marks taskID finished and writes the held-back blocks that
+// are no longer waiting for an earlier task.
+func (l *Logger) EndTaskLines(taskID TaskID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.groups[taskID]; !ok {
+		return
+	}
+	l.groupDone[taskID] = true
+	for len(l.groupOrder) > 0 && l.groupDone[l.groupOrder[0]] {
+		id := l.groupOrder[0]
+		l.groupOrder = l.groupOrder[1:]
+		l.out.Write(l.groups[id].Bytes())
+		delete(l.groups, id)
+	}
+}
+
+// FlushTaskLines writes every block still held back, in order, and stops
+// grouping, e.g. after a failure left some tasks unstarted.
+func (l *Logger) FlushTaskLines() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range l.groupOrder {
+		if b, ok := l.groups[id]; ok {
+			l.out.Write(b.Bytes())
+		}
+	}
+	l.groupOrder, l.groups, l.groupDone = nil, nil, nil
+}
+
+// TaskCommand echoes the command a task is about to run. The prefix ends in
+// "$" instead of "|" so the echo stands apart from the task's own output,
+// and with color the command is bold.
+func (l *Logger) TaskCommand(taskID TaskID, command string) {
+	l.taskLine(taskID, "$", ansiBold, command)
+}
+
+// TaskDimf logs a task line of little interest, like a cache hit, dimmed
+// when color is enabled.
+func (l *Logger) TaskDimf(taskID TaskID, format string, args ...any) {
+	l.taskLine(taskID, "|", ansiDim, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) taskLine(taskID TaskID, sep, style, line string) {
+	prefix := l.taskPrefix(taskID, sep)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w, ok := l.taskLogs[taskID]; ok {
+		// Log files have no prefix, so keep any marker on the line itself.
+		if sep != "|" {
+			fmt.Fprintf(w, "%s %s\n", sep, line)
+		} else {
+			fmt.Fprintf(w, "%s\n", line)
+		}
+	}
+	out := l.out
+	if b, ok := l.groups[taskID]; ok {
+		out = b
+	}
 	if line == "" {
-		fmt.Fprintf(l.out, "%s\n", prefix)
+		fmt.Fprintf(out, "%s\n", prefix)
 		return
 	}
-	fmt.Fprintf(l.out, "%s %s\n", prefix, line)
+	if l.colorEnabled && style != "" {
+		line = style + line + ansiReset
+	}
+	fmt.Fprintf(out, "%s %s\n", prefix, line)
 }
 
-func (l *Logger) taskPrefix(taskID TaskID) string {
+func (l *Logger) taskPrefix(taskID TaskID, sep string) string {
 	name := string(taskID)
 	if l.prefixWidth > 0 {
 		name = fmt.Sprintf("%-*s", l.prefixWidth, name)
 	}
 
 	if !l.colorEnabled {
-		return fmt.Sprintf("%s |", name)
+		return fmt.Sprintf("%s %s", name, sep)
 	}
 
 	color := ansiColorForTask(taskID)
-	return fmt.Sprintf("%s%s |%s", color, name, ansiReset)
+	return fmt.Sprintf("%s%s %s%s", color, name, sep, ansiReset)
 }
 
-const ansiReset = "\x1b[0m"
+const (
+	ansiReset = "\x1b[0m"
+	ansiBold  = "\x1b[1m"
+	ansiDim   = "\x1b[2m"
+)
 
 func ansiColorForTask(taskID TaskID) string {
 	// A small set of high-contrast colors that work on light/dark terminals.
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTaskLogFiles(t *testing.T) {
+	withTempWD(t, func() {
+		logDir := filepath.Join(".build-tool", "logs")
+		writeFileContent(t, filepath.Join(logDir, "pkg_lib.log"), "stale output from an earlier run\n")
+
+		log := NewLogger(io.Discard, io.Discard, LoggerOptions{TaskLogDir: logDir})
+		closeLib, err := log.OpenTaskLog("pkg/lib")
+		if err != nil {
+			t.Fatalf("OpenTaskLog: %v", err)
+		}
+		closeApp, err := log.OpenTaskLog("app")
+		if err != nil {
+			t.Fatalf("OpenTaskLog: %v", err)
+		}
+		log.TaskLine("pkg/lib", "compiling lib")
+		log.TaskLine("app", "compiling app")
+		log.TaskLine("other", "not logged to a file")
+		if err := closeLib(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		log.TaskLine("pkg/lib", "after close")
+		if err := closeApp(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+
+		tests := []struct {
+			file string
+			want string
+		}{
+			{file: "pkg_lib.log", want: "compiling lib\n"},
+			{file: "app.log", want: "compiling app\n"},
+		}
+		for _, tt := range tests {
+			got, err := os.ReadFile(filepath.Join(logDir, tt.file))
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("%s = %q, want %q", tt.file, got, tt.want)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(logDir, "other.log")); !os.IsNotExist(err) {
+			t.Errorf("other.log exists without OpenTaskLog: %v", err)
+		}
+	})
+}
+
+func TestTaskCommandAndDimLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		color bool
+		want  string
+	}{
+		{
+			name: "no-color",
+			want: "app | output\n" +
+				"app $ make all\n" +
+				"app | CACHE HIT\n",
+		},
+		{
+			name:  "color",
+			color: true,
+			want: ansiColorForTask("app") + "app |" + ansiReset + " output\n" +
+				ansiColorForTask("app") + "app $" + ansiReset + " " + ansiBold + "make all" + ansiReset + "\n" +
+				ansiColorForTask("app") + "app |" + ansiReset + " " + ansiDim + "CACHE HIT" + ansiReset + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			log := NewLogger(&out, io.Discard, LoggerOptions{ColorEnabled: tt.color})
+			log.TaskLine("app", "output")
+			log.TaskCommand("app", "make all")
+			log.TaskDimf("app", "CACHE %s", "HIT")
+			if got := out.String(); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBufferTaskOutputKeepsTail(t *testing.T) {
+	var out bytes.Buffer
+	log := NewLogger(&out, io.Discard, LoggerOptions{})
+	log.BufferTaskOutput("app", 2)
+	for _, line := range []string{"one", "two", "three", "four", "five"} {
+		log.TaskOutput("app", line)
+	}
+	if n := len(log.buffered["app"].lines); n != 2 {
+		t.Errorf("buffer holds %d lines, want only the last 2", n)
+	}
+	log.EndTaskOutput("app", true)
+	want := "app | (3 earlier line(s) of output omitted)\napp | four\napp | five\n"
+	if got := out.String(); got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+
+	out.Reset()
+	log.BufferTaskOutput("app", 2)
+	for range 5 {
+		log.TaskOutput("app", "line")
+	}
+	log.EndTaskOutput("app", false)
+	if got, want := out.String(), "app | (5 line(s) of output hidden)\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
@@ -5,18 +5,42 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
 )
 
 type TaskID string
 type Path string
 
 type Task struct {
-	ID           TaskID
-	Inputs       []Path
-	Outputs      []Path
-	Dependencies []TaskID
-	Command      string
-	Cache        bool // default: true
+	ID              TaskID
+	Inputs          []Path
+	Outputs         []Path
+	Dependencies    []TaskID
+	Command         string
+	Cache           bool      // default: true
+	CacheMode       CacheMode // narrows Cache to restore-only or store-only; "" is readwrite
+	CacheSalt       string    // folded into the task key to invalidate it by hand
+	Image           string    // optional container image; runs the command via docker
+	Shell           string    // shell for the command; default "sh"
+	Env             map[string]string
+	EnvKeys         []string          // variables whose values are part of the task key
+	SecretEnv       map[string]string // variable -> file holding its value; not part of the key
+	FailFast        bool              // run the command with `set -e`
+	Dir             string            // slash-separated dir the command runs in, relative to the workspace root
+	Sandbox         bool              // default: true; false runs the task in the workspace even under -sandbox
+	AllowFailure    bool              // a failure is reported but doesn't fail the build
+	IgnoreExitCodes []int             // non-zero exit codes that count as success
+	Idempotent      bool              // no outputs; skipped while its key is unchanged
+	SerialDeps      bool              // run Dependencies one at a time, in declared order
+	OutputNormalize string            // filter outputs go through before dependents key on them
+	Pool            string            // concurrency pool the task takes a slot of; "" for none
+	KeyCommands     []string          // commands whose stdout is part of the task key
+	WriteIfChanged  bool              // leave outputs whose workspace copy is already identical untouched
+	ExpectOutputs   map[Path]string   // output -> SHA-256 the task must produce; nil for no check
+	RoutedDeps      []TaskID          // indirect dependencies inputs were routed to; a sandbox stages their outputs too
 }
 
 type TaskMap map[TaskID]Task
@@ -32,33 +56,250 @@ func NewTaskMap(tasks []Task) TaskMap {
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
 
 func run() error {
 	configPath := flag.String("config", "build-tool.jsonc", "path to build tool config (JSONC)")
+	profile := flag.String("profile", "", "load the config for this profile instead, e.g. \"ci\" selects build-tool.ci.jsonc next to -config")
+	cacheDir := flag.String("cache-dir", filepath.Join(".build-tool", "cache"), "writable cache directory")
+	baseCacheDir := flag.String("base-cache-dir", "", "read-only cache consulted before -cache-dir; new entries are never written to it")
 	sandbox := flag.Bool("sandbox", false, "run tasks in a sandbox directory under .build-tool")
+	sandboxStageMode := flag.String("sandbox-stage-mode", string(StageSymlink), "how to place inputs in sandboxes: symlink, hardlink (looks like a real file; editing it in place edits the original) or copy")
+	sandboxDir := flag.String("sandbox-dir", envOr("BUILD_TOOL_SANDBOX_DIR", defaultSandboxDir), "directory to create sandboxes in, e.g. on a tmpfs (env BUILD_TOOL_SANDBOX_DIR)")
+	cacheMaxBytes := flag.Int64("cache-max-bytes-per-build", 0, "stop caching outputs once this many bytes were stored in one build (0 = unlimited)")
+	cachePackBelow := flag.Int64("cache-pack-below", 0, "store outputs smaller than this many bytes in one pack file per cache entry, saving inodes (0 = off)")
+	checkWrites := flag.Bool("check-writes", false, "fail tasks run outside the sandbox that change workspace files outside their declared outputs; with -jobs above 1, outside any task's outputs (compares the file tree before and after each run)")
+	checkHermetic := flag.Bool("check-hermetic", false, "report files sandboxed tasks write without declaring them as outputs (requires -sandbox)")
+	strict := flag.Bool("strict", false, "turn consistency warnings into failures (undeclared outputs under -check-hermetic, cache entries whose stored command differs)")
+	verbose := flag.Bool("verbose", false, "log extra diagnostics, e.g. input globs whose matches were all excluded")
+	explain := flag.Bool("explain", false, "log each task's cache decision (key, cache layers, hashed vs stamped inputs)")
+	requireCacheable := flag.Bool("require-cacheable", false, "refuse to build if any needed task can't be restored from the cache (cache disabled, or no outputs and not idempotent)")
+	dumpKeyPayload := flag.String("dump-key-payload", "", "write the payload hashed into each task's key to <dir>/<task>.json, to diff keys across machines")
+	traceInputs := flag.Bool("trace-inputs", false, "log every input file hashed into each task's key, with its digest and whether it came from the stamp cache")
+	continueRun := flag.Bool("continue", false, "skip tasks that succeeded in the previous (failed) run with unchanged keys")
+	shell := flag.String("shell", "sh", "shell that runs task commands as \"<shell> -c\" (container tasks always use sh)")
+	jobs := flag.Int("jobs", 0, "maximum number of tasks to run in parallel (0 = number of CPUs)")
+	remoteCache := flag.String("remote-cache", "", "base URL of an HTTP remote cache to fetch missing entries from and upload new ones to")
+	strictOutputs := flag.Bool("strict-outputs", false, "warn when outputs restored from the cache differ from what the output globs match")
+	recordEnv := flag.String("record-env", "", "write PATH, LANG, LC_* and the tasks' env_keys from the environment tasks inherit to this JSON file, for -replay-env")
+	var recordEnvVars stringsFlag
+	flag.Var(&recordEnvVars, "record-env-var", "also record this variable with -record-env (repeatable); secret_env names are never recorded")
+	replayEnv := flag.String("replay-env", "", "run with exactly the environment recorded in this -record-env file instead of the current one")
+	printOrder := flag.Bool("print-order", false, "before running, log the planned tasks grouped into layers that can run in parallel")
+	criticalPath := flag.Bool("critical-path", false, "report the chain of dependencies with the longest total duration in the summary")
+	resultsFile := flag.String("results-file", "", "also write the end-of-build summary (cache bytes per task, savings, failures) as JSON to this file")
+	offline := flag.Bool("offline", envBool("BUILD_TOOL_OFFLINE"), "use only the local cache, ignoring -remote-cache and -base-cache-dir (env BUILD_TOOL_OFFLINE)")
+	cpuProfile := flag.String("cpuprofile", "", "write a CPU profile of the build tool to this file")
+	memProfile := flag.String("memprofile", "", "write a heap profile of the build tool to this file on exit")
+	outDir := flag.String("out-dir", "", "after a successful build, copy the requested tasks' outputs into this directory")
+	logDir := flag.String("log-dir", "", "also write each task's output to <dir>/<task>.log, truncated when the task runs (e.g. .build-tool/logs)")
+	sampleLargeInputs := flag.Int64("sample-large-inputs", 0, "UNSAFE: digest inputs larger than this many bytes from their size and first and last MiB only, missing edits in between (0 = always hash whole files)")
+	normalizeEOL := flag.String("normalize-eol", "", "comma-separated extensions of text inputs to hash with CRLF line endings read as LF, e.g. \".c,.h\" (binary files are hashed as is)")
+	buildTimeout := flag.Duration("build-timeout", 0, "kill running tasks and fail with exit code 5 if the build takes longer than this, e.g. 30m (0 = no limit)")
+	deterministic := flag.Bool("deterministic", false, "start ready tasks in name order and print each task's output in one block, in an order fixed up front, so identical builds log identical output")
+	warnKeyCollisions := flag.Bool("warn-key-collisions", false, "warn when two tasks compute the same key in one build and so share a cache entry")
+	namespaceByID := flag.Bool("namespace-by-id", false, "fold each task's ID into its key, so tasks with identical commands and inputs never share a cache entry")
+	printVersion := flag.Bool("version", false, "print the tool's version and build info and exit")
+	keyToolVersion := flag.Bool("key-includes-tool-version", false, "fold the tool's version and binary checksum into every task key (upgrading the tool then invalidates all cache entries)")
+	allowParent := flag.Bool("allow-parent-inputs", false, "accept inputs above the working directory, e.g. \"../shared/*.h\"")
+	var onlyOutputs stringsFlag
+	flag.Var(&onlyOutputs, "only-outputs", "on a cache hit of a requested task, restore only its outputs matching this glob or under this directory (repeatable)")
+	var skip stringsFlag
+	flag.Var(&skip, "skip", "leave this task and the dependencies only it needs out of the build (repeatable); a task that still runs may not depend on it")
+	depsOnly := flag.Bool("deps-only", false, "build: build the targets' dependencies and restore their outputs, but don't run the targets themselves")
+	since := flag.String("since", "", "only build targets with an input modified after this RFC 3339 time or file's mtime (a heuristic; see TargetsChangedSince)")
+	var refresh stringsFlag
+	flag.Var(&refresh, "refresh", "run this task instead of restoring it from the cache and store the new result (repeatable); other tasks stay cached")
+	cacheMode := flag.String("cache-mode", string(CacheReadWrite), "cache use for every task: read (restore, never store), readwrite, write (always run, then store) or off; narrows each task's own cache setting")
+	allowlistPath := flag.String("command-allowlist", "", "file listing the executables tasks may run, one per line; other commands are refused (for untrusted configs)")
+	maxOutputLines := flag.Int("max-task-output-lines", 0, "hide task output unless the task fails, then show its last N lines (0 = stream all output live)")
+	cacheFailures := flag.Bool("cache-failures", false, "record failing commands' exit code and output in the cache and replay them while the task key is unchanged (a flaky failure sticks until an input changes)")
+	mergeStderr := flag.Bool("merge-stderr", false, "merge each task's stderr into its stdout so lines keep their original order")
+	stampMode := flag.String("stamp-mode", string(StampFull), "how to tell whether an input changed: mtime (mtime and size only, fastest), full (all file metadata) or content (always hash)")
+	restoreMode := flag.String("restore-mode", string(RestoreHardlink), "how to restore cached outputs: hardlink (fast; links outputs produced read-only to their read-only blobs and copies the rest, and an entry edited through a link is evicted) or copy")
+	verifyCache := flag.Bool("verify-cache", false, "check that a cache entry's stored outputs match its manifest and digests before restoring; corrupt entries are evicted and rerun")
+	stampVerify := flag.Bool("stamp-verify", false, "re-hash recently modified or small files on a stamp cache hit (guards against clock skew)")
 	flag.Parse()
 
+	if *printVersion || flag.Arg(0) == "version" {
+		writeVersion(os.Stdout)
+		return nil
+	}
+
+	// Path flags are relative to where the tool was started, which needn't
+	// be the workspace root it runs in (see enterWorkspace).
+	if err := absPathFlags(flag.CommandLine, "cache-dir", "base-cache-dir", "sandbox-dir", "out-dir", "log-dir", "results-file", "command-allowlist", "memprofile"); err != nil {
+		return usagef("%v", err)
+	}
+
+	stopProfiling, err := startProfiling(*cpuProfile, *memProfile)
+	if err != nil {
+		return withExitCode(exitInternal, err)
+	}
+	defer func() {
+		if err := stopProfiling(); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing profile: %v\n", err)
+		}
+	}()
+
+	allowParentInputs = *allowParent
+
+	configGiven := false
+	flag.Visit(func(f *flag.Flag) { configGiven = configGiven || f.Name == "config" })
+	if !configGiven {
+		p, err := findConfigUpward(*configPath)
+		if err != nil {
+			return withExitCode(exitInternal, fmt.Errorf("find %s: %w", *configPath, err))
+		}
+		*configPath = p
+	}
+
+	if *profile != "" {
+		p, err := ProfileConfigPath(*configPath, *profile)
+		if err != nil {
+			return withExitCode(exitUsage, err)
+		}
+		*configPath = p
+	}
+
+	if *configPath, err = enterWorkspace(*configPath); err != nil {
+		return withExitCode(exitInternal, err)
+	}
+
+	settings, err := LoadSettings(*configPath)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("load settings from %q: %w", *configPath, err))
+	}
+	if err := applySettings(flag.CommandLine, settings); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+
+	globalCacheMode, err := ParseCacheMode(*cacheMode)
+	if err != nil {
+		return usagef("-cache-mode: %v", err)
+	}
+
+	var onlyOutputPaths []Path
+	for _, pat := range onlyOutputs {
+		if !doublestar.ValidatePattern(pat) {
+			return usagef("-only-outputs: invalid glob %q", pat)
+		}
+		onlyOutputPaths = append(onlyOutputPaths, Path(pat))
+	}
+
+	eolExts, err := parseEOLExtensions(*normalizeEOL)
+	if err != nil {
+		return usagef("-normalize-eol: %v", err)
+	}
+
+	globalStampMode, err := ParseStampMode(*stampMode)
+	if err != nil {
+		return usagef("-stamp-mode: %v", err)
+	}
+	globalRestoreMode, err := ParseRestoreMode(*restoreMode)
+	if err != nil {
+		return usagef("-restore-mode: %v", err)
+	}
+	stageMode, err := ParseSandboxStageMode(*sandboxStageMode)
+	if err != nil {
+		return usagef("-sandbox-stage-mode: %v", err)
+	}
+
+	var allowlist CommandAllowlist
+	if *allowlistPath != "" {
+		if allowlist, err = LoadCommandAllowlist(*allowlistPath); err != nil {
+			return usagef("-command-allowlist: %v", err)
+		}
+	}
+
+	if *checkHermetic && !*sandbox {
+		return usagef("-check-hermetic requires -sandbox")
+	}
+
 	args := flag.Args()
 	if len(args) == 0 {
 		fmt.Printf("Usage: %s [-config build-tool.jsonc] build <task1> <task2> ...\n", os.Args[0])
+		fmt.Printf("       %s run <task>\n", os.Args[0])
 		fmt.Printf("       %s clean\n", os.Args[0])
-		return fmt.Errorf("no tasks specified")
+		fmt.Printf("       %s version\n", os.Args[0])
+		fmt.Printf("       %s cache stats [--json] [--output file]\n", os.Args[0])
+		fmt.Printf("       %s cache inspect [--json] [--output file] (<taskKey> | --task <id>)\n", os.Args[0])
+		fmt.Printf("       %s cache warm <task>...\n", os.Args[0])
+		fmt.Printf("       %s cache restore (<taskKey> | --tag <name>) --dest <dir>\n", os.Args[0])
+		fmt.Printf("       %s cache tag <taskKey> <name>\n", os.Args[0])
+		fmt.Printf("       %s diff-outputs [--output file] <task>\n", os.Args[0])
+		fmt.Printf("       %s deps [--transitive] [--files] [--json] [--output file] <task>\n", os.Args[0])
+		fmt.Printf("       %s lint [--output file] [target...]\n", os.Args[0])
+		fmt.Printf("       %s fmt [--check]\n", os.Args[0])
+		fmt.Printf("       %s export [-o file]\n", os.Args[0])
+		fmt.Printf("       %s add-task [-input path]... [-output path]... [-no-cache] <task> <command>\n", os.Args[0])
+		fmt.Printf("       %s doctor\n", os.Args[0])
+		return usagef("no tasks specified")
 	}
 
 	if args[0] == "clean" {
 		if err := os.RemoveAll(".build-tool"); err != nil {
-			return fmt.Errorf("remove .build-tool: %w", err)
+			return withExitCode(exitInternal, fmt.Errorf("remove .build-tool: %w", err))
 		}
 		fmt.Printf("Removed .build-tool\n")
 		return nil
 	}
 
+	cacheRoot := *cacheDir
+
+	// Commands that compute task keys without building.
+	keyOpts := keyOptions(*keyToolVersion)
+	keyOpts.SampleLargeInputs = *sampleLargeInputs
+	keyOpts.NormalizeEOL = eolExts
+	keyOpts.NamespaceByID = *namespaceByID
+	if keyOpts.Ignore, err = LoadIgnoreRules(ignoreFilePath); err != nil {
+		return withExitCode(exitInternal, fmt.Errorf("load ignore file: %w", err))
+	}
+	stampOpts := StampCacheOptions{Verify: *stampVerify, Mode: globalStampMode}
+
+	switch args[0] {
+	case "cache":
+		return runCacheCommand(cacheRoot, *configPath, keyOpts, stampOpts, args[1:])
+	case "diff-outputs":
+		return runDiffOutputsCommand(cacheRoot, *configPath, keyOpts, stampOpts, args[1:])
+	case "deps":
+		return runDepsCommand(*configPath, args[1:])
+	case "fmt":
+		return runFmtCommand(*configPath, args[1:])
+	case "lint":
+		return runLintCommand(*configPath, args[1:])
+	case "export":
+		return runExportCommand(*configPath, args[1:])
+	case "add-task":
+		return runAddTaskCommand(*configPath, args[1:])
+	case "doctor":
+		return runDoctorCommand(doctorOptions{ConfigPath: *configPath, CacheDir: cacheRoot, SandboxDir: *sandboxDir, Shell: *shell}, args[1:])
+	}
+
+	// Both apply before anything reads the environment for tasks; a replayed
+	// environment is what gets recorded if both are given. Recording needs
+	// the config for env_keys and secret_env names.
+	if *replayEnv != "" {
+		if err := ReplayEnv(invocationPath(*replayEnv)); err != nil {
+			return withExitCode(exitUsage, fmt.Errorf("-replay-env: %w", err))
+		}
+	}
+
 	taskMap, err := LoadTaskMapFromConfig(*configPath)
 	if err != nil {
-		return fmt.Errorf("load tasks from %q: %w", *configPath, err)
+		return withExitCode(exitUsage, fmt.Errorf("load tasks from %q: %w", *configPath, err))
+	}
+	if *recordEnv != "" {
+		if err := RecordEnv(invocationPath(*recordEnv), taskMap, recordEnvVars); err != nil {
+			return withExitCode(exitInternal, fmt.Errorf("-record-env: %w", err))
+		}
+	}
+	setTaskShell(taskMap, *shell)
+	pools, err := LoadPools(*configPath)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("load pools from %q: %w", *configPath, err))
 	}
 
 	maxTaskIDLen := 0
@@ -67,10 +308,65 @@ func run() error {
 			maxTaskIDLen = n
 		}
 	}
-	log := NewLogger(os.Stdout, os.Stderr, LoggerOptions{ColorEnabled: DetectColorEnabled(), PrefixWidth: maxTaskIDLen})
+	log := NewLogger(os.Stdout, os.Stderr, LoggerOptions{ColorEnabled: DetectColorEnabled(), PrefixWidth: maxTaskIDLen, TaskLogDir: *logDir})
 	log.Printf("Loaded %d tasks from %s\n", len(taskMap), *configPath)
 
-	executor := NewTaskExecutor(".build-tool/cache", filepath.Join(".build-tool", "cache", "stamps.json"), log, *sandbox)
+	stampCachePath := filepath.Join(cacheRoot, "stamps.json")
+
+	// Fail before running anything rather than mid-build inside a task.
+	if err := checkWritableDir(cacheRoot); err != nil {
+		return withExitCode(exitInternal, fmt.Errorf("cache dir %s is not writable: %w", cacheRoot, err))
+	}
+	if *sandbox {
+		if err := checkWritableDir(*sandboxDir); err != nil {
+			return withExitCode(exitInternal, fmt.Errorf("sandbox dir %s is not writable: %w", *sandboxDir, err))
+		}
+	}
+
+	executor := NewTaskExecutor(cacheRoot, stampCachePath, log, TaskExecutorOptions{
+		Sandbox:                *sandbox,
+		SandboxDir:             *sandboxDir,
+		SandboxStageMode:       stageMode,
+		Jobs:                   *jobs,
+		Pools:                  pools,
+		StampVerify:            *stampVerify,
+		RestoreMode:            globalRestoreMode,
+		VerifyCache:            *verifyCache,
+		StampMode:              globalStampMode,
+		CacheMaxBytesPerBuild:  *cacheMaxBytes,
+		CachePackBelow:         *cachePackBelow,
+		CheckHermetic:          *checkHermetic,
+		CheckWrites:            *checkWrites,
+		Strict:                 *strict,
+		Explain:                *explain,
+		TraceInputs:            *traceInputs,
+		DumpKeyPayloadDir:      invocationPath(*dumpKeyPayload),
+		RequireCacheable:       *requireCacheable,
+		WarnKeyCollisions:      *warnKeyCollisions,
+		Deterministic:          *deterministic,
+		BuildTimeout:           *buildTimeout,
+		NamespaceByID:          *namespaceByID,
+		Verbose:                *verbose,
+		JournalPath:            filepath.Join(".build-tool", "last-run.json"),
+		Continue:               *continueRun,
+		RemoteCache:            *remoteCache,
+		Offline:                *offline,
+		CriticalPath:           *criticalPath,
+		PrintOrder:             *printOrder,
+		StrictOutputs:          *strictOutputs,
+		BaseCacheDir:           *baseCacheDir,
+		KeyIncludesToolVersion: *keyToolVersion,
+		SampleLargeInputs:      *sampleLargeInputs,
+		NormalizeEOL:           eolExts,
+		Skip:                   flagTaskIDs(skip),
+		Refresh:                flagTaskIDs(refresh),
+		OnlyOutputs:            onlyOutputPaths,
+		CacheMode:              globalCacheMode,
+		CommandAllowlist:       allowlist,
+		MergeStderr:            *mergeStderr,
+		MaxTaskOutputLines:     *maxOutputLines,
+		CacheFailures:          *cacheFailures,
+	})
 	defer func() {
 		if err := executor.CleanupSandbox(); err != nil {
 			log.Errorf("error cleaning sandbox: %v\n", err)
@@ -78,27 +374,88 @@ func run() error {
 	}()
 
 	if err := executor.Load(); err != nil {
-		return fmt.Errorf("load stamp cache: %w", err)
+		return withExitCode(exitInternal, fmt.Errorf("load build state: %w", err))
 	}
 	defer func() {
 		if err := executor.Save(); err != nil {
-			log.Errorf("error saving stamp cache: %v\n", err)
+			log.Errorf("error saving build state: %v\n", err)
 		}
 	}()
 
 	switch args[0] {
 	case "build":
-		taskIDs := make([]TaskID, len(args)-1)
-		for i, arg := range args[1:] {
-			taskIDs[i] = TaskID(arg)
+		taskIDs, err := expandTargets(taskMap, args[1:])
+		if err != nil {
+			return err
+		}
+		if *since != "" {
+			ref, err := parseSince(*since)
+			if err != nil {
+				return err
+			}
+			changed, err := TargetsChangedSince(taskMap, taskIDs, ref)
+			if err != nil {
+				return err
+			}
+			for _, id := range taskIDs {
+				if !slices.Contains(changed, id) {
+					log.Printf("%s: no input changed since %s, not building\n", id, ref.Format(time.RFC3339))
+				}
+			}
+			taskIDs = changed
+		}
+		if *depsOnly {
+			if taskIDs, err = targetDependencies(taskMap, taskIDs); err != nil {
+				return err
+			}
 		}
 
-		if err := executor.ExecuteTasks(taskMap, taskIDs); err != nil {
+		err = executor.ExecuteTasks(taskMap, taskIDs)
+		if err == nil && *outDir != "" {
+			err = executor.CollectOutputs(taskMap, taskIDs, *outDir)
+		}
+		summary := executor.Summary()
+		summary.Print(log)
+		if *resultsFile != "" {
+			if rerr := summary.WriteResults(*resultsFile, err); rerr != nil {
+				log.Errorf("error writing results file: %v\n", rerr)
+			}
+		}
+		if jerr := executor.FinishRun(err == nil); jerr != nil {
+			log.Errorf("error updating run journal: %v\n", jerr)
+		}
+		if err != nil {
+			return err
+		}
+	case "run":
+		if len(args) != 2 {
+			return usagef("usage: run <task>")
+		}
+		err := executor.RunTask(taskMap, TaskID(args[1]))
+		summary := executor.Summary()
+		summary.Print(log)
+		if *resultsFile != "" {
+			if rerr := summary.WriteResults(*resultsFile, err); rerr != nil {
+				log.Errorf("error writing results file: %v\n", rerr)
+			}
+		}
+		if jerr := executor.FinishRun(err == nil); jerr != nil {
+			log.Errorf("error updating run journal: %v\n", jerr)
+		}
+		if err != nil {
 			return err
 		}
 	default:
-		return fmt.Errorf("unknown command %q", args[0])
+		return usagef("unknown command %q", args[0])
 	}
 
 	return nil
 }
+
+func flagTaskIDs(ids stringsFlag) []TaskID {
+	out := make([]TaskID, len(ids))
+	for i, id := range ids {
+		out[i] = TaskID(id)
+	}
+	return out
+}
@@ -0,0 +1,19 @@
+package main
+
+import "time"
+
+// Observer receives task lifecycle events, for embedding the executor (e.g.
+// to drive a custom UI) without scraping its log. Callbacks run on worker
+// goroutines, concurrently for tasks running in parallel, and must not block
+// for long.
+type Observer interface {
+	// OnTaskStart is called before a task's key is computed.
+	OnTaskStart(id TaskID)
+	// OnTaskCacheHit is called when a task's outputs come from the cache
+	// instead of running it. OnTaskFinish follows.
+	OnTaskCacheHit(id TaskID)
+	// OnTaskFinish is called when a task is done, with the error it failed
+	// with, if any. allow_failure tasks report theirs too, although their
+	// failure doesn't fail the build.
+	OnTaskFinish(id TaskID, err error, d time.Duration)
+}
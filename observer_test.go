@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(event string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, event)
+}
+
+func (o *recordingObserver) OnTaskStart(id TaskID)    { o.record("start " + string(id)) }
+func (o *recordingObserver) OnTaskCacheHit(id TaskID) { o.record("hit " + string(id)) }
+func (o *recordingObserver) OnTaskFinish(id TaskID, err error, d time.Duration) {
+	o.record(fmt.Sprintf("finish %s err=%v", id, err != nil))
+}
+
+func TestObserverEvents(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			{ID: "gen", Outputs: []Path{"gen.txt"}, Command: "echo gen > gen.txt", Cache: true},
+			{ID: "use", Dependencies: []TaskID{"gen"}, Outputs: []Path{"use.txt"}, Command: "cat gen.txt > use.txt", Cache: true},
+			{ID: "lint", Dependencies: []TaskID{"use"}, Command: "exit 1", AllowFailure: true},
+		})
+
+		tests := []struct {
+			name string
+			want []string
+		}{
+			{
+				name: "cold",
+				want: []string{"start gen", "finish gen err=false", "start use", "finish use err=false", "start lint", "finish lint err=true"},
+			},
+			{
+				name: "warm",
+				want: []string{"start gen", "hit gen", "finish gen err=false", "start use", "hit use", "finish use err=false", "start lint", "finish lint err=true"},
+			},
+		}
+		for _, tt := range tests {
+			obs := &recordingObserver{}
+			build(t, taskMap, TaskExecutorOptions{Observer: obs}, "lint")
+			if !slices.Equal(obs.events, tt.want) {
+				t.Errorf("%s build events = %q, want %q", tt.name, obs.events, tt.want)
+			}
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"golang.org/x/crypto/blake2b"
+)
+
+// normalizedDigestPrefix marks digests made by hashFileNormalized, and the
+// dependency keys made from them (normalizedDepKey).
+const normalizedDigestPrefix = "norm:"
+
+// normalizedDepKey is what dependents of task, which has output_normalize,
+// chain instead of its task key: a digest of outputs (relative to dir) as
+// the filter prints them. Runs whose outputs differ only in what the filter
+// strips, e.g. after an input change that doesn't matter, give the same
+// key, so dependents stay cache hits.
+func normalizedDepKey(task Task, dir string, outputs []Path) (string, error) {
+	hasher, err := blake2b.New256(nil)
+	if err != nil {
+		return "", err
+	}
+	for _, out := range slices.Sorted(slices.Values(outputs)) {
+		d, err := hashFileNormalized(filepath.Join(dir, filepath.FromSlash(string(out))), task.OutputNormalize)
+		if err != nil {
+			return "", fmt.Errorf("normalize output %s: %w", out, err)
+		}
+		fmt.Fprintf(hasher, "%s\x00%s\x00", out, d)
+	}
+	return normalizedDigestPrefix + hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// specsMatch reports whether the file p is selected by specs, applied in
+// order as by ExpandFileSpecs: a later negation removes what an earlier
+// spec matched. A spec naming a directory matches the files under it.
+func specsMatch(specs []Path, p Path) bool {
+	matched := false
+	for _, spec := range specs {
+		pat, neg, err := parseSpec(string(spec))
+		if err != nil {
+			continue
+		}
+		if ok, _ := doublestar.Match(pat, string(p)); !ok {
+			if ok, _ = doublestar.Match(pat+"/**", string(p)); !ok {
+				continue
+			}
+		}
+		matched = !neg
+	}
+	return matched
+}
+
+// hashFileNormalized digests what command writes to stdout when given the
+// file at path on stdin, rather than the file itself. The command runs from
+// the workspace root and is part of the digest, so changing the filter
+// changes the digest.
+func hashFileNormalized(path, command string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	hasher, err := blake2b.New256(nil)
+	if err != nil {
+		return "", err
+	}
+	hasher.Write([]byte(command))
+	hasher.Write([]byte{0})
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = in
+	cmd.Stdout = hasher
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			return "", fmt.Errorf("output_normalize %q: %w: %s", command, err, msg)
+		}
+		return "", fmt.Errorf("output_normalize %q: %w", command, err)
+	}
+	return normalizedDigestPrefix + hex.EncodeToString(hasher.Sum(nil)), nil
+}
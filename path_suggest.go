@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/fs"
+	"path"
+)
+
+// closestSibling returns the file in p's directory whose name is closest to
+// p's by edit distance, for a "did you mean" hint on a missing path. Only
+// near misses count (a third of the name's length, at least 1), so an
+// unrelated file is never suggested. It is best-effort: any error, e.g. a
+// missing directory, means no suggestion.
+func closestSibling(fsys fs.FS, p string) (string, bool) {
+	dir, name := path.Split(p)
+	listDir := path.Clean(dir)
+	if dir == "" {
+		listDir = "."
+	}
+	entries, err := fs.ReadDir(fsys, listDir)
+	if err != nil {
+		return "", false
+	}
+	best, bestDist := "", max(1, len(name)/3)+1
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		// ReadDir sorts by name, so ties go to the first.
+		if d := editDistance(name, e.Name()); d < bestDist {
+			best, bestDist = e.Name(), d
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	return dir + best, true
+}
+
+// editDistance is the Levenshtein distance between a and b, in bytes.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
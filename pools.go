@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// LoadPools returns the concurrency pools of the config at configPath: pool
+// name -> the most tasks in it that run at once. A missing config has none.
+func LoadPools(configPath string) (map[string]int, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read config file %q: %w", configPath, err)
+	}
+	cfg, err := decodeBuildConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePools(configPath, cfg.Pools); err != nil {
+		return nil, err
+	}
+	return cfg.Pools, nil
+}
+
+func validatePools(configPath string, pools map[string]int) error {
+	for name, size := range pools {
+		if name == "" {
+			return &ConfigError{File: configPath, Field: "pools", Reason: "pool name must not be empty"}
+		}
+		if size < 1 {
+			return &ConfigError{File: configPath, Field: "pools", Reason: fmt.Sprintf("pool %s must allow at least 1 task, not %d", name, size)}
+		}
+	}
+	return nil
+}
+
+// nextRunnable returns the index in ready of the first task that may start,
+// or -1 if every ready task's pool is full. running counts the started,
+// unfinished tasks per pool. A pool without a limit in e.pools never fills.
+func (e *TaskExecutor) nextRunnable(taskMap TaskMap, ready []TaskID, running map[string]int) int {
+	for i, id := range ready {
+		pool := taskMap[id].Pool
+		if limit, ok := e.pools[pool]; pool == "" || !ok || running[pool] < limit {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op on Windows, which has no process groups.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills cmd. Processes it started are left running.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		_ = cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// RemoteCache is an HTTP cache backend that stores each task entry as a tar
+// archive at <BaseURL>/tasks/<taskKey>.tar (PUT to store, GET to fetch).
+//
+// Archives are streamed in both directions: uploads are written from disk
+// into the request body through an io.Pipe and downloads are extracted as
+// they arrive, so memory use stays bounded regardless of artifact size.
+type RemoteCache struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewRemoteCache(baseURL string) *RemoteCache {
+	return &RemoteCache{BaseURL: strings.TrimSuffix(baseURL, "/"), Client: http.DefaultClient}
+}
+
+func (r *RemoteCache) entryURL(taskKey string) string {
+	return r.BaseURL + "/tasks/" + taskKey + ".tar"
+}
+
+// Upload streams the local entry directory entryDir to the remote cache.
+func (r *RemoteCache) Upload(ctx context.Context, taskKey string, entryDir string) error {
+	// The archive length is computed up front so the upload works with
+	// stores that reject chunked bodies (e.g. S3 presigned PUTs).
+	size, err := tarSize(entryDir)
+	if err != nil {
+		return fmt.Errorf("size archive: %w", err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTar(pw, entryDir, false))
+	}()
+	defer pr.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, r.entryURL(taskKey), pr)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/x-tar")
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload %s: %w", taskKey, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("upload %s: %s", taskKey, resp.Status)
+	}
+	return nil
+}
+
+// Download fetches the entry for taskKey and extracts it into destDir, which
+// must not exist yet. It returns false if the remote has no such entry.
+func (r *RemoteCache) Download(ctx context.Context, taskKey string, destDir string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.entryURL(taskKey), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("download %s: %w", taskKey, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return false, fmt.Errorf("download %s: %s", taskKey, resp.Status)
+	}
+
+	if err := extractTar(resp.Body, destDir); err != nil {
+		return false, fmt.Errorf("extract %s: %w", taskKey, err)
+	}
+	return true, nil
+}
+
+// writeTar writes the regular files under dir as a tar archive with
+// slash-separated relative names. With zeroContent, file bodies are written as
+// zeros without reading them, which yields the archive's exact length cheaply.
+func writeTar(w io.Writer, dir string, zeroContent bool) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filepath.ToSlash(rel),
+			Size:     info.Size(),
+			Mode:     int64(info.Mode().Perm()),
+			ModTime:  info.ModTime(),
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if zeroContent {
+			_, err := io.CopyN(tw, zeroReader{}, info.Size())
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func tarSize(dir string) (int64, error) {
+	var cw countingWriter
+	if err := writeTar(&cw, dir, true); err != nil {
+		return 0, err
+	}
+	return cw.n, nil
+}
+
+// extractTar extracts regular files from r into destDir, rejecting entries
+// that would escape it. Files keep the archive's mtimes, which
+// LocalCache.CheckUnmodified compares.
+func extractTar(r io.Reader, destDir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("archive entry %q escapes destination", hdr.Name)
+		}
+		dst := filepath.Join(destDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fs.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Chtimes(dst, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+}
+
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
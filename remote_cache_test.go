@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestRemote serves PUT/GET of entries from files in a temp dir, streaming
+// both ways so the server doesn't skew the client's memory measurements.
+func newTestRemote(t *testing.T) *httptest.Server {
+	t.Helper()
+	dir := t.TempDir()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := filepath.Join(dir, filepath.Base(r.URL.Path))
+		switch r.Method {
+		case http.MethodPut:
+			if r.ContentLength < 0 {
+				http.Error(w, "length required", http.StatusLengthRequired)
+				return
+			}
+			f, err := os.Create(p)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer f.Close()
+			n, err := io.Copy(f, r.Body)
+			if err != nil || n != r.ContentLength {
+				http.Error(w, "short body", http.StatusBadRequest)
+			}
+		case http.MethodGet:
+			http.ServeFile(w, r, p)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func writeFileContent(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("MkdirAll %q: %v", path, err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile %q: %v", path, err)
+	}
+}
+
+func TestRemoteCacheRoundTripLargeOutput(t *testing.T) {
+	const size = 64 << 20
+	srv := newTestRemote(t)
+	remote := NewRemoteCache(srv.URL + "/")
+
+	src := NewLocalCache(t.TempDir())
+	entry := src.taskDir("k1")
+	writeFileContent(t, filepath.Join(entry, "manifest.json"), `{"task_key":"k1"}`)
+	big := filepath.Join(entry, "outputs", "out", "big.bin")
+	if err := os.MkdirAll(filepath.Dir(big), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(big, []byte(strings.Repeat("x", 1<<20)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(big, size); err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	if err := remote.Upload(context.Background(), "k1", entry); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	dst := t.TempDir()
+	ok, err := remote.Download(context.Background(), "k1", dst)
+	if err != nil || !ok {
+		t.Fatalf("Download = %v, %v", ok, err)
+	}
+	runtime.ReadMemStats(&after)
+
+	// Nothing should hold a full copy of the artifact in memory.
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > size/4 {
+		t.Errorf("round trip allocated %d bytes for a %d byte output", alloc, size)
+	}
+
+	want, err := hashFileContents(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := hashFileContents(filepath.Join(dst, "outputs", "out", "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("downloaded output digest = %s, want %s", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "manifest.json")); err != nil {
+		t.Errorf("manifest not downloaded: %v", err)
+	}
+}
+
+func TestRemoteCacheDownloadMiss(t *testing.T) {
+	srv := newTestRemote(t)
+	remote := NewRemoteCache(srv.URL)
+
+	ok, err := remote.Download(context.Background(), "missing", t.TempDir())
+	if err != nil || ok {
+		t.Fatalf("Download = %v, %v; want miss", ok, err)
+	}
+}
+
+func TestBuildStateFetchRemote(t *testing.T) {
+	srv := newTestRemote(t)
+
+	up := NewBuildState(t.TempDir(), filepath.Join(t.TempDir(), "stamps.json"), StampCacheOptions{})
+	up.remote = NewRemoteCache(srv.URL)
+	entry := up.localCache.taskDir("k1")
+	writeFileContent(t, filepath.Join(entry, "manifest.json"), `{"task_key":"k1","outputs":["a.txt"]}`)
+	writeFileContent(t, filepath.Join(entry, "outputs", "a.txt"), "hello")
+	if err := up.UploadRemote(context.Background(), "k1"); err != nil {
+		t.Fatalf("UploadRemote: %v", err)
+	}
+
+	down := NewBuildState(t.TempDir(), filepath.Join(t.TempDir(), "stamps.json"), StampCacheOptions{})
+	down.remote = NewRemoteCache(srv.URL)
+	ok, err := down.FetchRemote(context.Background(), "k1")
+	if err != nil || !ok {
+		t.Fatalf("FetchRemote = %v, %v", ok, err)
+	}
+	outs, err := down.localCache.ReadManifestOutputs("k1")
+	if err != nil || len(outs) != 1 || outs[0] != "a.txt" {
+		t.Fatalf("ReadManifestOutputs = %v, %v", outs, err)
+	}
+}
+
+func TestOfflineSkipsRemoteCache(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{{ID: "gen", Outputs: []Path{"gen.txt"}, Command: "echo gen > gen.txt", Cache: true}})
+		opts := TaskExecutorOptions{RemoteCache: srv.URL, Offline: true}
+		// A miss and store, then a local hit: neither may touch the remote.
+		build(t, taskMap, opts, "gen")
+		build(t, taskMap, opts, "gen")
+		if n := requests.Load(); n != 0 {
+			t.Errorf("offline build made %d remote requests, want 0", n)
+		}
+
+		build(t, taskMap, TaskExecutorOptions{RemoteCache: srv.URL, CacheMode: CacheWrite}, "gen")
+		if requests.Load() == 0 {
+			t.Error("online build made no remote requests; the test server isn't reached")
+		}
+	})
+}
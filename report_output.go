@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// reportOutput collects what a read-only command (deps, cache stats, cache
+// inspect, diff-outputs) prints, so Close can decide where it goes: the
+// -output file if given, a pager if stdout is a terminal and the report
+// doesn't fit on it, or stdout.
+type reportOutput struct {
+	bytes.Buffer
+	path string
+}
+
+// reportOutputFlag adds the shared -output flag to fs.
+func reportOutputFlag(fs *flag.FlagSet) *reportOutput {
+	out := &reportOutput{}
+	fs.StringVar(&out.path, "output", "", "write the report to this file instead of stdout")
+	return out
+}
+
+// Close writes the collected report.
+func (r *reportOutput) Close() error {
+	if r.path != "" {
+		if err := writeFileAtomic(invocationPath(r.path), r.Bytes()); err != nil {
+			return fmt.Errorf("write %q: %w", r.path, err)
+		}
+		return nil
+	}
+	if DetectColorEnabled() && bytes.Count(r.Bytes(), []byte("\n")) >= terminalLines() {
+		if err := page(r.Bytes()); err == nil {
+			return nil
+		}
+		// Without a working pager, print as usual.
+	}
+	_, err := os.Stdout.Write(r.Bytes())
+	return err
+}
+
+// terminalLines returns the terminal's height from $LINES, or a typical 24.
+func terminalLines() int {
+	if n, err := strconv.Atoi(os.Getenv("LINES")); err == nil && n > 0 {
+		return n
+	}
+	return 24
+}
+
+// page shows data in $PAGER, or less. LESS defaults to FRX so less quits
+// when the report fits after all and passes color escapes through.
+func page(data []byte) error {
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = "less"
+	}
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if _, ok := os.LookupEnv("LESS"); !ok {
+		cmd.Env = append(cmd.Env, "LESS=FRX")
+	}
+	return cmd.Run()
+}
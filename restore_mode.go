@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// RestoreMode selects how cached outputs are placed in the workspace.
+type RestoreMode string
+
+const (
+	// RestoreHardlink links outputs to the cache's copy (the default): fast
+	// and stamp-stable, since every restore yields the same inode and
+	// mtime. The cache's copy is read-only and a link shares its mode, so
+	// only outputs the task produced read-only are linked; others are
+	// copied with the mode they were produced with. A task's outputs are
+	// unshared before it runs in the workspace (see unshareOutputs), and an
+	// edit in place by other means is caught by LocalCache.CheckUnmodified.
+	RestoreHardlink RestoreMode = "hardlink"
+	// RestoreCopy copies outputs, so they can be edited freely. Copies cost
+	// time and disk space, and each restore gives them a new mtime.
+	RestoreCopy RestoreMode = "copy"
+)
+
+func ParseRestoreMode(s string) (RestoreMode, error) {
+	switch m := RestoreMode(s); m {
+	case RestoreHardlink, RestoreCopy:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown restore mode %q (want hardlink or copy)", s)
+}
+
+// unshareOutputs gives each existing file matched by specs that has other
+// hardlinks, such as a hardlink-restored output sharing its cache blob, an
+// inode of its own. It runs before a task's command in the workspace, so a
+// command writing its outputs in place can't write into the cache. The copy
+// keeps the content and mtime, for commands that update outputs
+// incrementally. Specs matching nothing yet are skipped.
+func unshareOutputs(specs []Path) error {
+	opts := ExpandOptions{AllowEmpty: true, ExpandDirs: true, AllowParent: true}
+	for _, spec := range specs {
+		files, err := ExpandFileSpecsWithOptions("", []Path{spec}, opts)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if err := unshareFile(string(f)); err != nil {
+				return fmt.Errorf("unshare output %s: %w", f, err)
+			}
+		}
+	}
+	return nil
+}
+
+func unshareFile(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || !fi.Mode().IsRegular() || linkCount(fi) < 2 {
+		return nil
+	}
+	if err := copyOutput(path, path); err != nil {
+		return err
+	}
+	return os.Chtimes(path, fi.ModTime(), fi.ModTime())
+}
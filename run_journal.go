@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RunJournal records the tasks that succeeded during the current run, and
+// their keys, so a failed build can be resumed without rerunning them.
+type RunJournal struct {
+	mu        sync.Mutex
+	path      string
+	previous  map[TaskID]string
+	succeeded map[TaskID]string
+}
+
+func NewRunJournal(path string) *RunJournal {
+	return &RunJournal{
+		path:      path,
+		previous:  make(map[TaskID]string),
+		succeeded: make(map[TaskID]string),
+	}
+}
+
+// Load reads the journal left by the previous run. A missing or corrupt
+// journal is treated as empty.
+func (j *RunJournal) Load() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	data, err := os.ReadFile(j.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read run journal: %w", err)
+	}
+
+	previous := make(map[TaskID]string)
+	if err := json.Unmarshal(data, &previous); err != nil {
+		return nil
+	}
+	j.previous = previous
+	return nil
+}
+
+// SucceededBefore reports whether the previous run completed taskID with the
+// same key.
+func (j *RunJournal) SucceededBefore(taskID TaskID, taskKey string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	k, ok := j.previous[taskID]
+	return ok && k == taskKey
+}
+
+// Record marks taskID as having succeeded with taskKey in this run.
+func (j *RunJournal) Record(taskID TaskID, taskKey string) {
+	j.mu.Lock()
+	j.succeeded[taskID] = taskKey
+	j.mu.Unlock()
+}
+
+// Finish clears the journal after a successful build. After a failed build it
+// writes this run's successes, plus those carried over from the previous run,
+// so the next run can continue from them.
+func (j *RunJournal) Finish(success bool) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if success {
+		if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove run journal: %w", err)
+		}
+		return nil
+	}
+
+	entries := make(map[TaskID]string, len(j.previous)+len(j.succeeded))
+	for id, k := range j.previous {
+		entries[id] = k
+	}
+	for id, k := range j.succeeded {
+		entries[id] = k
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("marshal run journal: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o755); err != nil {
+		return fmt.Errorf("create run journal dir: %w", err)
+	}
+	if err := os.WriteFile(j.path, data, 0o644); err != nil {
+		return fmt.Errorf("write run journal: %w", err)
+	}
+	return nil
+}
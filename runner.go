@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Runner builds the process used to execute a task's command. workDir is the
+// workspace (or sandbox) root; the command runs in task.Dir beneath it.
+type Runner interface {
+	Command(task Task, workDir string) (*exec.Cmd, error)
+}
+
+// RunnerForTask returns the runner a task should be executed with.
+func RunnerForTask(task Task) Runner {
+	if task.Image != "" {
+		return DockerRunner{Image: task.Image}
+	}
+	return ShellRunner{Shell: task.Shell}
+}
+
+// ShellRunner runs commands on the host via `<shell> -c`.
+type ShellRunner struct {
+	Shell string // default: "sh"
+}
+
+func (r ShellRunner) shell() string {
+	if r.Shell == "" {
+		return "sh"
+	}
+	return r.Shell
+}
+
+func (r ShellRunner) Command(task Task, workDir string) (*exec.Cmd, error) {
+	shell := r.shell()
+	cmd := exec.Command(shell, "-c", shellScript(task, shell))
+	if dir := filepath.Join(workDir, filepath.FromSlash(task.Dir)); dir != "" {
+		cmd.Dir = dir
+	}
+	return cmd, nil
+}
+
+// DockerRunner runs commands inside a container, with workDir mounted as the
+// container's working directory.
+type DockerRunner struct {
+	Image string
+}
+
+func (r DockerRunner) Command(task Task, workDir string) (*exec.Cmd, error) {
+	if workDir == "" {
+		workDir = "."
+	}
+	absDir, err := filepath.Abs(workDir)
+	if err != nil {
+		return nil, fmt.Errorf("resolve work dir: %w", err)
+	}
+
+	args := []string{"run", "--rm", "-v", absDir + ":/work", "-w", path.Join("/work", task.Dir)}
+	// "-e KEY" forwards the value from the docker client's environment.
+	for _, k := range sortedEnvKeys(task.Env) {
+		args = append(args, "-e", k)
+	}
+	for _, k := range sortedEnvKeys(task.SecretEnv) {
+		args = append(args, "-e", k)
+	}
+	args = append(args, r.Image, "sh", "-c", shellScript(task, "sh"))
+	return exec.Command("docker", args...), nil
+}
+
+// shellScript returns the script passed to `shell -c` for task. With
+// fail_fast, POSIX shells get `set -e` so any failing statement aborts the
+// task; other shells run the command unchanged.
+func shellScript(task Task, shell string) string {
+	if task.FailFast && isPOSIXShell(shell) {
+		return "set -e\n" + task.Command
+	}
+	return task.Command
+}
+
+// runnerShell returns the shell r runs commands with.
+func runnerShell(r Runner) string {
+	if sr, ok := r.(ShellRunner); ok {
+		return sr.shell()
+	}
+	// Containers always run `sh -c`.
+	return "sh"
+}
+
+// RunnerSupportsFailFast reports whether fail_fast has an effect under r.
+func RunnerSupportsFailFast(r Runner) bool {
+	if sr, ok := r.(ShellRunner); ok {
+		return isPOSIXShell(sr.shell())
+	}
+	// Containers always run `sh -c`.
+	return true
+}
+
+func isPOSIXShell(shell string) bool {
+	switch strings.TrimSuffix(filepath.Base(shell), ".exe") {
+	case "sh", "bash", "dash", "ash", "ksh", "zsh":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// SandboxStageMode selects how inputs are placed in a sandbox.
+type SandboxStageMode string
+
+const (
+	// StageSymlink links each input to its source (the default). Tools
+	// that resolve symlinks see paths outside the sandbox.
+	StageSymlink SandboxStageMode = "symlink"
+	// StageHardlink hardlinks inputs, so they look like real files, and
+	// copies where that fails (e.g. across filesystems). A hardlink shares
+	// its source's inode, so sources are made read-only while the task runs
+	// (stageGuard). That doesn't stop root: an edit in place that gets
+	// through is warned about afterwards, and a cache entry it reached is
+	// evicted.
+	StageHardlink SandboxStageMode = "hardlink"
+	// StageCopy copies inputs: slowest, but fully isolated.
+	StageCopy SandboxStageMode = "copy"
+)
+
+func ParseSandboxStageMode(s string) (SandboxStageMode, error) {
+	switch m := SandboxStageMode(s); m {
+	case StageSymlink, StageHardlink, StageCopy:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown sandbox stage mode %q (want symlink, hardlink or copy)", s)
+}
+
+// stager returns the function that stages a file in mode m.
+func (m SandboxStageMode) stager() func(src, dst string) error {
+	switch m {
+	case StageHardlink:
+		return stageFileByHardlink
+	case StageCopy:
+		return copyFile
+	}
+	return stageFileBySymlink
+}
+
+// linkFile is os.Link, a variable so tests can simulate a link across
+// filesystems.
+var linkFile = os.Link
+
+func stageFileByHardlink(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	// Best-effort replace.
+	_ = os.Remove(dst)
+
+	if err := linkFile(src, dst); err == nil {
+		return nil
+	}
+	// E.g. a sandbox dir on a tmpfs.
+	return copyFile(src, dst)
+}
+
+// stageGuard drops the write bits of hardlinked sources while the tasks that
+// staged them run, and restores them when the last one is done. Tasks
+// running in parallel may stage the same source, hence the counts.
+type stageGuard struct {
+	mu    sync.Mutex
+	refs  map[string]int
+	modes map[string]fs.FileMode // permissions before the first acquire
+}
+
+func (g *stageGuard) acquire(sources []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.refs == nil {
+		g.refs = make(map[string]int)
+		g.modes = make(map[string]fs.FileMode)
+	}
+	for _, src := range sources {
+		if g.refs[src] == 0 {
+			fi, err := os.Stat(src)
+			if err != nil {
+				continue // staging reports it
+			}
+			perm := fi.Mode().Perm()
+			g.modes[src] = perm
+			if perm&0o222 != 0 {
+				_ = os.Chmod(src, perm&^0o222)
+			}
+		}
+		g.refs[src]++
+	}
+}
+
+func (g *stageGuard) release(sources []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, src := range sources {
+		if g.refs[src] == 0 {
+			continue
+		}
+		g.refs[src]--
+		if g.refs[src] > 0 {
+			continue
+		}
+		if perm := g.modes[src]; perm&0o222 != 0 {
+			_ = os.Chmod(src, perm)
+		}
+		delete(g.refs, src)
+		delete(g.modes, src)
+	}
+}
+
+// stagedSourceStamps stats the sources of hardlinked inputs before a task
+// runs, so changedStagedSources can tell whether the task edited one.
+func stagedSourceStamps(sources []string) map[string]FileStamp {
+	stamps := make(map[string]FileStamp, len(sources))
+	for _, src := range sources {
+		if stamp, err := StatStamp(src); err == nil {
+			stamps[src] = stamp
+		}
+	}
+	return stamps
+}
+
+// changedStagedSources returns the sources in stamps that changed since
+// they were recorded, sorted.
+func changedStagedSources(stamps map[string]FileStamp) []string {
+	var changed []string
+	for src, before := range stamps {
+		after, err := StatStamp(src)
+		if err != nil || !after.Equal(before) {
+			changed = append(changed, src)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Settings is the root config's "settings" block: project defaults for
+// command-line flags. A flag given on the command line wins over a setting,
+// which wins over the flag's built-in default.
+type Settings struct {
+	Sandbox  *bool  `json:"sandbox,omitempty"`
+	CacheDir string `json:"cache_dir,omitempty"`
+	Jobs     int    `json:"jobs,omitempty"`
+	// Shell runs task commands ("<shell> -c"); containers always use sh.
+	Shell string `json:"shell,omitempty"`
+}
+
+// LoadSettings returns the settings of the config at configPath. A missing
+// config has none, so commands that don't need one (e.g. cache stats) still
+// work. Included configs can't have settings; LoadTaskMapFromConfig rejects
+// them.
+func LoadSettings(configPath string) (Settings, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Settings{}, nil
+		}
+		return Settings{}, fmt.Errorf("read config file %q: %w", configPath, err)
+	}
+	cfg, err := decodeBuildConfig(data)
+	if err != nil {
+		return Settings{}, err
+	}
+	if cfg.Settings == nil {
+		return Settings{}, nil
+	}
+	if cfg.Settings.Jobs < 0 {
+		return Settings{}, &ConfigError{File: configPath, Field: "settings", Reason: "settings.jobs must not be negative"}
+	}
+	return *cfg.Settings, nil
+}
+
+// setTaskShell makes every task in taskMap run its command with shell.
+func setTaskShell(taskMap TaskMap, shell string) {
+	shell = defaultShellAsEmpty(shell)
+	for id, task := range taskMap {
+		task.Shell = shell
+		taskMap[id] = task
+	}
+}
+
+// defaultShellAsEmpty maps the default shell to "", so naming it explicitly
+// doesn't change task keys.
+func defaultShellAsEmpty(shell string) string {
+	if shell == "sh" {
+		return ""
+	}
+	return shell
+}
+
+// applySettings sets each flag in fs that has a setting and wasn't given on
+// the command line.
+func applySettings(fs *flag.FlagSet, s Settings) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	values := make(map[string]string)
+	if s.Sandbox != nil {
+		values["sandbox"] = strconv.FormatBool(*s.Sandbox)
+	}
+	if s.CacheDir != "" {
+		values["cache-dir"] = s.CacheDir
+	}
+	if s.Jobs != 0 {
+		values["jobs"] = strconv.Itoa(s.Jobs)
+	}
+	if s.Shell != "" {
+		values["shell"] = s.Shell
+	}
+	for name, v := range values {
+		if given[name] {
+			continue
+		}
+		if err := fs.Set(name, v); err != nil {
+			return fmt.Errorf("settings: %s: %w", name, err)
+		}
+	}
+	return nil
+}
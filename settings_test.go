@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+func TestSettingsPrecedence(t *testing.T) {
+	withTempWD(t, func() {
+		path := writeConfig(t, `{
+			// Project defaults for flags.
+			"settings": {"sandbox": true, "cache_dir": "/tmp/shared-cache", "jobs": 3, "shell": "bash"},
+			"tasks": {"app": {"command": "true"}},
+		}`)
+		settings, err := LoadSettings(path)
+		if err != nil {
+			t.Fatalf("LoadSettings: %v", err)
+		}
+
+		tests := []struct {
+			name     string
+			args     []string
+			settings Settings
+			sandbox  bool
+			cacheDir string
+			jobs     int
+			shell    string
+		}{
+			{name: "built-in defaults", sandbox: false, cacheDir: "cache", jobs: 0, shell: "sh"},
+			{name: "config", settings: settings, sandbox: true, cacheDir: "/tmp/shared-cache", jobs: 3, shell: "bash"},
+			{
+				name:     "flags win",
+				args:     []string{"-sandbox=false", "-cache-dir", "mine", "-jobs", "8", "-shell", "sh"},
+				settings: settings,
+				sandbox:  false, cacheDir: "mine", jobs: 8, shell: "sh",
+			},
+			{name: "partly overridden", args: []string{"-jobs", "1"}, settings: settings, sandbox: true, cacheDir: "/tmp/shared-cache", jobs: 1, shell: "bash"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				fs := flag.NewFlagSet("test", flag.ContinueOnError)
+				fs.SetOutput(io.Discard)
+				sandbox := fs.Bool("sandbox", false, "")
+				cacheDir := fs.String("cache-dir", "cache", "")
+				jobs := fs.Int("jobs", 0, "")
+				shell := fs.String("shell", "sh", "")
+				if err := fs.Parse(tt.args); err != nil {
+					t.Fatalf("Parse: %v", err)
+				}
+				if err := applySettings(fs, tt.settings); err != nil {
+					t.Fatalf("applySettings: %v", err)
+				}
+				if *sandbox != tt.sandbox || *cacheDir != tt.cacheDir || *jobs != tt.jobs || *shell != tt.shell {
+					t.Errorf("got sandbox=%v cache-dir=%q jobs=%d shell=%q, want %v %q %d %q",
+						*sandbox, *cacheDir, *jobs, *shell, tt.sandbox, tt.cacheDir, tt.jobs, tt.shell)
+				}
+			})
+		}
+
+		taskMap, err := LoadTaskMapFromConfig(path)
+		if err != nil {
+			t.Fatalf("LoadTaskMapFromConfig: %v", err)
+		}
+		if got := taskMap["app"].Shell; got != "bash" {
+			t.Errorf("task shell = %q, want the settings shell", got)
+		}
+	})
+}
+
+func TestSettingsErrors(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "sub/build.jsonc", `{"settings": {"jobs": 2}, "tasks": {}}`)
+		path := writeConfig(t, `{"includes": ["sub/build.jsonc"], "tasks": {}}`)
+		if _, err := LoadTaskMapFromConfig(path); err == nil {
+			t.Errorf("settings in an included config were accepted")
+		}
+
+		path = writeConfig(t, `{"settings": {"jobs": -1}, "tasks": {}}`)
+		if _, err := LoadSettings(path); err == nil {
+			t.Errorf("negative settings.jobs was accepted")
+		}
+
+		if s, err := LoadSettings("missing.jsonc"); err != nil || s != (Settings{}) {
+			t.Errorf("LoadSettings(missing) = %+v, %v; want no settings", s, err)
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// parseSince resolves a -since reference: an RFC 3339 time, or a file whose
+// modification time is used (e.g. a marker touched after the last build).
+func parseSince(ref string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, ref); err == nil {
+		return t, nil
+	}
+	fi, err := os.Stat(invocationPath(ref))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return time.Time{}, usagef("-since: %q is neither an RFC 3339 time nor an existing file", ref)
+		}
+		return time.Time{}, fmt.Errorf("-since: %w", err)
+	}
+	return fi.ModTime(), nil
+}
+
+// TargetsChangedSince returns the targets that have an input, their own or
+// a dependency's, modified after since. It only compares mtimes (via
+// StatStamp), so it is a heuristic for quick local rebuilds: a change that
+// keeps the mtime, or one that isn't an input file (a command or env edit),
+// goes unnoticed, and a kept target is still checked against the cache as
+// usual.
+func TargetsChangedSince(taskMap TaskMap, targets []TaskID, since time.Time) ([]TaskID, error) {
+	cutoff := since.UnixNano()
+	ignore, err := LoadIgnoreRules(ignoreFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("load ignore file: %w", err)
+	}
+	var changed []TaskID
+	for _, id := range targets {
+		deps, err := TaskDeps(taskMap, id, true)
+		if err != nil {
+			return nil, err
+		}
+		newer, err := hasInputNewerThan(taskMap, append(deps, id), cutoff, ignore)
+		if err != nil {
+			return nil, err
+		}
+		if newer {
+			changed = append(changed, id)
+		}
+	}
+	return changed, nil
+}
+
+func hasInputNewerThan(taskMap TaskMap, ids []TaskID, cutoff int64, ignore *IgnoreRules) (bool, error) {
+	for _, id := range ids {
+		inputs, err := ExpandFileSpecsWithOptions("", taskMap[id].Inputs, inputExpandOptions(ignore))
+		if err != nil {
+			return false, fmt.Errorf("expand inputs for task %s: %w", id, err)
+		}
+		for _, in := range inputs {
+			stamp, err := StatStamp(string(in))
+			if err != nil {
+				// Missing inputs are for the build to report.
+				return true, nil
+			}
+			if stamp.MTimeUnixNano > cutoff {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
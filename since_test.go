@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTargetsChangedSince(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "a.txt", "a")
+		writeFileContent(t, "b.txt", "b")
+		writeFileContent(t, "base.txt", "base")
+		taskMap := NewTaskMap([]Task{
+			{ID: "a", Inputs: []Path{"a.txt"}, Command: "true"},
+			{ID: "b", Inputs: []Path{"b.txt"}, Command: "true"},
+			{ID: "base", Inputs: []Path{"base.txt"}, Command: "true"},
+			{ID: "app", Dependencies: []TaskID{"base"}, Command: "true"},
+		})
+		old := time.Now().Add(-time.Hour)
+		for _, name := range []string{"a.txt", "b.txt", "base.txt"} {
+			if err := os.Chtimes(name, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+		writeFileContent(t, "marker", "")
+		if err := os.Chtimes("marker", old.Add(time.Minute), old.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		ref, err := parseSince("marker")
+		if err != nil {
+			t.Fatalf("parseSince: %v", err)
+		}
+		targets := []TaskID{"a", "b", "app"}
+
+		tests := []struct {
+			name  string
+			touch string
+			want  []TaskID
+		}{
+			{name: "nothing touched", want: nil},
+			{name: "own input", touch: "a.txt", want: []TaskID{"a"}},
+			{name: "dependency input", touch: "base.txt", want: []TaskID{"a", "app"}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if tt.touch != "" {
+					now := time.Now()
+					if err := os.Chtimes(tt.touch, now, now); err != nil {
+						t.Fatal(err)
+					}
+				}
+				got, err := TargetsChangedSince(taskMap, targets, ref)
+				if err != nil {
+					t.Fatalf("TargetsChangedSince: %v", err)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("TargetsChangedSince = %v, want %v", got, tt.want)
+				}
+			})
+		}
+
+		if _, err := parseSince("2024-05-01T12:00:00Z"); err != nil {
+			t.Errorf("parseSince(time): %v", err)
+		}
+		if _, err := parseSince("no-such-marker"); exitCode(err) != exitUsage {
+			t.Errorf("parseSince(missing file) err = %v, want usage error", err)
+		}
+	})
+}
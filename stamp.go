@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 // FileStamp is a persisted snapshot of file metadata that can be used to detect
@@ -52,43 +57,120 @@ type FileStampCache struct {
 	path    string
 	entries map[string]stampCacheEntry
 	dirty   bool
+
+	verify bool
+	mode   StampMode
+	log    *Logger
+}
+
+// StampMode trades hashing work for safety when deciding whether a file
+// changed since its digest was recorded.
+type StampMode string
+
+const (
+	// StampFull compares every FileStamp field (the default).
+	StampFull StampMode = "full"
+	// StampMTime trusts mtime and size alone and never re-hashes on a hit.
+	StampMTime StampMode = "mtime"
+	// StampContent ignores stamps and always hashes.
+	StampContent StampMode = "content"
+)
+
+func ParseStampMode(s string) (StampMode, error) {
+	switch m := StampMode(s); m {
+	case StampFull, StampMTime, StampContent:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown stamp mode %q (want mtime, full or content)", s)
+}
+
+// stampCacheFile is the on-disk form of the stamp cache. Entries recorded
+// under another mode are dropped on load, so a stricter mode never inherits
+// digests that were only trusted under looser rules. Older files are a bare
+// entries map written in full mode.
+type stampCacheFile struct {
+	Mode    StampMode                  `json:"mode"`
+	Entries map[string]stampCacheEntry `json:"entries"`
+}
+
+// StampCacheOptions configures a FileStampCache.
+type StampCacheOptions struct {
+	// Verify re-hashes files on a stamp hit when they were modified recently
+	// or are small, to catch stale digests caused by clock skew (e.g. on
+	// networked filesystems). Mismatches are logged and corrected.
+	Verify bool
+	// Mode selects how stamps are compared; empty means StampFull.
+	Mode StampMode
+	// Log receives warnings. May be nil.
+	Log *Logger
 }
 
+// Files within these limits are re-hashed on a stamp hit when verification is
+// enabled.
+const (
+	stampVerifyWindow    = 5 * time.Minute
+	stampVerifySizeLimit = 1 << 20
+)
+
 // NewFileStampCache creates a new stamp cache that will be persisted at path.
-func NewFileStampCache(path string) *FileStampCache {
+func NewFileStampCache(path string, opts StampCacheOptions) *FileStampCache {
 	return &FileStampCache{
 		path:    path,
 		entries: make(map[string]stampCacheEntry),
+		verify:  opts.Verify,
+		mode:    cmp.Or(opts.Mode, StampFull),
+		log:     opts.Log,
 	}
 }
 
-// Load reads the stamp cache from disk. If the file does not exist the cache
-// starts empty.
+// Load reads the stamp cache from disk. If the file does not exist or can't
+// be read the cache starts empty: stamps only save re-hashing, so an
+// unreadable file (e.g. on a read-only mount) is a warning, not an error.
 func (c *FileStampCache) Load() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	// StampContent neither reads nor writes stamps, leaving the file as the
+	// previous mode wrote it.
+	if c.mode == StampContent {
+		c.entries = make(map[string]stampCacheEntry)
+		return nil
+	}
+
 	data, err := os.ReadFile(c.path)
 	if err != nil {
-		if os.IsNotExist(err) {
-			c.entries = make(map[string]stampCacheEntry)
-			return nil
+		c.entries = make(map[string]stampCacheEntry)
+		if !os.IsNotExist(err) {
+			c.warnf("warning: read stamp cache: %v; continuing without it\n", err)
 		}
-		return fmt.Errorf("read stamp cache: %w", err)
+		return nil
 	}
-
-	entries := make(map[string]stampCacheEntry)
-	if err := json.Unmarshal(data, &entries); err != nil {
+	if data, err = decompressStamps(data); err != nil {
 		// Corrupt cache – start fresh.
 		c.entries = make(map[string]stampCacheEntry)
 		return nil
 	}
-	c.entries = entries
+
+	var file stampCacheFile
+	if err := json.Unmarshal(data, &file); err != nil || file.Entries == nil {
+		file = stampCacheFile{Mode: StampFull}
+		if err := json.Unmarshal(data, &file.Entries); err != nil {
+			// Corrupt cache – start fresh.
+			c.entries = make(map[string]stampCacheEntry)
+			return nil
+		}
+	}
+	c.entries = file.Entries
+	if file.Mode != c.mode {
+		c.entries = make(map[string]stampCacheEntry)
+		c.dirty = true
+	}
 	return nil
 }
 
 // Save writes the stamp cache to disk if it was modified since the last load
-// or save.
+// or save. Failing to write it only costs re-hashing in the next build, so
+// IO errors are logged as warnings rather than returned.
 func (c *FileStampCache) Save() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -97,30 +179,66 @@ func (c *FileStampCache) Save() error {
 		return nil
 	}
 
-	data, err := json.Marshal(c.entries)
-	if err != nil {
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if err := json.NewEncoder(zw).Encode(stampCacheFile{Mode: c.mode, Entries: c.entries}); err != nil {
 		return fmt.Errorf("marshal stamp cache: %w", err)
 	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("compress stamp cache: %w", err)
+	}
 
 	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
-		return fmt.Errorf("create stamp cache dir: %w", err)
+		c.warnf("warning: create stamp cache dir: %v; stamps not saved\n", err)
+		return nil
 	}
 
-	if err := os.WriteFile(c.path, data, 0o644); err != nil {
-		return fmt.Errorf("write stamp cache: %w", err)
+	if err := writeFileAtomic(c.path, buf.Bytes()); err != nil {
+		c.warnf("warning: write stamp cache: %v; stamps not saved\n", err)
+		return nil
 	}
 
 	c.dirty = false
 	return nil
 }
 
+// decompressStamps returns the JSON of a stamp cache file. Save writes it
+// gzipped, since paths repeat a lot; files from older versions are plain
+// JSON and are returned as is.
+func decompressStamps(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+func (c *FileStampCache) warnf(format string, args ...any) {
+	if c.log != nil {
+		c.log.Errorf(format, args...)
+	}
+}
+
 // Lookup returns the cached digest for path if the file's current stamp
 // matches the cached one. Returns ("", false) on miss.
+//
+// With verification enabled, a hit on a recently modified or small file is
+// confirmed by re-hashing; a stale digest is logged and replaced.
+//
+// StampMTime compares only mtime and size and skips verification;
+// StampContent always misses.
 func (c *FileStampCache) Lookup(path string) (string, bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	if c.mode == StampContent {
+		return "", false
+	}
 
+	c.mu.Lock()
 	entry, ok := c.entries[path]
+	c.mu.Unlock()
 	if !ok {
 		return "", false
 	}
@@ -130,15 +248,51 @@ func (c *FileStampCache) Lookup(path string) (string, bool) {
 		return "", false
 	}
 
+	if c.mode == StampMTime {
+		if entry.Stamp.MTimeUnixNano != current.MTimeUnixNano || entry.Stamp.Size != current.Size {
+			return "", false
+		}
+		return entry.Digest, true
+	}
+
 	if !entry.Stamp.Equal(current) {
 		return "", false
 	}
 
-	return entry.Digest, true
+	if !c.verify || !shouldVerifyStamp(current, time.Now()) {
+		return entry.Digest, true
+	}
+
+	d, err := hashFile(path)
+	if err != nil {
+		return "", false
+	}
+	if d != entry.Digest {
+		if c.log != nil {
+			c.log.Errorf("warning: stale stamp cache digest for %q (clock skew?); re-hashed\n", path)
+		}
+		c.mu.Lock()
+		c.entries[path] = stampCacheEntry{Stamp: current, Digest: d}
+		c.dirty = true
+		c.mu.Unlock()
+	}
+	return d, true
 }
 
-// Update records a new (stamp, digest) pair for path.
+func shouldVerifyStamp(s FileStamp, now time.Time) bool {
+	if s.Size <= stampVerifySizeLimit {
+		return true
+	}
+	age := now.Sub(time.Unix(0, s.MTimeUnixNano))
+	return age < stampVerifyWindow
+}
+
+// Update records a new (stamp, digest) pair for path. StampContent never
+// reads them, so it records nothing.
 func (c *FileStampCache) Update(path string, digest string) {
+	if c.mode == StampContent {
+		return
+	}
 	stamp, err := StatStamp(path)
 	if err != nil {
 		return
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFileStampCacheVerifyDetectsStaleDigest(t *testing.T) {
+	withTempWD(t, func() {
+		const path = "in.txt"
+
+		// Records the original content, then rewrites it with the same size,
+		// inode, and mtime so the stamp no longer changes.
+		recordThenMutate := func(c *FileStampCache) string {
+			t.Helper()
+			if err := os.WriteFile(path, []byte("aaaa"), 0o644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			oldDigest, err := hashFile(path)
+			if err != nil {
+				t.Fatalf("hashFile: %v", err)
+			}
+			c.Update(path, oldDigest)
+
+			if err := os.WriteFile(path, []byte("bbbb"), 0o644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			if err := os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+				t.Fatalf("Chtimes: %v", err)
+			}
+			return oldDigest
+		}
+
+		t.Run("off-returns-stale", func(t *testing.T) {
+			c := NewFileStampCache("stamps.json", StampCacheOptions{})
+			oldDigest := recordThenMutate(c)
+
+			got, ok := c.Lookup(path)
+			if !ok || got != oldDigest {
+				t.Fatalf("Lookup = %q, %v; want stale hit %q", got, ok, oldDigest)
+			}
+		})
+
+		t.Run("on-rehashes-and-warns", func(t *testing.T) {
+			var errBuf bytes.Buffer
+			log := NewLogger(&bytes.Buffer{}, &errBuf, LoggerOptions{})
+			c := NewFileStampCache("stamps.json", StampCacheOptions{Verify: true, Log: log})
+			recordThenMutate(c)
+
+			want, err := hashFile(path)
+			if err != nil {
+				t.Fatalf("hashFile: %v", err)
+			}
+			got, ok := c.Lookup(path)
+			if !ok || got != want {
+				t.Fatalf("Lookup = %q, %v; want %q", got, ok, want)
+			}
+			if !strings.Contains(errBuf.String(), "stale stamp cache digest") {
+				t.Fatalf("expected warning, got %q", errBuf.String())
+			}
+
+			// The corrected entry is served without another warning.
+			errBuf.Reset()
+			if got, _ := c.Lookup(path); got != want {
+				t.Fatalf("second Lookup = %q, want %q", got, want)
+			}
+			if errBuf.Len() != 0 {
+				t.Fatalf("unexpected warning on second lookup: %q", errBuf.String())
+			}
+		})
+	})
+}
+
+func TestFileStampCacheIOFailuresAreWarnings(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T)
+		path     string
+		wantWarn []string
+	}{
+		{
+			// A directory stands in for an unreadable file; permissions
+			// don't stop tests running as root.
+			name:     "unreadable",
+			setup:    func(t *testing.T) { writeFile(t, "stamps.json/x") },
+			path:     "stamps.json",
+			wantWarn: []string{"read stamp cache", "write stamp cache"},
+		},
+		{
+			name:     "unwritable-dir",
+			setup:    func(t *testing.T) { writeFile(t, "cache") },
+			path:     "cache/stamps.json",
+			wantWarn: []string{"create stamp cache dir"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempWD(t, func() {
+				tt.setup(t)
+				writeFile(t, "in.txt")
+				var errBuf bytes.Buffer
+				c := NewFileStampCache(tt.path, StampCacheOptions{Log: NewLogger(&bytes.Buffer{}, &errBuf, LoggerOptions{})})
+
+				if err := c.Load(); err != nil {
+					t.Fatalf("Load: %v", err)
+				}
+				d, err := hashFile("in.txt")
+				if err != nil {
+					t.Fatalf("hashFile: %v", err)
+				}
+				c.Update("in.txt", d)
+				if got, ok := c.Lookup("in.txt"); !ok || got != d {
+					t.Errorf("in-memory Lookup = %q, %v; want %q", got, ok, d)
+				}
+				if err := c.Save(); err != nil {
+					t.Fatalf("Save: %v", err)
+				}
+				for _, want := range tt.wantWarn {
+					if !strings.Contains(errBuf.String(), want) {
+						t.Errorf("warnings %q missing %q", errBuf.String(), want)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestFileStampCacheModes(t *testing.T) {
+	tests := []struct {
+		mode    StampMode
+		wantHit bool // after the file is replaced with one of equal mtime and size
+	}{
+		{mode: StampFull, wantHit: false},
+		{mode: StampMTime, wantHit: true},
+		{mode: StampContent, wantHit: false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			withTempWD(t, func() {
+				writeFileContent(t, "in.txt", "aaaa")
+				c := NewFileStampCache("stamps.json", StampCacheOptions{Mode: tt.mode})
+				d, err := hashFile("in.txt")
+				if err != nil {
+					t.Fatalf("hashFile: %v", err)
+				}
+				c.Update("in.txt", d)
+				if _, ok := c.Lookup("in.txt"); ok != (tt.mode != StampContent) {
+					t.Errorf("Lookup of unchanged file hit = %v", ok)
+				}
+
+				// A new inode with the same mtime and size.
+				fi, err := os.Stat("in.txt")
+				if err != nil {
+					t.Fatalf("Stat: %v", err)
+				}
+				writeFileContent(t, "new.txt", "bbbb")
+				if err := os.Chtimes("new.txt", fi.ModTime(), fi.ModTime()); err != nil {
+					t.Fatalf("Chtimes: %v", err)
+				}
+				if err := os.Rename("new.txt", "in.txt"); err != nil {
+					t.Fatalf("Rename: %v", err)
+				}
+				if _, ok := c.Lookup("in.txt"); ok != tt.wantHit {
+					t.Errorf("Lookup of replaced file hit = %v, want %v", ok, tt.wantHit)
+				}
+			})
+		})
+	}
+}
+
+func TestFileStampCacheModeSwitchDropsEntries(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "in.txt", "aaaa")
+		d, err := hashFile("in.txt")
+		if err != nil {
+			t.Fatalf("hashFile: %v", err)
+		}
+		c := NewFileStampCache("stamps.json", StampCacheOptions{Mode: StampMTime})
+		c.Update("in.txt", d)
+		if err := c.Save(); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+
+		for _, tt := range []struct {
+			mode    StampMode
+			wantHit bool
+		}{
+			{mode: StampContent, wantHit: false},
+			{mode: StampMTime, wantHit: true}, // content mode left the file alone
+			{mode: StampFull, wantHit: false},
+		} {
+			c := NewFileStampCache("stamps.json", StampCacheOptions{Mode: tt.mode})
+			if err := c.Load(); err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if _, ok := c.Lookup("in.txt"); ok != tt.wantHit {
+				t.Errorf("%s: Lookup hit = %v, want %v", tt.mode, ok, tt.wantHit)
+			}
+		}
+	})
+}
+
+func TestFileStampCacheLoadsLegacyFormat(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "in.txt", "aaaa")
+		d, err := hashFile("in.txt")
+		if err != nil {
+			t.Fatalf("hashFile: %v", err)
+		}
+		stamp, err := StatStamp("in.txt")
+		if err != nil {
+			t.Fatalf("StatStamp: %v", err)
+		}
+		data, err := json.Marshal(map[string]stampCacheEntry{"in.txt": {Stamp: stamp, Digest: d}})
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		writeFileContent(t, "stamps.json", string(data))
+
+		c := NewFileStampCache("stamps.json", StampCacheOptions{})
+		if err := c.Load(); err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		if got, ok := c.Lookup("in.txt"); !ok || got != d {
+			t.Errorf("Lookup = %q, %v; want %q from a bare entries map", got, ok, d)
+		}
+	})
+}
+
+func TestFileStampCacheSavesCompressed(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "in.txt", "aaaa")
+		d, err := hashFile("in.txt")
+		if err != nil {
+			t.Fatalf("hashFile: %v", err)
+		}
+		c := NewFileStampCache("stamps.json", StampCacheOptions{})
+		if err := c.Load(); err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		c.Update("in.txt", d)
+		if err := c.Save(); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+
+		data, err := os.ReadFile("stamps.json")
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+			t.Errorf("stamps.json isn't gzipped: %q", data)
+		}
+
+		c = NewFileStampCache("stamps.json", StampCacheOptions{})
+		if err := c.Load(); err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		if got, ok := c.Lookup("in.txt"); !ok || got != d {
+			t.Errorf("Lookup after a round trip = %q, %v; want %q", got, ok, d)
+		}
+	})
+}
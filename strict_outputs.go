@@ -0,0 +1,64 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// outputDrift compares the outputs recorded in a cache entry with those the
+// task's output specs match in the workspace now. extra are matched but not
+// recorded (e.g. left behind by a run that produced a different set),
+// missing are recorded but no longer matched. Both are sorted.
+func outputDrift(recorded, matched []Path) (extra, missing []Path) {
+	inRecorded := make(map[Path]bool, len(recorded))
+	for _, p := range recorded {
+		inRecorded[p] = true
+	}
+	inMatched := make(map[Path]bool, len(matched))
+	for _, p := range matched {
+		inMatched[p] = true
+		if !inRecorded[p] {
+			extra = append(extra, p)
+		}
+	}
+	for _, p := range recorded {
+		if !inMatched[p] {
+			missing = append(missing, p)
+		}
+	}
+	slices.Sort(extra)
+	slices.Sort(missing)
+	return extra, missing
+}
+
+// checkRestoredOutputs warns, under -strict-outputs, when the outputs just
+// restored for task differ from what its output specs match afterwards. The
+// manifest decides what is restored; a difference means the task's output
+// set isn't deterministic, or files from another run are in the way.
+func (e *TaskExecutor) checkRestoredOutputs(task Task, taskKey string) {
+	recorded, err := e.state.cacheFor(taskKey).ReadManifestOutputs(taskKey)
+	if err != nil {
+		e.log.Taskf(task.ID, "warning: -strict-outputs: %v", err)
+		return
+	}
+	matched, _, err := expandOutputSpecs("", task.Outputs, e.ignore)
+	if err != nil {
+		e.log.Taskf(task.ID, "warning: -strict-outputs: expand outputs: %v", err)
+		return
+	}
+	extra, missing := outputDrift(recorded, matched)
+	if len(extra) > 0 {
+		e.log.Taskf(task.ID, "warning: outputs match files the cache entry doesn't have: %s", joinPaths(extra))
+	}
+	if len(missing) > 0 {
+		e.log.Taskf(task.ID, "warning: cache entry has outputs the output specs no longer match: %s", joinPaths(missing))
+	}
+}
+
+func joinPaths(paths []Path) string {
+	s := make([]string, len(paths))
+	for i, p := range paths {
+		s[i] = string(p)
+	}
+	return strings.Join(s, ", ")
+}
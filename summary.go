@@ -0,0 +1,230 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// BuildSummary collects totals reported at the end of a build. The JSON
+// form is what -results-file writes; durations are in nanoseconds.
+type BuildSummary struct {
+	CacheBytesWritten   int64 `json:"cache_bytes_written"`
+	CacheBudgetExceeded bool  `json:"cache_budget_exceeded"`
+	// CacheBytesByTask lists the tasks that wrote to the cache, biggest
+	// first.
+	CacheBytesByTask []TaskCacheBytes `json:"cache_bytes_by_task"`
+	// CacheSavedBytes and CacheSavedTime estimate what cache hits saved:
+	// the size of the hits' outputs and how long their commands ran when
+	// the entries were stored. Entries that don't record these (older ones,
+	// or seeded by `cache warm`) add nothing.
+	CacheSavedBytes int64         `json:"cache_saved_bytes"`
+	CacheSavedTime  time.Duration `json:"cache_saved_time_ns"`
+	// AllowedFailures lists allow_failure tasks that failed, sorted.
+	AllowedFailures []TaskID `json:"allowed_failures"`
+	// Skipped lists tasks pruned with -skip that the build reached, sorted.
+	Skipped []TaskID `json:"skipped"`
+	// CriticalPath, with -critical-path, is the chain of dependencies with
+	// the longest total duration, dependencies first. However many jobs
+	// run, the build takes at least that long.
+	CriticalPath []TaskDuration `json:"critical_path,omitempty"`
+}
+
+// TaskDuration is how long a task took in this build, cache hits included.
+type TaskDuration struct {
+	ID       TaskID        `json:"id"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// taskTiming is a task's own duration and the dependencies it waited for.
+type taskTiming struct {
+	d    time.Duration
+	deps []TaskID
+}
+
+func (e *TaskExecutor) recordTiming(task Task, d time.Duration) {
+	e.timingsMu.Lock()
+	defer e.timingsMu.Unlock()
+	if e.timings == nil {
+		e.timings = make(map[TaskID]taskTiming)
+	}
+	e.timings[task.ID] = taskTiming{d: d, deps: task.Dependencies}
+}
+
+// criticalPath returns the chain through timings, following dependencies,
+// whose durations add up to the most, dependencies first. Ties go to the
+// smaller task ID so the result is stable.
+func criticalPath(timings map[TaskID]taskTiming) []TaskDuration {
+	// total[id] is the longest chain ending at id; next[id] the dependency
+	// it continues from.
+	total := make(map[TaskID]time.Duration, len(timings))
+	next := make(map[TaskID]TaskID, len(timings))
+	var longest func(id TaskID) time.Duration
+	longest = func(id TaskID) time.Duration {
+		if d, ok := total[id]; ok {
+			return d
+		}
+		var best time.Duration
+		var bestDep TaskID
+		found := false
+		for _, dep := range timings[id].deps {
+			if _, ok := timings[dep]; !ok {
+				continue
+			}
+			if d := longest(dep); !found || d > best || d == best && dep < bestDep {
+				best, bestDep, found = d, dep, true
+			}
+		}
+		if found {
+			next[id] = bestDep
+		}
+		total[id] = best + timings[id].d
+		return total[id]
+	}
+
+	var end TaskID
+	found := false
+	for _, id := range slices.Sorted(maps.Keys(timings)) {
+		if d := longest(id); !found || d > total[end] {
+			end, found = id, true
+		}
+	}
+	if !found {
+		return nil
+	}
+	var path []TaskDuration
+	for id, ok := end, true; ok; id, ok = next[id] {
+		path = append(path, TaskDuration{ID: id, Duration: timings[id].d})
+	}
+	slices.Reverse(path)
+	return path
+}
+
+// TaskCacheBytes is the number of bytes a task stored in the cache.
+type TaskCacheBytes struct {
+	ID    TaskID `json:"id"`
+	Bytes int64  `json:"bytes"`
+}
+
+func (e *TaskExecutor) recordCacheBytes(id TaskID, n int64) {
+	if n == 0 {
+		return
+	}
+	e.cacheBytesMu.Lock()
+	defer e.cacheBytesMu.Unlock()
+	if e.cacheBytes == nil {
+		e.cacheBytes = make(map[TaskID]int64)
+	}
+	e.cacheBytes[id] += n
+}
+
+// recordCacheSaving adds what the hit on taskKey saved to the summary,
+// as recorded in its manifest. The full entry counts even if -only-outputs
+// restored part of it: the command didn't have to run either way.
+func (e *TaskExecutor) recordCacheSaving(taskKey string) {
+	manifest, err := e.state.cacheFor(taskKey).readManifest(taskKey)
+	if err != nil {
+		return
+	}
+	e.cacheBytesMu.Lock()
+	defer e.cacheBytesMu.Unlock()
+	e.savedBytes += manifest.OutputBytes
+	e.savedTime += manifest.RunDuration
+}
+
+func (e *TaskExecutor) Summary() BuildSummary {
+	var s BuildSummary
+	s.CacheBytesWritten, s.CacheBudgetExceeded = e.state.localCache.BytesWritten()
+
+	e.cacheBytesMu.Lock()
+	for id, n := range e.cacheBytes {
+		s.CacheBytesByTask = append(s.CacheBytesByTask, TaskCacheBytes{ID: id, Bytes: n})
+	}
+	s.CacheSavedBytes, s.CacheSavedTime = e.savedBytes, e.savedTime
+	e.cacheBytesMu.Unlock()
+	slices.SortFunc(s.CacheBytesByTask, func(a, b TaskCacheBytes) int {
+		if c := cmp.Compare(b.Bytes, a.Bytes); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	e.failedMu.Lock()
+	for id := range e.allowedFailures {
+		s.AllowedFailures = append(s.AllowedFailures, id)
+	}
+	e.failedMu.Unlock()
+	slices.Sort(s.AllowedFailures)
+
+	for id := range e.skip {
+		if e.skipped(id) {
+			s.Skipped = append(s.Skipped, id)
+		}
+	}
+	slices.Sort(s.Skipped)
+
+	if e.criticalPath {
+		e.timingsMu.Lock()
+		s.CriticalPath = criticalPath(e.timings)
+		e.timingsMu.Unlock()
+	}
+	return s
+}
+
+func (s BuildSummary) Print(log *Logger) {
+	log.Printf("Cache: stored %s\n", formatBytes(s.CacheBytesWritten))
+	for _, t := range s.CacheBytesByTask {
+		log.Printf("  %10s  %s\n", formatBytes(t.Bytes), t.ID)
+	}
+	if s.CacheSavedBytes > 0 || s.CacheSavedTime > 0 {
+		log.Printf("Cache saved ~%s / ~%s this build\n", formatBytes(s.CacheSavedBytes), s.CacheSavedTime.Round(time.Millisecond))
+	}
+	if s.CacheBudgetExceeded {
+		log.Errorf("warning: cache byte budget exceeded; some outputs were not cached\n")
+	}
+	if len(s.AllowedFailures) > 0 {
+		log.Errorf("warning: %d task(s) failed with allow_failure: %s\n", len(s.AllowedFailures), joinTaskIDs(s.AllowedFailures))
+	}
+	if len(s.Skipped) > 0 {
+		log.Printf("Skipped %d task(s): %s\n", len(s.Skipped), joinTaskIDs(s.Skipped))
+	}
+	if len(s.CriticalPath) > 0 {
+		var total time.Duration
+		steps := make([]string, len(s.CriticalPath))
+		for i, t := range s.CriticalPath {
+			total += t.Duration
+			steps[i] = fmt.Sprintf("%s (%s)", t.ID, t.Duration.Round(time.Millisecond))
+		}
+		log.Printf("Critical path: %s: %s\n", total.Round(time.Millisecond), strings.Join(steps, " -> "))
+	}
+}
+
+// WriteResults writes s as JSON to path for -results-file, with whether
+// the build succeeded and, if not, its error.
+func (s BuildSummary) WriteResults(path string, buildErr error) error {
+	results := struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error,omitempty"`
+		BuildSummary
+	}{Success: buildErr == nil, BuildSummary: s}
+	if buildErr != nil {
+		results.Error = buildErr.Error()
+	}
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+func joinTaskIDs(ids []TaskID) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = string(id)
+	}
+	return strings.Join(strs, ", ")
+}
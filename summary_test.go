@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummaryCacheBytesByTask(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			{ID: "small", Outputs: []Path{"small.bin"}, Command: "head -c 10 /dev/zero > small.bin", Cache: true},
+			{ID: "big", Outputs: []Path{"big.bin"}, Command: "head -c 5000 /dev/zero > big.bin", Cache: true},
+			{ID: "uncached", Outputs: []Path{"u.bin"}, Command: "head -c 100 /dev/zero > u.bin"},
+		})
+		e := newTestExecutor(t, TaskExecutorOptions{})
+		if err := e.ExecuteTasks(taskMap, []TaskID{"small", "big", "uncached"}); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+
+		s := e.Summary()
+		want := []TaskCacheBytes{{ID: "big", Bytes: 5000}, {ID: "small", Bytes: 10}}
+		if !slices.Equal(s.CacheBytesByTask, want) {
+			t.Fatalf("CacheBytesByTask = %v, want %v", s.CacheBytesByTask, want)
+		}
+
+		var out bytes.Buffer
+		s.Print(NewLogger(&out, &out, LoggerOptions{}))
+		if i, j := strings.Index(out.String(), "big"), strings.Index(out.String(), "small"); i < 0 || j < i {
+			t.Errorf("summary not sorted by size:\n%s", out.String())
+		}
+
+		if err := s.WriteResults("results.json", nil); err != nil {
+			t.Fatalf("WriteResults: %v", err)
+		}
+		data, err := os.ReadFile("results.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var results struct {
+			Success          bool             `json:"success"`
+			CacheBytesByTask []TaskCacheBytes `json:"cache_bytes_by_task"`
+		}
+		if err := json.Unmarshal(data, &results); err != nil {
+			t.Fatalf("results file isn't JSON: %v\n%s", err, data)
+		}
+		if !results.Success || !slices.Equal(results.CacheBytesByTask, want) {
+			t.Errorf("results file = %s, want success and cache bytes %v", data, want)
+		}
+	})
+}
+
+func TestCacheBudget(t *testing.T) {
+	for _, sandbox := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sandbox=%v", sandbox), func(t *testing.T) {
+			withTempWD(t, func() {
+				taskMap := NewTaskMap([]Task{
+					{ID: "first", Outputs: []Path{"a.bin"}, Command: "head -c 3000 /dev/zero > a.bin", Cache: true},
+					{ID: "second", Dependencies: []TaskID{"first"}, Outputs: []Path{"b.bin"}, Command: "head -c 2000 /dev/zero > b.bin", Cache: true},
+				})
+				opts := TaskExecutorOptions{Sandbox: sandbox, CacheMaxBytesPerBuild: 4000}
+				e := newTestExecutor(t, opts)
+				if err := e.ExecuteTasks(taskMap, []TaskID{"second"}); err != nil {
+					t.Fatalf("ExecuteTasks: %v", err)
+				}
+
+				s := e.Summary()
+				if s.CacheBytesWritten != 3000 || !s.CacheBudgetExceeded {
+					t.Errorf("summary = %d bytes, exceeded %v; want 3000, true", s.CacheBytesWritten, s.CacheBudgetExceeded)
+				}
+				// The refused entry's outputs still reach the workspace.
+				if fi, err := os.Stat("b.bin"); err != nil || fi.Size() != 2000 {
+					t.Errorf("b.bin = %v, %v; want 2000 bytes", fi, err)
+				}
+				if key, _ := e.keys.Get("first"); !e.state.localCache.Has(key) {
+					t.Error("first wasn't cached")
+				}
+				if key, _ := e.keys.Get("second"); e.state.localCache.Has(key) {
+					t.Error("second was cached past the budget")
+				}
+			})
+		})
+	}
+}
+
+func TestSummaryCacheSaved(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			{ID: "small", Outputs: []Path{"small.bin"}, Command: "head -c 10 /dev/zero > small.bin", Cache: true},
+			{ID: "big", Outputs: []Path{"a.bin", "b.bin"}, Command: "sleep 0.1 && head -c 3000 /dev/zero > a.bin && head -c 2000 /dev/zero > b.bin", Cache: true},
+			{ID: "uncached", Outputs: []Path{"u.bin"}, Command: "head -c 100 /dev/zero > u.bin"},
+		})
+		ids := []TaskID{"small", "big", "uncached"}
+		first := newTestExecutor(t, TaskExecutorOptions{})
+		if err := first.ExecuteTasks(taskMap, ids); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+		if s := first.Summary(); s.CacheSavedBytes != 0 || s.CacheSavedTime != 0 {
+			t.Errorf("cold build saved %d bytes / %s, want nothing", s.CacheSavedBytes, s.CacheSavedTime)
+		}
+
+		second := newTestExecutor(t, TaskExecutorOptions{})
+		if err := second.ExecuteTasks(taskMap, ids); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+		s := second.Summary()
+		if s.CacheSavedBytes != 5010 {
+			t.Errorf("CacheSavedBytes = %d, want 5010 (outputs of both hits)", s.CacheSavedBytes)
+		}
+		if s.CacheSavedTime < 100*time.Millisecond {
+			t.Errorf("CacheSavedTime = %s, want at least big's 100ms run", s.CacheSavedTime)
+		}
+
+		var out bytes.Buffer
+		s.Print(NewLogger(&out, &out, LoggerOptions{}))
+		if want := "Cache saved ~4.9 KiB / ~"; !strings.Contains(out.String(), want) {
+			t.Errorf("summary = %q, want it to contain %q", out.String(), want)
+		}
+	})
+}
+
+func TestCriticalPath(t *testing.T) {
+	timings := map[TaskID]taskTiming{
+		"a":   {d: 2 * time.Second},
+		"b":   {d: 2 * time.Second, deps: []TaskID{"a"}},
+		"c":   {d: 2 * time.Second, deps: []TaskID{"b"}},
+		"big": {d: 5 * time.Second},
+		// A dependency that didn't run (e.g. skipped) is ignored.
+		"d": {d: time.Second, deps: []TaskID{"missing"}},
+	}
+	got := criticalPath(timings)
+	want := []TaskDuration{{"a", 2 * time.Second}, {"b", 2 * time.Second}, {"c", 2 * time.Second}}
+	if !slices.Equal(got, want) {
+		t.Errorf("criticalPath = %v, want %v", got, want)
+	}
+	if got := criticalPath(nil); got != nil {
+		t.Errorf("criticalPath(nil) = %v, want nil", got)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// expandTargets resolves command-line targets to task IDs. An argument with
+// glob characters (e.g. "test:*") selects every task whose ID matches it, in
+// ID order, and must match at least one; escape a character with '\' to
+// match it literally. An argument naming a task exactly is always that task,
+// and other arguments pass through for the build to report if unknown.
+// Duplicates are dropped.
+func expandTargets(taskMap TaskMap, args []string) ([]TaskID, error) {
+	var ids []TaskID
+	seen := make(map[TaskID]bool)
+	add := func(id TaskID) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, arg := range args {
+		if _, ok := taskMap[TaskID(arg)]; ok || !hasGlobMeta(arg) {
+			add(TaskID(arg))
+			continue
+		}
+		if !doublestar.ValidatePattern(arg) {
+			return nil, usagef("invalid target pattern %q", arg)
+		}
+		matched := false
+		for _, id := range sortedTaskIDs(taskMap) {
+			if ok, _ := doublestar.Match(arg, string(id)); ok {
+				add(id)
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, usagef("target pattern %q matches no task", arg)
+		}
+	}
+	return ids, nil
+}
+
+// targetDependencies returns the direct dependencies of targets, for
+// -deps-only: building them (and so everything below) prepares the targets
+// without running them. No target's command may run, so a target that
+// another target depends on is left out, and a dependency that would run
+// a target, directly or not, is replaced by its own dependencies in turn.
+// Duplicates are dropped.
+func targetDependencies(taskMap TaskMap, targets []TaskID) ([]TaskID, error) {
+	isTarget := make(map[TaskID]bool)
+	for _, id := range targets {
+		if _, ok := taskMap[id]; !ok {
+			return nil, usagef("task %s not found", id)
+		}
+		isTarget[id] = true
+	}
+	reachesTarget := func(id TaskID) bool {
+		for dep := range dependencyClosure(taskMap, id) {
+			if isTarget[dep] {
+				return true
+			}
+		}
+		return false
+	}
+
+	var deps []TaskID
+	seen := make(map[TaskID]bool)
+	var visit func(TaskID)
+	visit = func(id TaskID) {
+		for _, dep := range taskMap[id].Dependencies {
+			if isTarget[dep] || seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			if reachesTarget(dep) {
+				visit(dep)
+				continue
+			}
+			deps = append(deps, dep)
+		}
+	}
+	for _, id := range targets {
+		visit(id)
+	}
+	return deps, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpandTargets(t *testing.T) {
+	taskMap := NewTaskMap([]Task{
+		{ID: "test:unit"},
+		{ID: "test:e2e"},
+		{ID: "lint"},
+		{ID: "gen*"},
+		{ID: "gen-proto"},
+	})
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    []TaskID
+		wantErr bool
+	}{
+		{name: "literal", args: []string{"lint"}, want: []TaskID{"lint"}},
+		{name: "pattern", args: []string{"test:*"}, want: []TaskID{"test:e2e", "test:unit"}},
+		{name: "mixed without duplicates", args: []string{"test:unit", "test:*", "lint"}, want: []TaskID{"test:unit", "test:e2e", "lint"}},
+		{name: "exact ID with glob characters", args: []string{"gen*"}, want: []TaskID{"gen*"}},
+		{name: "escaped", args: []string{`gen\*`}, want: []TaskID{"gen*"}},
+		{name: "unknown literal passes through", args: []string{"nope"}, want: []TaskID{"nope"}},
+		{name: "no match", args: []string{"deploy:*"}, wantErr: true},
+		{name: "invalid pattern", args: []string{"test:[*"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandTargets(taskMap, tt.args)
+			if tt.wantErr {
+				if exitCode(err) != exitUsage {
+					t.Fatalf("expandTargets = %v, %v; want usage error", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandTargets: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expandTargets = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetDependencies(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			{ID: "gen", Command: "echo gen >> ran.txt"},
+			{ID: "lib", Dependencies: []TaskID{"gen"}, Command: "echo lib >> ran.txt"},
+			{ID: "tool", Command: "echo tool >> ran.txt"},
+			{ID: "app", Dependencies: []TaskID{"lib", "tool"}, Command: "echo app >> ran.txt"},
+			{ID: "test", Dependencies: []TaskID{"app", "tool"}, Command: "echo test >> ran.txt"},
+			{ID: "e2e", Dependencies: []TaskID{"test", "fixtures"}, Command: "echo e2e >> ran.txt"},
+			{ID: "fixtures", Command: "echo fixtures >> ran.txt"},
+		})
+
+		tests := []struct {
+			name    string
+			targets []TaskID
+			want    []TaskID
+		}{
+			{name: "direct dependencies", targets: []TaskID{"app"}, want: []TaskID{"lib", "tool"}},
+			{name: "shared dependency once", targets: []TaskID{"app", "test"}, want: []TaskID{"lib", "tool"}},
+			{name: "no dependencies", targets: []TaskID{"gen"}, want: nil},
+			// Building test would run app, so its other dependencies stand in.
+			{name: "transitive target", targets: []TaskID{"e2e", "app"}, want: []TaskID{"tool", "fixtures", "lib"}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, err := targetDependencies(taskMap, tt.targets)
+				if err != nil {
+					t.Fatalf("targetDependencies: %v", err)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("targetDependencies = %v, want %v", got, tt.want)
+				}
+			})
+		}
+		if _, err := targetDependencies(taskMap, []TaskID{"nope"}); exitCode(err) != exitUsage {
+			t.Errorf("targetDependencies(unknown) err = %v, want usage error", err)
+		}
+
+		// Building them runs the whole subtree below the target, not the target.
+		deps, _ := targetDependencies(taskMap, []TaskID{"app"})
+		build(t, taskMap, TaskExecutorOptions{}, deps...)
+		data, err := os.ReadFile("ran.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ran := strings.Fields(string(data))
+		slices.Sort(ran)
+		if want := []string{"gen", "lib", "tool"}; !slices.Equal(ran, want) {
+			t.Errorf("ran %v, want %v", ran, want)
+		}
+
+		// Neither app nor anything depending on it runs when app is a target.
+		if err := os.Remove("ran.txt"); err != nil {
+			t.Fatal(err)
+		}
+		deps, _ = targetDependencies(taskMap, []TaskID{"e2e", "app"})
+		build(t, taskMap, TaskExecutorOptions{}, deps...)
+		data, err = os.ReadFile("ran.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ran = strings.Fields(string(data))
+		slices.Sort(ran)
+		if want := []string{"fixtures", "gen", "lib", "tool"}; !slices.Equal(ran, want) {
+			t.Errorf("ran %v, want %v", ran, want)
+		}
+	})
+}
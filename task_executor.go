@@ -2,15 +2,21 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/sync/errgroup"
@@ -22,25 +28,322 @@ type TaskExecutor struct {
 	memo  *TaskMemo
 	log   *Logger
 
-	sandbox bool
+	sandbox          bool
+	checkHermetic    bool
+	checkWrites      bool
+	strict           bool
+	explainCache     bool
+	traceInputs      bool
+	keyPayloadDir    string
+	warnCollisions   bool
+	deterministic    bool
+	buildTimeout     time.Duration
+	ctx              context.Context // canceled on SIGINT/SIGTERM or when the build timeout expires
+	requireCacheable bool
+	verbose          bool
+	jobs             int
+	pools            map[string]int
 
+	journal        *RunJournal
+	continueRun    bool
+	alwaysRun      map[TaskID]bool // set by RunTask; never skipped by -continue
+	targets        map[TaskID]bool // tasks requested from ExecuteTasks
+	onlyOutputs    []Path
+	strictOutputs  bool
+	skip           map[TaskID]bool
+	refresh        map[TaskID]bool
+	refreshed      map[TaskID]bool // refresh plus their dependents in this build
+	stageGuard     stageGuard      // hardlinked sources made read-only while tasks run
+	cacheMode      CacheMode
+	allowlist      CommandAllowlist
+	mergeStderr    bool
+	maxOutputLines int
+	cacheFailures  bool
+	observer       Observer
+
+	failedMu        sync.Mutex
+	allowedFailures map[TaskID]error
+
+	cacheBytesMu sync.Mutex
+	cacheBytes   map[TaskID]int64 // bytes each task stored in the cache this run
+	savedBytes   int64            // output bytes of this run's cache hits
+	savedTime    time.Duration    // recorded run time of this run's cache hits
+
+	criticalPath bool
+	printOrder   bool
+	timingsMu    sync.Mutex
+	timings      map[TaskID]taskTiming // tasks executed this run
+
+	keyOwnersMu sync.Mutex
+	keyOwners   map[string]TaskID // task key -> first task that computed it
+
+	outputOwnersMu sync.Mutex
+	outputOwners   map[Path]TaskID // expanded output -> task that produced it this run
+	produced       map[TaskID]bool // tasks whose command ran this build
+
+	sandboxBase    string
+	stageMode      SandboxStageMode
 	sandboxOnce    sync.Once
 	sandboxRootDir string
 	sandboxInitErr error
+
+	// ignore is the workspace ignore file, read once by Load.
+	ignore *IgnoreRules
 }
 
-func NewTaskExecutor(cacheRoot string, stampCachePath string, log *Logger, sandbox bool) *TaskExecutor {
+type TaskExecutorOptions struct {
+	// Jobs is the maximum number of tasks run in parallel. Zero means the
+	// number of CPUs.
+	Jobs int
+	// Pools limits how many tasks of each Task.Pool run at once, within
+	// Jobs. A pool missing here is unlimited.
+	Pools map[string]int
+	// Sandbox runs tasks in a sandbox directory under .build-tool.
+	Sandbox bool
+	// SandboxDir is where per-run sandbox directories are created. Empty
+	// means .build-tool/sandboxes.
+	SandboxDir string
+	// SandboxStageMode selects how inputs are placed in sandboxes; empty
+	// means StageSymlink. Containerized tasks always get copies.
+	SandboxStageMode SandboxStageMode
+	// StampVerify re-hashes recently modified or small files on a stamp hit.
+	StampVerify bool
+	// RestoreMode is how cached outputs are restored into the workspace;
+	// empty means RestoreHardlink. Base cache hits are always copied.
+	RestoreMode RestoreMode
+	// VerifyCache checks each restored entry's outputs against its manifest
+	// and digests and treats a mismatch as a miss, evicting the entry so the
+	// rerun stores a good copy.
+	VerifyCache bool
+	// StampMode selects how file stamps are compared; empty means StampFull.
+	StampMode StampMode
+	// CacheMaxBytesPerBuild stops storing outputs once this many bytes have
+	// been written to the cache. Zero means unlimited.
+	CacheMaxBytesPerBuild int64
+	// CachePackBelow stores outputs smaller than this many bytes in one pack
+	// file per cache entry (see LocalCache.PackBelow). Zero disables packing.
+	CachePackBelow int64
+	// CheckHermetic reports files a sandboxed task writes without declaring
+	// them as outputs.
+	CheckHermetic bool
+	// CheckWrites fails tasks run outside the sandbox that change workspace
+	// files outside their declared outputs, or with more than one job,
+	// outside any task's (see write_check.go).
+	CheckWrites bool
+	// Strict turns consistency warnings into failures: undeclared outputs
+	// fail the task, and cache entries whose stored command differs from the
+	// task's are treated as misses.
+	Strict bool
+	// Explain logs each task's cache decision: key, which cache layers had
+	// it, and how its inputs were digested.
+	Explain bool
+	// RequireCacheable fails a build before anything runs if a task it
+	// needs can't be restored from the cache, e.g. for release builds.
+	RequireCacheable bool
+	// TraceInputs logs every input file of each task key with its digest and
+	// whether it was hashed or taken from the stamp cache.
+	TraceInputs bool
+	// DumpKeyPayloadDir, if set, is where each task's key payload is
+	// written as <task>.json, for diffing keys across machines.
+	DumpKeyPayloadDir string
+	// BuildTimeout, if positive, caps each ExecuteTasks call: when it
+	// expires, running commands are killed, nothing else starts, nothing
+	// more is stored in the cache, and ErrBuildTimedOut is returned.
+	BuildTimeout time.Duration
+	// Deterministic starts ready tasks in task ID order and logs each task's
+	// lines in one block, in an order fixed before the build starts, so an
+	// identical build logs identical bytes.
+	Deterministic bool
+	// WarnKeyCollisions logs a warning when two tasks compute the same key
+	// in one build, which makes them share a cache entry.
+	WarnKeyCollisions bool
+	// NamespaceByID folds each task's ID into its key, so tasks never share
+	// cache entries (see KeyOptions.NamespaceByID).
+	NamespaceByID bool
+	// Verbose logs diagnostics that are usually noise, such as input globs
+	// whose matches were all excluded again.
+	Verbose bool
+	// JournalPath is where tasks that succeeded are recorded so a failed
+	// build can be resumed. Empty disables the journal.
+	JournalPath string
+	// Continue skips tasks the journal records as having succeeded in the
+	// previous run with an unchanged key.
+	Continue bool
+	// BaseCacheDir is a read-only cache (e.g. a snapshot from a previous CI
+	// pipeline) consulted before the local cache. Entries are never written
+	// to it.
+	BaseCacheDir string
+	// KeyIncludesToolVersion folds the tool's build ID into every task key,
+	// so entries are never reused across builds of the tool.
+	KeyIncludesToolVersion bool
+	// SampleLargeInputs, if positive, only samples inputs larger than this
+	// many bytes when hashing them (see KeyOptions.SampleLargeInputs).
+	SampleLargeInputs int64
+	// NormalizeEOL lists extensions of text inputs hashed with CRLF read as
+	// LF (see KeyOptions.NormalizeEOL).
+	NormalizeEOL map[string]bool
+	// Observer, if set, is told about task lifecycle events.
+	Observer Observer
+	// MaxTaskOutputLines, if positive, holds back each task's output: a
+	// successful task logs a one-line summary instead, a failed one the last
+	// MaxTaskOutputLines lines.
+	MaxTaskOutputLines int
+	// CacheFailures records a command's non-zero exit and output under its
+	// task key, and replays them instead of rerunning while the key is
+	// unchanged. Opt-in: a flaky failure stays cached until an input changes
+	// or the build runs without it.
+	CacheFailures bool
+	// MergeStderr sends each task's stderr into the same pipe as its stdout,
+	// so their lines keep the order a terminal would show. Without it the
+	// two streams are read concurrently and may interleave differently.
+	MergeStderr bool
+	// CommandAllowlist, if set, refuses to run commands whose executables
+	// aren't listed, for building untrusted configs.
+	CommandAllowlist CommandAllowlist
+	// CacheMode applies to every task on top of its own cache setting, e.g.
+	// CacheRead keeps a CI lane from writing to a shared cache.
+	CacheMode CacheMode
+	// OnlyOutputs, if set, restricts what a cache hit of a requested task
+	// restores to the outputs matching these globs (or under these
+	// directories). Dependencies are always restored in full, and a task
+	// that runs still produces everything.
+	OnlyOutputs []Path
+	// StrictOutputs warns after a cache hit when the restored outputs differ
+	// from what the task's output specs match in the workspace.
+	StrictOutputs bool
+	// Skip prunes these tasks, and the dependencies only they need, from
+	// every build. A build in which a task that still runs depends on a
+	// skipped one is a usage error: it would run without those outputs.
+	Skip []TaskID
+	// Refresh runs these tasks instead of restoring them and stores the new
+	// results, like CacheWrite for just these tasks. Their keys don't
+	// change, so their dependents in the build are refreshed too; other
+	// tasks are restored as usual.
+	Refresh []TaskID
+	// CriticalPath adds the build's critical path to the summary.
+	CriticalPath bool
+	// PrintOrder logs the planned tasks layer by layer before running them.
+	PrintOrder bool
+	// RemoteCache is the base URL of an HTTP remote cache. Entries missing
+	// locally are fetched from it and newly stored entries are uploaded.
+	RemoteCache string
+	// Offline ignores RemoteCache and BaseCacheDir, so the build only uses
+	// the local cache.
+	Offline bool
+}
+
+func NewTaskExecutor(cacheRoot string, stampCachePath string, log *Logger, opts TaskExecutorOptions) *TaskExecutor {
+	stampOpts := StampCacheOptions{Verify: opts.StampVerify, Mode: opts.StampMode, Log: log}
+	state := NewBuildState(cacheRoot, stampCachePath, stampOpts)
+	state.localCache.MaxBytesWritten = opts.CacheMaxBytesPerBuild
+	state.localCache.Jobs = opts.Jobs
+	state.localCache.Verify = opts.VerifyCache
+	state.localCache.RestoreMode = opts.RestoreMode
+	state.localCache.PackBelow = opts.CachePackBelow
+	if opts.BaseCacheDir != "" {
+		state.baseCache = NewLocalCache(opts.BaseCacheDir)
+		state.baseCache.Jobs = opts.Jobs
+		state.baseCache.Verify = opts.VerifyCache
+		// The base cache is shared and not ours to guard: a hardlinked
+		// output edited in place would change it for every later user.
+		state.baseCache.RestoreMode = RestoreCopy
+	}
+	if opts.RemoteCache != "" {
+		state.remote = NewRemoteCache(opts.RemoteCache)
+	}
+	state.offline = opts.Offline
+	state.keyOpts = keyOptions(opts.KeyIncludesToolVersion)
+	state.keyOpts.SampleLargeInputs = opts.SampleLargeInputs
+	state.keyOpts.NormalizeEOL = opts.NormalizeEOL
+	state.keyOpts.NamespaceByID = opts.NamespaceByID
+	jobs := opts.Jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+	var journal *RunJournal
+	if opts.JournalPath != "" {
+		journal = NewRunJournal(opts.JournalPath)
+	}
+	var skip map[TaskID]bool
+	for _, id := range opts.Skip {
+		if skip == nil {
+			skip = make(map[TaskID]bool)
+		}
+		skip[id] = true
+	}
+	var refresh map[TaskID]bool
+	for _, id := range opts.Refresh {
+		if refresh == nil {
+			refresh = make(map[TaskID]bool)
+		}
+		refresh[id] = true
+	}
+	sandboxBase := opts.SandboxDir
+	if sandboxBase == "" {
+		sandboxBase = defaultSandboxDir
+	}
 	return &TaskExecutor{
-		state:   NewBuildState(cacheRoot, stampCachePath),
-		keys:    NewTaskKeyStore(),
-		memo:    NewTaskMemo(),
-		log:     log,
-		sandbox: sandbox,
+		state:            state,
+		keys:             NewTaskKeyStore(),
+		memo:             NewTaskMemo(),
+		log:              log,
+		sandbox:          opts.Sandbox,
+		checkHermetic:    opts.CheckHermetic,
+		checkWrites:      opts.CheckWrites,
+		strict:           opts.Strict,
+		explainCache:     opts.Explain,
+		traceInputs:      opts.TraceInputs,
+		keyPayloadDir:    opts.DumpKeyPayloadDir,
+		warnCollisions:   opts.WarnKeyCollisions,
+		deterministic:    opts.Deterministic,
+		buildTimeout:     opts.BuildTimeout,
+		ctx:              context.Background(),
+		requireCacheable: opts.RequireCacheable,
+		verbose:          opts.Verbose,
+		jobs:             jobs,
+		pools:            opts.Pools,
+		journal:          journal,
+		continueRun:      opts.Continue,
+		sandboxBase:      sandboxBase,
+		stageMode:        opts.SandboxStageMode,
+		skip:             skip,
+		refresh:          refresh,
+		cacheMode:        opts.CacheMode,
+		allowlist:        opts.CommandAllowlist,
+		mergeStderr:      opts.MergeStderr,
+		maxOutputLines:   opts.MaxTaskOutputLines,
+		criticalPath:     opts.CriticalPath,
+		printOrder:       opts.PrintOrder,
+		onlyOutputs:      opts.OnlyOutputs,
+		strictOutputs:    opts.StrictOutputs,
+		cacheFailures:    opts.CacheFailures,
+		observer:         opts.Observer,
 	}
 }
 
 func (e *TaskExecutor) Load() error {
-	return e.state.Load()
+	if err := e.state.Load(); err != nil {
+		return err
+	}
+	ignore, err := LoadIgnoreRules(ignoreFilePath)
+	if err != nil {
+		return fmt.Errorf("load ignore file: %w", err)
+	}
+	e.ignore = ignore
+	e.state.keyOpts.Ignore = ignore
+	if e.journal != nil {
+		return e.journal.Load()
+	}
+	return nil
+}
+
+// FinishRun updates the run journal: cleared after a successful build, kept
+// for --continue after a failed one.
+func (e *TaskExecutor) FinishRun(success bool) error {
+	if e.journal == nil {
+		return nil
+	}
+	return e.journal.Finish(success)
 }
 
 func (e *TaskExecutor) Save() error {
@@ -48,9 +351,6 @@ func (e *TaskExecutor) Save() error {
 }
 
 func (e *TaskExecutor) CleanupSandbox() error {
-	if !e.sandbox {
-		return nil
-	}
 	// Don't create a sandbox root just to delete it.
 	if e.sandboxRootDir == "" {
 		return nil
@@ -59,70 +359,585 @@ func (e *TaskExecutor) CleanupSandbox() error {
 }
 
 func (e *TaskExecutor) ExecuteTasks(taskMap TaskMap, taskIDs []TaskID) error {
-	if err := e.executeTasks(taskMap, taskIDs, true); err != nil {
+	e.targets = make(map[TaskID]bool)
+	for _, id := range taskIDs {
+		e.targets[id] = true
+	}
+	// Tasks run in their own process groups (setProcessGroup), so a Ctrl-C
+	// only reaches build-tool; canceling ctx kills the groups.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if e.buildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.buildTimeout)
+		defer cancel()
+	}
+	e.ctx = ctx
+	defer func() { e.ctx = context.Background() }()
+	if err := e.executeGraph(taskMap, taskIDs); err != nil {
 		return err
 	}
+
+	if e.sandbox {
+		// In sandbox mode we avoid writing intermediate outputs into the workspace.
+		// Export only the explicitly requested (top-level) tasks.
+		if err := e.exportOutputs(taskMap, taskIDs); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (e *TaskExecutor) executeTasks(taskMap TaskMap, taskIDs []TaskID, topLevel bool) error {
-	g := new(errgroup.Group)
+// restoreSelection returns the outputs to restore for id: nil (all of them)
+// unless id was requested, OnlyOutputs is set and id was a cache hit. A task
+// that ran produces everything, so a sandboxed run exports everything too.
+func (e *TaskExecutor) restoreSelection(id TaskID) []Path {
+	if !e.targets[id] {
+		return nil
+	}
+	e.outputOwnersMu.Lock()
+	defer e.outputOwnersMu.Unlock()
+	if e.produced[id] {
+		return nil
+	}
+	return e.onlyOutputs
+}
 
-	for _, id := range taskIDs {
-		task, exists := taskMap[id]
-		if !exists {
-			return fmt.Errorf("task %s not found", id)
+// warnUnmatchedOnlyOutputs warns about each -only-outputs pattern that
+// selects none of the outputs in id's cache entry for taskKey, which would
+// otherwise be restored as an empty hit without a word.
+func (e *TaskExecutor) warnUnmatchedOnlyOutputs(id TaskID, taskKey string, only []Path) {
+	manifest, err := e.state.cacheFor(taskKey).readManifest(taskKey)
+	if err != nil {
+		return
+	}
+	for _, pat := range only {
+		if len(matchingOutputs(manifest.Outputs, []Path{pat})) == 0 {
+			e.log.Taskf(id, "warning: -only-outputs %s matches none of its outputs; nothing restored for it", pat)
 		}
-		t := task
+	}
+}
 
-		g.Go(func() error {
-			return e.executeTask(taskMap, t)
-		})
+// RunTask builds the dependencies of id as usual, using the cache, and then
+// always runs id itself without looking it up in or storing it to the cache.
+// It is for running programs rather than producing artifacts.
+func (e *TaskExecutor) RunTask(taskMap TaskMap, id TaskID) error {
+	task, ok := taskMap[id]
+	if !ok {
+		return usagef("task %s not found", id)
 	}
+	task.Cache = false
+	runMap := maps.Clone(taskMap)
+	runMap[id] = task
+	e.alwaysRun = map[TaskID]bool{id: true}
+	return e.ExecuteTasks(runMap, []TaskID{id})
+}
 
-	if err := g.Wait(); err != nil {
+// stopReason returns why e.ctx was canceled: ErrBuildTimedOut or
+// ErrBuildInterrupted.
+func (e *TaskExecutor) stopReason() error {
+	if errors.Is(e.ctx.Err(), context.DeadlineExceeded) {
+		return ErrBuildTimedOut
+	}
+	return ErrBuildInterrupted
+}
+
+type taskResult struct {
+	id  TaskID
+	err error
+}
+
+// executeGraph runs taskIDs and their transitive dependencies. The graph is
+// walked once: each task is handed to a fixed pool of workers as soon as all
+// of its dependencies have succeeded, so shared dependencies are scheduled
+// once rather than requested by every dependent. After a failure, tasks
+// that don't depend on the failed one still run; the first error is returned.
+func (e *TaskExecutor) executeGraph(taskMap TaskMap, taskIDs []TaskID) error {
+	for id := range e.skip {
+		if _, ok := taskMap[id]; !ok {
+			return usagef("-skip: task %s not found", id)
+		}
+	}
+	for id := range e.refresh {
+		if _, ok := taskMap[id]; !ok {
+			return usagef("-refresh: task %s not found", id)
+		}
+	}
+
+	pending := make(map[TaskID]int) // unfinished dependencies per task
+	dependents := make(map[TaskID][]TaskID)
+	var visit func(id TaskID) error
+	visit = func(id TaskID) error {
+		if _, ok := pending[id]; ok {
+			return nil
+		}
+		task, ok := taskMap[id]
+		if !ok {
+			return usagef("task %s not found", id)
+		}
+		// A skipped task's own dependencies aren't needed.
+		if e.skip[id] {
+			pending[id] = 0
+			return nil
+		}
+		pending[id] = len(task.Dependencies)
+		for _, dep := range task.Dependencies {
+			if err := visit(dep); err != nil {
+				return err
+			}
+			dependents[dep] = append(dependents[dep], id)
+		}
+		return nil
+	}
+	for _, id := range taskIDs {
+		if err := visit(id); err != nil {
+			return err
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(pending)) {
+		if e.skip[id] {
+			continue
+		}
+		for _, dep := range taskMap[id].Dependencies {
+			if e.skip[dep] {
+				return usagef("-skip: task %s depends on skipped task %s; skip it too", id, dep)
+			}
+		}
+	}
+	var planned []TaskID
+	for _, id := range slices.Sorted(maps.Keys(pending)) {
+		if !e.skip[id] {
+			planned = append(planned, id)
+		}
+	}
+	if err := checkDeclaredOutputs(taskMap, planned); err != nil {
 		return err
 	}
 
-	if topLevel && e.sandbox {
-		// In sandbox mode we avoid writing intermediate outputs into the workspace.
-		// Export only the explicitly requested (top-level) tasks.
-		for _, id := range taskIDs {
-			task, ok := taskMap[id]
-			if !ok {
-				continue
+	// A refreshed task keeps its key, so its dependents would restore
+	// results built from its old outputs: they're refreshed too.
+	e.refreshed = make(map[TaskID]bool)
+	var refreshFrom func(id TaskID)
+	refreshFrom = func(id TaskID) {
+		if e.refreshed[id] || e.skip[id] {
+			return
+		}
+		e.refreshed[id] = true
+		for _, d := range dependents[id] {
+			refreshFrom(d)
+		}
+	}
+	for id := range e.refresh {
+		if _, ok := pending[id]; ok {
+			refreshFrom(id)
+		}
+	}
+
+	// serial_deps: each dependency of such a task also waits for the one
+	// declared before it. The rest of the graph stays parallel.
+	for id := range pending {
+		task := taskMap[id]
+		if !task.SerialDeps || e.skip[id] {
+			continue
+		}
+		for i := 1; i < len(task.Dependencies); i++ {
+			prev, dep := task.Dependencies[i-1], task.Dependencies[i]
+			if dependsOn(taskMap, prev, dep) {
+				return usagef("task %s: serial_deps lists %s before %s, but %s depends on %s", id, prev, dep, prev, dep)
 			}
-			if !task.Cache {
-				continue
+			pending[dep]++
+			dependents[prev] = append(dependents[prev], dep)
+		}
+	}
+
+	if e.requireCacheable {
+		if err := e.checkCacheable(taskMap, pending); err != nil {
+			return err
+		}
+	}
+
+	if e.printOrder {
+		e.logPlan(pending, dependents)
+	}
+
+	if e.deterministic {
+		e.log.GroupTaskLines(scheduleOrder(pending, dependents))
+		defer e.log.FlushTaskLines()
+	}
+
+	var ready []TaskID
+	for id, n := range pending {
+		if n == 0 {
+			ready = append(ready, id)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool { return ready[i] < ready[j] })
+
+	workers := min(e.jobs, len(pending))
+	work := make(chan TaskID)
+	results := make(chan taskResult)
+	for range workers {
+		go func() {
+			for id := range work {
+				results <- taskResult{id: id, err: e.executeTask(taskMap, taskMap[id])}
 			}
-			key, ok := e.keys.Get(id)
-			if !ok {
+		}()
+	}
+
+	var firstErr error
+	running, finished := 0, 0
+	poolRunning := make(map[string]int)
+	timeout := e.ctx.Done()
+	for len(ready) > 0 || running > 0 {
+		// A nil channel disables the send case while nothing is ready or
+		// every ready task waits for a pool slot.
+		var send chan TaskID
+		var next TaskID
+		i := e.nextRunnable(taskMap, ready, poolRunning)
+		if i >= 0 {
+			send, next = work, ready[i]
+		}
+
+		select {
+		case <-timeout:
+			// Running tasks are being killed; wait for them, start nothing.
+			timeout = nil
+			ready = nil
+		case send <- next:
+			ready = slices.Delete(ready, i, i+1)
+			running++
+			poolRunning[taskMap[next].Pool]++
+		case r := <-results:
+			running--
+			finished++
+			poolRunning[taskMap[r.id].Pool]--
+			if e.deterministic {
+				e.log.EndTaskLines(r.id)
+			}
+			if r.err != nil {
+				if firstErr == nil {
+					firstErr = r.err
+				}
 				continue
 			}
-			if _, err := e.state.Restore(key, task.Outputs); err != nil {
-				return fmt.Errorf("export outputs for task %s: %w", id, err)
+			for _, d := range dependents[r.id] {
+				pending[d]--
+				if pending[d] == 0 {
+					ready = append(ready, d)
+				}
+			}
+			if e.deterministic {
+				sort.Slice(ready, func(i, j int) bool { return ready[i] < ready[j] })
+			}
+		}
+	}
+	close(work)
+
+	if e.ctx.Err() != nil {
+		if err := e.stopReason(); err != ErrBuildTimedOut {
+			return err
+		}
+		return fmt.Errorf("%w after %s", ErrBuildTimedOut, e.buildTimeout)
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if finished < len(pending) {
+		return fmt.Errorf("%w among %d task(s)", ErrDependencyCycle, len(pending)-finished)
+	}
+	return nil
+}
+
+// scheduleOrder returns the order tasks would run in one at a time,
+// starting ready tasks in ID order. It doesn't modify pending.
+func scheduleOrder(pending map[TaskID]int, dependents map[TaskID][]TaskID) []TaskID {
+	left := maps.Clone(pending)
+	var ready, order []TaskID
+	for id, n := range left {
+		if n == 0 {
+			ready = append(ready, id)
+		}
+	}
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool { return ready[i] < ready[j] })
+		id := ready[0]
+		ready = ready[1:]
+		order = append(order, id)
+		for _, d := range dependents[id] {
+			left[d]--
+			if left[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+	return order
+}
+
+// scheduleLayers groups the tasks of pending by depth: the first layer has
+// no unfinished dependencies, and each later one depends only on earlier
+// layers, so the tasks within a layer can run in parallel. Layers are
+// sorted by ID. Tasks on a cycle are in no layer. It doesn't modify pending.
+func scheduleLayers(pending map[TaskID]int, dependents map[TaskID][]TaskID) [][]TaskID {
+	left := maps.Clone(pending)
+	var layer []TaskID
+	for id, n := range left {
+		if n == 0 {
+			layer = append(layer, id)
+		}
+	}
+	var layers [][]TaskID
+	for len(layer) > 0 {
+		sort.Slice(layer, func(i, j int) bool { return layer[i] < layer[j] })
+		layers = append(layers, layer)
+		var next []TaskID
+		for _, id := range layer {
+			for _, d := range dependents[id] {
+				left[d]--
+				if left[d] == 0 {
+					next = append(next, d)
+				}
 			}
+		}
+		layer = next
+	}
+	return layers
+}
+
+// logPlan logs the build's layers for -print-order.
+func (e *TaskExecutor) logPlan(pending map[TaskID]int, dependents map[TaskID][]TaskID) {
+	layers := scheduleLayers(pending, dependents)
+	var b strings.Builder
+	fmt.Fprintf(&b, "Execution order: %d task(s) in %d layer(s); a layer's tasks can run in parallel\n", len(pending), len(layers))
+	for i, layer := range layers {
+		ids := make([]string, len(layer))
+		for j, id := range layer {
+			ids[j] = string(id)
+		}
+		fmt.Fprintf(&b, "  %d: %s\n", i+1, strings.Join(ids, " "))
+	}
+	e.log.Printf("%s", b.String())
+}
+
+// checkCacheable fails unless every planned task can be restored from the
+// cache, listing all that can't. Skipped tasks and the target of RunTask,
+// which never uses the cache by design, are exempt.
+func (e *TaskExecutor) checkCacheable(taskMap TaskMap, planned map[TaskID]int) error {
+	var bad []string
+	for id := range planned {
+		task := taskMap[id]
+		if e.skip[id] || e.alwaysRun[id] || e.refreshed[id] {
+			continue
+		}
+		switch {
+		case !e.cacheReads(task):
+			bad = append(bad, fmt.Sprintf("%s (cache disabled)", id))
+		case len(task.Outputs) == 0 && !task.Idempotent && !(e.sandbox && task.Sandbox):
+			// Outside the sandbox an entry without outputs never counts as
+			// a hit, so such a task always runs.
+			bad = append(bad, fmt.Sprintf("%s (no outputs and not idempotent)", id))
+		}
+	}
+	if len(bad) == 0 {
+		return nil
+	}
+	sort.Strings(bad)
+	return usagef("-require-cacheable: %d task(s) can't be restored from the cache:\n  %s", len(bad), strings.Join(bad, "\n  "))
+}
 
-			outs, err := e.state.localCache.ReadManifestOutputs(key)
-			if err == nil {
-				e.state.UpdateOutputStamps(outs)
+// dependsOn reports whether task a depends on task b, directly or not.
+func dependsOn(taskMap TaskMap, a, b TaskID) bool {
+	seen := make(map[TaskID]bool)
+	var walk func(id TaskID) bool
+	walk = func(id TaskID) bool {
+		if seen[id] {
+			return false
+		}
+		seen[id] = true
+		for _, dep := range taskMap[id].Dependencies {
+			if dep == b || walk(dep) {
+				return true
 			}
 		}
+		return false
 	}
+	return walk(a)
+}
 
+// exportOutputs restores the cached outputs of taskIDs into the workspace.
+func (e *TaskExecutor) exportOutputs(taskMap TaskMap, taskIDs []TaskID) error {
+	for _, id := range taskIDs {
+		task, ok := taskMap[id]
+		if !ok {
+			continue
+		}
+		if !e.cacheUsed(task) || e.skipped(id) {
+			continue
+		}
+		key, ok := e.keys.Get(id)
+		if !ok {
+			continue
+		}
+		only := e.restoreSelection(id)
+		if _, err := e.state.Restore(key, only, task.WriteIfChanged); err != nil {
+			return withExitCode(exitInternal, fmt.Errorf("export outputs for task %s: %w", id, err))
+		}
+		if only != nil {
+			e.warnUnmatchedOnlyOutputs(id, key, only)
+		}
+	}
 	return nil
 }
 
 func (e *TaskExecutor) executeTask(taskMap TaskMap, task Task) error {
 	return e.memo.Do(task.ID, func() error {
-		return e.doExecuteTask(taskMap, task)
+		if e.skip[task.ID] {
+			// The key only marks it (see skipped): executeGraph refused the
+			// build if anything that runs depends on it.
+			e.keys.Set(task.ID, skippedTaskKey(task.ID))
+			e.log.Taskf(task.ID, "SKIPPED (-skip)")
+			return nil
+		}
+		if e.observer != nil {
+			e.observer.OnTaskStart(task.ID)
+		}
+		start := time.Now()
+		err := e.doExecuteTask(taskMap, task)
+		if err == nil && task.OutputNormalize != "" {
+			err = e.setNormalizedDepKey(task)
+		}
+		d := time.Since(start)
+		e.recordTiming(task, d)
+		if e.observer != nil {
+			e.observer.OnTaskFinish(task.ID, err, d)
+		}
+		if err != nil {
+			if !task.AllowFailure {
+				return err
+			}
+			e.recordAllowedFailure(task, err)
+			return nil
+		}
+		if e.journal != nil {
+			if key, ok := e.keys.Get(task.ID); ok {
+				e.journal.Record(task.ID, key)
+			}
+		}
+		return nil
 	})
 }
 
+// setNormalizedDepKey keys the dependents of task, which has
+// output_normalize, on its normalized outputs rather than its task key. They
+// are read from the workspace, or from the cache entry for a sandboxed task
+// whose outputs weren't exported.
+func (e *TaskExecutor) setNormalizedDepKey(task Task) error {
+	dir := ""
+	var outputs []Path
+	if e.sandbox && task.Sandbox && e.cacheUsed(task) {
+		key, _ := e.keys.Get(task.ID)
+		tmp, err := os.MkdirTemp("", "build-tool-normalize-")
+		if err != nil {
+			return withExitCode(exitInternal, err)
+		}
+		defer os.RemoveAll(tmp)
+		manifest, err := e.state.cacheFor(key).RestoreToDir(key, nil, tmp)
+		if err != nil {
+			return withExitCode(exitInternal, fmt.Errorf("read outputs of task %s: %w", task.ID, err))
+		}
+		if manifest != nil {
+			dir, outputs = tmp, manifest.Outputs
+		}
+	}
+	if dir == "" {
+		var err error
+		if outputs, _, err = expandOutputSpecs("", task.Outputs, e.ignore); err != nil {
+			return fmt.Errorf("expand outputs for task %s: %w", task.ID, err)
+		}
+	}
+	depKey, err := normalizedDepKey(task, dir, outputs)
+	if err != nil {
+		return fmt.Errorf("task %s: %w", task.ID, err)
+	}
+	e.keys.SetDepKey(task.ID, depKey)
+	return nil
+}
+
+// recordAllowedFailure tolerates the failure of an allow_failure task so its
+// dependents still run. The task's key is replaced so that dependents built
+// without its outputs never share cache entries with ones built with them.
+func (e *TaskExecutor) recordAllowedFailure(task Task, err error) {
+	e.log.Taskf(task.ID, "warning: failure allowed: %v", err)
+
+	key, _ := e.keys.Get(task.ID)
+	e.keys.Set(task.ID, "failed:"+key)
+
+	e.failedMu.Lock()
+	defer e.failedMu.Unlock()
+	if e.allowedFailures == nil {
+		e.allowedFailures = make(map[TaskID]error)
+	}
+	e.allowedFailures[task.ID] = err
+}
+
+func (e *TaskExecutor) logCacheHit(task Task) {
+	if e.observer != nil {
+		e.observer.OnTaskCacheHit(task.ID)
+	}
+	if task.Idempotent {
+		e.log.TaskDimf(task.ID, "SKIPPED (idempotent, unchanged since last success)")
+		return
+	}
+	e.log.TaskDimf(task.ID, "CACHE HIT")
+}
+
+// cacheReads reports whether task may be restored from the cache, given
+// both its own setting and -cache-mode.
+func (e *TaskExecutor) cacheReads(task Task) bool {
+	return task.Cache && task.CacheMode.Reads() && e.cacheMode.Reads() && !e.refreshed[task.ID]
+}
+
+// cacheWrites reports whether task's outputs may be stored in the cache.
+func (e *TaskExecutor) cacheWrites(task Task) bool {
+	return task.Cache && task.CacheMode.Writes() && e.cacheMode.Writes()
+}
+
+func (e *TaskExecutor) cacheUsed(task Task) bool {
+	return e.cacheReads(task) || e.cacheWrites(task)
+}
+
+func skippedTaskKey(id TaskID) string {
+	return "skipped:" + string(id)
+}
+
+// skipped reports whether id was pruned with -skip in this build.
+func (e *TaskExecutor) skipped(id TaskID) bool {
+	key, ok := e.keys.Get(id)
+	return ok && key == skippedTaskKey(id)
+}
+
+func (e *TaskExecutor) failedAllowed(id TaskID) bool {
+	e.failedMu.Lock()
+	defer e.failedMu.Unlock()
+	_, ok := e.allowedFailures[id]
+	return ok
+}
+
+// runsInSandbox reports whether task's command runs in a sandbox. Without
+// -sandbox, write_if_changed tasks still do, so their outputs can be
+// compared before they reach the workspace; "sandbox": false opts out of
+// both.
+func (e *TaskExecutor) runsInSandbox(task Task) bool {
+	return task.Sandbox && (e.sandbox || task.WriteIfChanged)
+}
+
+// doExecuteTask runs a single task. Its dependencies have already run.
 func (e *TaskExecutor) doExecuteTask(taskMap TaskMap, task Task) error {
-	// Execute dependencies in parallel.
-	if len(task.Dependencies) > 0 {
-		if err := e.executeTasks(taskMap, task.Dependencies, false); err != nil {
+	// Tasks that opt out of the sandbox run in the workspace, so they need
+	// their dependencies' outputs there too.
+	sandbox := e.runsInSandbox(task)
+	if e.sandbox && !sandbox {
+		if err := e.exportOutputs(taskMap, task.Dependencies); err != nil {
 			return err
 		}
 	}
@@ -132,38 +947,164 @@ func (e *TaskExecutor) doExecuteTask(taskMap TaskMap, task Task) error {
 		return err
 	}
 
-	taskKey, taskJSON, err := e.state.ComputeKey(task, depKeys)
+	var progress func(in Path, done, total int64)
+	if e.verbose {
+		progress = func(in Path, done, total int64) {
+			e.log.Taskf(task.ID, "hashing %s: %d%% of %s", in, done*100/total, formatBytes(total))
+		}
+	}
+	var trace func(in Path, digest string, stamped bool)
+	if e.traceInputs {
+		trace = func(in Path, digest string, stamped bool) {
+			source := "hashed"
+			if stamped {
+				source = "stamp cache"
+			}
+			e.log.Taskf(task.ID, "input %s: %s (%s)", in, digest, source)
+		}
+	}
+	taskKey, taskJSON, keyStats, err := e.state.ComputeKey(task, depKeys, progress, trace)
 	if err != nil {
 		return fmt.Errorf("compute task key for task %s: %w", task.ID, err)
 	}
 	e.keys.Set(task.ID, taskKey)
+	if err := e.dumpKeyPayload(task.ID, taskJSON); err != nil {
+		return fmt.Errorf("dump key payload for task %s: %w", task.ID, err)
+	}
+	if e.warnCollisions {
+		e.warnKeyCollision(task.ID, taskKey)
+	}
+	if e.verbose && len(task.Inputs) > 0 {
+		e.warnInputSpecs(task)
+	}
+	explain := cacheExplanation{Key: taskKey, Stats: keyStats, Local: "-", Base: "-", Remote: "-"}
 
-	// Lookup from cache
-	if task.Cache {
-		if e.sandbox {
-			if e.state.localCache.Has(taskKey) {
-				e.log.Taskf(task.ID, "CACHE HIT")
-				return nil
-			}
+	if e.continueRun && e.journal != nil && !e.alwaysRun[task.ID] && !e.refreshed[task.ID] && e.journal.SucceededBefore(task.ID, taskKey) {
+		e.explain(task, explain, "skip (succeeded in previous run)")
+		e.log.Taskf(task.ID, "SKIPPED (succeeded in previous run)")
+		return nil
+	}
+
+	if e.cacheFailures && e.cacheReads(task) {
+		if f := e.state.localCache.LoadFailure(taskKey); f != nil {
+			e.explain(task, explain, "hit (cached failure)")
+			return e.replayFailure(task, f)
+		}
+	}
+
+	if !e.cacheUsed(task) {
+		e.explain(task, explain, "run (cache disabled)")
+		return e.executeTaskRun(taskMap, task, taskKey, taskJSON, sandbox)
+	}
+	if e.refreshed[task.ID] {
+		if e.refresh[task.ID] {
+			e.explain(task, explain, "run (-refresh)")
 		} else {
-			hit, err := e.state.Restore(taskKey, task.Outputs)
-			if err != nil {
-				return fmt.Errorf("cache restore: %w", err)
+			e.explain(task, explain, "run (depends on a refreshed task)")
+		}
+		return e.executeTaskRun(taskMap, task, taskKey, taskJSON, sandbox)
+	}
+	if !e.cacheReads(task) {
+		e.explain(task, explain, "run (cache write-only)")
+		return e.executeTaskRun(taskMap, task, taskKey, taskJSON, sandbox)
+	}
+
+	explain.Local = hitOrMiss(e.state.localCache.Has(taskKey))
+	if e.state.baseCache != nil && !e.state.offline {
+		explain.Base = hitOrMiss(e.state.baseCache.Has(taskKey))
+	}
+	// A remote cache is only an extra source for the local one; failing to
+	// reach it must not fail the build.
+	if e.state.remoteCache() != nil && !e.state.Has(taskKey) {
+		fetched, err := e.state.FetchRemote(context.Background(), taskKey)
+		explain.Remote = hitOrMiss(fetched)
+		if err != nil {
+			explain.Remote = "error"
+			e.log.Taskf(task.ID, "warning: remote cache: %v", err)
+		}
+	}
+
+	// Lookup from cache
+	if !e.checkStoredCommand(task, taskKey) {
+		e.explain(task, explain, "miss (stored command differs)")
+		return e.executeTaskRun(taskMap, task, taskKey, taskJSON, sandbox)
+	}
+	// An idempotent task has nothing to restore; its entry only records
+	// that it succeeded with this key. Without -sandbox, hits are restored
+	// into the workspace even for tasks that run in one.
+	if sandbox && e.sandbox || task.Idempotent {
+		err := e.state.CheckUnmodified(taskKey)
+		if errors.Is(err, ErrCorruptCacheEntry) {
+			e.log.Taskf(task.ID, "warning: %v; treating as a miss", err)
+			explain.Local = "corrupt"
+			err = nil
+		}
+		if err != nil {
+			return withExitCode(exitInternal, fmt.Errorf("cache check: %w", err))
+		}
+		if e.state.Has(taskKey) {
+			if err := e.claimHit(task.ID, taskKey); err != nil {
+				return err
 			}
+			e.explain(task, explain, "hit")
+			e.logCacheHit(task)
+			e.recordCacheSaving(taskKey)
+			return nil
+		}
+	} else {
+		only := e.restoreSelection(task.ID)
+		hit, err := e.state.Restore(taskKey, only, task.WriteIfChanged)
+		if errors.Is(err, ErrCorruptCacheEntry) {
+			e.log.Taskf(task.ID, "warning: %v; treating as a miss", err)
+			explain.Local = "corrupt"
+			hit, err = false, nil
+		}
+		if err != nil {
+			return withExitCode(exitInternal, fmt.Errorf("cache restore: %w", err))
+		}
 
-			if hit {
-				e.log.Taskf(task.ID, "CACHE HIT")
-				return nil
+		if hit {
+			if err := e.claimHit(task.ID, taskKey); err != nil {
+				return err
+			}
+			e.explain(task, explain, "hit")
+			e.logCacheHit(task)
+			e.recordCacheSaving(taskKey)
+			if only != nil {
+				e.log.TaskDimf(task.ID, "restored only outputs matching -only-outputs")
+				e.warnUnmatchedOnlyOutputs(task.ID, taskKey, only)
+			} else if e.strictOutputs {
+				e.checkRestoredOutputs(task, taskKey)
 			}
+			return nil
 		}
 	}
 
-	return e.executeTaskRun(taskMap, task, taskKey, taskJSON, e.sandbox)
+	e.explain(task, explain, "miss")
+	return e.executeTaskRun(taskMap, task, taskKey, taskJSON, sandbox)
+}
+
+// defaultSandboxDir is where sandboxes are created unless
+// TaskExecutorOptions.SandboxDir says otherwise.
+var defaultSandboxDir = filepath.Join(".build-tool", "sandboxes")
+
+// warnInputSpecs logs input globs whose matches later negations all removed,
+// and an input set that ends up empty. A second expansion is only paid for
+// under -verbose.
+func (e *TaskExecutor) warnInputSpecs(task Task) {
+	// The same options as the real expansion, so it can't fail where
+	// that one doesn't (e.g. on a parent input) and hide the warnings.
+	opts := inputExpandOptions(e.ignore)
+	opts.Warn = func(msg string) { e.log.Taskf(task.ID, "warning: %s", msg) }
+	ins, err := ExpandFileSpecsWithOptions("", task.Inputs, opts)
+	if err == nil && len(ins) == 0 {
+		e.log.Taskf(task.ID, "warning: inputs match no files after exclusions")
+	}
 }
 
 func (e *TaskExecutor) sandboxRoot() (string, error) {
 	e.sandboxOnce.Do(func() {
-		base := filepath.Join(".build-tool", "sandboxes")
+		base := e.sandboxBase
 		if err := os.MkdirAll(base, 0o755); err != nil {
 			e.sandboxInitErr = fmt.Errorf("create sandbox base: %w", err)
 			return
@@ -184,8 +1125,23 @@ func (e *TaskExecutor) sandboxRoot() (string, error) {
 }
 
 func (e *TaskExecutor) executeTaskRun(taskMap TaskMap, task Task, taskKey string, taskJSON []byte, sandbox bool) error {
+	if e.allowlist != nil {
+		err := e.allowlist.Check(task.Command, runnerShell(RunnerForTask(task)))
+		if err == nil {
+			err = e.allowlist.CheckEnv(task.Env)
+		}
+		if err == nil {
+			err = e.allowlist.CheckEnv(task.SecretEnv)
+		}
+		if err != nil {
+			return withExitCode(exitUsage, fmt.Errorf("task %s: refusing to run command: %w", task.ID, err))
+		}
+	}
+
 	execDir := ""
 	cleanup := func() {}
+	var linkedSources map[string]FileStamp  // sources of hardlinked inputs
+	cacheSources := make(map[string]string) // staged sources in a cache entry, to its key
 
 	if sandbox {
 		root, err := e.sandboxRoot()
@@ -207,11 +1163,17 @@ func (e *TaskExecutor) executeTaskRun(taskMap TaskMap, task Task, taskKey string
 			return fmt.Errorf("create sandbox work dir: %w", err)
 		}
 		execDir = workDir
+		if task.Dir != "" {
+			if err := os.MkdirAll(filepath.Join(workDir, filepath.FromSlash(task.Dir)), 0o755); err != nil {
+				cleanup()
+				return fmt.Errorf("create sandbox task dir: %w", err)
+			}
+		}
 
 		// Stage inputs.
 		staged := make(map[string]string) // rel (slash) -> src path
 		if len(task.Inputs) > 0 {
-			ins, err := ExpandFileSpecs(task.Inputs)
+			ins, err := ExpandFileSpecsWithOptions("", task.Inputs, inputExpandOptions(e.ignore))
 			if err != nil {
 				cleanup()
 				return fmt.Errorf("expand inputs for task %s: %w", task.ID, err)
@@ -226,24 +1188,34 @@ func (e *TaskExecutor) executeTaskRun(taskMap TaskMap, task Task, taskKey string
 			}
 		}
 
-		// Stage direct dependency outputs.
-		for _, depID := range task.Dependencies {
+		// Stage dependency outputs: those of indirect dependencies inputs
+		// were routed to first, so direct ones win.
+		packedKeys := make(map[TaskID]string)
+		for _, depID := range append(slices.Clone(task.RoutedDeps), task.Dependencies...) {
 			depTask, ok := taskMap[depID]
 			if !ok {
 				cleanup()
 				return fmt.Errorf("task %s depends on unknown task %s", task.ID, depID)
 			}
 
-			depOutputs, depSrcDir, err := e.depOutputsForStaging(depID, depTask)
+			depOutputs, depSrcDir, packedKey, err := e.depOutputsForStaging(depID, depTask)
 			if err != nil {
 				cleanup()
 				return err
 			}
+			if packedKey != "" {
+				for _, out := range depOutputs {
+					delete(staged, filepath.ToSlash(string(out)))
+				}
+				packedKeys[depID] = packedKey
+				continue
+			}
 			for _, out := range depOutputs {
 				rel := filepath.ToSlash(string(out))
 				var src string
 				if depSrcDir != "" {
 					src = filepath.Join(depSrcDir, filepath.FromSlash(string(out)))
+					cacheSources[src], _ = e.keys.Get(depID)
 				} else {
 					src = filepath.FromSlash(string(out))
 				}
@@ -258,123 +1230,435 @@ func (e *TaskExecutor) executeTaskRun(taskMap TaskMap, task Task, taskKey string
 			paths = append(paths, rel)
 		}
 		sort.Strings(paths)
+		// Links to host paths don't resolve inside a container, so
+		// containerized tasks get copies instead.
+		stage := e.stageMode.stager()
+		if task.Image != "" {
+			stage = copyFile
+		} else if e.stageMode == StageHardlink {
+			sources := make([]string, 0, len(paths))
+			for _, rel := range paths {
+				sources = append(sources, staged[rel])
+			}
+			// Read-only while the task runs, so an edit in place fails
+			// rather than reach the workspace or the cache.
+			e.stageGuard.acquire(sources)
+			defer e.stageGuard.release(sources)
+			linkedSources = stagedSourceStamps(sources)
+		}
 		for _, rel := range paths {
 			src := staged[rel]
 			dst := filepath.Join(workDir, filepath.FromSlash(rel))
-			if err := stageFileBySymlink(src, dst); err != nil {
+			// A parent input ("../shared/x.h") lands next to the work dir;
+			// anything further up would leave the sandbox.
+			if r, err := filepath.Rel(sandboxDir, dst); err != nil || !filepath.IsLocal(r) {
+				cleanup()
+				return fmt.Errorf("stage %q: input is more than one directory above the workspace, which sandboxes don't support", rel)
+			}
+			if err := stage(src, dst); err != nil {
 				cleanup()
 				return fmt.Errorf("stage %q: %w", rel, err)
 			}
 		}
+		for _, depID := range slices.Sorted(maps.Keys(packedKeys)) {
+			key := packedKeys[depID]
+			if _, err := e.state.cacheFor(key).RestoreToDir(key, nil, workDir); err != nil {
+				cleanup()
+				return fmt.Errorf("stage outputs of dependency %s: %w", depID, err)
+			}
+		}
 	}
 	defer cleanup()
 
+	if !sandbox {
+		if err := unshareOutputs(task.Outputs); err != nil {
+			return fmt.Errorf("task %s: %w", task.ID, err)
+		}
+	}
+
+	var before map[string]fileSnapshot
+	if sandbox && e.checkHermetic {
+		snap, err := snapshotDir(execDir)
+		if err != nil {
+			return fmt.Errorf("snapshot sandbox for task %s: %w", task.ID, err)
+		}
+		before = snap
+	}
+	var writeSkip map[string]bool
+	var writesBefore map[string]fileSnapshot
+	if !sandbox && e.checkWrites {
+		writeSkip = e.writeCheckSkip()
+		snap, err := snapshotTree(".", writeSkip)
+		if err != nil {
+			return fmt.Errorf("snapshot workspace for task %s: %w", task.ID, err)
+		}
+		writesBefore = snap
+	}
+
+	closeLog, err := e.log.OpenTaskLog(task.ID)
+	if err != nil {
+		return fmt.Errorf("open log file for task %s: %w", task.ID, err)
+	}
+	defer func() {
+		if err := closeLog(); err != nil {
+			e.log.Errorf("error closing log file for task %s: %v\n", task.ID, err)
+		}
+	}()
+
 	// Execute task.
-	e.log.Taskf(task.ID, "$ %s", task.Command)
+	e.log.TaskCommand(task.ID, task.Command)
 
-	cmd := exec.Command("sh", "-c", task.Command)
-	if execDir != "" {
-		cmd.Dir = execDir
+	runner := RunnerForTask(task)
+	if task.FailFast && !RunnerSupportsFailFast(runner) {
+		e.log.Taskf(task.ID, "warning: fail_fast has no effect with a non-POSIX shell")
 	}
-	stdout, err := cmd.StdoutPipe()
+	cmd, err := runner.Command(task, execDir)
 	if err != nil {
-		return fmt.Errorf("stdout pipe for task %s: %w", task.ID, err)
+		return fmt.Errorf("prepare command for task %s: %w", task.ID, err)
 	}
-	stderr, err := cmd.StderrPipe()
+	secrets, err := loadSecretEnv(task)
 	if err != nil {
-		return fmt.Errorf("stderr pipe for task %s: %w", task.ID, err)
+		return fmt.Errorf("task %s: %w", task.ID, err)
 	}
-	if err := cmd.Start(); err != nil {
+	if len(task.Env) > 0 || len(secrets) > 0 {
+		cmd.Env = taskEnviron(task, secrets)
+	}
+	redact := secretRedactor(secrets)
+	var streams []io.Reader
+	closeWriter := func() {}
+	if e.mergeStderr {
+		// One pipe for both streams keeps their relative order, as a
+		// terminal would show it.
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			return fmt.Errorf("output pipe for task %s: %w", task.ID, err)
+		}
+		defer pr.Close()
+		cmd.Stdout, cmd.Stderr = pw, pw
+		streams = []io.Reader{pr}
+		closeWriter = func() { _ = pw.Close() }
+	} else {
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return fmt.Errorf("stdout pipe for task %s: %w", task.ID, err)
+		}
+		stderr, err := cmd.StderrPipe()
+		if err != nil {
+			return fmt.Errorf("stderr pipe for task %s: %w", task.ID, err)
+		}
+		streams = []io.Reader{stdout, stderr}
+	}
+	if e.maxOutputLines > 0 {
+		e.log.BufferTaskOutput(task.ID, e.maxOutputLines)
+		// ProcessState is only set once the command was waited for.
+		defer func() {
+			failed := cmd.ProcessState == nil || !cmd.ProcessState.Success() && !ignoredExitCode(task, cmd.ProcessState.ExitCode())
+			e.log.EndTaskOutput(task.ID, failed)
+		}()
+	}
+	setProcessGroup(cmd)
+	runStart := time.Now()
+	err = cmd.Start()
+	// The child has its own copy; ours would keep the pipe from reaching EOF.
+	closeWriter()
+	if err != nil {
 		return fmt.Errorf("start task %s: %w", task.ID, err)
 	}
+	// Killing the whole group closes the pipes the copies below wait on.
+	stopKill := context.AfterFunc(e.ctx, func() { killProcessGroup(cmd) })
+	defer stopKill()
 
+	var record func(line string)
+	var outputMu sync.Mutex
+	output := newLineRing(failureOutputLines)
+	if e.cacheFailures && e.cacheWrites(task) {
+		record = func(line string) {
+			outputMu.Lock()
+			output.add(line)
+			outputMu.Unlock()
+		}
+	}
 	g := new(errgroup.Group)
-	g.Go(func() error { return e.copyTaskOutput(task.ID, stdout) })
-	g.Go(func() error { return e.copyTaskOutput(task.ID, stderr) })
+	for _, r := range streams {
+		g.Go(func() error { return e.copyTaskOutput(task.ID, r, redact, record) })
+	}
 
-	waitErr := cmd.Wait()
+	// Finish reading before Wait, which closes the pipes.
 	copyErr := g.Wait()
+	waitErr := cmd.Wait()
+	runDuration := time.Since(runStart)
 	if copyErr != nil {
 		return fmt.Errorf("read output for task %s: %w", task.ID, copyErr)
 	}
+	for _, src := range changedStagedSources(linkedSources) {
+		e.log.Taskf(task.ID, "warning: modified hardlinked input %s in place, changing the original too", src)
+		if key, ok := cacheSources[src]; ok && e.state.cacheFor(key) == e.state.localCache {
+			// The blob is shared with the entry (and maybe others):
+			// it must not be restored again.
+			if err := e.state.localCache.EvictCorrupt(key); err != nil {
+				e.log.Taskf(task.ID, "warning: evict cache entry %s: %v", key, err)
+			}
+		}
+	}
+	if e.ctx.Err() != nil {
+		// Abandon the run rather than cache what it got to.
+		return fmt.Errorf("task %s: %w", task.ID, e.stopReason())
+	}
 	if waitErr != nil {
-		return fmt.Errorf("execute task %s: %w", task.ID, waitErr)
+		failErr := newTaskFailedError(task, waitErr)
+		if !ignoredExitCode(task, failErr.ExitCode) {
+			// Signals and the like say more about the machine than the inputs.
+			if record != nil && failErr.ExitCode > 0 {
+				if err := e.state.localCache.StoreFailure(taskKey, cachedFailure{ExitCode: failErr.ExitCode, Output: output.tail(), Omitted: output.total - len(output.lines)}); err != nil {
+					e.log.Taskf(task.ID, "warning: cache failure: %v", err)
+				}
+			}
+			return failErr
+		}
+		e.log.TaskDimf(task.ID, "exit %d treated as success (ignore_exit_codes)", failErr.ExitCode)
+	}
+	if writesBefore != nil {
+		if err := e.checkTaskWrites(taskMap, task, writesBefore, writeSkip); err != nil {
+			return err
+		}
+	}
+	if task.ExpectOutputs != nil {
+		if err := e.checkExpectedOutputs(task, execDir); err != nil {
+			return err
+		}
 	}
 
 	if !sandbox {
 		// Workspace mode: keep the old behavior; only cacheable tasks validate/record outputs.
-		if task.Cache {
-			var expandedOutputs []Path
+		if e.cacheWrites(task) {
+			// A failure recorded for this key, e.g. before a flaky test
+			// passed without -cache-failures, must not be replayed later.
+			e.state.localCache.RemoveFailure(taskKey)
+			var expandedOutputs, outputDirs []Path
 			if len(task.Outputs) > 0 {
-				expandedOutputs, err = ExpandFileSpecs(task.Outputs)
+				expandedOutputs, outputDirs, err = expandOutputSpecs("", task.Outputs, e.ignore)
 				if err != nil {
 					return fmt.Errorf("expand outputs for task %s: %w", task.ID, err)
 				}
+				if err := e.claimOutputs(task.ID, expandedOutputs, true); err != nil {
+					return err
+				}
 			}
 
-			if err := e.state.Store(taskKey, taskJSON, expandedOutputs); err != nil {
-				return fmt.Errorf("cache store error for task %s: %w", task.ID, err)
+			// A successful store stamps the outputs from its digests.
+			if written, err := e.state.Store(task.ID, taskKey, taskJSON, expandedOutputs, outputDirs, runDuration); err != nil {
+				if !errors.Is(err, ErrCacheBudgetExceeded) {
+					return withExitCode(exitInternal, fmt.Errorf("cache store error for task %s: %w", task.ID, err))
+				}
+				e.log.Taskf(task.ID, "warning: %v; outputs not cached", err)
+				e.state.UpdateOutputStamps(expandedOutputs)
+			} else {
+				e.recordCacheBytes(task.ID, written)
+				e.uploadRemote(task, taskKey)
+			}
+		} else if len(task.Outputs) > 0 {
+			// Uncached outputs aren't validated, but they're still claimed.
+			if expandedOutputs, _, err := expandOutputSpecs("", task.Outputs, e.ignore); err == nil {
+				if err := e.claimOutputs(task.ID, expandedOutputs, true); err != nil {
+					return err
+				}
 			}
-
-			e.state.UpdateOutputStamps(expandedOutputs)
 		}
 		return nil
 	}
 
 	// Sandbox mode: expand outputs in the sandbox and export them.
-	var expandedOutputs []Path
+	var expandedOutputs, outputDirs []Path
 	if len(task.Outputs) > 0 {
-		expandedOutputs, err = ExpandFileSpecsInDir(execDir, task.Outputs)
+		expandedOutputs, outputDirs, err = expandOutputSpecs(execDir, task.Outputs, e.ignore)
 		if err != nil {
 			return fmt.Errorf("expand outputs for task %s: %w", task.ID, err)
 		}
+		if err := checkOutputsInDir(execDir, expandedOutputs); err != nil {
+			return fmt.Errorf("task %s: %w", task.ID, err)
+		}
+		if err := e.claimOutputs(task.ID, expandedOutputs, true); err != nil {
+			return err
+		}
 	}
 
-	if task.Cache {
-		if err := e.state.StoreFromDir(taskKey, taskJSON, expandedOutputs, execDir); err != nil {
-			return fmt.Errorf("cache store error for task %s: %w", task.ID, err)
+	if before != nil {
+		if err := e.checkTaskHermetic(task, execDir, before, expandedOutputs); err != nil {
+			return err
+		}
+	}
+
+	stored := false
+	if e.cacheWrites(task) {
+		e.state.localCache.RemoveFailure(taskKey)
+		written, err := e.state.StoreFromDir(task.ID, taskKey, taskJSON, expandedOutputs, outputDirs, execDir, runDuration)
+		switch {
+		case err == nil:
+			stored = true
+			e.recordCacheBytes(task.ID, written)
+			e.uploadRemote(task, taskKey)
+			// Only write_if_changed tasks get here without -sandbox, and
+			// dependents expect their outputs in the workspace.
+			if !e.sandbox {
+				if _, err := e.state.Restore(taskKey, nil, true); err != nil {
+					return fmt.Errorf("export outputs for task %s: %w", task.ID, err)
+				}
+			}
+		case errors.Is(err, ErrCacheBudgetExceeded):
+			e.log.Taskf(task.ID, "warning: %v; outputs not cached", err)
+		default:
+			return withExitCode(exitInternal, fmt.Errorf("cache store error for task %s: %w", task.ID, err))
+		}
+	}
+	if !stored {
+		for _, dir := range outputDirs {
+			if err := os.MkdirAll(filepath.FromSlash(string(dir)), 0o755); err != nil {
+				return fmt.Errorf("export output %q for task %s: %w", dir, task.ID, err)
+			}
 		}
-	} else {
 		for _, out := range expandedOutputs {
 			src := filepath.Join(execDir, filepath.FromSlash(string(out)))
 			dst := filepath.FromSlash(string(out))
+			if task.WriteIfChanged {
+				if d, err := hashFileContents(src); err == nil && hasDigest(dst, d) {
+					continue
+				}
+			}
 			if err := copyFile(src, dst); err != nil {
 				return fmt.Errorf("export output %q for task %s: %w", out, task.ID, err)
 			}
 		}
 	}
 
-	// Note: in sandbox mode, cacheable tasks are exported to the workspace only at
-	// the top level. So we only update output stamps here for non-cache tasks.
-	if !task.Cache {
+	// Note: in sandbox mode, cached tasks are exported to the workspace only at
+	// the top level. So we only update output stamps here for uncached outputs.
+	if !stored {
 		e.state.UpdateOutputStamps(expandedOutputs)
 	}
 	return nil
 }
 
+func (e *TaskExecutor) uploadRemote(task Task, taskKey string) {
+	if err := e.state.UploadRemote(context.Background(), taskKey); err != nil {
+		e.log.Taskf(task.ID, "warning: remote cache: %v", err)
+	}
+}
+
+// TaskFailedError reports a task command that ran but did not succeed.
+type TaskFailedError struct {
+	ID       TaskID
+	Command  string
+	ExitCode int // -1 if the command didn't exit normally (e.g. killed by a signal)
+	Err      error
+}
+
+// ignoredExitCode reports whether task's ignore_exit_codes lists code.
+func ignoredExitCode(task Task, code int) bool {
+	return code > 0 && slices.Contains(task.IgnoreExitCodes, code)
+}
+
+func newTaskFailedError(task Task, err error) *TaskFailedError {
+	code := -1
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		code = ee.ExitCode()
+	}
+	return &TaskFailedError{ID: task.ID, Command: task.Command, ExitCode: code, Err: err}
+}
+
+func (e *TaskFailedError) Error() string {
+	if e.ExitCode >= 0 {
+		return fmt.Sprintf("task %s failed (exit %d): $ %s", e.ID, e.ExitCode, shortCommand(e.Command))
+	}
+	return fmt.Sprintf("task %s failed (%v): $ %s", e.ID, e.Err, shortCommand(e.Command))
+}
+
+func (e *TaskFailedError) Unwrap() error { return e.Err }
+
+// shortCommand returns the first line of cmd, truncated so an error message
+// stays on one line.
+func shortCommand(cmd string) string {
+	const maxLen = 80
+	cmd = strings.TrimSpace(cmd)
+	first, _, multiline := strings.Cut(cmd, "\n")
+	first = strings.TrimSpace(first)
+	if len(first) > maxLen {
+		return first[:maxLen] + "..."
+	}
+	if multiline {
+		return first + " ..."
+	}
+	return first
+}
+
+// checkStoredCommand warns when the cache entry for taskKey was stored for a
+// different command, which indicates a key collision or an entry written by an
+// older key scheme. It returns false if the entry must not be used.
+func (e *TaskExecutor) checkStoredCommand(task Task, taskKey string) bool {
+	stored, ok := e.state.StoredCommand(taskKey)
+	if !ok || stored == task.Command {
+		return true
+	}
+	if e.strict {
+		e.log.Taskf(task.ID, "warning: cached command %q differs from %q; ignoring cache entry", stored, task.Command)
+		return false
+	}
+	e.log.Taskf(task.ID, "warning: cached command %q differs from %q", stored, task.Command)
+	return true
+}
+
+// checkTaskHermetic reports sandbox files the task created or modified
+// without declaring them as outputs.
+func (e *TaskExecutor) checkTaskHermetic(task Task, execDir string, before map[string]fileSnapshot, outputs []Path) error {
+	after, err := snapshotDir(execDir)
+	if err != nil {
+		return fmt.Errorf("snapshot sandbox for task %s: %w", task.ID, err)
+	}
+
+	violations := undeclaredWrites(before, after, outputs)
+	for _, v := range violations {
+		e.log.Taskf(task.ID, "not hermetic: %s undeclared output %s", v.Kind, v.Path)
+	}
+	if len(violations) > 0 && e.strict {
+		return fmt.Errorf("task %s is not hermetic: %d undeclared output(s)", task.ID, len(violations))
+	}
+	return nil
+}
+
 // depOutputsForStaging returns the set of outputs to stage for depID.
 // If srcDir is non-empty, outputs should be read from srcDir/<output>.
-func (e *TaskExecutor) depOutputsForStaging(depID TaskID, depTask Task) (outs []Path, srcDir string, err error) {
-	if depTask.Cache {
+func (e *TaskExecutor) depOutputsForStaging(depID TaskID, depTask Task) (outs []Path, srcDir string, packedKey string, err error) {
+	// A tolerated failure or a skipped task leaves nothing reliable to stage.
+	if e.failedAllowed(depID) || e.skipped(depID) {
+		return nil, "", "", nil
+	}
+	if e.cacheUsed(depTask) {
 		depKey, ok := e.keys.Get(depID)
 		if !ok {
-			return nil, "", fmt.Errorf("missing dependency task key for %s", depID)
+			return nil, "", "", fmt.Errorf("missing dependency task key for %s", depID)
 		}
-		manifestOuts, err := e.state.localCache.ReadManifestOutputs(depKey)
+		cache := e.state.cacheFor(depKey)
+		manifest, err := cache.readManifest(depKey)
 		if err == nil {
-			return manifestOuts, filepath.Join(e.state.localCache.taskDir(depKey), "outputs"), nil
+			if len(manifest.Pack) > 0 {
+				// Packed outputs have no file in the entry to stage from,
+				// and a sandboxed hit was never exported to the workspace:
+				// the caller restores the entry into the sandbox instead.
+				return manifest.Outputs, "", depKey, nil
+			}
+			return manifest.Outputs, filepath.Join(cache.taskDir(depKey), "outputs"), "", nil
 		}
 		// Fall back to expanding from the workspace.
 	}
 
 	if len(depTask.Outputs) == 0 {
-		return nil, "", nil
+		return nil, "", "", nil
 	}
-	wsOuts, err := ExpandFileSpecs(depTask.Outputs)
+	wsOuts, _, err := expandOutputSpecs("", depTask.Outputs, e.ignore)
 	if err != nil {
-		return nil, "", fmt.Errorf("expand outputs for dependency %s: %w", depID, err)
+		return nil, "", "", fmt.Errorf("expand outputs for dependency %s: %w", depID, err)
 	}
-	return wsOuts, "", nil
+	return wsOuts, "", "", nil
 }
 
 func sanitizeSandboxName(s string) string {
@@ -397,6 +1681,27 @@ func sanitizeSandboxName(s string) string {
 	return out
 }
 
+// checkOutputsInDir verifies that every output resolves to a file inside dir.
+// A sandboxed task could otherwise declare a symlink to a file elsewhere on
+// the host and have it stored or exported as its output.
+func checkOutputsInDir(dir string, outputs []Path) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	for _, out := range outputs {
+		resolved, err := filepath.EvalSymlinks(filepath.Join(dir, filepath.FromSlash(string(out))))
+		if err != nil {
+			return fmt.Errorf("resolve output %q: %w", out, err)
+		}
+		rel, err := filepath.Rel(root, resolved)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("output %q resolves to %s, outside the sandbox", out, resolved)
+		}
+	}
+	return nil
+}
+
 func stageFileBySymlink(src, dst string) error {
 	srcAbs, err := filepath.Abs(src)
 	if err != nil {
@@ -418,14 +1723,97 @@ func stageFileBySymlink(src, dst string) error {
 	return copyFile(srcAbs, dst)
 }
 
-func (e *TaskExecutor) copyTaskOutput(taskID TaskID, r io.Reader) error {
+// claimOutputs records id as the producer of outputs, failing if another
+// task already produced one of them in this build. Every task whose outputs
+// land claims them: runs, cached or not, and cache hits (from the manifest).
+// checkDeclaredOutputs has already compared the specs; this catches globs
+// that only overlap once expanded. ran marks id as having run, for
+// restoreSelection.
+func (e *TaskExecutor) claimOutputs(id TaskID, outputs []Path, ran bool) error {
+	e.outputOwnersMu.Lock()
+	defer e.outputOwnersMu.Unlock()
+	if e.outputOwners == nil {
+		e.outputOwners = make(map[Path]TaskID)
+	}
+	if e.produced == nil {
+		e.produced = make(map[TaskID]bool)
+	}
+	for _, out := range outputs {
+		if owner, ok := e.outputOwners[out]; ok && owner != id {
+			return withExitCode(exitUsage, fmt.Errorf("task %s: output %s was already produced by task %s in this build", id, out, owner))
+		}
+	}
+	for _, out := range outputs {
+		e.outputOwners[out] = id
+	}
+	if ran {
+		e.produced[id] = true
+	}
+	return nil
+}
+
+// claimHit claims the outputs of id's cache hit on taskKey, as recorded in
+// its manifest.
+func (e *TaskExecutor) claimHit(id TaskID, taskKey string) error {
+	manifest, err := e.state.cacheFor(taskKey).readManifest(taskKey)
+	if err != nil {
+		return nil // nothing to claim; the restore already read it
+	}
+	return e.claimOutputs(id, manifest.Outputs, false)
+}
+
+// warnKeyCollision warns if another task computed taskKey in this build.
+// Tasks whose command, inputs, outputs and dependencies match share a key,
+// which may be intended deduplication or a copy-paste mistake.
+func (e *TaskExecutor) warnKeyCollision(id TaskID, taskKey string) {
+	e.keyOwnersMu.Lock()
+	defer e.keyOwnersMu.Unlock()
+	if e.keyOwners == nil {
+		e.keyOwners = make(map[string]TaskID)
+	}
+	owner, ok := e.keyOwners[taskKey]
+	if !ok {
+		e.keyOwners[taskKey] = id
+		return
+	}
+	if owner != id {
+		e.log.Taskf(id, "warning: same key as task %s, so they share a cache entry (use -namespace-by-id to keep them apart)", owner)
+	}
+}
+
+// replayFailure reports a failure recorded by -cache-failures as if the
+// command had just failed again.
+func (e *TaskExecutor) replayFailure(task Task, f *cachedFailure) error {
+	e.log.Taskf(task.ID, "CACHED FAILURE (unchanged since it failed; run without -cache-failures to retry)")
+	if e.maxOutputLines > 0 {
+		e.log.BufferTaskOutput(task.ID, e.maxOutputLines)
+		defer e.log.EndTaskOutput(task.ID, true)
+	}
+	if f.Omitted > 0 {
+		e.log.TaskDimf(task.ID, "(%d earlier line(s) of output not recorded)", f.Omitted)
+	}
+	for _, line := range f.Output {
+		e.log.TaskOutput(task.ID, line)
+	}
+	return &TaskFailedError{ID: task.ID, Command: task.Command, ExitCode: f.ExitCode, Err: errCachedFailure}
+}
+
+// copyTaskOutput logs r line by line, passing each line to record if set.
+// Lines are masked with redact first, if set.
+func (e *TaskExecutor) copyTaskOutput(taskID TaskID, r io.Reader, redact *strings.Replacer, record func(line string)) error {
 	br := bufio.NewReader(r)
 	for {
 		line, err := br.ReadString('\n')
 		if line != "" {
 			line = strings.TrimSuffix(line, "\n")
 			line = strings.TrimSuffix(line, "\r")
-			e.log.TaskLine(taskID, line)
+			if redact != nil {
+				line = redact.Replace(line)
+			}
+			e.log.TaskOutput(taskID, line)
+			if record != nil {
+				record(line)
+			}
 		}
 		if err != nil {
 			if errors.Is(err, io.EOF) {
@@ -0,0 +1,2456 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+func newTestExecutor(t *testing.T, opts TaskExecutorOptions) *TaskExecutor {
+	t.Helper()
+	log := NewLogger(io.Discard, io.Discard, LoggerOptions{})
+	root := filepath.Join(".build-tool", "cache")
+	e := NewTaskExecutor(root, filepath.Join(root, "stamps.json"), log, opts)
+	if err := e.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return e
+}
+
+// build runs taskIDs with a fresh executor, like a separate invocation.
+func build(t *testing.T, taskMap TaskMap, opts TaskExecutorOptions, taskIDs ...TaskID) {
+	t.Helper()
+	e := newTestExecutor(t, opts)
+	if err := e.ExecuteTasks(taskMap, taskIDs); err != nil {
+		t.Fatalf("ExecuteTasks: %v", err)
+	}
+	if err := e.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+}
+
+func TestTaskOutputReadToEnd(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			// More than a pipe buffer, written right before exiting.
+			{ID: "chatty", Command: "seq 1 100000"},
+		})
+
+		var out strings.Builder
+		e := newTestExecutor(t, TaskExecutorOptions{})
+		e.log = NewLogger(&out, &out, LoggerOptions{})
+		if err := e.ExecuteTasks(taskMap, []TaskID{"chatty"}); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+		if !strings.HasSuffix(out.String(), " 100000\n") {
+			t.Fatalf("task output is truncated: ends in %q", out.String()[max(0, out.Len()-40):])
+		}
+	})
+}
+
+func TestCheckHermetic(t *testing.T) {
+	tests := []struct {
+		name     string
+		command  string
+		strict   bool
+		wantLogs []string
+		wantErr  bool
+	}{
+		{name: "declared only", command: "cp in.txt out.txt"},
+		{name: "created", command: "cp in.txt out.txt && echo x > stray.txt", wantLogs: []string{"not hermetic: created undeclared output stray.txt"}},
+		{name: "modified input", command: "cp in.txt out.txt && echo x >> in.txt", wantLogs: []string{"not hermetic: modified undeclared output in.txt"}},
+		{name: "strict", command: "cp in.txt out.txt && echo x > stray.txt", strict: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempWD(t, func() {
+				writeFileContent(t, "in.txt", "in")
+				taskMap := NewTaskMap([]Task{
+					{ID: "gen", Inputs: []Path{"in.txt"}, Outputs: []Path{"out.txt"}, Command: tt.command, Sandbox: true},
+				})
+				var out bytes.Buffer
+				e := newTestExecutor(t, TaskExecutorOptions{Sandbox: true, CheckHermetic: true, Strict: tt.strict})
+				e.log = NewLogger(&out, &out, LoggerOptions{})
+				err := e.ExecuteTasks(taskMap, []TaskID{"gen"})
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("ExecuteTasks err = %v, wantErr %v", err, tt.wantErr)
+				}
+				for _, want := range tt.wantLogs {
+					if !strings.Contains(out.String(), want) {
+						t.Errorf("log = %q, want it to contain %q", out.String(), want)
+					}
+				}
+				if len(tt.wantLogs) == 0 && !tt.wantErr && strings.Contains(out.String(), "not hermetic") {
+					t.Errorf("log = %q, want no hermeticity warning", out.String())
+				}
+			})
+		})
+	}
+}
+
+func TestSandboxOptOut(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "src.txt", "src")
+		taskMap := NewTaskMap([]Task{
+			{ID: "gen", Inputs: []Path{"src.txt"}, Outputs: []Path{"gen.txt"}, Command: "cp src.txt gen.txt", Cache: true, Sandbox: true},
+			// Runs in the workspace, where gen's output must be exported.
+			{ID: "use", Dependencies: []TaskID{"gen"}, Outputs: []Path{"use.txt"}, Command: "cp gen.txt use.txt && pwd > where.txt", Cache: true},
+		})
+		build(t, taskMap, TaskExecutorOptions{Sandbox: true}, "use")
+
+		if got, err := os.ReadFile("use.txt"); err != nil || string(got) != "src" {
+			t.Errorf("use.txt = %q, %v; want %q", got, err, "src")
+		}
+		where, err := os.ReadFile("where.txt")
+		if err != nil {
+			t.Fatalf("the opted-out task didn't run in the workspace: %v", err)
+		}
+		wd, _ := os.Getwd()
+		wd, _ = filepath.EvalSymlinks(wd)
+		if got := strings.TrimSpace(string(where)); got != wd {
+			t.Errorf("use ran in %s, want the workspace %s", got, wd)
+		}
+	})
+}
+
+func TestContinueFromJournal(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			{ID: "a", Command: "echo run >> a.log"},
+			{ID: "b", Dependencies: []TaskID{"a"}, Command: "test -f ok"},
+		})
+		journal := filepath.Join(".build-tool", "journal.json")
+		run := func(opts TaskExecutorOptions) error {
+			t.Helper()
+			opts.JournalPath = journal
+			e := newTestExecutor(t, opts)
+			err := e.ExecuteTasks(taskMap, []TaskID{"b"})
+			if ferr := e.FinishRun(err == nil); ferr != nil {
+				t.Fatalf("FinishRun: %v", ferr)
+			}
+			return err
+		}
+		runs := func() int {
+			data, _ := os.ReadFile("a.log")
+			return strings.Count(string(data), "run")
+		}
+
+		if err := run(TaskExecutorOptions{}); err == nil {
+			t.Fatal("first build succeeded, want b to fail")
+		}
+		writeFile(t, "ok")
+		if err := run(TaskExecutorOptions{Continue: true}); err != nil {
+			t.Fatalf("continued build: %v", err)
+		}
+		if n := runs(); n != 1 {
+			t.Errorf("a ran %d times, want once: -continue should skip it", n)
+		}
+		if _, err := os.Stat(journal); !os.IsNotExist(err) {
+			t.Errorf("journal after a successful build: %v, want it removed", err)
+		}
+
+		// Nothing to continue from after a success.
+		if err := run(TaskExecutorOptions{Continue: true}); err != nil {
+			t.Fatalf("third build: %v", err)
+		}
+		if n := runs(); n != 2 {
+			t.Errorf("a ran %d times, want twice", n)
+		}
+	})
+}
+
+func TestCacheHitRecordsOutputStamps(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "src.txt")
+
+		taskMap := NewTaskMap([]Task{
+			{ID: "gen", Inputs: []Path{"src.txt"}, Outputs: []Path{"gen.txt"}, Command: "cp src.txt gen.txt", Cache: true},
+			{ID: "use", Inputs: []Path{"gen.txt"}, Outputs: []Path{"use.txt"}, Dependencies: []TaskID{"gen"}, Command: "cp gen.txt use.txt", Cache: true},
+		})
+
+		build(t, taskMap, TaskExecutorOptions{}, "use")
+
+		var calls atomic.Int64
+		orig := hashFile
+		hashFile = func(path string) (string, error) {
+			calls.Add(1)
+			return orig(path)
+		}
+		t.Cleanup(func() { hashFile = orig })
+
+		build(t, taskMap, TaskExecutorOptions{}, "use")
+
+		if n := calls.Load(); n != 0 {
+			t.Fatalf("fully cached build hashed %d files, want 0", n)
+		}
+	})
+}
+
+func TestInPlaceWritesDontReachCache(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			// cp writes into an existing gen.txt rather than replacing it.
+			// A read-only output has its blob's mode, so hits link it; the
+			// chmod reaches the blob too unless gen.txt was unshared.
+			{ID: "gen", Inputs: []Path{"src.txt"}, Outputs: []Path{"gen.txt"}, Command: "chmod u+w gen.txt 2>/dev/null; cp src.txt gen.txt && chmod 444 gen.txt", Cache: true, Sandbox: true},
+			{ID: "use", Dependencies: []TaskID{"gen"}, Outputs: []Path{"use.txt"}, Command: "cp gen.txt use.txt", Cache: true, Sandbox: true},
+		})
+		buildWith := func(src string, opts TaskExecutorOptions, id TaskID) {
+			t.Helper()
+			writeFileContent(t, "src.txt", src)
+			build(t, taskMap, opts, id)
+		}
+		wantFile := func(path, want string) {
+			t.Helper()
+			if got, err := os.ReadFile(path); err != nil || string(got) != want {
+				t.Errorf("%s = %q, %v; want %q", path, got, err, want)
+			}
+		}
+
+		// A rerun in the workspace must not write through gen.txt, which
+		// the hit on "one" linked to that entry's blob.
+		buildWith("one", TaskExecutorOptions{}, "gen")
+		buildWith("two", TaskExecutorOptions{}, "gen")
+		buildWith("one", TaskExecutorOptions{}, "gen")
+		buildWith("three", TaskExecutorOptions{}, "gen")
+		wantFile("gen.txt", "three")
+		buildWith("one", TaskExecutorOptions{}, "gen")
+		wantFile("gen.txt", "one")
+
+		// An edit by other means is detected, and the entry rebuilt.
+		if err := os.WriteFile("gen.txt", []byte("edited"), 0o644); err != nil {
+			if errors.Is(err, fs.ErrPermission) {
+				return // the read-only blob stopped it
+			}
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		e := newTestExecutor(t, TaskExecutorOptions{Sandbox: true})
+		e.log = NewLogger(&out, &out, LoggerOptions{})
+		if err := e.ExecuteTasks(taskMap, []TaskID{"use"}); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+		wantFile("use.txt", "one")
+		if !strings.Contains(out.String(), "was modified after it was stored") {
+			t.Errorf("log = %q, want a warning about the edited entry", out.String())
+		}
+	})
+}
+
+func TestRestoreKeepsModeOfSharedContent(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "src.sh", "#!/bin/sh\necho ran\n")
+		// Same bytes, different modes: each needs a blob of its own.
+		taskMap := NewTaskMap([]Task{
+			{ID: "plain", Inputs: []Path{"src.sh"}, Outputs: []Path{"plain.txt"}, Command: "cp src.sh plain.txt && chmod 644 plain.txt", Cache: true},
+			{ID: "exe", Inputs: []Path{"src.sh"}, Outputs: []Path{"run.sh"}, Command: "cp src.sh run.sh && chmod 755 run.sh", Cache: true},
+		})
+		build(t, taskMap, TaskExecutorOptions{}, "plain", "exe")
+		for _, p := range []string{"plain.txt", "run.sh"} {
+			if err := os.Remove(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		build(t, taskMap, TaskExecutorOptions{}, "plain", "exe")
+
+		for path, want := range map[string]fs.FileMode{"plain.txt": 0o644, "run.sh": 0o755} {
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != want {
+				t.Errorf("%s mode = %v, want %v", path, fi.Mode().Perm(), want)
+			}
+		}
+		if out, err := exec.Command("./run.sh").CombinedOutput(); err != nil || string(out) != "ran\n" {
+			t.Errorf("./run.sh = %q, %v; want it to run", out, err)
+		}
+	})
+}
+
+func TestOutputStampsFromManifestDigests(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "src.txt")
+		writeFileContent(t, "extra.txt", "1")
+		taskMap := NewTaskMap([]Task{
+			{ID: "gen", Inputs: []Path{"src.txt"}, Outputs: []Path{"gen.txt"}, Command: "cp src.txt gen.txt", Cache: true},
+			{ID: "use", Inputs: []Path{"gen.txt", "extra.txt"}, Outputs: []Path{"use.txt"}, Dependencies: []TaskID{"gen"}, Command: "cat gen.txt extra.txt > use.txt", Cache: true},
+		})
+
+		var mu sync.Mutex
+		hashed := make(map[string]int)
+		orig := hashFile
+		hashFile = func(path string) (string, error) {
+			mu.Lock()
+			hashed[filepath.ToSlash(path)]++
+			mu.Unlock()
+			return orig(path)
+		}
+		t.Cleanup(func() { hashFile = orig })
+
+		// Storing gen.txt digests it while copying it into the cache; its
+		// stamp then serves use's key.
+		build(t, taskMap, TaskExecutorOptions{}, "use")
+		if n := hashed["gen.txt"]; n != 0 {
+			t.Errorf("cold build hashed gen.txt %d times, want 0 (the store digests it)", n)
+		}
+
+		// A hit restores gen.txt with its stamp, so rebuilding use doesn't
+		// hash it at all.
+		clear(hashed)
+		if err := os.Remove("gen.txt"); err != nil {
+			t.Fatal(err)
+		}
+		writeFileContent(t, "extra.txt", "2")
+		build(t, taskMap, TaskExecutorOptions{}, "use")
+		if n := hashed["gen.txt"]; n != 0 {
+			t.Errorf("hit then downstream rebuild hashed gen.txt %d times, want 0", n)
+		}
+	})
+}
+
+func TestBuildTimeout(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			{ID: "slow", Outputs: []Path{"out.txt"}, Command: "sleep 10; echo done > out.txt", Cache: true},
+			{ID: "after", Dependencies: []TaskID{"slow"}, Command: "echo ran > after.txt"},
+		})
+		e := newTestExecutor(t, TaskExecutorOptions{BuildTimeout: 200 * time.Millisecond})
+		start := time.Now()
+		err := e.ExecuteTasks(taskMap, []TaskID{"after"})
+		if !errors.Is(err, ErrBuildTimedOut) || exitCode(err) != exitTimeout {
+			t.Fatalf("err = %v (exit %d), want ErrBuildTimedOut (exit %d)", err, exitCode(err), exitTimeout)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("build took %s; the sleeping task wasn't killed", d)
+		}
+		if _, err := os.Stat("after.txt"); !os.IsNotExist(err) {
+			t.Errorf("a dependent started after the timeout: %v", err)
+		}
+		if key, ok := e.keys.Get("slow"); !ok || e.state.localCache.Has(key) {
+			t.Errorf("timed-out task has a cache entry (key known: %v)", ok)
+		}
+	})
+}
+
+func TestInterruptKillsRunningTasks(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			{ID: "slow", Command: "sleep 10; echo done > out.txt"},
+		})
+		e := newTestExecutor(t, TaskExecutorOptions{})
+		time.AfterFunc(200*time.Millisecond, func() {
+			p, _ := os.FindProcess(os.Getpid())
+			_ = p.Signal(os.Interrupt)
+		})
+		start := time.Now()
+		err := e.ExecuteTasks(taskMap, []TaskID{"slow"})
+		if !errors.Is(err, ErrBuildInterrupted) || exitCode(err) != exitInterrupted {
+			t.Fatalf("err = %v (exit %d), want ErrBuildInterrupted (exit %d)", err, exitCode(err), exitInterrupted)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("build took %s; the sleeping task wasn't killed", d)
+		}
+	})
+}
+
+func TestSecretEnv(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "token.txt", "s3cr3t\n")
+		task := Task{
+			ID:        "publish",
+			Outputs:   []Path{"seen.txt"},
+			Command:   `echo "using $TOKEN" && printf %s "$TOKEN" > seen.txt`,
+			SecretEnv: map[string]string{"TOKEN": "token.txt"},
+			Cache:     true,
+		}
+		taskMap := NewTaskMap([]Task{task})
+
+		key, taskJSON, err := ComputeTaskKey(task, nil, nil)
+		if err != nil {
+			t.Fatalf("ComputeTaskKey: %v", err)
+		}
+		if strings.Contains(string(taskJSON), "s3cr3t") || strings.Contains(string(taskJSON), "TOKEN\"") {
+			t.Errorf("key payload mentions the secret: %s", taskJSON)
+		}
+
+		var out bytes.Buffer
+		e := newTestExecutor(t, TaskExecutorOptions{})
+		e.log = NewLogger(&out, &out, LoggerOptions{})
+		if err := e.ExecuteTasks(taskMap, []TaskID{"publish"}); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+		if data, err := os.ReadFile("seen.txt"); err != nil || string(data) != "s3cr3t" {
+			t.Errorf("process saw TOKEN = %q, %v; want the secret without its newline", data, err)
+		}
+		if strings.Contains(out.String(), "s3cr3t") || !strings.Contains(out.String(), "using ***") {
+			t.Errorf("log doesn't redact the secret:\n%s", out.String())
+		}
+
+		// Output is redacted line by line, so each line of a multi-line
+		// secret is masked too.
+		writeFileContent(t, "key.pem", "-----BEGIN KEY-----\nMIIBOgIBAAJBAKj\n-----END KEY-----\n")
+		task.SecretEnv = map[string]string{"KEY": "key.pem"}
+		task.Command = `printf '%s\n' "$KEY" && echo "$KEY" | sed -n 2p`
+		out.Reset()
+		e = newTestExecutor(t, TaskExecutorOptions{})
+		e.log = NewLogger(&out, &out, LoggerOptions{})
+		if err := e.ExecuteTasks(NewTaskMap([]Task{task}), []TaskID{"publish"}); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+		if strings.Contains(out.String(), "MIIBOgIBAAJBAKj") || strings.Contains(out.String(), "BEGIN KEY") {
+			t.Errorf("log doesn't redact the multi-line secret:\n%s", out.String())
+		}
+
+		writeFileContent(t, "token.txt", "rotated")
+		task.SecretEnv = map[string]string{"TOKEN": "token.txt"}
+		task.Command = `echo "using $TOKEN" && printf %s "$TOKEN" > seen.txt`
+		if rotated, _, err := ComputeTaskKey(task, nil, nil); err != nil || rotated != key {
+			t.Errorf("key after changing the secret = %s, %v; want unchanged %s", rotated, err, key)
+		}
+	})
+}
+
+func TestIgnoreExitCodes(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "a.txt", "a")
+		taskMap := NewTaskMap([]Task{
+			{ID: "diff", Inputs: []Path{"a.txt"}, Outputs: []Path{"diff.txt"}, Command: "echo ran >> runs.log; echo changed > diff.txt; exit 1", Cache: true, IgnoreExitCodes: []int{1}},
+			{ID: "broken", Command: "exit 2", IgnoreExitCodes: []int{1}},
+		})
+
+		build(t, taskMap, TaskExecutorOptions{}, "diff")
+		build(t, taskMap, TaskExecutorOptions{}, "diff")
+		if data, _ := os.ReadFile("runs.log"); string(data) != "ran\n" {
+			t.Errorf("runs.log = %q, want one run and then a cache hit", data)
+		}
+
+		err := newTestExecutor(t, TaskExecutorOptions{}).ExecuteTasks(taskMap, []TaskID{"broken"})
+		var failed *TaskFailedError
+		if !errors.As(err, &failed) || failed.ExitCode != 2 {
+			t.Errorf("exit 2 with ignore_exit_codes [1]: err = %v, want a TaskFailedError", err)
+		}
+	})
+}
+
+func TestFailFast(t *testing.T) {
+	withTempWD(t, func() {
+		tests := []struct {
+			name     string
+			failFast bool
+			wantErr  bool
+		}{
+			{name: "off-later-statement-masks-failure", failFast: false, wantErr: false},
+			{name: "on-aborts-on-first-failure", failFast: true, wantErr: true},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				taskMap := NewTaskMap([]Task{
+					{ID: "multi", Command: "false\ntrue", FailFast: tt.failFast},
+				})
+				err := newTestExecutor(t, TaskExecutorOptions{}).ExecuteTasks(taskMap, []TaskID{"multi"})
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("ExecuteTasks err = %v, wantErr %v", err, tt.wantErr)
+				}
+			})
+		}
+	})
+}
+
+func TestShellScriptFailFast(t *testing.T) {
+	task := Task{Command: "make", FailFast: true}
+	if got := shellScript(task, "/bin/bash"); got != "set -e\nmake" {
+		t.Errorf("bash script = %q", got)
+	}
+	if got := shellScript(task, "pwsh"); got != "make" {
+		t.Errorf("non-POSIX script = %q, want unchanged", got)
+	}
+	if RunnerSupportsFailFast(ShellRunner{Shell: "pwsh"}) {
+		t.Errorf("pwsh reported as supporting fail_fast")
+	}
+}
+
+func TestCacheHitStoredCommandMismatch(t *testing.T) {
+	withTempWD(t, func() {
+		task := Task{ID: "gen", Outputs: []Path{"out.txt"}, Command: "echo new > out.txt", Cache: true}
+		taskMap := NewTaskMap([]Task{task})
+
+		// Plant an entry under the task's key that was stored for another command.
+		seed := func(t *testing.T) {
+			t.Helper()
+			key, _, err := ComputeTaskKey(task, nil, nil)
+			if err != nil {
+				t.Fatalf("ComputeTaskKey: %v", err)
+			}
+			// The previous case may have left a read-only restored link.
+			_ = os.Remove("out.txt")
+			if err := os.WriteFile("out.txt", []byte("old\n"), 0o644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			cache := NewLocalCache(filepath.Join(".build-tool", "cache"))
+			if _, err := cache.Store(key, []byte(`{"command":"echo old > out.txt"}`), []Path{"out.txt"}); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			if err := os.Remove("out.txt"); err != nil {
+				t.Fatalf("Remove: %v", err)
+			}
+		}
+
+		tests := []struct {
+			name    string
+			strict  bool
+			wantOut string
+			wantLog string
+		}{
+			{name: "warns-and-hits", strict: false, wantOut: "old\n", wantLog: "CACHE HIT"},
+			{name: "strict-treats-as-miss", strict: true, wantOut: "new\n", wantLog: "ignoring cache entry"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				seed(t)
+
+				var out bytes.Buffer
+				e := newTestExecutor(t, TaskExecutorOptions{Strict: tt.strict})
+				e.log = NewLogger(&out, &out, LoggerOptions{})
+				if err := e.ExecuteTasks(taskMap, []TaskID{"gen"}); err != nil {
+					t.Fatalf("ExecuteTasks: %v", err)
+				}
+
+				if !strings.Contains(out.String(), `cached command "echo old > out.txt" differs`) {
+					t.Errorf("missing mismatch warning in log:\n%s", out.String())
+				}
+				if !strings.Contains(out.String(), tt.wantLog) {
+					t.Errorf("log missing %q:\n%s", tt.wantLog, out.String())
+				}
+				got, err := os.ReadFile("out.txt")
+				if err != nil {
+					t.Fatalf("ReadFile: %v", err)
+				}
+				if string(got) != tt.wantOut {
+					t.Errorf("out.txt = %q, want %q", got, tt.wantOut)
+				}
+			})
+		}
+	})
+}
+
+// wideDiamond returns a graph where "top" depends on n tasks that all depend
+// on "base".
+func wideDiamond(n int, cmd func(id TaskID) string) TaskMap {
+	tasks := []Task{{ID: "base", Command: cmd("base")}}
+	top := Task{ID: "top", Command: cmd("top")}
+	for i := range n {
+		id := TaskID(fmt.Sprintf("mid%d", i))
+		tasks = append(tasks, Task{ID: id, Dependencies: []TaskID{"base"}, Command: cmd(id)})
+		top.Dependencies = append(top.Dependencies, id)
+	}
+	return NewTaskMap(append(tasks, top))
+}
+
+func TestExecuteDiamondOrderAndOnce(t *testing.T) {
+	withTempWD(t, func() {
+		// Each task fails unless its dependencies already logged themselves.
+		taskMap := wideDiamond(20, func(id TaskID) string {
+			switch id {
+			case "base":
+				return "echo base >> log.txt"
+			case "top":
+				return "test $(grep -c mid log.txt) = 20 && echo top >> log.txt"
+			default:
+				return fmt.Sprintf("grep -q base log.txt && echo %s >> log.txt", id)
+			}
+		})
+
+		build(t, taskMap, TaskExecutorOptions{Jobs: 4}, "top", "base")
+
+		data, err := os.ReadFile("log.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Fields(string(data))
+		if len(lines) != 22 || lines[0] != "base" || lines[21] != "top" {
+			t.Fatalf("log = %v, want base, 20 mids, top", lines)
+		}
+	})
+}
+
+func TestExecuteDependencyCycle(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			{ID: "a", Dependencies: []TaskID{"b"}, Command: "true"},
+			{ID: "b", Dependencies: []TaskID{"a"}, Command: "true"},
+		})
+		err := newTestExecutor(t, TaskExecutorOptions{}).ExecuteTasks(taskMap, []TaskID{"a"})
+		if err == nil || !strings.Contains(err.Error(), "cycle") {
+			t.Fatalf("ExecuteTasks error = %v, want dependency cycle", err)
+		}
+	})
+}
+
+// BenchmarkExecuteWideDiamond measures scheduling overhead on a fully cached
+// wide diamond, where each iteration is a fresh build of cache hits.
+func BenchmarkExecuteWideDiamond(b *testing.B) {
+	dir := b.TempDir()
+	old, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+	chdirMu.Lock()
+	defer chdirMu.Unlock()
+	if err := os.Chdir(dir); err != nil {
+		b.Fatal(err)
+	}
+	defer os.Chdir(old)
+
+	taskMap := wideDiamond(200, func(id TaskID) string { return fmt.Sprintf("echo %s > %s.out", id, id) })
+	for id, task := range taskMap {
+		task.Outputs = []Path{Path(id + ".out")}
+		task.Cache = true
+		taskMap[id] = task
+	}
+
+	log := NewLogger(io.Discard, io.Discard, LoggerOptions{})
+	root := filepath.Join(".build-tool", "cache")
+	run := func() {
+		e := NewTaskExecutor(root, filepath.Join(root, "stamps.json"), log, TaskExecutorOptions{})
+		if err := e.Load(); err != nil {
+			b.Fatal(err)
+		}
+		if err := e.ExecuteTasks(taskMap, []TaskID{"top"}); err != nil {
+			b.Fatal(err)
+		}
+		if err := e.Save(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	run()
+
+	for b.Loop() {
+		run()
+	}
+}
+
+func TestAllowFailure(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			{ID: "lint", Outputs: []Path{"lint.txt"}, Command: "exit 1", Cache: true, AllowFailure: true},
+			{ID: "app", Outputs: []Path{"app.txt"}, Dependencies: []TaskID{"lint"}, Command: "echo app > app.txt", Cache: true},
+		})
+
+		e := newTestExecutor(t, TaskExecutorOptions{})
+		if err := e.ExecuteTasks(taskMap, []TaskID{"app"}); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+		if _, err := os.Stat("app.txt"); err != nil {
+			t.Errorf("dependent of allowed failure did not run: %v", err)
+		}
+		if got := e.Summary().AllowedFailures; !slices.Equal(got, []TaskID{"lint"}) {
+			t.Errorf("AllowedFailures = %v, want [lint]", got)
+		}
+
+		// Without allow_failure the same failure fails the build.
+		lint := taskMap["lint"]
+		lint.AllowFailure = false
+		taskMap["lint"] = lint
+		if err := newTestExecutor(t, TaskExecutorOptions{}).ExecuteTasks(taskMap, []TaskID{"app"}); err == nil {
+			t.Fatal("ExecuteTasks succeeded, want lint failure")
+		}
+	})
+}
+
+func TestSandboxOutputSymlinkEscape(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "secret.txt")
+		secret, err := filepath.Abs("secret.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		taskMap := NewTaskMap([]Task{
+			{ID: "leak", Outputs: []Path{"out.txt"}, Command: "ln -s '" + secret + "' out.txt", Cache: true, Sandbox: true},
+		})
+		e := newTestExecutor(t, TaskExecutorOptions{Sandbox: true})
+		defer e.CleanupSandbox()
+
+		err = e.ExecuteTasks(taskMap, []TaskID{"leak"})
+		if err == nil || !strings.Contains(err.Error(), "outside the sandbox") {
+			t.Fatalf("ExecuteTasks error = %v, want sandbox escape", err)
+		}
+		if _, err := os.Lstat("out.txt"); !os.IsNotExist(err) {
+			t.Errorf("escaping output was exported: %v", err)
+		}
+	})
+}
+
+func TestTaskFailedErrorShowsExitCodeAndCommand(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			{ID: "compile", Command: "echo compiling\nexit 2"},
+		})
+		err := newTestExecutor(t, TaskExecutorOptions{}).ExecuteTasks(taskMap, []TaskID{"compile"})
+
+		var tf *TaskFailedError
+		if !errors.As(err, &tf) || tf.ExitCode != 2 {
+			t.Fatalf("ExecuteTasks error = %v, want TaskFailedError with exit 2", err)
+		}
+		if want := "task compile failed (exit 2): $ echo compiling ..."; err.Error() != want {
+			t.Errorf("error = %q, want %q", err.Error(), want)
+		}
+	})
+}
+
+func TestShortCommand(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{cmd: "gcc -c main.c", want: "gcc -c main.c"},
+		{cmd: "  make\n  make install\n", want: "make ..."},
+		{cmd: strings.Repeat("x", 100), want: strings.Repeat("x", 80) + "..."},
+	}
+	for _, tt := range tests {
+		if got := shortCommand(tt.cmd); got != tt.want {
+			t.Errorf("shortCommand(%q) = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestBaseCacheHit(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "src.txt")
+		taskMap := NewTaskMap([]Task{
+			{ID: "gen", Inputs: []Path{"src.txt"}, Outputs: []Path{"gen.txt"}, Command: "cp src.txt gen.txt && echo run >> runs.log", Cache: true},
+		})
+		log := NewLogger(io.Discard, io.Discard, LoggerOptions{})
+		run := func(cacheRoot string, opts TaskExecutorOptions) {
+			t.Helper()
+			e := NewTaskExecutor(cacheRoot, filepath.Join(cacheRoot, "stamps.json"), log, opts)
+			if err := e.Load(); err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if err := e.ExecuteTasks(taskMap, []TaskID{"gen"}); err != nil {
+				t.Fatalf("ExecuteTasks: %v", err)
+			}
+		}
+
+		// Populate what becomes the base cache, then start from a clean
+		// workspace with an empty local cache.
+		run("base", TaskExecutorOptions{})
+		if err := os.Remove("gen.txt"); err != nil {
+			t.Fatal(err)
+		}
+		run("local", TaskExecutorOptions{BaseCacheDir: "base"})
+
+		if data, _ := os.ReadFile("runs.log"); strings.Count(string(data), "run") != 1 {
+			t.Errorf("task ran again despite a base cache entry: %q", data)
+		}
+		restored, err := os.Stat("gen.txt")
+		if err != nil {
+			t.Fatalf("output not restored from base cache: %v", err)
+		}
+		base := NewLocalCache("base")
+		entries, err := os.ReadDir(filepath.Join("base", "tasks"))
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("base cache entries = %v, %v; want one", entries, err)
+		}
+		m, err := base.readManifest(entries[0].Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blob, err := os.Stat(base.blobPath(m.blobID("gen.txt"))); err != nil || os.SameFile(restored, blob) {
+			t.Errorf("base cache hit linked its blob (stat %v); want a copy", err)
+		}
+		if entries, _ := os.ReadDir(filepath.Join("local", "tasks")); len(entries) != 0 {
+			t.Errorf("local cache has %d entries, want 0", len(entries))
+		}
+	})
+}
+
+func TestIgnoreFileLoadedOncePerBuild(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "src/a.txt")
+		writeFileContent(t, "src/debug.log", "one")
+		writeFileContent(t, ignoreFilePath, "*.log\n")
+		taskMap := NewTaskMap([]Task{
+			{ID: "gen", Inputs: []Path{"src/**"}, Outputs: []Path{"gen.txt"}, Command: "cat src/*.txt > gen.txt && echo run >> runs.log", Cache: true},
+		})
+		runs := func() int {
+			data, _ := os.ReadFile("runs.log")
+			return strings.Count(string(data), "run")
+		}
+
+		build(t, taskMap, TaskExecutorOptions{}, "gen")
+		writeFileContent(t, "src/debug.log", "two")
+		build(t, taskMap, TaskExecutorOptions{}, "gen")
+		if n := runs(); n != 1 {
+			t.Fatalf("task ran %d times, want 1: an ignored file changed the key", n)
+		}
+
+		// The rules Load read stay in force for the whole build.
+		e := newTestExecutor(t, TaskExecutorOptions{})
+		writeFileContent(t, ignoreFilePath, "")
+		if err := e.ExecuteTasks(taskMap, []TaskID{"gen"}); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+		if n := runs(); n != 1 {
+			t.Errorf("task ran %d times, want 1: the ignore file was re-read mid-build", n)
+		}
+	})
+}
+
+func TestSandboxStagesRoutedIndirectDependency(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap, err := LoadTaskMapFromConfig(writeConfig(t, `{"tasks": {
+			"gen": {"outputs": ["gen.txt"], "command": "echo gen > gen.txt"},
+			"mid": {"inputs": [":gen"], "outputs": ["mid.txt"], "command": "cp gen.txt mid.txt"},
+			"top": {"inputs": [":mid", "gen.txt"], "outputs": ["top.txt"], "command": "cat mid.txt gen.txt > top.txt"}
+		}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		build(t, taskMap, TaskExecutorOptions{Sandbox: true}, "top")
+		if got, err := os.ReadFile("top.txt"); err != nil || string(got) != "gen\ngen\n" {
+			t.Errorf("top.txt = %q, %v; want gen.txt staged from the indirect dependency", got, err)
+		}
+		if _, err := os.Stat("gen.txt"); err == nil {
+			t.Errorf("gen.txt was exported to the workspace; only the target's outputs should be")
+		}
+	})
+}
+
+func TestSandboxStagesPackedDependencyOutputs(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "src.txt", "fresh")
+		taskMap, err := LoadTaskMapFromConfig(writeConfig(t, `{"tasks": {
+			"gen": {"inputs": ["src.txt"], "outputs": ["gen.txt"], "command": "cp src.txt gen.txt", "cache": true},
+			"use": {"inputs": [":gen", "use.in"], "outputs": ["use.txt"], "command": "cp gen.txt use.txt", "cache": true}
+		}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := TaskExecutorOptions{Sandbox: true, CachePackBelow: 1 << 10}
+		writeFileContent(t, "use.in", "1")
+		build(t, taskMap, opts, "use")
+
+		// gen is a hit that is never exported; a stale copy in the
+		// workspace must not be what use sees.
+		writeFileContent(t, "gen.txt", "stale")
+		writeFileContent(t, "use.in", "2")
+		build(t, taskMap, opts, "use")
+		if data, err := os.ReadFile("use.txt"); err != nil || string(data) != "fresh" {
+			t.Errorf("use.txt = %q, %v; want gen.txt unpacked from the cache", data, err)
+		}
+
+		// A truncated pack is a corrupt entry: gen reruns.
+		key, err := resolveTaskKey(taskMap, "gen", nil, KeyOptions{}, make(map[TaskID]resolvedKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		e := newTestExecutor(t, opts)
+		e.log = NewLogger(&out, &out, LoggerOptions{})
+		if err := os.Truncate(e.state.localCache.packPath(key), 2); err != nil {
+			t.Fatal(err)
+		}
+		writeFileContent(t, "use.in", "3")
+		if err := e.ExecuteTasks(taskMap, []TaskID{"use"}); err != nil {
+			t.Fatalf("ExecuteTasks with a truncated pack: %v", err)
+		}
+		if !strings.Contains(out.String(), "pack file is truncated; treating as a miss") {
+			t.Errorf("log doesn't treat the truncated pack as a miss:\n%s", out.String())
+		}
+		if data, err := os.ReadFile("use.txt"); err != nil || string(data) != "fresh" {
+			t.Errorf("use.txt = %q, %v; want fresh", data, err)
+		}
+	})
+}
+
+func TestExplain(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "src.txt")
+		taskMap := NewTaskMap([]Task{
+			{ID: "gen", Inputs: []Path{"src.txt"}, Outputs: []Path{"gen.txt"}, Command: "cp src.txt gen.txt", Cache: true},
+		})
+
+		run := func(opts TaskExecutorOptions) string {
+			t.Helper()
+			var out bytes.Buffer
+			e := newTestExecutor(t, opts)
+			e.log = NewLogger(&out, &out, LoggerOptions{})
+			if err := e.ExecuteTasks(taskMap, []TaskID{"gen"}); err != nil {
+				t.Fatalf("ExecuteTasks: %v", err)
+			}
+			if err := e.Save(); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			return out.String()
+		}
+
+		tests := []struct {
+			name string
+			opts TaskExecutorOptions
+			want []string
+		}{
+			{name: "cold", opts: TaskExecutorOptions{Explain: true}, want: []string{"local=miss base=- remote=-", `decision="miss"`, "inputs=1 hashed=1 stamped=0"}},
+			{name: "warm", opts: TaskExecutorOptions{Explain: true}, want: []string{"local=hit base=- remote=-", `decision="hit"`, "inputs=1 hashed=0 stamped=1"}},
+			{name: "off", opts: TaskExecutorOptions{}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				log := run(tt.opts)
+				if tt.want == nil && strings.Contains(log, "explain:") {
+					t.Errorf("explain line logged without Explain:\n%s", log)
+				}
+				for _, w := range tt.want {
+					if !strings.Contains(log, w) {
+						t.Errorf("log missing %q:\n%s", w, log)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestDumpKeyPayload(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "a.txt", "a")
+		taskMap := NewTaskMap([]Task{
+			{ID: "gen:a", Inputs: []Path{"a.txt"}, Outputs: []Path{"a.out"}, Command: "cp a.txt a.out", Cache: true},
+			{ID: "gen/a", Inputs: []Path{"a.txt"}, Outputs: []Path{"b.out"}, Command: "cp a.txt b.out", Cache: true},
+			{ID: "use", Dependencies: []TaskID{"gen:a", "gen/a"}, Command: "true"},
+		})
+		e := newTestExecutor(t, TaskExecutorOptions{DumpKeyPayloadDir: "payloads"})
+		if err := e.ExecuteTasks(taskMap, []TaskID{"use"}); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+
+		for _, tt := range []struct {
+			id   TaskID
+			file string
+		}{{"gen:a", "gen%3Aa.json"}, {"gen/a", "gen%2Fa.json"}, {"use", "use.json"}} {
+			dumped, err := os.ReadFile(filepath.Join("payloads", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, _ := e.keys.Get(tt.id)
+			if sum := blake2b.Sum256(dumped); hex.EncodeToString(sum[:]) != key {
+				t.Errorf("%s: dumped payload doesn't hash to the task key %s", tt.id, key)
+			}
+		}
+
+		_, want, err := ComputeTaskKey(taskMap["gen:a"], nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.ReadFile(filepath.Join("payloads", "gen%3Aa.json")); !bytes.Equal(got, want) {
+			t.Errorf("dumped payload = %s, want ComputeTaskKey's %s", got, want)
+		}
+	})
+}
+
+func TestTraceInputs(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "a.txt", "a")
+		writeFileContent(t, "b.txt", "b")
+		taskMap := NewTaskMap([]Task{
+			{ID: "cat", Inputs: []Path{"a.txt", "b.txt"}, Command: "cat a.txt b.txt", Cache: true},
+		})
+		da, _ := hashFileContents("a.txt")
+		db, _ := hashFileContents("b.txt")
+
+		run := func(opts TaskExecutorOptions) string {
+			t.Helper()
+			var out bytes.Buffer
+			e := newTestExecutor(t, opts)
+			e.log = NewLogger(&out, &out, LoggerOptions{})
+			if err := e.ExecuteTasks(taskMap, []TaskID{"cat"}); err != nil {
+				t.Fatalf("ExecuteTasks: %v", err)
+			}
+			if err := e.Save(); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			return out.String()
+		}
+
+		if log := run(TaskExecutorOptions{}); strings.Contains(log, "input a.txt") {
+			t.Errorf("inputs traced without TraceInputs:\n%s", log)
+		}
+		// The first run recorded stamps, so the digests now come from them.
+		writeFileContent(t, "b.txt", "b2")
+		db2, _ := hashFileContents("b.txt")
+		log := run(TaskExecutorOptions{TraceInputs: true})
+		for _, w := range []string{
+			"input a.txt: " + da + " (stamp cache)",
+			"input b.txt: " + db2 + " (hashed)",
+		} {
+			if !strings.Contains(log, w) {
+				t.Errorf("log missing %q:\n%s", w, log)
+			}
+		}
+		if strings.Contains(log, db) {
+			t.Errorf("log has the old digest of b.txt:\n%s", log)
+		}
+	})
+}
+
+func TestDirectoryOutputRestore(t *testing.T) {
+	for _, sandbox := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sandbox=%v", sandbox), func(t *testing.T) {
+			withTempWD(t, func() {
+				taskMap := NewTaskMap([]Task{{
+					ID:      "gen",
+					Outputs: []Path{"dist"},
+					Command: "mkdir -p dist/sub/empty && echo a > dist/a.txt && echo b > dist/sub/b.txt",
+					Cache:   true,
+				}})
+				opts := TaskExecutorOptions{Sandbox: sandbox}
+
+				build(t, taskMap, opts, "gen")
+				if err := os.RemoveAll("dist"); err != nil {
+					t.Fatalf("RemoveAll: %v", err)
+				}
+				e := newTestExecutor(t, opts)
+				var out bytes.Buffer
+				e.log = NewLogger(&out, &out, LoggerOptions{})
+				if err := e.ExecuteTasks(taskMap, []TaskID{"gen"}); err != nil {
+					t.Fatalf("ExecuteTasks: %v", err)
+				}
+				if !strings.Contains(out.String(), "CACHE HIT") {
+					t.Fatalf("second build was not a cache hit:\n%s", out.String())
+				}
+
+				for path, want := range map[string]string{"dist/a.txt": "a\n", "dist/sub/b.txt": "b\n"} {
+					got, err := os.ReadFile(path)
+					if err != nil || string(got) != want {
+						t.Errorf("%s = %q, %v; want %q", path, got, err, want)
+					}
+				}
+				if fi, err := os.Stat(filepath.Join("dist", "sub", "empty")); err != nil || !fi.IsDir() {
+					t.Errorf("empty dir not restored: %v", err)
+				}
+			})
+		})
+	}
+}
+
+func TestSandboxStageMode(t *testing.T) {
+	const classify = `if [ -L in.txt ]; then echo symlink; elif [ "$(stat -c %h in.txt)" -gt 1 ]; then echo hardlink; else echo copy; fi > kind.txt`
+	tests := []struct {
+		name     string
+		mode     SandboxStageMode
+		crossFS  bool // links fail as they would across filesystems
+		wantKind string
+	}{
+		{name: "default", wantKind: "symlink"},
+		{name: "symlink", mode: StageSymlink, wantKind: "symlink"},
+		{name: "hardlink", mode: StageHardlink, wantKind: "hardlink"},
+		{name: "hardlink across filesystems", mode: StageHardlink, crossFS: true, wantKind: "copy"},
+		{name: "copy", mode: StageCopy, wantKind: "copy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempWD(t, func() {
+				if tt.crossFS {
+					linkFile = func(string, string) error { return syscall.EXDEV }
+					t.Cleanup(func() { linkFile = os.Link })
+				}
+				writeFileContent(t, "in.txt", "in")
+				taskMap := NewTaskMap([]Task{{ID: "gen", Inputs: []Path{"in.txt"}, Outputs: []Path{"kind.txt"}, Command: classify, Cache: true, Sandbox: true}})
+				build(t, taskMap, TaskExecutorOptions{Sandbox: true, SandboxStageMode: tt.mode}, "gen")
+				if got, err := os.ReadFile("kind.txt"); err != nil || strings.TrimSpace(string(got)) != tt.wantKind {
+					t.Errorf("input staged as %q, %v; want %s", got, err, tt.wantKind)
+				}
+			})
+		})
+	}
+}
+
+func TestSandboxHardlinkedInputEditedInPlace(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "in.txt", "in\n")
+		writeFileContent(t, "src.txt", "gen\n")
+		// Sources are read-only while the tasks run; only root gets
+		// through, and then it's reported.
+		taskMap := NewTaskMap([]Task{
+			{ID: "gen", Inputs: []Path{"src.txt"}, Outputs: []Path{"gen.txt"}, Command: "cp src.txt gen.txt", Cache: true, Sandbox: true},
+			{ID: "use", Inputs: []Path{"in.txt"}, Dependencies: []TaskID{"gen"}, Outputs: []Path{"out.txt"}, Command: "{ echo more >> in.txt; echo more >> gen.txt; } 2>/dev/null; cat in.txt gen.txt > out.txt", Cache: true, Sandbox: true},
+		})
+
+		var out bytes.Buffer
+		e := newTestExecutor(t, TaskExecutorOptions{Sandbox: true, SandboxStageMode: StageHardlink})
+		e.log = NewLogger(&out, &out, LoggerOptions{})
+		if err := e.ExecuteTasks(taskMap, []TaskID{"use"}); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+		if fi, err := os.Stat("in.txt"); err != nil || fi.Mode().Perm()&0o200 == 0 {
+			t.Errorf("in.txt mode after the build = %v, %v; want writable again", fi, err)
+		}
+		genKey, _ := e.keys.Get("gen")
+		if os.Geteuid() != 0 {
+			if data, _ := os.ReadFile("in.txt"); string(data) != "in\n" {
+				t.Errorf("in.txt = %q; the edit should have been refused", data)
+			}
+			if !e.state.localCache.Has(genKey) {
+				t.Errorf("gen's entry was evicted although its blob is intact")
+			}
+			return
+		}
+		if !strings.Contains(out.String(), "warning: modified hardlinked input in.txt in place") {
+			t.Errorf("missing in-place edit warning:\n%s", out.String())
+		}
+		if e.state.localCache.Has(genKey) {
+			t.Errorf("gen's entry is still cached after use edited its blob in place")
+		}
+	})
+}
+
+func TestSandboxDir(t *testing.T) {
+	withTempWD(t, func() {
+		sandboxDir := t.TempDir()
+		taskMap := NewTaskMap([]Task{{ID: "gen", Outputs: []Path{"out.txt"}, Command: "pwd > out.txt", Cache: true, Sandbox: true}})
+
+		e := newTestExecutor(t, TaskExecutorOptions{Sandbox: true, SandboxDir: sandboxDir})
+		if err := e.ExecuteTasks(taskMap, []TaskID{"gen"}); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+		got, err := os.ReadFile("out.txt")
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if resolved, err := filepath.EvalSymlinks(sandboxDir); err != nil || !strings.HasPrefix(string(got), resolved) {
+			t.Errorf("task ran in %q, want under %s (%v)", strings.TrimSpace(string(got)), resolved, err)
+		}
+		if _, err := os.Stat(filepath.Join(".build-tool", "sandboxes")); !os.IsNotExist(err) {
+			t.Errorf("default sandbox dir created: %v", err)
+		}
+
+		if err := e.CleanupSandbox(); err != nil {
+			t.Fatalf("CleanupSandbox: %v", err)
+		}
+		if entries, err := os.ReadDir(sandboxDir); err != nil || len(entries) != 0 {
+			t.Errorf("sandbox dir after cleanup = %v, %v; want empty", entries, err)
+		}
+	})
+}
+
+func TestVerboseWarnsOnExcludedInputs(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "src/a.c")
+		taskMap := NewTaskMap([]Task{{ID: "cc", Inputs: []Path{"src/*.c", "!src/a.c"}, Command: "true", Cache: true}})
+
+		for _, verbose := range []bool{false, true} {
+			var out bytes.Buffer
+			e := newTestExecutor(t, TaskExecutorOptions{Verbose: verbose})
+			e.log = NewLogger(&out, &out, LoggerOptions{})
+			if err := e.ExecuteTasks(taskMap, []TaskID{"cc"}); err != nil {
+				t.Fatalf("ExecuteTasks: %v", err)
+			}
+			for _, want := range []string{`glob "src/*.c" matched 1 file(s), all removed`, "inputs match no files after exclusions"} {
+				if got := strings.Contains(out.String(), want); got != verbose {
+					t.Errorf("verbose=%v: log contains %q = %v:\n%s", verbose, want, got, out.String())
+				}
+			}
+		}
+	})
+}
+
+func TestVerboseWarnsOnExcludedParentInputs(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "shared/x.h")
+		if err := os.MkdirAll("ws", 0o755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.Chdir("ws"); err != nil {
+			t.Fatalf("Chdir: %v", err)
+		}
+		allowParentInputs = true
+		t.Cleanup(func() { allowParentInputs = false })
+
+		taskMap := NewTaskMap([]Task{{ID: "cc", Inputs: []Path{"../shared/*.h", "!../shared/x.h"}, Command: "true", Cache: true}})
+		var out bytes.Buffer
+		e := newTestExecutor(t, TaskExecutorOptions{Verbose: true})
+		e.log = NewLogger(&out, &out, LoggerOptions{})
+		if err := e.ExecuteTasks(taskMap, []TaskID{"cc"}); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+		if want := `glob "../shared/*.h" matched 1 file(s), all removed`; !strings.Contains(out.String(), want) {
+			t.Errorf("log doesn't contain %q:\n%s", want, out.String())
+		}
+	})
+}
+
+func TestRunTaskAlwaysRunsTarget(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			{ID: "compile", Outputs: []Path{"app"}, Command: "echo x >> compiled.log && echo app > app", Cache: true},
+			{ID: "app", Dependencies: []TaskID{"compile"}, Outputs: []Path{"ran.log"}, Command: "echo x >> ran.log", Cache: true},
+		})
+
+		for range 2 {
+			e := newTestExecutor(t, TaskExecutorOptions{})
+			if err := e.RunTask(taskMap, "app"); err != nil {
+				t.Fatalf("RunTask: %v", err)
+			}
+			if err := e.Save(); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+		}
+
+		for path, want := range map[string]string{"compiled.log": "x\n", "ran.log": "x\nx\n"} {
+			got, err := os.ReadFile(path)
+			if err != nil || string(got) != want {
+				t.Errorf("%s = %q, %v; want %q", path, got, err, want)
+			}
+		}
+		if !taskMap["app"].Cache {
+			t.Error("RunTask modified the caller's task map")
+		}
+	})
+}
+
+func TestSandboxParentInput(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "shared/x.h", "shared\n")
+		if err := os.MkdirAll("ws", 0o755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.Chdir("ws"); err != nil {
+			t.Fatalf("Chdir: %v", err)
+		}
+		allowParentInputs = true
+		t.Cleanup(func() { allowParentInputs = false })
+
+		taskMap := NewTaskMap([]Task{{ID: "gen", Inputs: []Path{"../shared/x.h"}, Outputs: []Path{"out.txt"}, Command: "cat ../shared/x.h > out.txt", Cache: true, Sandbox: true}})
+		e := newTestExecutor(t, TaskExecutorOptions{Sandbox: true})
+		if err := e.ExecuteTasks(taskMap, []TaskID{"gen"}); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+		if err := e.CleanupSandbox(); err != nil {
+			t.Fatalf("CleanupSandbox: %v", err)
+		}
+		if got, err := os.ReadFile("out.txt"); err != nil || string(got) != "shared\n" {
+			t.Errorf("out.txt = %q, %v", got, err)
+		}
+	})
+}
+
+func TestSkipTask(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			{ID: "tool", Outputs: []Path{"tool.txt"}, Command: "echo tool > tool.txt", Cache: true},
+			{ID: "gen", Dependencies: []TaskID{"tool"}, Outputs: []Path{"gen.txt"}, Command: "echo gen > gen.txt", Cache: true},
+			{ID: "app", Outputs: []Path{"app"}, Command: "echo app > app", Cache: true},
+		})
+
+		e := newTestExecutor(t, TaskExecutorOptions{Skip: []TaskID{"gen"}})
+		if err := e.ExecuteTasks(taskMap, []TaskID{"app", "gen"}); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+		if _, err := os.Stat("app"); err != nil {
+			t.Errorf("app wasn't built: %v", err)
+		}
+		for _, path := range []string{"tool.txt", "gen.txt"} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("%s exists, want skipped task and its dependency not run (err %v)", path, err)
+			}
+		}
+		if got := e.Summary().Skipped; !slices.Equal(got, []TaskID{"gen"}) {
+			t.Errorf("Summary().Skipped = %v, want [gen]", got)
+		}
+	})
+}
+
+func TestSkipTaskWithDependent(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			{ID: "gen", Outputs: []Path{"gen.txt"}, Command: "echo gen > gen.txt", Cache: true},
+			{ID: "lib", Dependencies: []TaskID{"gen"}, Outputs: []Path{"lib.txt"}, Command: "echo lib > lib.txt", Cache: true},
+			{ID: "app", Dependencies: []TaskID{"lib"}, Outputs: []Path{"app"}, Command: "echo app > app", Cache: true},
+		})
+
+		e := newTestExecutor(t, TaskExecutorOptions{Skip: []TaskID{"gen"}})
+		err := e.ExecuteTasks(taskMap, []TaskID{"app"})
+		if exitCode(err) != exitUsage || !strings.Contains(err.Error(), "task lib depends on skipped task gen") {
+			t.Fatalf("ExecuteTasks err = %v, want a usage error about lib", err)
+		}
+		for _, path := range []string{"gen.txt", "lib.txt", "app"} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("%s exists, want nothing run (err %v)", path, err)
+			}
+		}
+
+		// Skipping the whole chain up to the target is fine.
+		build(t, taskMap, TaskExecutorOptions{Skip: []TaskID{"gen", "lib", "app"}}, "app")
+	})
+}
+
+func TestSkipUnknownTask(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{{ID: "a", Command: "true"}})
+		e := newTestExecutor(t, TaskExecutorOptions{Skip: []TaskID{"typo"}})
+		err := e.ExecuteTasks(taskMap, []TaskID{"a"})
+		if exitCode(err) != exitUsage {
+			t.Fatalf("ExecuteTasks err = %v, want usage error", err)
+		}
+	})
+}
+
+func TestRefresh(t *testing.T) {
+	withTempWD(t, func() {
+		// Each run appends to a log outside the outputs and records the run
+		// count in its output, so a restore shows which run was stored.
+		taskMap := NewTaskMap([]Task{
+			{ID: "gen", Outputs: []Path{"gen.txt"}, Command: "echo run >> gen.runs && wc -l < gen.runs | tr -d ' ' > gen.txt", Cache: true},
+			{ID: "lib", Outputs: []Path{"lib.txt"}, Command: "echo run >> lib.runs && wc -l < lib.runs | tr -d ' ' > lib.txt", Cache: true},
+		})
+		runs := func(id string) int {
+			t.Helper()
+			data, err := os.ReadFile(id + ".runs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return strings.Count(string(data), "\n")
+		}
+
+		build(t, taskMap, TaskExecutorOptions{}, "gen", "lib")
+		build(t, taskMap, TaskExecutorOptions{Refresh: []TaskID{"gen"}}, "gen", "lib")
+		if got := runs("gen"); got != 2 {
+			t.Errorf("gen ran %d times, want 2 (refreshed)", got)
+		}
+		if got := runs("lib"); got != 1 {
+			t.Errorf("lib ran %d times, want 1 (still restored)", got)
+		}
+
+		if err := os.Remove("gen.txt"); err != nil {
+			t.Fatal(err)
+		}
+		build(t, taskMap, TaskExecutorOptions{}, "gen")
+		if got := runs("gen"); got != 2 {
+			t.Errorf("gen ran %d times, want 2 (restored after refresh)", got)
+		}
+		if data, err := os.ReadFile("gen.txt"); err != nil || strings.TrimSpace(string(data)) != "2" {
+			t.Errorf("gen.txt = %q, %v; want the refreshed result stored", data, err)
+		}
+
+		e := newTestExecutor(t, TaskExecutorOptions{Refresh: []TaskID{"typo"}})
+		if err := e.ExecuteTasks(taskMap, []TaskID{"gen"}); exitCode(err) != exitUsage {
+			t.Errorf("ExecuteTasks with unknown -refresh err = %v, want usage error", err)
+		}
+	})
+}
+
+func TestRefreshRunsDependents(t *testing.T) {
+	withTempWD(t, func() {
+		// noise.txt isn't an input: refreshing gen is the only way to pick
+		// it up.
+		configPath := writeConfig(t, `{"tasks": {
+			"gen": {"command": "cp noise.txt gen.txt", "outputs": ["gen.txt"], "cache": true},
+			"use": {"command": "cp gen.txt use.txt", "inputs": [":gen"], "outputs": ["use.txt"], "cache": true},
+		}}`)
+		taskMap, err := LoadTaskMapFromConfig(configPath)
+		if err != nil {
+			t.Fatalf("LoadTaskMapFromConfig: %v", err)
+		}
+		writeFileContent(t, "noise.txt", "one")
+		build(t, taskMap, TaskExecutorOptions{}, "use")
+
+		writeFileContent(t, "noise.txt", "two")
+		build(t, taskMap, TaskExecutorOptions{Refresh: []TaskID{"gen"}}, "use")
+		for _, p := range []string{"gen.txt", "use.txt"} {
+			if data, err := os.ReadFile(p); err != nil || string(data) != "two" {
+				t.Errorf("%s after -refresh gen = %q, %v; want two", p, data, err)
+			}
+		}
+
+		// The dependent's entry was refreshed too, so a later hit agrees.
+		for _, p := range []string{"gen.txt", "use.txt"} {
+			if err := os.Remove(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		build(t, taskMap, TaskExecutorOptions{}, "use")
+		if data, err := os.ReadFile("use.txt"); err != nil || string(data) != "two" {
+			t.Errorf("use.txt restored = %q, %v; want two", data, err)
+		}
+	})
+}
+
+func TestStrictOutputs(t *testing.T) {
+	withTempWD(t, func() {
+		// The file the glob matches is named after the run count, so the
+		// output set differs from run to run under the same key.
+		taskMap := NewTaskMap([]Task{{
+			ID:      "gen",
+			Outputs: []Path{"out/*.txt"},
+			Command: "echo run >> gen.runs && mkdir -p out && touch out/$(wc -l < gen.runs | tr -d ' ').txt",
+			Cache:   true,
+		}})
+		build(t, taskMap, TaskExecutorOptions{}, "gen")
+		// Another run stores out/2.txt; out/1.txt stays behind locally.
+		if err := os.Rename("out/1.txt", "keep.txt"); err != nil {
+			t.Fatal(err)
+		}
+		build(t, taskMap, TaskExecutorOptions{Refresh: []TaskID{"gen"}}, "gen")
+		if err := os.Rename("keep.txt", "out/1.txt"); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name   string
+			strict bool
+			want   string
+		}{
+			{name: "default", strict: false},
+			{name: "strict", strict: true, want: "outputs match files the cache entry doesn't have: out/1.txt"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var out bytes.Buffer
+				e := newTestExecutor(t, TaskExecutorOptions{StrictOutputs: tt.strict})
+				e.log = NewLogger(&out, &out, LoggerOptions{})
+				if err := e.ExecuteTasks(taskMap, []TaskID{"gen"}); err != nil {
+					t.Fatalf("ExecuteTasks: %v", err)
+				}
+				if _, err := os.Stat("out/2.txt"); err != nil {
+					t.Errorf("out/2.txt not restored: %v", err)
+				}
+				got := strings.Contains(out.String(), "warning: outputs match")
+				if got != (tt.want != "") || tt.want != "" && !strings.Contains(out.String(), tt.want) {
+					t.Errorf("log = %q, want warning %q", out.String(), tt.want)
+				}
+			})
+		}
+	})
+}
+
+func TestOutputNormalize(t *testing.T) {
+	tests := []struct {
+		name      string
+		normalize string
+		wantRuns  int
+	}{
+		{name: "raw digest", wantRuns: 2},
+		{name: "normalized", normalize: `"output_normalize": "grep -v '^built at'",`, wantRuns: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempWD(t, func() {
+				// gen drops comment lines from src.txt and stamps the build
+				// time into its output.
+				taskMap, err := LoadTaskMapFromConfig(writeConfig(t, `{"tasks": {
+					"gen": {
+						"command": "mkdir -p gen && { echo built at $(date +%s%N); grep -v '^#' src.txt; } > gen/out.txt",
+						"inputs": ["src.txt"],
+						"outputs": ["gen/out.txt"],
+						"cache": true,
+						`+tt.normalize+`
+					},
+					"app": {
+						"command": "echo run >> app.runs && cp gen/out.txt app.txt",
+						"inputs": [":gen"],
+						"outputs": ["app.txt"],
+						"cache": true,
+					},
+				}}`))
+				if err != nil {
+					t.Fatalf("LoadTaskMapFromConfig: %v", err)
+				}
+				runs := func() int {
+					t.Helper()
+					data, err := os.ReadFile("app.runs")
+					if err != nil {
+						t.Fatal(err)
+					}
+					return strings.Count(string(data), "\n")
+				}
+
+				writeFileContent(t, "src.txt", "hello\n")
+				build(t, taskMap, TaskExecutorOptions{}, "app")
+				// A comment changes gen's key, so gen reruns and only the
+				// timestamp in its output differs.
+				writeFileContent(t, "src.txt", "# note\nhello\n")
+				build(t, taskMap, TaskExecutorOptions{}, "app")
+				if got := runs(); got != tt.wantRuns {
+					t.Errorf("app ran %d times, want %d", got, tt.wantRuns)
+				}
+
+				writeFileContent(t, "src.txt", "# note\nbye\n")
+				build(t, taskMap, TaskExecutorOptions{}, "app")
+				if got := runs(); got != tt.wantRuns+1 {
+					t.Errorf("app ran %d times after a real change, want %d", got, tt.wantRuns+1)
+				}
+
+				// In a sandbox, gen's normalized digests come from its cache
+				// entry rather than the workspace.
+				e := newTestExecutor(t, TaskExecutorOptions{Sandbox: true})
+				var out bytes.Buffer
+				e.log = NewLogger(&out, &out, LoggerOptions{})
+				if err := e.ExecuteTasks(taskMap, []TaskID{"app"}); err != nil {
+					t.Fatalf("ExecuteTasks: %v", err)
+				}
+				if !strings.Contains(out.String(), "app | CACHE HIT") {
+					t.Errorf("sandboxed build of app was not a cache hit:\n%s", out.String())
+				}
+			})
+		})
+	}
+}
+
+func TestCheckWrites(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		jobs    int
+		wantLog string // empty: the task passes the check
+	}{
+		{name: "own outputs only", command: "mkdir -p out && echo a > out/a.txt", jobs: 1},
+		{name: "another task's output", command: "mkdir -p out && echo a > out/a.txt && echo b > gen.txt", jobs: 1, wantLog: "undeclared write: created gen.txt"},
+		// With more jobs gen could be running alongside app, so writing its
+		// output isn't blamed on app.
+		{name: "another task's output in parallel", command: "mkdir -p out && echo a > out/a.txt && echo b > gen.txt", jobs: 2},
+		{name: "undeclared file", command: "mkdir -p out && echo a > out/a.txt && echo x > stray.txt", wantLog: "undeclared write: created stray.txt"},
+		{name: "modified input", command: "mkdir -p out && echo a > out/a.txt && echo edit >> src.txt", wantLog: "undeclared write: modified src.txt"},
+		{name: "deleted file", command: "mkdir -p out && echo a > out/a.txt && rm src.txt", wantLog: "undeclared write: deleted src.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempWD(t, func() {
+				writeFileContent(t, "src.txt", "src")
+				taskMap := NewTaskMap([]Task{
+					{ID: "app", Inputs: []Path{"src.txt"}, Outputs: []Path{"out"}, Command: tt.command, Cache: true},
+					{ID: "gen", Outputs: []Path{"gen.txt"}, Command: "echo b > gen.txt", Cache: true},
+				})
+				var out bytes.Buffer
+				e := newTestExecutor(t, TaskExecutorOptions{CheckWrites: true, Jobs: tt.jobs})
+				e.log = NewLogger(&out, &out, LoggerOptions{})
+				err := e.ExecuteTasks(taskMap, []TaskID{"app"})
+				if tt.wantLog == "" {
+					if err != nil {
+						t.Fatalf("ExecuteTasks: %v\n%s", err, out.String())
+					}
+					return
+				}
+				if err == nil || !strings.Contains(err.Error(), "outside its declared outputs") {
+					t.Errorf("ExecuteTasks err = %v, want an undeclared write failure", err)
+				}
+				if !strings.Contains(out.String(), tt.wantLog) {
+					t.Errorf("log = %q, want %q", out.String(), tt.wantLog)
+				}
+				if key, ok := e.keys.Get("app"); !ok || e.state.Has(key) {
+					t.Errorf("outputs of a task failing the write check were cached")
+				}
+			})
+		})
+	}
+}
+
+func TestEmptyOutputsFeedDependents(t *testing.T) {
+	withTempWD(t, func() {
+		// Both markers are empty and so share one blob once cached.
+		taskMap := NewTaskMap([]Task{
+			{ID: "mark", Outputs: []Path{"a.marker", "b.marker"}, Command: "echo run >> mark.runs && : > a.marker && : > b.marker", Cache: true},
+			{ID: "use", Dependencies: []TaskID{"mark"}, Inputs: []Path{"a.marker", "b.marker"}, Outputs: []Path{"use.txt"}, Command: "echo run >> use.runs && cat a.marker b.marker > use.txt", Cache: true},
+		})
+		runs := func(id string) int {
+			t.Helper()
+			data, err := os.ReadFile(id + ".runs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return strings.Count(string(data), "\n")
+		}
+
+		build(t, taskMap, TaskExecutorOptions{}, "use")
+		for _, p := range []string{"a.marker", "b.marker", "use.txt"} {
+			if err := os.Remove(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		build(t, taskMap, TaskExecutorOptions{}, "use")
+		if got := runs("mark") + runs("use"); got != 2 {
+			t.Errorf("tasks ran %d times in total, want 2 (second build restored)", got)
+		}
+		for _, p := range []string{"a.marker", "b.marker"} {
+			if fi, err := os.Stat(p); err != nil || fi.Size() != 0 {
+				t.Errorf("%s after restore: %v, %v; want an empty file", p, fi, err)
+			}
+		}
+	})
+}
+
+func TestVerifyCacheRepairsCorruptOutputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    TaskExecutorOptions
+		corrupt func(c *LocalCache, key string) string // returns the file to overwrite
+	}{
+		{
+			name:    "files",
+			opts:    TaskExecutorOptions{VerifyCache: true},
+			corrupt: func(c *LocalCache, key string) string { return filepath.Join(c.taskDir(key), "outputs", "out.txt") },
+		},
+		{
+			name:    "packed",
+			opts:    TaskExecutorOptions{VerifyCache: true, CachePackBelow: 1 << 10},
+			corrupt: func(c *LocalCache, key string) string { return c.packPath(key) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempWD(t, func() {
+				taskMap := NewTaskMap([]Task{{ID: "gen", Outputs: []Path{"out.txt"}, Command: "echo run >> runs.txt && echo good > out.txt", Cache: true}})
+				runs := func() int {
+					t.Helper()
+					data, err := os.ReadFile("runs.txt")
+					if err != nil {
+						t.Fatal(err)
+					}
+					return strings.Count(string(data), "\n")
+				}
+				e := newTestExecutor(t, tt.opts)
+				if err := e.ExecuteTasks(taskMap, []TaskID{"gen"}); err != nil {
+					t.Fatalf("ExecuteTasks: %v", err)
+				}
+				key, _ := e.keys.Get("gen")
+
+				// Flip the stored bytes in place, as bit rot would, keeping the
+				// size. The workspace copy goes away so a hit must restore.
+				path := tt.corrupt(e.state.localCache, key)
+				if err := os.Chmod(path, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("evil\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Remove("out.txt"); err != nil && !errors.Is(err, os.ErrNotExist) {
+					t.Fatal(err)
+				}
+
+				var out bytes.Buffer
+				e = newTestExecutor(t, tt.opts)
+				e.log = NewLogger(&out, &out, LoggerOptions{})
+				if err := e.ExecuteTasks(taskMap, []TaskID{"gen"}); err != nil {
+					t.Fatalf("ExecuteTasks: %v", err)
+				}
+				if runs() != 2 {
+					t.Errorf("task ran %d times, want 2 (the corrupt entry is a miss)", runs())
+				}
+				if !strings.Contains(out.String(), "out.txt doesn't match its digest") {
+					t.Errorf("log doesn't report the corruption:\n%s", out.String())
+				}
+
+				// The re-stored entry is good again: a restore hits and yields
+				// the real content.
+				if err := os.Remove("out.txt"); err != nil {
+					t.Fatal(err)
+				}
+				build(t, taskMap, tt.opts, "gen")
+				if runs() != 2 {
+					t.Errorf("task ran %d times, want 2 (the repaired entry hits)", runs())
+				}
+				if data, err := os.ReadFile("out.txt"); err != nil || string(data) != "good\n" {
+					t.Errorf("out.txt = %q, %v; want the task's real output", data, err)
+				}
+			})
+		})
+	}
+}
+
+func TestWriteIfChanged(t *testing.T) {
+	tests := []struct {
+		name string
+		opts TaskExecutorOptions
+		task Task
+	}{
+		{
+			name: "exported from sandbox",
+			opts: TaskExecutorOptions{Sandbox: true},
+			task: Task{ID: "gen", Inputs: []Path{"src.txt"}, Outputs: []Path{"out.txt"}, Sandbox: true},
+		},
+		{
+			name: "restored as copy",
+			opts: TaskExecutorOptions{Sandbox: true, RestoreMode: RestoreCopy},
+			task: Task{ID: "gen", Inputs: []Path{"src.txt"}, Outputs: []Path{"out.txt"}, Sandbox: true, Cache: true},
+		},
+		// Without -sandbox the task still runs in one, so its command never
+		// writes the workspace copy itself.
+		{
+			name: "workspace mode",
+			task: Task{ID: "gen", Inputs: []Path{"src.txt"}, Outputs: []Path{"out.txt"}, Sandbox: true},
+		},
+		{
+			name: "workspace mode cached",
+			task: Task{ID: "gen", Inputs: []Path{"src.txt"}, Outputs: []Path{"out.txt"}, Sandbox: true, Cache: true},
+		},
+	}
+	for _, tt := range tests {
+		for _, writeIfChanged := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/write_if_changed=%v", tt.name, writeIfChanged), func(t *testing.T) {
+				withTempWD(t, func() {
+					task := tt.task
+					task.WriteIfChanged = writeIfChanged
+					gen := func(src, output string) {
+						t.Helper()
+						writeFileContent(t, "src.txt", src)
+						task.Command = "echo " + output + " > out.txt"
+						build(t, NewTaskMap([]Task{task}), tt.opts, "gen")
+					}
+					old := time.Now().Add(-time.Hour).Truncate(time.Second)
+					age := func() {
+						t.Helper()
+						if err := os.Chtimes("out.txt", old, old); err != nil {
+							t.Fatal(err)
+						}
+					}
+					kept := func() bool {
+						t.Helper()
+						fi, err := os.Stat("out.txt")
+						if err != nil {
+							t.Fatal(err)
+						}
+						return fi.ModTime().Equal(old)
+					}
+
+					// A new key regenerates identical content.
+					gen("v1", "same")
+					age()
+					gen("v2", "same")
+					if kept() != writeIfChanged {
+						t.Errorf("mtime kept = %v after regenerating identical output, want %v", kept(), writeIfChanged)
+					}
+
+					// Real changes are always written.
+					age()
+					gen("v3", "new")
+					if data, _ := os.ReadFile("out.txt"); kept() || string(data) != "new\n" {
+						t.Errorf("out.txt = %q, mtime kept = %v; want the new content written", data, kept())
+					}
+				})
+			})
+		}
+	}
+}
+
+func TestExpectOutputs(t *testing.T) {
+	sumA := fmt.Sprintf("%x", sha256.Sum256([]byte("a\n")))
+	sumB := fmt.Sprintf("%x", sha256.Sum256([]byte("b\n")))
+	tests := []struct {
+		name    string
+		outputs []Path // default: dist
+		command string
+		expect  map[Path]string
+		wantLog string // "" means the task must succeed
+	}{
+		{
+			name:    "matching",
+			command: "mkdir -p dist && echo a > dist/a.txt && echo b > dist/b.txt",
+			expect:  map[Path]string{"dist/a.txt": sumA, "dist/b.txt": sumB},
+		},
+		{
+			name:    "mismatching",
+			command: "mkdir -p dist && echo a > dist/a.txt && echo tampered > dist/b.txt",
+			expect:  map[Path]string{"dist/a.txt": sumA, "dist/b.txt": sumB},
+			wantLog: "expect_outputs: dist/b.txt has sha256 ",
+		},
+		{
+			name:    "missing",
+			command: "mkdir -p dist && echo a > dist/a.txt",
+			expect:  map[Path]string{"dist/a.txt": sumA, "dist/b.txt": sumB},
+			wantLog: "expect_outputs: missing output dist/b.txt",
+		},
+		{
+			name:    "extra",
+			command: "mkdir -p dist && echo a > dist/a.txt && echo b > dist/b.txt",
+			expect:  map[Path]string{"dist/a.txt": sumA},
+			wantLog: "expect_outputs: unexpected output dist/b.txt",
+		},
+		{
+			name:    "glob matching nothing",
+			outputs: []Path{"dist/*.txt"},
+			command: "mkdir -p dist",
+			expect:  map[Path]string{"dist/a.txt": sumA},
+			wantLog: "expect_outputs: missing output dist/a.txt",
+		},
+		{
+			name:    "literal output not created",
+			outputs: []Path{"dist/a.txt"},
+			command: "true",
+			expect:  map[Path]string{"dist/a.txt": sumA},
+			wantLog: "expect_outputs: missing output dist/a.txt",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempWD(t, func() {
+				outputs := tt.outputs
+				if outputs == nil {
+					outputs = []Path{"dist"}
+				}
+				taskMap := NewTaskMap([]Task{{ID: "release", Outputs: outputs, Command: tt.command, Cache: true, ExpectOutputs: tt.expect}})
+				var out bytes.Buffer
+				e := newTestExecutor(t, TaskExecutorOptions{})
+				e.log = NewLogger(&out, &out, LoggerOptions{})
+				err := e.ExecuteTasks(taskMap, []TaskID{"release"})
+				if tt.wantLog == "" {
+					if err != nil {
+						t.Fatalf("ExecuteTasks: %v\n%s", err, out.String())
+					}
+					return
+				}
+				if err == nil || !strings.Contains(err.Error(), "don't match expect_outputs") {
+					t.Fatalf("ExecuteTasks err = %v, want an expect_outputs failure", err)
+				}
+				if !strings.Contains(out.String(), tt.wantLog) {
+					t.Errorf("log missing %q:\n%s", tt.wantLog, out.String())
+				}
+				if key, ok := e.keys.Get("release"); ok && e.state.Has(key) {
+					t.Error("cached the outputs of a task that failed expect_outputs")
+				}
+			})
+		})
+	}
+
+	// The expectation is part of the key: changing it isn't answered by the
+	// entry of a run checked against the old one.
+	t.Run("changed expectation", func(t *testing.T) {
+		withTempWD(t, func() {
+			task := Task{ID: "release", Outputs: []Path{"dist"}, Command: "mkdir -p dist && echo a > dist/a.txt", Cache: true, ExpectOutputs: map[Path]string{"dist/a.txt": sumA}}
+			build(t, NewTaskMap([]Task{task}), TaskExecutorOptions{}, "release")
+			task.ExpectOutputs = map[Path]string{"dist/a.txt": sumB}
+			e := newTestExecutor(t, TaskExecutorOptions{})
+			if err := e.ExecuteTasks(NewTaskMap([]Task{task}), []TaskID{"release"}); err == nil || !strings.Contains(err.Error(), "don't match expect_outputs") {
+				t.Errorf("ExecuteTasks err = %v, want an expect_outputs failure instead of a cache hit", err)
+			}
+		})
+	})
+}
+
+func TestCacheModes(t *testing.T) {
+	tests := []struct {
+		mode      CacheMode // -cache-mode
+		taskMode  CacheMode // the task's own "cache" setting
+		wantRun   bool      // runs despite a warm cache
+		wantStore bool      // stores from a cold cache
+	}{
+		{mode: CacheReadWrite, taskMode: CacheReadWrite, wantRun: false, wantStore: true},
+		{mode: CacheRead, taskMode: CacheReadWrite, wantRun: false, wantStore: false},
+		{mode: CacheWrite, taskMode: CacheReadWrite, wantRun: true, wantStore: true},
+		{mode: CacheOff, taskMode: CacheReadWrite, wantRun: true, wantStore: false},
+		{mode: CacheReadWrite, taskMode: CacheRead, wantRun: false, wantStore: false},
+		{mode: CacheReadWrite, taskMode: CacheWrite, wantRun: true, wantStore: true},
+		{mode: CacheWrite, taskMode: CacheRead, wantRun: true, wantStore: false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode)+"/"+string(tt.taskMode), func(t *testing.T) {
+			withTempWD(t, func() {
+				task := Task{ID: "gen", Outputs: []Path{"out.txt"}, Command: "echo x >> ran.log && echo out > out.txt", Cache: true, CacheMode: tt.taskMode}
+				taskMap := NewTaskMap([]Task{task})
+				key, _, err := ComputeTaskKey(task, nil, nil)
+				if err != nil {
+					t.Fatalf("ComputeTaskKey: %v", err)
+				}
+				cache := NewLocalCache(filepath.Join(".build-tool", "cache"))
+
+				build(t, taskMap, TaskExecutorOptions{CacheMode: tt.mode}, "gen")
+				if got := cache.Has(key); got != tt.wantStore {
+					t.Errorf("stored from cold cache = %v, want %v", got, tt.wantStore)
+				}
+
+				warm := taskMap["gen"]
+				warm.CacheMode = CacheReadWrite
+				build(t, NewTaskMap([]Task{warm}), TaskExecutorOptions{}, "gen")
+				if err := os.Remove("ran.log"); err != nil {
+					t.Fatalf("Remove: %v", err)
+				}
+				build(t, taskMap, TaskExecutorOptions{CacheMode: tt.mode}, "gen")
+				if _, err := os.Stat("ran.log"); (err == nil) != tt.wantRun {
+					t.Errorf("ran with warm cache = %v, want %v", err == nil, tt.wantRun)
+				}
+				if got, err := os.ReadFile("out.txt"); err != nil || string(got) != "out\n" {
+					t.Errorf("out.txt = %q, %v", got, err)
+				}
+			})
+		})
+	}
+}
+
+func TestMergeStderrKeepsOrder(t *testing.T) {
+	withTempWD(t, func() {
+		cmd := "for i in 1 2 3 4 5; do echo out$i; echo err$i >&2; done"
+		taskMap := NewTaskMap([]Task{{ID: "gen", Command: cmd}})
+
+		var out bytes.Buffer
+		e := newTestExecutor(t, TaskExecutorOptions{MergeStderr: true})
+		e.log = NewLogger(&out, io.Discard, LoggerOptions{})
+		if err := e.ExecuteTasks(taskMap, []TaskID{"gen"}); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+
+		want := "gen $ " + cmd + "\n"
+		for i := 1; i <= 5; i++ {
+			want += fmt.Sprintf("gen | out%d\ngen | err%d\n", i, i)
+		}
+		if !strings.HasPrefix(out.String(), want) {
+			t.Errorf("log = %q, want prefix %q", out.String(), want)
+		}
+	})
+}
+
+func TestIdempotentTaskSkippedWhenUnchanged(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "manifest.yaml", "replicas: 1\n")
+		taskMap, err := LoadTaskMapFromConfig(writeConfig(t, `{"tasks": {
+			"deploy": {"command": "echo x >> applied.log", "inputs": ["manifest.yaml"], "idempotent": true},
+		}}`))
+		if err != nil {
+			t.Fatalf("LoadTaskMapFromConfig: %v", err)
+		}
+
+		var out bytes.Buffer
+		for range 2 {
+			e := newTestExecutor(t, TaskExecutorOptions{})
+			e.log = NewLogger(&out, io.Discard, LoggerOptions{})
+			if err := e.ExecuteTasks(taskMap, []TaskID{"deploy"}); err != nil {
+				t.Fatalf("ExecuteTasks: %v", err)
+			}
+			if err := e.Save(); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+		}
+		if got, err := os.ReadFile("applied.log"); err != nil || string(got) != "x\n" {
+			t.Errorf("applied.log = %q, %v; want one run", got, err)
+		}
+		if !strings.Contains(out.String(), "SKIPPED (idempotent") {
+			t.Errorf("log missing idempotent skip:\n%s", out.String())
+		}
+
+		writeFileContent(t, "manifest.yaml", "replicas: 2\n")
+		build(t, taskMap, TaskExecutorOptions{}, "deploy")
+		if got, err := os.ReadFile("applied.log"); err != nil || string(got) != "x\nx\n" {
+			t.Errorf("applied.log = %q, %v; want a rerun after the input changed", got, err)
+		}
+	})
+}
+
+func TestCacheFailuresReplaysUnchangedFailure(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "in.txt", "v1\n")
+		taskMap := NewTaskMap([]Task{
+			{ID: "test", Inputs: []Path{"in.txt"}, Command: "echo x >> runs.log; echo boom; exit 3", Cache: true},
+		})
+
+		run := func() (string, error) {
+			var out bytes.Buffer
+			e := newTestExecutor(t, TaskExecutorOptions{CacheFailures: true})
+			e.log = NewLogger(&out, io.Discard, LoggerOptions{})
+			err := e.ExecuteTasks(taskMap, []TaskID{"test"})
+			if err := e.Save(); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			return out.String(), err
+		}
+		runs := func() string {
+			data, _ := os.ReadFile("runs.log")
+			return string(data)
+		}
+
+		for i := range 2 {
+			out, err := run()
+			var tfe *TaskFailedError
+			if !errors.As(err, &tfe) || tfe.ExitCode != 3 {
+				t.Fatalf("run %d: err = %v, want exit 3", i, err)
+			}
+			if !strings.Contains(out, "boom") {
+				t.Errorf("run %d: output missing %q:\n%s", i, "boom", out)
+			}
+		}
+		if got := runs(); got != "x\n" {
+			t.Errorf("runs.log = %q, want the second run replayed from the cache", got)
+		}
+
+		writeFileContent(t, "in.txt", "v2\n")
+		if _, err := run(); err == nil {
+			t.Fatalf("run after input change succeeded, want failure")
+		}
+		if got := runs(); got != "x\nx\n" {
+			t.Errorf("runs.log = %q, want a rerun after the input changed", got)
+		}
+	})
+}
+
+func TestCacheFailuresRecordsOutputTail(t *testing.T) {
+	withTempWD(t, func() {
+		command := fmt.Sprintf("seq %d; exit 1", failureOutputLines+5)
+		taskMap := NewTaskMap([]Task{{ID: "test", Command: command, Cache: true}})
+		for range 2 {
+			var out bytes.Buffer
+			e := newTestExecutor(t, TaskExecutorOptions{CacheFailures: true})
+			e.log = NewLogger(&out, io.Discard, LoggerOptions{})
+			if err := e.ExecuteTasks(taskMap, []TaskID{"test"}); err == nil {
+				t.Fatal("ExecuteTasks succeeded, want a failure")
+			}
+			if got := out.String(); strings.Contains(got, "CACHED FAILURE") {
+				if !strings.Contains(got, "(5 earlier line(s) of output not recorded)") || strings.Contains(got, "| 5\n") || !strings.Contains(got, "| 6\n") {
+					t.Errorf("replayed output doesn't start at line 6:\n%.300s", got)
+				}
+				return
+			}
+		}
+		t.Fatal("second run didn't replay the failure")
+	})
+}
+
+func TestCacheFailuresKeptWithoutCacheWrites(t *testing.T) {
+	withTempWD(t, func() {
+		task := Task{ID: "test", Command: "echo x >> runs.log; test -f pass", Cache: true}
+		replayed := func() bool {
+			var out bytes.Buffer
+			e := newTestExecutor(t, TaskExecutorOptions{CacheFailures: true})
+			e.log = NewLogger(&out, io.Discard, LoggerOptions{})
+			_ = e.ExecuteTasks(NewTaskMap([]Task{task}), []TaskID{"test"})
+			return strings.Contains(out.String(), "CACHED FAILURE")
+		}
+		if replayed() {
+			t.Fatal("first run replayed a failure")
+		}
+		writeFileContent(t, "pass", "")
+
+		// A read-only run and a run failing -check-writes succeed at
+		// the command but store nothing, so the failure stays.
+		e := newTestExecutor(t, TaskExecutorOptions{CacheMode: CacheRead})
+		if err := e.ExecuteTasks(NewTaskMap([]Task{task}), []TaskID{"test"}); err != nil {
+			t.Fatalf("read-only run: %v", err)
+		}
+		e = newTestExecutor(t, TaskExecutorOptions{CheckWrites: true})
+		if err := e.ExecuteTasks(NewTaskMap([]Task{task}), []TaskID{"test"}); err == nil {
+			t.Fatal("-check-writes run succeeded despite writing runs.log")
+		}
+		if !replayed() {
+			t.Error("failure not replayed after runs that stored nothing")
+		}
+
+		build(t, NewTaskMap([]Task{task}), TaskExecutorOptions{}, "test")
+		if replayed() {
+			t.Error("failure replayed after a stored successful run")
+		}
+	})
+}
+
+func TestOverlappingGlobOutputsFail(t *testing.T) {
+	for _, sandbox := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sandbox=%v", sandbox), func(t *testing.T) {
+			withTempWD(t, func() {
+				// The globs differ, so only their expansions overlap:
+				// both tasks also write out/shared.txt.
+				taskMap := NewTaskMap([]Task{
+					{ID: "a", Outputs: []Path{"out/*.txt"}, Command: "mkdir -p out && echo a > out/a.txt && echo a > out/shared.txt", Cache: true, Sandbox: true},
+					{ID: "b", Outputs: []Path{"out/[bs]*.txt"}, Command: "mkdir -p out && echo b > out/b.txt && echo b > out/shared.txt", Cache: true, Sandbox: true},
+				})
+				e := newTestExecutor(t, TaskExecutorOptions{Sandbox: sandbox, Jobs: 1})
+				err := e.ExecuteTasks(taskMap, []TaskID{"a", "b"})
+				if exitCode(err) != exitUsage || !strings.Contains(err.Error(), "already produced by task a") {
+					t.Fatalf("ExecuteTasks = %v, want out/shared.txt claimed twice", err)
+				}
+				if !strings.Contains(err.Error(), "out/shared.txt") {
+					t.Errorf("error %q doesn't name out/shared.txt", err)
+				}
+
+				// A warm build restores both from the cache and must
+				// still notice.
+				for _, id := range []TaskID{"a", "b"} {
+					build(t, taskMap, TaskExecutorOptions{Sandbox: sandbox, Jobs: 1}, id)
+				}
+				e = newTestExecutor(t, TaskExecutorOptions{Sandbox: sandbox, Jobs: 1})
+				err = e.ExecuteTasks(taskMap, []TaskID{"a", "b"})
+				if exitCode(err) != exitUsage || !strings.Contains(err.Error(), "already produced by task a") {
+					t.Fatalf("warm ExecuteTasks = %v, want out/shared.txt claimed twice", err)
+				}
+			})
+		})
+	}
+}
+
+func TestOverlappingDeclaredOutputsFail(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Path
+	}{
+		{"same literal", "out.txt", "out.txt"},
+		{"file under dir", "out", "out/b.txt"},
+		{"glob covers literal", "out/*.txt", "out/b.txt"},
+		{"same glob", "gen/**", "gen/**"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempWD(t, func() {
+				taskMap := NewTaskMap([]Task{
+					{ID: "a", Outputs: []Path{tt.a}, Command: "echo a >> runs.log", Cache: false},
+					{ID: "b", Outputs: []Path{tt.b}, Command: "echo b >> runs.log", Cache: false},
+				})
+				e := newTestExecutor(t, TaskExecutorOptions{Jobs: 1})
+				err := e.ExecuteTasks(taskMap, []TaskID{"a", "b"})
+				if exitCode(err) != exitUsage || !strings.Contains(err.Error(), "task a (output "+string(tt.a)+") and task b") {
+					t.Fatalf("ExecuteTasks = %v, want the overlap reported", err)
+				}
+				if _, err := os.Stat("runs.log"); !os.IsNotExist(err) {
+					t.Errorf("a task ran despite the overlap")
+				}
+			})
+		})
+	}
+}
+
+func TestRequireCacheable(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			{ID: "gen", Outputs: []Path{"gen.txt"}, Command: "echo x > gen.txt && echo ran >> runs.log", Cache: true},
+			{ID: "stamp", Outputs: []Path{"stamp.txt"}, Command: "date > stamp.txt", Cache: false},
+			{ID: "check", Command: "true", Cache: true},
+			{ID: "release", Dependencies: []TaskID{"gen", "stamp", "check"}, Outputs: []Path{"release.txt"}, Command: "cat gen.txt stamp.txt > release.txt", Cache: true},
+			{ID: "lib", Dependencies: []TaskID{"gen"}, Outputs: []Path{"lib.txt"}, Command: "cp gen.txt lib.txt", Cache: true},
+		})
+
+		e := newTestExecutor(t, TaskExecutorOptions{RequireCacheable: true})
+		err := e.ExecuteTasks(taskMap, []TaskID{"release"})
+		if exitCode(err) != exitUsage {
+			t.Fatalf("ExecuteTasks = %v, want a usage error", err)
+		}
+		for _, w := range []string{"2 task(s)", "check (no outputs and not idempotent)", "stamp (cache disabled)"} {
+			if !strings.Contains(err.Error(), w) {
+				t.Errorf("error %q missing %q", err, w)
+			}
+		}
+		if _, err := os.Stat("runs.log"); !os.IsNotExist(err) {
+			t.Errorf("tasks ran before the check failed: %v", err)
+		}
+
+		build(t, taskMap, TaskExecutorOptions{RequireCacheable: true}, "lib")
+	})
+}
+
+func TestDeterministicLogs(t *testing.T) {
+	withTempWD(t, func() {
+		// The slowest task sorts first, so without grouping its lines would
+		// land after the others'.
+		taskMap := NewTaskMap([]Task{
+			{ID: "a", Command: "echo a1; sleep 0.05; echo a2"},
+			{ID: "b", Command: "echo b1; sleep 0.01; echo b2"},
+			{ID: "c", Command: "echo c1; echo c2"},
+			{ID: "all", Dependencies: []TaskID{"c", "b", "a"}, Command: "echo done"},
+		})
+		run := func() string {
+			t.Helper()
+			var out bytes.Buffer
+			e := newTestExecutor(t, TaskExecutorOptions{Jobs: 3, Deterministic: true})
+			e.log = NewLogger(&out, &out, LoggerOptions{})
+			if err := e.ExecuteTasks(taskMap, []TaskID{"all"}); err != nil {
+				t.Fatalf("ExecuteTasks: %v", err)
+			}
+			return out.String()
+		}
+
+		first := run()
+		if second := run(); second != first {
+			t.Errorf("logs differ between identical builds:\n%s\n---\n%s", first, second)
+		}
+		want := []string{"a | a1", "a | a2", "b | b1", "b | b2", "c | c1", "c | c2", "all | done"}
+		last := -1
+		for _, w := range want {
+			i := strings.Index(first, w)
+			if i < 0 || i < last {
+				t.Fatalf("%q missing or out of order in:\n%s", w, first)
+			}
+			last = i
+		}
+	})
+}
+
+func TestKeyCollisions(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      TaskExecutorOptions
+		wantWarn  bool
+		wantEqual bool
+	}{
+		{name: "silent by default", wantEqual: true},
+		{name: "warn", opts: TaskExecutorOptions{WarnKeyCollisions: true}, wantWarn: true, wantEqual: true},
+		{name: "namespace by id", opts: TaskExecutorOptions{WarnKeyCollisions: true, NamespaceByID: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempWD(t, func() {
+				writeFileContent(t, "src.txt", "x")
+				taskMap := NewTaskMap([]Task{
+					{ID: "lint", Inputs: []Path{"src.txt"}, Command: "cat src.txt", Cache: true},
+					{ID: "lint-copy", Inputs: []Path{"src.txt"}, Command: "cat src.txt", Cache: true},
+				})
+				var out bytes.Buffer
+				e := newTestExecutor(t, tt.opts)
+				e.log = NewLogger(&out, &out, LoggerOptions{})
+				if err := e.ExecuteTasks(taskMap, []TaskID{"lint", "lint-copy"}); err != nil {
+					t.Fatalf("ExecuteTasks: %v", err)
+				}
+				if got := strings.Contains(out.String(), "share a cache entry"); got != tt.wantWarn {
+					t.Errorf("warned = %v, want %v:\n%s", got, tt.wantWarn, out.String())
+				}
+				a, _ := e.keys.Get("lint")
+				b, _ := e.keys.Get("lint-copy")
+				if got := a == b; got != tt.wantEqual {
+					t.Errorf("keys equal = %v, want %v", got, tt.wantEqual)
+				}
+			})
+		})
+	}
+}
+
+func TestOnlyOutputsRestoresSubset(t *testing.T) {
+	for _, sandbox := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sandbox=%v", sandbox), func(t *testing.T) {
+			withTempWD(t, func() {
+				writeFileContent(t, "src.txt", "v1")
+				taskMap := NewTaskMap([]Task{{
+					ID:      "pkg",
+					Inputs:  []Path{"src.txt"},
+					Outputs: []Path{"bin/app", "debug/app.sym"},
+					Command: "mkdir -p bin debug && cp src.txt bin/app && cp src.txt debug/app.sym",
+					Cache:   true,
+					Sandbox: true,
+				}})
+				opts := TaskExecutorOptions{Sandbox: sandbox}
+				build(t, taskMap, opts, "pkg")
+				for _, p := range []string{"bin", "debug"} {
+					if err := os.RemoveAll(p); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				opts.OnlyOutputs = []Path{"bin/*"}
+				build(t, taskMap, opts, "pkg")
+				if _, err := os.Stat("bin/app"); err != nil {
+					t.Errorf("bin/app not restored: %v", err)
+				}
+				if _, err := os.Stat("debug/app.sym"); !os.IsNotExist(err) {
+					t.Errorf("debug/app.sym restored despite -only-outputs: %v", err)
+				}
+
+				// A pattern that selects nothing is called out.
+				opts.OnlyOutputs = []Path{"bin/*", "lib/*"}
+				var out bytes.Buffer
+				e := newTestExecutor(t, opts)
+				e.log = NewLogger(&out, &out, LoggerOptions{})
+				if err := e.ExecuteTasks(taskMap, []TaskID{"pkg"}); err != nil {
+					t.Fatalf("ExecuteTasks: %v", err)
+				}
+				if !strings.Contains(out.String(), "-only-outputs lib/* matches none of its outputs") || strings.Contains(out.String(), "-only-outputs bin/*") {
+					t.Errorf("log doesn't warn about lib/* alone:\n%s", out.String())
+				}
+				opts.OnlyOutputs = []Path{"bin/*"}
+
+				// A miss runs the task, which produces everything.
+				writeFileContent(t, "src.txt", "v2")
+				build(t, taskMap, opts, "pkg")
+				if data, err := os.ReadFile("debug/app.sym"); err != nil || string(data) != "v2" {
+					t.Errorf("debug/app.sym after a run = %q, %v; want v2", data, err)
+				}
+			})
+		})
+	}
+}
+
+func TestSerialDeps(t *testing.T) {
+	withTempWD(t, func() {
+		step := func(id string) string {
+			return fmt.Sprintf("echo start-%s >> log.txt && sleep 0.05 && echo end-%s >> log.txt", id, id)
+		}
+		taskMap := NewTaskMap([]Task{
+			{ID: "c", Command: step("c")},
+			{ID: "a", Command: step("a")},
+			{ID: "b", Command: step("b")},
+			{ID: "top", Dependencies: []TaskID{"c", "a", "b"}, Command: "true", SerialDeps: true},
+		})
+		build(t, taskMap, TaskExecutorOptions{Jobs: 4}, "top")
+
+		data, err := os.ReadFile("log.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"start-c", "end-c", "start-a", "end-a", "start-b", "end-b"}
+		if got := strings.Fields(string(data)); !slices.Equal(got, want) {
+			t.Errorf("log = %v, want %v", got, want)
+		}
+
+		// An order that contradicts the dependency graph can't be honored.
+		taskMap["a"] = Task{ID: "a", Dependencies: []TaskID{"b"}, Command: "true"}
+		err = newTestExecutor(t, TaskExecutorOptions{}).ExecuteTasks(taskMap, []TaskID{"top"})
+		if exitCode(err) != exitUsage || !strings.Contains(err.Error(), "a depends on b") {
+			t.Errorf("ExecuteTasks error = %v, want usage error about the order", err)
+		}
+	})
+}
+
+func TestPools(t *testing.T) {
+	withTempWD(t, func() {
+		// Each task logs + when it starts and - when it ends, to its own
+		// log per kind, so the logs show how many ran at once.
+		step := func(log string) string {
+			return fmt.Sprintf("echo + >> %s && sleep 0.2 && echo - >> %s", log, log)
+		}
+		var tasks []Task
+		var ids []TaskID
+		for i := range 5 {
+			link := Task{ID: TaskID(fmt.Sprintf("link%d", i)), Command: step("link.log"), Pool: "link"}
+			compile := Task{ID: TaskID(fmt.Sprintf("compile%d", i)), Command: step("compile.log")}
+			tasks = append(tasks, link, compile)
+			ids = append(ids, link.ID, compile.ID)
+		}
+		build(t, NewTaskMap(tasks), TaskExecutorOptions{Jobs: 8, Pools: map[string]int{"link": 2}}, ids...)
+
+		maxRunning := func(log string) int {
+			t.Helper()
+			data, err := os.ReadFile(log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			running, most := 0, 0
+			for _, f := range strings.Fields(string(data)) {
+				if f == "+" {
+					running++
+				} else {
+					running--
+				}
+				most = max(most, running)
+			}
+			return most
+		}
+		if got := maxRunning("link.log"); got != 2 {
+			t.Errorf("at most %d link tasks ran at once, want 2", got)
+		}
+		if got := maxRunning("compile.log"); got <= 2 {
+			t.Errorf("at most %d unpooled tasks ran at once, want them to run wide", got)
+		}
+	})
+}
+
+func TestPrintOrder(t *testing.T) {
+	withTempWD(t, func() {
+		taskMap := NewTaskMap([]Task{
+			{ID: "proto", Command: "true"},
+			{ID: "tool", Command: "true"},
+			{ID: "gen", Dependencies: []TaskID{"proto"}, Command: "true"},
+			{ID: "lib", Dependencies: []TaskID{"gen", "tool"}, Command: "true"},
+			{ID: "lint", Command: "true"},
+			// serial_deps holds lint back until lib is done, as the
+			// scheduler will.
+			{ID: "app", Dependencies: []TaskID{"lib", "lint"}, Command: "true", SerialDeps: true},
+		})
+		var out bytes.Buffer
+		e := newTestExecutor(t, TaskExecutorOptions{PrintOrder: true})
+		e.log = NewLogger(&out, &out, LoggerOptions{})
+		if err := e.ExecuteTasks(taskMap, []TaskID{"app"}); err != nil {
+			t.Fatalf("ExecuteTasks: %v", err)
+		}
+		want := "Execution order: 6 task(s) in 5 layer(s); a layer's tasks can run in parallel\n" +
+			"  1: proto tool\n" +
+			"  2: gen\n" +
+			"  3: lib\n" +
+			"  4: lint\n" +
+			"  5: app\n"
+		if !strings.HasPrefix(out.String(), want) {
+			t.Errorf("log =\n%s\nwant it to start with\n%s", out.String(), want)
+		}
+	})
+}
+
+func TestOutputGlobExpansion(t *testing.T) {
+	for _, sandbox := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sandbox=%v", sandbox), func(t *testing.T) {
+			withTempWD(t, func() {
+				// A cacheable task whose output glob matches nothing fails
+				// rather than storing an entry that never restores.
+				taskMap := NewTaskMap([]Task{{ID: "gen", Outputs: []Path{"**/*.o"}, Command: "echo x > a.c", Cache: true, Sandbox: true}})
+				e := newTestExecutor(t, TaskExecutorOptions{Sandbox: sandbox})
+				err := e.ExecuteTasks(taskMap, []TaskID{"gen"})
+				if err == nil || !strings.Contains(err.Error(), `glob "**/*.o" matched no files`) {
+					t.Fatalf("ExecuteTasks error = %v, want zero-match output error", err)
+				}
+				if key, ok := e.keys.Get("gen"); ok && e.state.Has(key) {
+					t.Error("stored an entry for a task whose outputs matched nothing")
+				}
+
+				// A match is stored as the concrete file list.
+				taskMap = NewTaskMap([]Task{{ID: "gen", Outputs: []Path{"**/*.o"}, Command: "mkdir -p obj && echo x > obj/a.o && echo y > obj/b.o", Cache: true, Sandbox: true}})
+				e = newTestExecutor(t, TaskExecutorOptions{Sandbox: sandbox})
+				if err := e.ExecuteTasks(taskMap, []TaskID{"gen"}); err != nil {
+					t.Fatalf("ExecuteTasks: %v", err)
+				}
+				key, _ := e.keys.Get("gen")
+				outs, err := e.state.localCache.ReadManifestOutputs(key)
+				if want := []Path{"obj/a.o", "obj/b.o"}; err != nil || !slices.Equal(outs, want) {
+					t.Errorf("manifest outputs = %v, %v; want %v", outs, err, want)
+				}
+			})
+		})
+	}
+}
+
+func TestMaxTaskOutputLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "success-hides-output",
+			command: "for i in 1 2 3 4 5; do echo line$i; done",
+			want:    []string{"gen | (5 line(s) of output hidden)"},
+			notWant: []string{"line1", "line5"},
+		},
+		{
+			name:    "failure-shows-tail",
+			command: "for i in 1 2 3 4 5; do echo line$i; done; exit 1",
+			want:    []string{"gen | (3 earlier line(s) of output omitted)", "gen | line4\ngen | line5\n"},
+			notWant: []string{"line3", "hidden"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempWD(t, func() {
+				taskMap := NewTaskMap([]Task{{ID: "gen", Command: tt.command}})
+				var out bytes.Buffer
+				e := newTestExecutor(t, TaskExecutorOptions{MaxTaskOutputLines: 2})
+				e.log = NewLogger(&out, io.Discard, LoggerOptions{})
+				_ = e.ExecuteTasks(taskMap, []TaskID{"gen"})
+
+				for _, want := range tt.want {
+					if !strings.Contains(out.String(), want) {
+						t.Errorf("log missing %q:\n%s", want, out.String())
+					}
+				}
+				for _, notWant := range tt.notWant {
+					if strings.Contains(out.String(), notWant) {
+						t.Errorf("log contains %q:\n%s", notWant, out.String())
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// taskHistoryLimit is the number of runs kept per task.
+const taskHistoryLimit = 10
+
+// TaskRun records the outputs a task produced when it was executed and stored.
+type TaskRun struct {
+	TaskKey string          `json:"task_key"`
+	Time    time.Time       `json:"time"`
+	Digests map[Path]string `json:"digests"`
+}
+
+// TaskHistory is a persistent record of the most recent runs of each task,
+// newest first. It lets output digests be compared across runs even when the
+// cache entry they came from has been overwritten.
+type TaskHistory struct {
+	mu    sync.Mutex
+	path  string
+	runs  map[TaskID][]TaskRun
+	dirty bool
+}
+
+func NewTaskHistory(path string) *TaskHistory {
+	return &TaskHistory{path: path, runs: make(map[TaskID][]TaskRun)}
+}
+
+// Load reads the history from disk. A missing or corrupt file starts empty.
+func (h *TaskHistory) Load() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			h.runs = make(map[TaskID][]TaskRun)
+			return nil
+		}
+		return fmt.Errorf("read task history: %w", err)
+	}
+
+	runs := make(map[TaskID][]TaskRun)
+	if err := json.Unmarshal(data, &runs); err != nil {
+		h.runs = make(map[TaskID][]TaskRun)
+		return nil
+	}
+	h.runs = runs
+	return nil
+}
+
+// Save writes the history to disk if it changed.
+func (h *TaskHistory) Save() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(h.runs)
+	if err != nil {
+		return fmt.Errorf("marshal task history: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0o755); err != nil {
+		return fmt.Errorf("create task history dir: %w", err)
+	}
+	if err := os.WriteFile(h.path, data, 0o644); err != nil {
+		return fmt.Errorf("write task history: %w", err)
+	}
+
+	h.dirty = false
+	return nil
+}
+
+// Record adds run as the newest run of taskID.
+func (h *TaskHistory) Record(taskID TaskID, run TaskRun) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	runs := append([]TaskRun{run}, h.runs[taskID]...)
+	if len(runs) > taskHistoryLimit {
+		runs = runs[:taskHistoryLimit]
+	}
+	h.runs[taskID] = runs
+	h.dirty = true
+}
+
+// Runs returns the recorded runs of taskID, newest first.
+func (h *TaskHistory) Runs(taskID TaskID) []TaskRun {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]TaskRun(nil), h.runs[taskID]...)
+}
+
+// previousRun returns the newest of runs (newest first) that isn't the one
+// that stored the current entry for key, i.e. the newest run with that key.
+func previousRun(runs []TaskRun, key string) (TaskRun, bool) {
+	skipped := false
+	for _, r := range runs {
+		if r.TaskKey == key && !skipped {
+			skipped = true
+			continue
+		}
+		return r, true
+	}
+	return TaskRun{}, false
+}
+
+// OutputDiff lists output paths that differ between two runs.
+type OutputDiff struct {
+	Added   []Path
+	Removed []Path
+	Changed []Path
+}
+
+func (d OutputDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// DiffRuns compares the output digests of an older and a newer run.
+func DiffRuns(older, newer TaskRun) OutputDiff {
+	var d OutputDiff
+	for p, nd := range newer.Digests {
+		od, ok := older.Digests[p]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, p)
+		case od != nd:
+			d.Changed = append(d.Changed, p)
+		}
+	}
+	for p := range older.Digests {
+		if _, ok := newer.Digests[p]; !ok {
+			d.Removed = append(d.Removed, p)
+		}
+	}
+	for _, ps := range [][]Path{d.Added, d.Removed, d.Changed} {
+		sort.Slice(ps, func(i, j int) bool { return ps[i] < ps[j] })
+	}
+	return d
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -20,11 +23,23 @@ type taskKeyInput struct {
 }
 
 type taskKeyPayload struct {
-	Version      int            `json:"v"`
-	Command      string         `json:"command"`
-	Dependencies []string       `json:"dependencies"`
-	Outputs      []string       `json:"outputs"`
-	Inputs       []taskKeyInput `json:"inputs"`
+	Version      int               `json:"v"`
+	Tool         string            `json:"tool,omitempty"`
+	Salt         string            `json:"cache_salt,omitempty"`
+	ID           string            `json:"id,omitempty"`
+	Command      string            `json:"command"`
+	Image        string            `json:"image,omitempty"`
+	Shell        string            `json:"shell,omitempty"`
+	Env          map[string]string `json:"env,omitempty"`
+	FailFast     bool              `json:"fail_fast,omitempty"`
+	IgnoreExit   []int             `json:"ignore_exit_codes,omitempty"`
+	Dir          string            `json:"dir,omitempty"`
+	Dependencies []string          `json:"dependencies"`
+	Outputs      []string          `json:"outputs"`
+	Inputs       []taskKeyInput    `json:"inputs"`
+	KeyCommands  []taskKeyCommand  `json:"key_commands,omitempty"`
+	// ExpectOutputs is encoded with sorted keys, like Env.
+	ExpectOutputs map[Path]string `json:"expect_outputs,omitempty"`
 }
 
 // TODO: remove JSON payload, just binary encoding
@@ -41,21 +56,98 @@ func marshalTaskPayload(p taskKeyPayload) ([]byte, error) {
 // ComputeTaskKey returns a content hash (CAS) of a canonical JSON
 // representation of the task. When a non-nil FileStampCache is provided,
 // files whose metadata has not changed since the last hash are not re-read.
+//
+// Outputs contribute their declared specs (normalized with NormalizeFileSpecs,
+// the same normalization the store uses when expanding them), not the files
+// they expand to: outputs don't exist until the task has run, so the key can
+// only depend on what was declared. The expanded outputs are recorded in the
+// cache manifest instead.
 func ComputeTaskKey(task Task, depTaskKeys []string, stamps *FileStampCache) (string, []byte, error) {
+	ignore, err := LoadIgnoreRules(ignoreFilePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("load ignore file: %w", err)
+	}
+	key, taskJSON, _, err := ComputeTaskKeyWithStats(task, depTaskKeys, stamps, KeyOptions{Ignore: ignore})
+	return key, taskJSON, err
+}
+
+// KeyOptions holds build-wide settings that change every task key.
+type KeyOptions struct {
+	// ToolID, if set, is folded into every key so that entries made by a
+	// different build of the tool are never reused (see toolBuildID). Off by
+	// default: upgrading the tool would otherwise invalidate every entry.
+	ToolID string
+	// Progress, if set, is called while hashing inputs of at least
+	// hashProgressMinSize bytes, roughly every tenth of the file. It doesn't
+	// affect the key.
+	Progress func(in Path, done, total int64)
+	// Trace, if set, is called with each input's digest and whether it came
+	// from the stamp cache. It doesn't affect the key.
+	Trace func(in Path, digest string, stamped bool)
+	// SampleLargeInputs, if positive, digests inputs larger than this many
+	// bytes from their size and first and last sampleBytes only (see
+	// hashFileSample). Unsafe: an edit in the middle of such a file keeps
+	// its key.
+	SampleLargeInputs int64
+	// NormalizeEOL lists file extensions (e.g. ".c") of text inputs that are
+	// hashed with CRLF line endings read as LF (see hashFileEOL), so
+	// checkouts with either line ending share keys.
+	NormalizeEOL map[string]bool
+	// NamespaceByID folds the task ID into its key. Without it, tasks with
+	// the same command, inputs, outputs and dependencies share a key and so
+	// a cache entry.
+	NamespaceByID bool
+	// Ignore is the workspace ignore file (see LoadIgnoreRules), loaded
+	// once for all the keys of a build and applied to input globs.
+	Ignore *IgnoreRules
+}
+
+// keyOptions returns the KeyOptions for the -key-includes-tool-version flag.
+func keyOptions(includeToolVersion bool) KeyOptions {
+	if !includeToolVersion {
+		return KeyOptions{}
+	}
+	return KeyOptions{ToolID: toolBuildID()}
+}
+
+// parseEOLExtensions parses the -normalize-eol list, e.g. ".c,.h".
+func parseEOLExtensions(list string) (map[string]bool, error) {
+	if list == "" {
+		return nil, nil
+	}
+	exts := make(map[string]bool)
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.TrimSpace(ext)
+		if len(ext) < 2 || ext[0] != '.' || strings.ContainsAny(ext[1:], `./\`) {
+			return nil, fmt.Errorf("invalid extension %q (want e.g. .c)", ext)
+		}
+		exts[ext] = true
+	}
+	return exts, nil
+}
+
+// KeyStats counts how the input digests of a task key were obtained.
+type KeyStats struct {
+	Inputs  int // expanded input files
+	Stamped int // digests reused from the stamp cache
+	Hashed  int // digests computed by reading the file
+}
+
+// ComputeTaskKeyWithStats is ComputeTaskKey with opts applied that also
+// reports how many inputs were hashed versus served from the stamp cache.
+func ComputeTaskKeyWithStats(task Task, depTaskKeys []string, stamps *FileStampCache, opts KeyOptions) (string, []byte, KeyStats, error) {
+	var stats KeyStats
 	depKeys := append([]string(nil), depTaskKeys...)
 	sort.Strings(depKeys)
 
-	outputSpecs := make([]string, 0, len(task.Outputs))
-	for _, out := range task.Outputs {
-		s := filepath.ToSlash(string(out))
-		s = strings.TrimPrefix(s, "./")
-		outputSpecs = append(outputSpecs, s)
+	outputSpecs, err := NormalizeFileSpecs(task.Outputs)
+	if err != nil {
+		return "", nil, stats, fmt.Errorf("normalize outputs: %w", err)
 	}
-	sort.Strings(outputSpecs)
 
-	expandedInputs, err := ExpandFileSpecs(task.Inputs)
+	expandedInputs, err := ExpandFileSpecsWithOptions("", task.Inputs, inputExpandOptions(opts.Ignore))
 	if err != nil {
-		return "", nil, fmt.Errorf("expand inputs: %w", err)
+		return "", nil, stats, fmt.Errorf("expand inputs: %w", err)
 	}
 
 	inputs := append([]Path(nil), expandedInputs...)
@@ -65,17 +157,53 @@ func ComputeTaskKey(task Task, depTaskKeys []string, stamps *FileStampCache) (st
 	for _, in := range inputs {
 		p := filepath.FromSlash(string(in))
 
-		// Fast path: reuse cached digest when file metadata is unchanged.
+		sample := false
+		if opts.SampleLargeInputs > 0 {
+			fi, err := os.Stat(p)
+			if err != nil {
+				return "", nil, stats, fmt.Errorf("stat input %q: %w", in, err)
+			}
+			sample = fi.Size() > opts.SampleLargeInputs
+		}
+
+		kind := ""
+		switch {
+		case sample:
+			kind = sampledDigestPrefix
+		case opts.NormalizeEOL[path.Ext(string(in))]:
+			kind = eolDigestPrefix
+		}
+
+		// Fast path: reuse cached digest when file metadata is unchanged,
+		// unless it was digested differently than it would be now (e.g.
+		// sampled, and we now want the full digest).
 		if stamps != nil {
-			if d, ok := stamps.Lookup(p); ok {
+			if d, ok := stamps.Lookup(p); ok && digestKind(d) == kind {
 				tInputs = append(tInputs, taskKeyInput{Path: string(in), Digest: d})
+				stats.Stamped++
+				if opts.Trace != nil {
+					opts.Trace(in, d, true)
+				}
 				continue
 			}
 		}
 
-		d, err := hashFile(p)
+		var d string
+		if sample {
+			d, err = hashFileSample(p)
+		} else if kind == eolDigestPrefix {
+			d, err = hashFileEOL(p)
+		} else if opts.Progress != nil {
+			d, err = hashFileWithProgress(p, func(done, total int64) { opts.Progress(in, done, total) })
+		} else {
+			d, err = hashFile(p)
+		}
 		if err != nil {
-			return "", nil, fmt.Errorf("hash input %q: %w", in, err)
+			return "", nil, stats, fmt.Errorf("hash input %q: %w", in, err)
+		}
+		stats.Hashed++
+		if opts.Trace != nil {
+			opts.Trace(in, d, false)
 		}
 
 		// Record the freshly computed digest in the stamp cache.
@@ -86,24 +214,63 @@ func ComputeTaskKey(task Task, depTaskKeys []string, stamps *FileStampCache) (st
 		tInputs = append(tInputs, taskKeyInput{Path: string(in), Digest: d})
 	}
 
+	keyCommands, err := runKeyCommands(task)
+	if err != nil {
+		return "", nil, stats, err
+	}
+
 	p := taskKeyPayload{
-		Version:      1,
-		Command:      task.Command,
-		Dependencies: depKeys,
-		Outputs:      outputSpecs,
-		Inputs:       tInputs,
+		Version:       2,
+		Tool:          opts.ToolID,
+		Salt:          task.CacheSalt,
+		ID:            namespaceID(task.ID, opts.NamespaceByID),
+		Command:       task.Command,
+		Image:         task.Image,
+		Shell:         task.Shell,
+		Env:           taskKeyEnv(task),
+		FailFast:      task.FailFast,
+		IgnoreExit:    task.IgnoreExitCodes,
+		Dir:           task.Dir,
+		Dependencies:  depKeys,
+		Outputs:       outputSpecs,
+		Inputs:        tInputs,
+		KeyCommands:   keyCommands,
+		ExpectOutputs: task.ExpectOutputs,
 	}
 
 	taskJSON, err := marshalTaskPayload(p)
 	if err != nil {
-		return "", nil, err
+		return "", nil, stats, err
 	}
+	stats.Inputs = len(inputs)
 
 	sum := blake2b.Sum256(taskJSON)
-	return hex.EncodeToString(sum[:]), taskJSON, nil
+	return hex.EncodeToString(sum[:]), taskJSON, stats, nil
 }
 
-func hashFile(path string) (string, error) {
+// namespaceID returns the ID folded into the key of task id: none unless
+// namespacing is on.
+func namespaceID(id TaskID, namespace bool) string {
+	if !namespace {
+		return ""
+	}
+	return string(id)
+}
+
+// hashFile is a variable so tests can observe hashing.
+var hashFile = hashFileContents
+
+func hashFileContents(path string) (string, error) {
+	return hashFileWithProgress(path, nil)
+}
+
+// hashProgressMinSize is the smallest file hashFileWithProgress reports
+// progress for. A variable so tests can lower it.
+var hashProgressMinSize int64 = 64 << 20
+
+// hashFileWithProgress is hashFileContents that calls report as large files
+// are read, so a long cold hash doesn't look like a hang.
+func hashFileWithProgress(path string, report func(done, total int64)) (string, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return "", err
@@ -115,9 +282,175 @@ func hashFile(path string) (string, error) {
 		return "", err
 	}
 
-	if _, err := io.Copy(hasher, file); err != nil {
+	var r io.Reader = file
+	if report != nil {
+		if fi, err := file.Stat(); err == nil && fi.Size() >= hashProgressMinSize {
+			r = &progressReader{r: file, total: fi.Size(), report: report}
+		}
+	}
+	if _, err := io.Copy(hasher, r); err != nil {
 		return "", err
 	}
 
 	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
+
+// sampleBytes is how much of each end of a file hashFileSample reads.
+const sampleBytes = 1 << 20
+
+// sampledDigestPrefix marks digests made by hashFileSample, so that a sampled
+// digest can never equal a full one.
+const sampledDigestPrefix = "sampled:"
+
+// eolDigestPrefix marks digests made by hashFileEOL.
+const eolDigestPrefix = "eol:"
+
+func isSampledDigest(d string) bool {
+	return strings.HasPrefix(d, sampledDigestPrefix)
+}
+
+// digestKind returns the prefix d was made with: sampledDigestPrefix,
+// eolDigestPrefix, normalizedDigestPrefix, or "" for a plain content digest.
+func digestKind(d string) string {
+	for _, prefix := range []string{sampledDigestPrefix, eolDigestPrefix, normalizedDigestPrefix} {
+		if strings.HasPrefix(d, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// binarySniffLen is how much of a file hashFileEOL checks for NUL bytes, the
+// same heuristic git uses to tell binary files from text.
+const binarySniffLen = 8000
+
+// hashFileEOL digests a text file with every CRLF read as LF. Files that
+// look binary are digested as they are, still under eolDigestPrefix.
+func hashFileEOL(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher, err := blake2b.New256(nil)
+	if err != nil {
+		return "", err
+	}
+	br := bufio.NewReaderSize(file, 64<<10)
+	head, err := br.Peek(binarySniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", err
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		if _, err := io.Copy(hasher, br); err != nil {
+			return "", err
+		}
+	} else {
+		w := &crlfWriter{w: hasher}
+		if _, err := io.Copy(w, br); err != nil {
+			return "", err
+		}
+		if err := w.Flush(); err != nil {
+			return "", err
+		}
+	}
+
+	return eolDigestPrefix + hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// crlfWriter writes to w with each CRLF replaced by LF. A CR ending one
+// write is held back until the next shows whether an LF follows.
+type crlfWriter struct {
+	w  io.Writer
+	cr bool
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	out := make([]byte, 0, len(p)+1)
+	if c.cr && p[0] != '\n' {
+		out = append(out, '\r')
+	}
+	c.cr = false
+	for i, b := range p {
+		if b == '\r' {
+			if i == len(p)-1 {
+				c.cr = true
+				continue
+			}
+			if p[i+1] == '\n' {
+				continue
+			}
+		}
+		out = append(out, b)
+	}
+	if _, err := c.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes a held-back trailing CR.
+func (c *crlfWriter) Flush() error {
+	if !c.cr {
+		return nil
+	}
+	c.cr = false
+	_, err := c.w.Write([]byte{'\r'})
+	return err
+}
+
+// hashFileSample digests a file's size and its first and last sampleBytes
+// bytes, which overlap for files up to twice that size.
+func hashFileSample(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	hasher, err := blake2b.New256(nil)
+	if err != nil {
+		return "", err
+	}
+	size := fi.Size()
+	if err := binary.Write(hasher, binary.BigEndian, size); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(hasher, io.NewSectionReader(file, 0, min(size, sampleBytes))); err != nil {
+		return "", err
+	}
+	tail := max(size-sampleBytes, 0)
+	if _, err := io.Copy(hasher, io.NewSectionReader(file, tail, size-tail)); err != nil {
+		return "", err
+	}
+
+	return sampledDigestPrefix + hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// progressReader counts the bytes read through it and calls report each
+// time another tenth of total has been read.
+type progressReader struct {
+	r      io.Reader
+	done   int64
+	total  int64
+	tenths int64
+	report func(done, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	if t := p.done * 10 / p.total; t > p.tenths {
+		p.tenths = t
+		p.report(p.done, p.total)
+	}
+	return n, err
+}
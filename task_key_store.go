@@ -8,10 +8,12 @@ import (
 type TaskKeyStore struct {
 	mu sync.Mutex
 	by map[TaskID]string
+	// dep overrides what dependents chain for a task (see SetDepKey).
+	dep map[TaskID]string
 }
 
 func NewTaskKeyStore() *TaskKeyStore {
-	return &TaskKeyStore{by: make(map[TaskID]string)}
+	return &TaskKeyStore{by: make(map[TaskID]string), dep: make(map[TaskID]string)}
 }
 
 func (s *TaskKeyStore) Get(taskID TaskID) (string, bool) {
@@ -27,6 +29,14 @@ func (s *TaskKeyStore) Set(taskID TaskID, taskKey string) {
 	s.mu.Unlock()
 }
 
+// SetDepKey makes dependents of taskID chain depKey instead of its task key,
+// e.g. the digest of its normalized outputs (see normalizedDepKey).
+func (s *TaskKeyStore) SetDepKey(taskID TaskID, depKey string) {
+	s.mu.Lock()
+	s.dep[taskID] = depKey
+	s.mu.Unlock()
+}
+
 func (s *TaskKeyStore) GetDepKeys(task Task) ([]string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -37,6 +47,9 @@ func (s *TaskKeyStore) GetDepKeys(task Task) ([]string, error) {
 		if !ok {
 			return nil, fmt.Errorf("missing dependency task key for %s", dep)
 		}
+		if d, ok := s.dep[dep]; ok {
+			k = d
+		}
 		depKeys = append(depKeys, k)
 	}
 	return depKeys, nil
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestComputeTaskKeyOutputSpecs(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "main.c")
+
+		key := func(t *testing.T, outputs ...Path) (string, []string) {
+			t.Helper()
+			task := Task{ID: "build", Command: "cc main.c", Inputs: []Path{"main.c"}, Outputs: outputs}
+			k, taskJSON, err := ComputeTaskKey(task, nil, nil)
+			if err != nil {
+				t.Fatalf("ComputeTaskKey: %v", err)
+			}
+			var p taskKeyPayload
+			if err := json.Unmarshal(taskJSON, &p); err != nil {
+				t.Fatalf("unmarshal payload: %v", err)
+			}
+			return k, p.Outputs
+		}
+
+		tests := []struct {
+			name     string
+			a, b     []Path
+			wantSame bool
+		}{
+			{name: "dot-slash-normalized", a: []Path{"./out/a.o"}, b: []Path{"out/a.o"}, wantSame: true},
+			{name: "negation-dot-slash-normalized", a: []Path{"out/**", "!./out/tmp/**"}, b: []Path{"out/**", "!out/tmp/**"}, wantSame: true},
+			{name: "different-globs-differ", a: []Path{"out/*.o"}, b: []Path{"out/**/*.o"}, wantSame: false},
+			{name: "negation-order-matters", a: []Path{"out/**", "!out/x"}, b: []Path{"!out/x", "out/**"}, wantSame: false},
+			{name: "escaped-bang-differs-from-negation", a: []Path{"\\!out"}, b: []Path{"!out"}, wantSame: false},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ka, _ := key(t, tt.a...)
+				kb, _ := key(t, tt.b...)
+				if (ka == kb) != tt.wantSame {
+					t.Fatalf("keys same=%v, want same=%v (a=%v b=%v)", ka == kb, tt.wantSame, tt.a, tt.b)
+				}
+			})
+		}
+
+		t.Run("payload-records-declared-specs", func(t *testing.T) {
+			_, got := key(t, "./out/**/*.o", "!./out/tmp/**", "\\!bang")
+			want := []string{"out/**/*.o", "!out/tmp/**", "\\!bang"}
+			if len(got) != len(want) {
+				t.Fatalf("outputs = %q, want %q", got, want)
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Fatalf("outputs = %q, want %q", got, want)
+				}
+			}
+		})
+	})
+}
+
+func TestComputeTaskKeyToolID(t *testing.T) {
+	withTempWD(t, func() {
+		task := Task{ID: "build", Command: "true"}
+		key := func(opts KeyOptions) string {
+			t.Helper()
+			k, _, _, err := ComputeTaskKeyWithStats(task, nil, nil, opts)
+			if err != nil {
+				t.Fatalf("ComputeTaskKeyWithStats: %v", err)
+			}
+			return k
+		}
+
+		plain, _, err := ComputeTaskKey(task, nil, nil)
+		if err != nil {
+			t.Fatalf("ComputeTaskKey: %v", err)
+		}
+		if got := key(keyOptions(false)); got != plain {
+			t.Errorf("key without the flag = %s, want the default %s", got, plain)
+		}
+
+		v1 := key(KeyOptions{ToolID: "v1.0.0+aaaa"})
+		v2 := key(KeyOptions{ToolID: "v1.0.1+bbbb"})
+		if v1 == plain || v1 == v2 {
+			t.Errorf("tool ID not folded into key: plain=%s v1=%s v2=%s", plain, v1, v2)
+		}
+		if id := keyOptions(true).ToolID; id == "" || id != toolBuildID() {
+			t.Errorf("keyOptions(true).ToolID = %q, want toolBuildID %q", id, toolBuildID())
+		}
+	})
+}
+
+func TestComputeTaskKeyCacheSalt(t *testing.T) {
+	withTempWD(t, func() {
+		writeFile(t, "main.c")
+		key := func(salt string) string {
+			t.Helper()
+			task := Task{ID: "build", Command: "cc main.c", Inputs: []Path{"main.c"}, CacheSalt: salt}
+			k, _, err := ComputeTaskKey(task, nil, nil)
+			if err != nil {
+				t.Fatalf("ComputeTaskKey: %v", err)
+			}
+			return k
+		}
+
+		tests := []struct {
+			name     string
+			a, b     string
+			wantSame bool
+		}{
+			{name: "same-salt", a: "libfoo-1.2", b: "libfoo-1.2", wantSame: true},
+			{name: "bumped-salt", a: "libfoo-1.2", b: "libfoo-1.3", wantSame: false},
+			{name: "salt-vs-none", a: "", b: "1", wantSame: false},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if ka, kb := key(tt.a), key(tt.b); (ka == kb) != tt.wantSame {
+					t.Errorf("keys same=%v, want same=%v (salts %q and %q)", ka == kb, tt.wantSame, tt.a, tt.b)
+				}
+			})
+		}
+
+		// No salt leaves the payload, and so existing keys, unchanged.
+		_, taskJSON, err := ComputeTaskKey(Task{ID: "build", Command: "true"}, nil, nil)
+		if err != nil {
+			t.Fatalf("ComputeTaskKey: %v", err)
+		}
+		if strings.Contains(string(taskJSON), "cache_salt") {
+			t.Errorf("payload without a salt = %s, want no cache_salt field", taskJSON)
+		}
+	})
+}
+
+func TestComputeTaskKeyKeyCommands(t *testing.T) {
+	withTempWD(t, func() {
+		// The command reads a file that is not an input, standing in for
+		// external state such as a tool version.
+		writeFileContent(t, "tool-version", "1.0")
+		task := Task{ID: "build", Command: "true", KeyCommands: []string{"cat tool-version"}}
+		key := func() string {
+			t.Helper()
+			k, _, err := ComputeTaskKey(task, nil, nil)
+			if err != nil {
+				t.Fatalf("ComputeTaskKey: %v", err)
+			}
+			return k
+		}
+
+		k1 := key()
+		if k2 := key(); k2 != k1 {
+			t.Errorf("key changed without the command's output changing")
+		}
+		writeFileContent(t, "tool-version", "2.0")
+		if k3 := key(); k3 == k1 {
+			t.Errorf("key unchanged after the command's output changed")
+		}
+
+		plain, taskJSON, err := ComputeTaskKey(Task{ID: "build", Command: "true"}, nil, nil)
+		if err != nil {
+			t.Fatalf("ComputeTaskKey: %v", err)
+		}
+		if plain == k1 || strings.Contains(string(taskJSON), "key_commands") {
+			t.Errorf("a task without key commands has key %s and payload %s; want a distinct key and no key_commands field", plain, taskJSON)
+		}
+
+		task.KeyCommands = []string{"echo broken >&2; exit 3"}
+		if _, _, err := ComputeTaskKey(task, nil, nil); err == nil || !strings.Contains(err.Error(), "broken") {
+			t.Errorf("ComputeTaskKey with a failing key command err = %v, want its stderr", err)
+		}
+	})
+}
+
+func TestComputeTaskKeyEmptyInput(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "empty.txt", "")
+		task := Task{ID: "use", Command: "cat empty.txt", Inputs: []Path{"empty.txt"}}
+		stamps := NewFileStampCache(filepath.Join(t.TempDir(), "stamps.json"), StampCacheOptions{})
+		key := func() (string, KeyStats) {
+			t.Helper()
+			k, _, stats, err := ComputeTaskKeyWithStats(task, nil, stamps, KeyOptions{})
+			if err != nil {
+				t.Fatalf("ComputeTaskKeyWithStats: %v", err)
+			}
+			return k, stats
+		}
+
+		first, stats := key()
+		if stats.Hashed != 1 {
+			t.Errorf("first key hashed %d inputs, want 1", stats.Hashed)
+		}
+		// A zero size is a valid stamp, not a missing one.
+		again, stats := key()
+		if again != first || stats.Stamped != 1 {
+			t.Errorf("second key = %s (stamped %d), want %s from the stamp cache", again, stats.Stamped, first)
+		}
+
+		writeFileContent(t, "empty.txt", "x")
+		if k, _ := key(); k == first {
+			t.Errorf("key unchanged after the empty input got content")
+		}
+		writeFileContent(t, "empty.txt", "")
+		if k, _ := key(); k != first {
+			t.Errorf("key = %s after emptying the input again, want %s", k, first)
+		}
+	})
+}
+
+func TestComputeTaskKeySampleLargeInputs(t *testing.T) {
+	withTempWD(t, func() {
+		big := bytes.Repeat([]byte("x"), 3*sampleBytes)
+		writeFileContent(t, "small.bin", strings.Repeat("s", 100))
+		writeFileContent(t, "big.bin", string(big))
+		task := Task{ID: "pack", Command: "true", Inputs: []Path{"small.bin", "big.bin"}}
+		stamps := NewFileStampCache(filepath.Join(t.TempDir(), "stamps.json"), StampCacheOptions{})
+
+		digests := func(opts KeyOptions) (string, map[string]string) {
+			t.Helper()
+			key, taskJSON, _, err := ComputeTaskKeyWithStats(task, nil, stamps, opts)
+			if err != nil {
+				t.Fatalf("ComputeTaskKeyWithStats: %v", err)
+			}
+			var p taskKeyPayload
+			if err := json.Unmarshal(taskJSON, &p); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			m := make(map[string]string)
+			for _, in := range p.Inputs {
+				m[in.Path] = in.Digest
+			}
+			return key, m
+		}
+		sampled := KeyOptions{SampleLargeInputs: 100}
+
+		fullKey, full := digests(KeyOptions{})
+		sampledKey, got := digests(sampled)
+		// A file exactly at the threshold is hashed in full.
+		if got["small.bin"] != full["small.bin"] {
+			t.Errorf("small.bin digest = %s, want the full digest %s", got["small.bin"], full["small.bin"])
+		}
+		if !isSampledDigest(got["big.bin"]) || got["big.bin"] == full["big.bin"] || sampledKey == fullKey {
+			t.Errorf("big.bin digest = %s (key %s), want a sampled digest distinct from %s (key %s)", got["big.bin"], sampledKey, full["big.bin"], fullKey)
+		}
+		// The stamp cache now holds the sampled digest; a full key must not reuse it.
+		if k, again := digests(KeyOptions{}); k != fullKey || again["big.bin"] != full["big.bin"] {
+			t.Errorf("full key after sampling = %s, want %s", k, fullKey)
+		}
+
+		// An edit in the middle goes unnoticed by design; one at the end doesn't.
+		big[len(big)/2] = 'y'
+		writeFileContent(t, "big.bin", string(big))
+		if k, _ := digests(sampled); k != sampledKey {
+			t.Errorf("sampled key changed after a middle edit")
+		}
+		if k, _ := digests(KeyOptions{}); k == fullKey {
+			t.Errorf("full key unchanged after a middle edit")
+		}
+		big[len(big)-1] = 'y'
+		writeFileContent(t, "big.bin", string(big))
+		if k, _ := digests(sampled); k == sampledKey {
+			t.Errorf("sampled key unchanged after an edit at the end")
+		}
+	})
+}
+
+func TestComputeTaskKeyNormalizeEOL(t *testing.T) {
+	eol := KeyOptions{NormalizeEOL: map[string]bool{".c": true}}
+	tests := []struct {
+		name      string
+		file      string
+		a, b      string
+		opts      KeyOptions
+		wantEqual bool
+	}{
+		{name: "normalized", file: "main.c", a: "int x;\r\nint y;\r\n", b: "int x;\nint y;\n", opts: eol, wantEqual: true},
+		{name: "raw", file: "main.c", a: "int x;\r\nint y;\r\n", b: "int x;\nint y;\n"},
+		{name: "other extension", file: "notes.txt", a: "a\r\n", b: "a\n", opts: eol},
+		{name: "binary", file: "blob.c", a: "\x00\r\n", b: "\x00\n", opts: eol},
+		{name: "lone CR kept", file: "main.c", a: "a\rb", b: "a\nb", opts: eol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTempWD(t, func() {
+				task := Task{ID: "cc", Command: "cc", Inputs: []Path{Path(tt.file)}}
+				key := func(content string) string {
+					t.Helper()
+					writeFileContent(t, tt.file, content)
+					k, _, _, err := ComputeTaskKeyWithStats(task, nil, nil, tt.opts)
+					if err != nil {
+						t.Fatalf("ComputeTaskKeyWithStats: %v", err)
+					}
+					return k
+				}
+				if got := key(tt.a) == key(tt.b); got != tt.wantEqual {
+					t.Errorf("keys equal = %v, want %v", got, tt.wantEqual)
+				}
+			})
+		})
+	}
+
+	// Normalized digests live in their own namespace, even for LF files.
+	withTempWD(t, func() {
+		writeFileContent(t, "main.c", "int x;\n")
+		raw, _ := hashFileContents("main.c")
+		normalized, err := hashFileEOL("main.c")
+		if err != nil {
+			t.Fatalf("hashFileEOL: %v", err)
+		}
+		if normalized == raw || digestKind(normalized) != eolDigestPrefix {
+			t.Errorf("hashFileEOL = %s, want an %q digest distinct from %s", normalized, eolDigestPrefix, raw)
+		}
+	})
+}
+
+func TestCRLFWriterAcrossWrites(t *testing.T) {
+	tests := []struct {
+		writes []string
+		want   string
+	}{
+		{writes: []string{"a\r", "\nb"}, want: "a\nb"},
+		{writes: []string{"a\r", "b"}, want: "a\rb"},
+		{writes: []string{"a\r\n\r\n"}, want: "a\n\n"},
+		{writes: []string{"a\r"}, want: "a\r"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w := &crlfWriter{w: &buf}
+		for _, s := range tt.writes {
+			if _, err := w.Write([]byte(s)); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("writes %q = %q, want %q", tt.writes, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestProgressReaderReportsTenths(t *testing.T) {
+	var reports []int64
+	r := &progressReader{r: bytes.NewReader(make([]byte, 1000)), total: 1000, report: func(done, total int64) {
+		reports = append(reports, done)
+	}}
+	// Small reads, as a slow disk would deliver them.
+	if _, err := io.CopyBuffer(struct{ io.Writer }{io.Discard}, r, make([]byte, 64)); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if len(reports) != 10 || reports[len(reports)-1] != 1000 {
+		t.Fatalf("reports = %v, want 10 ending at 1000", reports)
+	}
+	for i := 1; i < len(reports); i++ {
+		if reports[i] <= reports[i-1] {
+			t.Fatalf("reports = %v, want increasing", reports)
+		}
+	}
+}
+
+func TestHashFileWithProgress(t *testing.T) {
+	withTempWD(t, func() {
+		writeFileContent(t, "big.bin", strings.Repeat("x", 4096))
+		want, err := hashFileContents("big.bin")
+		if err != nil {
+			t.Fatalf("hashFileContents: %v", err)
+		}
+
+		for _, tt := range []struct {
+			minSize     int64
+			wantReports bool
+		}{
+			{minSize: 1 << 20, wantReports: false},
+			{minSize: 1024, wantReports: true},
+		} {
+			old := hashProgressMinSize
+			hashProgressMinSize = tt.minSize
+			var calls int
+			got, err := hashFileWithProgress("big.bin", func(done, total int64) { calls++ })
+			hashProgressMinSize = old
+			if err != nil || got != want {
+				t.Errorf("hashFileWithProgress = %q, %v; want %q", got, err, want)
+			}
+			if (calls > 0) != tt.wantReports {
+				t.Errorf("min size %d: %d progress reports, want reports = %v", tt.minSize, calls, tt.wantReports)
+			}
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sync"
+)
+
+// version is set at link time with -ldflags "-X main.version=v1.2.3". When
+// unset, the module version from the embedded build info is used.
+var version string
+
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// writeVersion prints the tool's version and, when the binary embeds them,
+// the VCS revision and commit time it was built from, for bug reports.
+func writeVersion(w io.Writer) {
+	fmt.Fprintf(w, "build-tool %s\n", toolVersion())
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	settings := make(map[string]string)
+	for _, s := range info.Settings {
+		settings[s.Key] = s.Value
+	}
+	if rev := settings["vcs.revision"]; rev != "" {
+		if settings["vcs.modified"] == "true" {
+			rev += " (modified)"
+		}
+		fmt.Fprintf(w, "  revision:  %s\n", rev)
+	}
+	if t := settings["vcs.time"]; t != "" {
+		fmt.Fprintf(w, "  committed: %s\n", t)
+	}
+	fmt.Fprintf(w, "  go:        %s\n", info.GoVersion)
+}
+
+// toolBuildID identifies this exact build of the tool: its version plus a
+// digest of the executable, so development builds, which all report
+// "(devel)", still differ when their code does.
+var toolBuildID = sync.OnceValue(func() string {
+	id := toolVersion()
+	exe, err := os.Executable()
+	if err != nil {
+		return id
+	}
+	d, err := hashFileContents(exe)
+	if err != nil {
+		return id
+	}
+	return id + "+" + d[:16]
+})
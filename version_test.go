@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteVersion(t *testing.T) {
+	for _, v := range []string{"", "v1.2.3"} {
+		t.Run("version="+v, func(t *testing.T) {
+			old := version
+			version = v
+			t.Cleanup(func() { version = old })
+
+			var out bytes.Buffer
+			writeVersion(&out)
+			first, _, _ := strings.Cut(out.String(), "\n")
+			if !strings.HasPrefix(first, "build-tool ") || first == "build-tool " {
+				t.Fatalf("first line = %q, want build-tool <version>:\n%s", first, out.String())
+			}
+			if v != "" && first != "build-tool "+v {
+				t.Errorf("first line = %q, want the -ldflags version %s", first, v)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// invocationDir is the directory the tool was started in, before
+// enterWorkspace moved to the workspace root. Files a command writes for the
+// user (export -o, --output) resolve against it.
+var invocationDir string
+
+// findConfigUpward looks for a config named name in the working directory
+// and its parents, so the tool can be started anywhere in a workspace. It
+// returns name unchanged if there is none.
+func findConfigUpward(name string) (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		p := filepath.Join(dir, name)
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return name, nil
+		}
+		dir = parent
+	}
+}
+
+// enterWorkspace makes the root config's directory the working directory,
+// so paths in the config resolve relative to the config file rather than
+// to where the tool was started, and task keys, cache entries and outputs
+// are the same from any directory. It returns configPath relative to the
+// new working directory. Without a config there is no workspace and nothing
+// changes.
+func enterWorkspace(configPath string) (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	invocationDir = wd
+	if _, err := os.Stat(configPath); err != nil {
+		return configPath, nil
+	}
+	dir := filepath.Dir(configPath)
+	if dir == "." {
+		return configPath, nil
+	}
+	if err := os.Chdir(dir); err != nil {
+		return "", fmt.Errorf("enter workspace %s: %w", dir, err)
+	}
+	return filepath.Base(configPath), nil
+}
+
+// absPathFlags makes the named flags given on the command line absolute, so
+// they keep naming what the user meant after enterWorkspace. Defaults and
+// settings are relative to the workspace root and stay as they are.
+func absPathFlags(fs *flag.FlagSet, names ...string) error {
+	var errs []error
+	fs.Visit(func(f *flag.Flag) {
+		for _, name := range names {
+			if f.Name != name || f.Value.String() == "" {
+				continue
+			}
+			abs, err := filepath.Abs(f.Value.String())
+			if err == nil {
+				err = f.Value.Set(abs)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %w", name, err))
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// invocationPath resolves a path the user gave a command against the
+// directory the tool was started in.
+func invocationPath(p string) string {
+	if p == "" || filepath.IsAbs(p) || invocationDir == "" {
+		return p
+	}
+	return filepath.Join(invocationDir, p)
+}
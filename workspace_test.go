@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildFromSubdirectory(t *testing.T) {
+	withTempWD(t, func() {
+		t.Cleanup(func() { invocationDir = "" })
+		root, err := os.Getwd()
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeConfig(t, `{
+			"tasks": {
+				"gen": {
+					"command": "mkdir -p out && cp src.txt out/gen.txt",
+					"inputs": ["src.txt"],
+					"outputs": ["out/gen.txt"]
+				}
+			}
+		}`)
+		writeFileContent(t, "src.txt", "hello")
+		writeFileContent(t, filepath.Join("pkg", "sub", ".keep"), "")
+
+		buildFrom := func(dir string) string {
+			t.Helper()
+			if err := os.Chdir(dir); err != nil {
+				t.Fatal(err)
+			}
+			configPath, err := findConfigUpward("build-tool.jsonc")
+			if err != nil {
+				t.Fatalf("findConfigUpward: %v", err)
+			}
+			if configPath, err = enterWorkspace(configPath); err != nil {
+				t.Fatalf("enterWorkspace: %v", err)
+			}
+			taskMap, err := LoadTaskMapFromConfig(configPath)
+			if err != nil {
+				t.Fatalf("LoadTaskMapFromConfig: %v", err)
+			}
+			key, _, err := ComputeTaskKey(taskMap["gen"], nil, nil)
+			if err != nil {
+				t.Fatalf("ComputeTaskKey: %v", err)
+			}
+			build(t, taskMap, TaskExecutorOptions{}, "gen")
+			return key
+		}
+
+		rootKey := buildFrom(root)
+		if err := os.RemoveAll(filepath.Join(root, "out")); err != nil {
+			t.Fatal(err)
+		}
+		sub := filepath.Join(root, "pkg", "sub")
+		if subKey := buildFrom(sub); subKey != rootKey {
+			t.Errorf("key from %s = %s, want %s as from the root", sub, subKey, rootKey)
+		}
+		if data, err := os.ReadFile(filepath.Join(root, "out", "gen.txt")); err != nil || string(data) != "hello" {
+			t.Errorf("out/gen.txt = %q, %v; want it restored at the workspace root", data, err)
+		}
+		if _, err := os.Stat(filepath.Join(sub, "out")); !os.IsNotExist(err) {
+			t.Errorf("outputs written under %s: %v", sub, err)
+		}
+		if got, want := invocationPath("deps.txt"), filepath.Join(sub, "deps.txt"); got != want {
+			t.Errorf("invocationPath = %s, want %s", got, want)
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// -check-writes compares the workspace before and after a task runs outside
+// the sandbox and fails it if files other than declared outputs changed. It
+// is a guardrail, not isolation: the write has happened by the time it is
+// reported. With -jobs 1 a task may only write its own outputs. Tasks run in
+// parallel share the workspace and a snapshot can't tell who wrote what, so
+// with more jobs a write is only blamed on a task if no task in the build
+// declares it as an output, and an undeclared write can still be blamed on a
+// task that ran at the same time.
+
+// writeCheckSkip returns the workspace-relative paths the write check
+// leaves out: VCS metadata and the tool's own state, which changes during
+// every build.
+func (e *TaskExecutor) writeCheckSkip() map[string]bool {
+	skip := map[string]bool{".git": true, ".build-tool": true}
+	wd, err := os.Getwd()
+	if err != nil {
+		return skip
+	}
+	for _, p := range []string{e.state.localCache.Root, e.sandboxBase, e.log.taskLogDir, e.journalPath()} {
+		if p == "" {
+			continue
+		}
+		if filepath.IsAbs(p) {
+			if p, err = filepath.Rel(wd, p); err != nil {
+				continue
+			}
+		}
+		if filepath.IsLocal(p) {
+			skip[filepath.ToSlash(filepath.Clean(p))] = true
+		}
+	}
+	return skip
+}
+
+func (e *TaskExecutor) journalPath() string {
+	if e.journal == nil {
+		return ""
+	}
+	return e.journal.path
+}
+
+// allowedWrites returns the output specs task may write: its own, or with
+// more than one job those of every task in taskMap, as any of them may be
+// running alongside it.
+func (e *TaskExecutor) allowedWrites(taskMap TaskMap, task Task) [][]Path {
+	if e.jobs == 1 {
+		return [][]Path{task.Outputs}
+	}
+	var outputSpecs [][]Path
+	for _, t := range taskMap {
+		if len(t.Outputs) > 0 {
+			outputSpecs = append(outputSpecs, t.Outputs)
+		}
+	}
+	return outputSpecs
+}
+
+// undeclaredWorkspaceWrites returns the files created, modified or deleted
+// between the snapshots that none of outputSpecs selects.
+func undeclaredWorkspaceWrites(before, after map[string]fileSnapshot, outputSpecs [][]Path) []hermeticViolation {
+	declared := func(p string) bool {
+		for _, specs := range outputSpecs {
+			if specsMatch(specs, Path(p)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var violations []hermeticViolation
+	for p, a := range after {
+		b, existed := before[p]
+		switch {
+		case !existed && !declared(p):
+			violations = append(violations, hermeticViolation{Path: p, Kind: "created"})
+		case existed && a != b && !declared(p):
+			violations = append(violations, hermeticViolation{Path: p, Kind: "modified"})
+		}
+	}
+	for p := range before {
+		if _, ok := after[p]; !ok && !declared(p) {
+			violations = append(violations, hermeticViolation{Path: p, Kind: "deleted"})
+		}
+	}
+	sort.Slice(violations, func(i, j int) bool { return violations[i].Path < violations[j].Path })
+	return violations
+}
+
+// checkTaskWrites fails task if it changed workspace files outside the
+// outputs it may write (see allowedWrites) since before was taken.
+func (e *TaskExecutor) checkTaskWrites(taskMap TaskMap, task Task, before map[string]fileSnapshot, skip map[string]bool) error {
+	after, err := snapshotTree(".", skip)
+	if err != nil {
+		return fmt.Errorf("snapshot workspace for task %s: %w", task.ID, err)
+	}
+	violations := undeclaredWorkspaceWrites(before, after, e.allowedWrites(taskMap, task))
+	for _, v := range violations {
+		e.log.Taskf(task.ID, "undeclared write: %s %s", v.Kind, v.Path)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("task %s changed %d file(s) outside its declared outputs", task.ID, len(violations))
+	}
+	return nil
+}